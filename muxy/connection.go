@@ -0,0 +1,150 @@
+package muxy
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionFault is a connection-level failure that a Middleware may ask
+// a connection-oriented Proxy (e.g. the TCP Proxy) to apply
+type ConnectionFault int
+
+const (
+	// FaultNone leaves the connection untouched
+	FaultNone ConnectionFault = iota
+
+	// FaultReset aborts both sides of the connection with a TCP RST
+	FaultReset
+
+	// FaultClose gracefully closes both sides of the connection
+	FaultClose
+
+	// FaultRefuse resets the client connection without ever dialing the target
+	FaultRefuse
+
+	// FaultHalfCloseRequest closes the write side towards the target,
+	// which then sees an EOF. Further client messages are not forwarded.
+	FaultHalfCloseRequest
+
+	// FaultHalfCloseResponse closes the write side towards the client,
+	// which then sees an EOF. Further target messages are not forwarded.
+	FaultHalfCloseResponse
+
+	// FaultStallRequest stops reading from the client, so that its
+	// send window eventually fills
+	FaultStallRequest
+
+	// FaultStallResponse stops reading from the target, so that its
+	// send window eventually fills
+	FaultStallResponse
+)
+
+var faultNames = map[ConnectionFault]string{
+	FaultNone:              "none",
+	FaultReset:             "reset",
+	FaultClose:             "close",
+	FaultRefuse:            "refuse",
+	FaultHalfCloseRequest:  "half_close_request",
+	FaultHalfCloseResponse: "half_close_response",
+	FaultStallRequest:      "stall_request",
+	FaultStallResponse:     "stall_response",
+}
+
+func (f ConnectionFault) String() string {
+	if name, ok := faultNames[f]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseConnectionFault converts a configured fault name, such as "reset",
+// into a ConnectionFault
+func ParseConnectionFault(name string) (ConnectionFault, bool) {
+	for f, n := range faultNames {
+		if n == name {
+			return f, true
+		}
+	}
+	return FaultNone, false
+}
+
+// Direction is the direction of travel of a message through a proxy
+type Direction int
+
+const (
+	// DirectionNone is used for events not associated with a message
+	DirectionNone Direction = iota
+
+	// DirectionRequest is a message from the client to the target
+	DirectionRequest
+
+	// DirectionResponse is a message from the target to the client
+	DirectionResponse
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirectionRequest:
+		return "request"
+	case DirectionResponse:
+		return "response"
+	}
+	return "none"
+}
+
+// Connection describes the connection an event belongs to, for
+// connection-oriented proxies such as the TCP Proxy.
+//
+// Each event receives its own copy, so Middlewares may freely set the
+// Fault fields: the proxy applies them once all Middlewares have run.
+type Connection struct {
+	// ID is the sequence number of the connection on its proxy, starting at 1
+	ID uint64
+
+	// ClientAddr is the address of the connecting client
+	ClientAddr net.Addr
+
+	// Opened is the time the connection was accepted
+	Opened time.Time
+
+	// SentBytes is the number of bytes sent to the target so far
+	SentBytes uint64
+
+	// ReceivedBytes is the number of bytes received from the target so far
+	ReceivedBytes uint64
+
+	// Direction of the current message, or DirectionNone on EventConnect
+	Direction Direction
+
+	// Offset of the current message within the stream of its direction,
+	// as originally read from the socket
+	Offset uint64
+
+	// Values holds state shared by every event of the connection, so that
+	// Middlewares can track it across events. Keys should be unique to each
+	// Middleware, such as a pointer to the Middleware itself.
+	Values *sync.Map
+
+	// Delay postpones delivery of the current message, without holding up
+	// the reading of the messages that follow it
+	Delay time.Duration
+
+	// Reply is sent back to the client on behalf of the target, once the
+	// current request message has been forwarded. Set the message Bytes to
+	// nil to answer a request in place of the target.
+	Reply []byte
+
+	// Fault is the connection-level fault to apply
+	Fault ConnectionFault
+
+	// FaultDelay postpones the Fault by the given duration
+	FaultDelay time.Duration
+
+	// FaultAfterBytes postpones the Fault until this many bytes have been
+	// proxied in total (both directions).
+	//
+	// FaultDelay and FaultAfterBytes are only honoured on EventConnect,
+	// faults requested on later events are applied immediately.
+	FaultAfterBytes uint64
+}
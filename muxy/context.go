@@ -15,12 +15,36 @@ type Context struct {
 
 	// Response contains a reference to the HTTP Response
 	// if it's an HTTP proxied event.
-	// It may be mutated by prior and future middlewares/plugins
+	// It may be mutated by prior and future middlewares/plugins.
+	// If set before dispatch, it is sent in place of the target's response,
+	// and the request is not sent to the target.
 	Response *http.Response
 
 	// ResponseWriter for the current HTTP session if it exists.
 	ResponseWriter http.ResponseWriter
 
+	// Flush, if set after dispatch, sends the HTTP response headers at
+	// once, and each part of the body as it is read, rather than
+	// buffering them
+	Flush bool
+
+	// Hijacked is set by middlewares that take over the HTTP connection
+	// from the ResponseWriter, after which the proxy writes nothing more
+	Hijacked bool
+
+	// Exchange numbers each HTTP request, and is shared by the events of
+	// the request and its response. It is zero for other proxies.
+	Exchange uint64
+
 	// Bytes contains the current message for TCP sessions.
 	Bytes []byte
+
+	// Connection contains details of the current TCP session, and
+	// allows Middlewares to request connection-level faults.
+	// It is nil for HTTP proxied events.
+	Connection *Connection
+
+	// Message contains the decoded message for sessions of protocol-aware
+	// proxies, such as the Redis Proxy. It is nil for other proxies.
+	Message *Message
 }
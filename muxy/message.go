@@ -0,0 +1,27 @@
+package muxy
+
+// Message is an application protocol message decoded by a protocol-aware
+// proxy, such as the Redis Proxy, so that Middlewares need not parse the
+// raw bytes of each message themselves.
+type Message struct {
+	// Protocol that decoded the message, e.g. "redis"
+	Protocol string
+
+	// Command is the name of the command or request type, e.g. "GET".
+	// Replies carry the Command of the request they answer.
+	Command string
+
+	// Key is the key, name or topic the command operates on, if any.
+	// Replies carry the Key of the request they answer.
+	Key string
+
+	// Fields holds any other protocol specific attributes of the message
+	Fields map[string]string
+
+	// Pipelined is true if the request was sent while the replies to
+	// other requests on the connection were outstanding
+	Pipelined bool
+
+	// Value is the decoded message, whose type depends on the Protocol
+	Value interface{}
+}
@@ -9,6 +9,10 @@ const (
 
 	// EventPostDispatch is the event sent directly after dispatching a request
 	EventPostDispatch
+
+	// EventConnect is the event sent when a connection-oriented proxy
+	// accepts a new client connection, before the target is dialed
+	EventConnect
 )
 
 // Middleware is a plugin that intercepts requests and injects chaos
@@ -0,0 +1,250 @@
+package protocol
+
+import (
+	"bufio"
+	"strconv"
+	"sync"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/amqp"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// AMQPProxy implements an AMQP 0-9-1 aware TCP proxy, for RabbitMQ. Frames
+// are decoded, so that middlewares can target methods by the exchange,
+// routing key or queue they act upon.
+type AMQPProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest frame that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultAMQPMaxSize is the default largest frame, well above the frame
+// size RabbitMQ negotiates by default
+const defaultAMQPMaxSize = 16 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &AMQPProxy{}, nil
+	}, "amqp_proxy")
+}
+
+// Setup the AMQP proxy
+func (p *AMQPProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultAMQPMaxSize
+	}
+
+	// Methods flow independently in each direction, rather than as
+	// requests and replies, so frames are decoded by a middleware of
+	// their own rather than a codec
+	p.setup("AMQP Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		return amqp.Split()
+	}, nil, append([]muxy.Middleware{&amqpDecoder{}}, middleware...))
+}
+
+// amqpSessionKey identifies the AMQP session of a connection in its Values
+type amqpSessionKey struct{}
+
+// amqpRoute is what a message was published to, or consumed from
+type amqpRoute struct {
+	exchange   string
+	routingKey string
+	queue      string
+}
+
+// amqpChannel tracks the messages in flight on a channel, so that their
+// acknowledgements can be matched by route
+type amqpChannel struct {
+	// content is the method whose content is being sent, by the client
+	// and the broker respectively
+	content [2]*muxy.Message
+
+	// published counts the messages published once publisher confirms
+	// are enabled, and confirms holds their routes by sequence number
+	confirm   bool
+	published uint64
+	confirms  map[uint64]amqpRoute
+
+	// deliveries are the routes of messages delivered to the client,
+	// by delivery tag
+	deliveries map[uint64]amqpRoute
+
+	// consumers are the queues of each consumer, by tag, and consuming
+	// and getting the queues of a basic.consume or basic.get in progress
+	consumers map[string]string
+	consuming string
+	getting   string
+}
+
+// amqpSession holds the channels of a connection
+type amqpSession struct {
+	lock     sync.Mutex
+	channels map[uint16]*amqpChannel
+}
+
+// channel returns the state of a channel, creating it if needed
+func (s *amqpSession) channel(id uint16) *amqpChannel {
+	c, ok := s.channels[id]
+	if !ok {
+		c = &amqpChannel{
+			confirms:   map[uint64]amqpRoute{},
+			deliveries: map[uint64]amqpRoute{},
+			consumers:  map[string]string{},
+		}
+		s.channels[id] = c
+	}
+	return c
+}
+
+// amqpDecoder decodes each frame before it is given to middlewares
+type amqpDecoder struct{}
+
+// Setup sets up the middleware
+func (m *amqpDecoder) Setup() {}
+
+// Teardown shuts down the middleware
+func (m *amqpDecoder) Teardown() {}
+
+// HandleEvent decodes the frame in ctx
+func (m *amqpDecoder) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Connection.Values == nil || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
+	v, _ := ctx.Connection.Values.LoadOrStore(amqpSessionKey{}, &amqpSession{channels: map[uint16]*amqpChannel{}})
+	s := v.(*amqpSession)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ctx.Message = s.decode(ctx.Bytes, e == muxy.EventPreDispatch)
+}
+
+// decode decodes a frame from the client (request) or the broker
+func (s *amqpSession) decode(b []byte, request bool) *muxy.Message {
+	if len(b) == len(amqp.ProtocolHeader) && string(b[:4]) == "AMQP" {
+		return &muxy.Message{Protocol: "amqp", Command: "protocol-header", Fields: map[string]string{}}
+	}
+
+	f, ok := amqp.ParseFrame(b)
+	if !ok {
+		log.Debug("AMQP Proxy unable to decode frame")
+		return nil
+	}
+	c := s.channel(f.Channel)
+	direction := 1
+	if request {
+		direction = 0
+	}
+
+	switch f.Type {
+	case amqp.FrameHeartbeat:
+		return &muxy.Message{Protocol: "amqp", Command: "heartbeat", Fields: map[string]string{"frame": "heartbeat"}}
+	case amqp.FrameHeader, amqp.FrameBody:
+		// Content frames are given the method they belong to
+		content := c.content[direction]
+		if content == nil {
+			return nil
+		}
+		msg := *content
+		msg.Fields = map[string]string{"frame": "header"}
+		if f.Type == amqp.FrameBody {
+			msg.Fields["frame"] = "body"
+		}
+		for k, v := range content.Fields {
+			if k != "frame" {
+				msg.Fields[k] = v
+			}
+		}
+		return &msg
+	case amqp.FrameMethod:
+	default:
+		return nil
+	}
+
+	method, ok := amqp.ParseMethod(f.Payload)
+	if !ok {
+		log.Debug("AMQP Proxy unable to decode method")
+		return nil
+	}
+	route := amqpRoute{exchange: method.Exchange, routingKey: method.RoutingKey, queue: method.Queue}
+
+	switch method.ID {
+	case amqp.ChannelOpen, amqp.ChannelCloseOk:
+		delete(s.channels, f.Channel)
+	case amqp.ConfirmSelect:
+		c.confirm = true
+	case amqp.BasicPublish:
+		if c.confirm {
+			c.published++
+			c.confirms[c.published] = route
+		}
+	case amqp.BasicConsume:
+		c.consuming = method.Queue
+	case amqp.BasicConsumeOk:
+		c.consumers[method.ConsumerTag] = c.consuming
+		route.queue = c.consuming
+	case amqp.BasicGet:
+		c.getting = method.Queue
+	case amqp.BasicDeliver:
+		route.queue = c.consumers[method.ConsumerTag]
+		c.deliveries[method.DeliveryTag] = route
+	case amqp.BasicGetOk:
+		route.queue = c.getting
+		c.deliveries[method.DeliveryTag] = route
+	case amqp.BasicAck, amqp.BasicNack, amqp.BasicReject:
+		// The broker confirms publishes, and the client acknowledges deliveries
+		routes := c.deliveries
+		if !request {
+			routes = c.confirms
+		}
+		route = routes[method.DeliveryTag]
+		for tag := range routes {
+			if tag == method.DeliveryTag || (method.Multiple && tag < method.DeliveryTag) {
+				delete(routes, tag)
+			}
+		}
+	}
+
+	msg := &muxy.Message{
+		Protocol: "amqp",
+		Command:  amqp.MethodName(method.ID),
+		Key:      route.routingKey,
+		Fields: map[string]string{
+			"frame":       "method",
+			"channel":     strconv.Itoa(int(f.Channel)),
+			"method_id":   strconv.Itoa(int(method.ID)),
+			"exchange":    route.exchange,
+			"routing_key": route.routingKey,
+			"queue":       route.queue,
+		},
+	}
+	if msg.Key == "" {
+		msg.Key = route.queue
+	}
+	if msg.Key == "" {
+		msg.Key = route.exchange
+	}
+	if method.ConsumerTag != "" {
+		msg.Fields["consumer_tag"] = method.ConsumerTag
+	}
+	if method.DeliveryTag > 0 {
+		msg.Fields["delivery_tag"] = strconv.FormatUint(method.DeliveryTag, 10)
+		msg.Fields["multiple"] = strconv.FormatBool(method.Multiple)
+	}
+	if method.ReplyCode > 0 {
+		msg.Fields["reply_code"] = strconv.Itoa(int(method.ReplyCode))
+	}
+
+	switch method.ID {
+	case amqp.BasicPublish, amqp.BasicDeliver, amqp.BasicGetOk, amqp.BasicReturn:
+		c.content[direction] = msg
+	}
+	return msg
+}
@@ -0,0 +1,460 @@
+// Package amqp decodes and encodes the frames of AMQP 0-9-1, as spoken by
+// RabbitMQ, for use by the AMQP Proxy and its Symptoms.
+package amqp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// ProtocolHeader is sent by the client to open a connection
+var ProtocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+// Types of frame
+const (
+	FrameMethod    = 1
+	FrameHeader    = 2
+	FrameBody      = 3
+	FrameHeartbeat = 8
+)
+
+// frameEnd terminates every frame
+const frameEnd = 0xce
+
+// Classes of method
+const (
+	ClassConnection = 10
+	ClassChannel    = 20
+	ClassExchange   = 40
+	ClassQueue      = 50
+	ClassBasic      = 60
+	ClassConfirm    = 85
+	ClassTx         = 90
+)
+
+// Methods, identified by their class and method id
+const (
+	ConnectionClose   = ClassConnection<<16 | 50
+	ConnectionCloseOk = ClassConnection<<16 | 51
+	ChannelOpen       = ClassChannel<<16 | 10
+	ChannelClose      = ClassChannel<<16 | 40
+	ChannelCloseOk    = ClassChannel<<16 | 41
+	ExchangeDeclare   = ClassExchange<<16 | 10
+	ExchangeDelete    = ClassExchange<<16 | 20
+	ExchangeBind      = ClassExchange<<16 | 30
+	ExchangeUnbind    = ClassExchange<<16 | 40
+	QueueDeclare      = ClassQueue<<16 | 10
+	QueueDeclareOk    = ClassQueue<<16 | 11
+	QueueBind         = ClassQueue<<16 | 20
+	QueuePurge        = ClassQueue<<16 | 30
+	QueueDelete       = ClassQueue<<16 | 40
+	QueueUnbind       = ClassQueue<<16 | 50
+	BasicConsume      = ClassBasic<<16 | 20
+	BasicConsumeOk    = ClassBasic<<16 | 21
+	BasicCancel       = ClassBasic<<16 | 30
+	BasicPublish      = ClassBasic<<16 | 40
+	BasicReturn       = ClassBasic<<16 | 50
+	BasicDeliver      = ClassBasic<<16 | 60
+	BasicGet          = ClassBasic<<16 | 70
+	BasicGetOk        = ClassBasic<<16 | 71
+	BasicAck          = ClassBasic<<16 | 80
+	BasicReject       = ClassBasic<<16 | 90
+	BasicNack         = ClassBasic<<16 | 120
+	ConfirmSelect     = ClassConfirm<<16 | 10
+)
+
+var methodNames = map[uint32]string{
+	ClassConnection<<16 | 10: "connection.start",
+	ClassConnection<<16 | 11: "connection.start-ok",
+	ClassConnection<<16 | 20: "connection.secure",
+	ClassConnection<<16 | 21: "connection.secure-ok",
+	ClassConnection<<16 | 30: "connection.tune",
+	ClassConnection<<16 | 31: "connection.tune-ok",
+	ClassConnection<<16 | 40: "connection.open",
+	ClassConnection<<16 | 41: "connection.open-ok",
+	ConnectionClose:          "connection.close",
+	ConnectionCloseOk:        "connection.close-ok",
+	ChannelOpen:              "channel.open",
+	ClassChannel<<16 | 11:    "channel.open-ok",
+	ClassChannel<<16 | 20:    "channel.flow",
+	ClassChannel<<16 | 21:    "channel.flow-ok",
+	ChannelClose:             "channel.close",
+	ChannelCloseOk:           "channel.close-ok",
+	ExchangeDeclare:          "exchange.declare",
+	ClassExchange<<16 | 11:   "exchange.declare-ok",
+	ExchangeDelete:           "exchange.delete",
+	ClassExchange<<16 | 21:   "exchange.delete-ok",
+	ExchangeBind:             "exchange.bind",
+	ClassExchange<<16 | 31:   "exchange.bind-ok",
+	ExchangeUnbind:           "exchange.unbind",
+	ClassExchange<<16 | 51:   "exchange.unbind-ok",
+	QueueDeclare:             "queue.declare",
+	QueueDeclareOk:           "queue.declare-ok",
+	QueueBind:                "queue.bind",
+	ClassQueue<<16 | 21:      "queue.bind-ok",
+	QueuePurge:               "queue.purge",
+	ClassQueue<<16 | 31:      "queue.purge-ok",
+	QueueDelete:              "queue.delete",
+	ClassQueue<<16 | 41:      "queue.delete-ok",
+	QueueUnbind:              "queue.unbind",
+	ClassQueue<<16 | 51:      "queue.unbind-ok",
+	ClassBasic<<16 | 10:      "basic.qos",
+	ClassBasic<<16 | 11:      "basic.qos-ok",
+	BasicConsume:             "basic.consume",
+	BasicConsumeOk:           "basic.consume-ok",
+	BasicCancel:              "basic.cancel",
+	ClassBasic<<16 | 31:      "basic.cancel-ok",
+	BasicPublish:             "basic.publish",
+	BasicReturn:              "basic.return",
+	BasicDeliver:             "basic.deliver",
+	BasicGet:                 "basic.get",
+	BasicGetOk:               "basic.get-ok",
+	ClassBasic<<16 | 72:      "basic.get-empty",
+	BasicAck:                 "basic.ack",
+	BasicReject:              "basic.reject",
+	ClassBasic<<16 | 100:     "basic.recover-async",
+	ClassBasic<<16 | 110:     "basic.recover",
+	ClassBasic<<16 | 111:     "basic.recover-ok",
+	BasicNack:                "basic.nack",
+	ConfirmSelect:            "confirm.select",
+	ClassConfirm<<16 | 11:    "confirm.select-ok",
+	ClassTx<<16 | 10:         "tx.select",
+	ClassTx<<16 | 11:         "tx.select-ok",
+	ClassTx<<16 | 20:         "tx.commit",
+	ClassTx<<16 | 21:         "tx.commit-ok",
+	ClassTx<<16 | 30:         "tx.rollback",
+	ClassTx<<16 | 31:         "tx.rollback-ok",
+}
+
+// replyCodes are the reply codes of connection.close and channel.close
+var replyCodes = map[string]uint16{
+	"REPLY_SUCCESS":       200,
+	"CONTENT_TOO_LARGE":   311,
+	"NO_ROUTE":            312,
+	"NO_CONSUMERS":        313,
+	"CONNECTION_FORCED":   320,
+	"INVALID_PATH":        402,
+	"ACCESS_REFUSED":      403,
+	"NOT_FOUND":           404,
+	"RESOURCE_LOCKED":     405,
+	"PRECONDITION_FAILED": 406,
+	"FRAME_ERROR":         501,
+	"SYNTAX_ERROR":        502,
+	"COMMAND_INVALID":     503,
+	"CHANNEL_ERROR":       504,
+	"UNEXPECTED_FRAME":    505,
+	"RESOURCE_ERROR":      506,
+	"NOT_ALLOWED":         530,
+	"NOT_IMPLEMENTED":     540,
+	"INTERNAL_ERROR":      541,
+}
+
+// MethodName returns the name of a method, e.g. "basic.publish"
+func MethodName(method uint32) string {
+	if name, ok := methodNames[method]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseReplyCode returns the reply code with the given name, e.g.
+// NOT_FOUND, or number
+func ParseReplyCode(s string) (uint16, bool) {
+	if code, ok := replyCodes[strings.ToUpper(s)]; ok {
+		return code, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	for _, code := range replyCodes {
+		if code == uint16(n) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// ReplyText returns the name of a reply code, e.g. "NOT_FOUND"
+func ReplyText(code uint16) string {
+	for name, c := range replyCodes {
+		if c == code {
+			return name
+		}
+	}
+	return "UNKNOWN"
+}
+
+// HardError returns true if the reply code closes the connection, rather
+// than the channel, when given as an error
+func HardError(code uint16) bool {
+	switch code {
+	case 311, 312, 313, 403, 404, 405, 406:
+		return false
+	}
+	return true
+}
+
+// Split splits a stream into frames, and the protocol header that opens
+// it. Streams that are not AMQP, such as TLS, are passed on as they are
+// read.
+func Split() bufio.SplitFunc {
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		if raw {
+			return len(data), data, nil
+		}
+
+		if data[0] == 'A' {
+			if len(data) < len(ProtocolHeader) {
+				return flush(data, atEOF)
+			}
+			if bytes.HasPrefix(data, []byte("AMQP")) {
+				return len(ProtocolHeader), data[:len(ProtocolHeader)], nil
+			}
+		}
+
+		switch data[0] {
+		case FrameMethod, FrameHeader, FrameBody, FrameHeartbeat:
+		default:
+			raw = true
+			return len(data), data, nil
+		}
+		if len(data) < 7 {
+			return flush(data, atEOF)
+		}
+		size := 8 + int(binary.BigEndian.Uint32(data[3:]))
+		if size < 8 {
+			raw = true
+			return len(data), data, nil
+		}
+		if len(data) < size {
+			return flush(data, atEOF)
+		}
+		return size, data[:size], nil
+	}
+}
+
+// flush requests more data, or passes on a partial frame at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Frame is a decoded frame
+type Frame struct {
+	Type    byte
+	Channel uint16
+	Payload []byte
+}
+
+// ParseFrame decodes a frame
+func ParseFrame(b []byte) (*Frame, bool) {
+	if len(b) < 8 || int(binary.BigEndian.Uint32(b[3:]))+8 != len(b) || b[len(b)-1] != frameEnd {
+		return nil, false
+	}
+	return &Frame{Type: b[0], Channel: binary.BigEndian.Uint16(b[1:]), Payload: b[7 : len(b)-1]}, true
+}
+
+// NewFrame encodes a frame
+func NewFrame(t byte, channel uint16, payload []byte) []byte {
+	b := make([]byte, 7, 8+len(payload))
+	b[0] = t
+	binary.BigEndian.PutUint16(b[1:], channel)
+	binary.BigEndian.PutUint32(b[3:], uint32(len(payload)))
+	b = append(b, payload...)
+	return append(b, frameEnd)
+}
+
+// Method is a decoded method frame. Only the arguments that identify
+// what the method acts upon are decoded.
+type Method struct {
+	ID          uint32
+	Exchange    string
+	RoutingKey  string
+	Queue       string
+	ConsumerTag string
+	DeliveryTag uint64
+	Multiple    bool
+	Requeue     bool
+	ReplyCode   uint16
+	ReplyText   string
+}
+
+// reader reads the arguments of a method
+type reader struct {
+	b  []byte
+	ok bool
+}
+
+func (r *reader) short() uint16 {
+	if len(r.b) < 2 {
+		r.ok = false
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) longlong() uint64 {
+	if len(r.b) < 8 {
+		r.ok = false
+		return 0
+	}
+	v := binary.BigEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v
+}
+
+func (r *reader) octet() byte {
+	if len(r.b) < 1 {
+		r.ok = false
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *reader) shortstr() string {
+	n := int(r.octet())
+	if len(r.b) < n {
+		r.ok = false
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
+
+// ParseMethod decodes the payload of a method frame
+func ParseMethod(payload []byte) (*Method, bool) {
+	r := &reader{b: payload, ok: true}
+	class := r.short()
+	id := r.short()
+	if !r.ok {
+		return nil, false
+	}
+	m := &Method{ID: uint32(class)<<16 | uint32(id)}
+
+	switch m.ID {
+	case ConnectionClose, ChannelClose:
+		m.ReplyCode = r.short()
+		m.ReplyText = r.shortstr()
+	case ExchangeDeclare, ExchangeDelete:
+		r.short()
+		m.Exchange = r.shortstr()
+	case ExchangeBind, ExchangeUnbind:
+		r.short()
+		r.shortstr()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case QueueDeclare, QueuePurge, QueueDelete, BasicGet:
+		r.short()
+		m.Queue = r.shortstr()
+	case QueueDeclareOk:
+		m.Queue = r.shortstr()
+	case QueueBind, QueueUnbind:
+		r.short()
+		m.Queue = r.shortstr()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case BasicConsume:
+		r.short()
+		m.Queue = r.shortstr()
+		m.ConsumerTag = r.shortstr()
+	case BasicConsumeOk, BasicCancel:
+		m.ConsumerTag = r.shortstr()
+	case BasicPublish:
+		r.short()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case BasicReturn:
+		m.ReplyCode = r.short()
+		m.ReplyText = r.shortstr()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case BasicDeliver:
+		m.ConsumerTag = r.shortstr()
+		m.DeliveryTag = r.longlong()
+		r.octet()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case BasicGetOk:
+		m.DeliveryTag = r.longlong()
+		r.octet()
+		m.Exchange = r.shortstr()
+		m.RoutingKey = r.shortstr()
+	case BasicAck:
+		m.DeliveryTag = r.longlong()
+		m.Multiple = r.octet()&1 != 0
+	case BasicReject:
+		m.DeliveryTag = r.longlong()
+		m.Requeue = r.octet()&1 != 0
+	case BasicNack:
+		m.DeliveryTag = r.longlong()
+		bits := r.octet()
+		m.Multiple = bits&1 != 0
+		m.Requeue = bits&2 != 0
+	}
+	return m, r.ok
+}
+
+// NewMethod encodes a method frame
+func NewMethod(channel uint16, method uint32, args []byte) []byte {
+	payload := make([]byte, 4, 4+len(args))
+	binary.BigEndian.PutUint32(payload, method)
+	return NewFrame(FrameMethod, channel, append(payload, args...))
+}
+
+// NewClose encodes the connection.close, for channel 0, or channel.close
+// of a channel, blaming the given method for the failure
+func NewClose(channel uint16, code uint16, text string, failed uint32) []byte {
+	method := uint32(ChannelClose)
+	if channel == 0 {
+		method = ConnectionClose
+	}
+	if len(text) > 255 {
+		text = text[:255]
+	}
+
+	args := make([]byte, 2, 9+len(text))
+	binary.BigEndian.PutUint16(args, code)
+	args = append(args, byte(len(text)))
+	args = append(args, text...)
+	args = append(args, byte(failed>>24), byte(failed>>16), byte(failed>>8), byte(failed))
+	return NewMethod(channel, method, args)
+}
+
+// NewAck encodes a basic.ack
+func NewAck(channel uint16, tag uint64, multiple bool) []byte {
+	args := make([]byte, 9)
+	binary.BigEndian.PutUint64(args, tag)
+	if multiple {
+		args[8] = 1
+	}
+	return NewMethod(channel, BasicAck, args)
+}
+
+// NewNack encodes a basic.nack
+func NewNack(channel uint16, tag uint64, multiple bool, requeue bool) []byte {
+	args := make([]byte, 9)
+	binary.BigEndian.PutUint64(args, tag)
+	if multiple {
+		args[8] |= 1
+	}
+	if requeue {
+		args[8] |= 2
+	}
+	return NewMethod(channel, BasicNack, args)
+}
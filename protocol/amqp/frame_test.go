@@ -0,0 +1,96 @@
+package amqp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func shortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func publish(channel uint16, exchange string, key string) []byte {
+	args := append([]byte{0, 0}, shortstr(exchange)...)
+	args = append(args, shortstr(key)...)
+	return NewMethod(channel, BasicPublish, append(args, 0))
+}
+
+func TestSplit(t *testing.T) {
+	want := [][]byte{
+		ProtocolHeader,
+		publish(1, "orders", "order.created"),
+		NewFrame(FrameHeader, 1, make([]byte, 14)),
+		NewFrame(FrameBody, 1, []byte("{}")),
+		NewFrame(FrameHeartbeat, 0, nil),
+	}
+	got := prototest.Scan(Split(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	// TLS is passed on as it is read
+	got = prototest.Scan(Split(), []byte{0x16, 0x03, 0x01, 0x00})
+	if len(got) != 4 {
+		t.Fatalf("Want TLS passed on as read, got %q", got)
+	}
+}
+
+func TestParseMethod(t *testing.T) {
+	deliver := append(shortstr("ctag-1"), 0, 0, 0, 0, 0, 0, 0, 9, 1)
+	deliver = append(deliver, shortstr("orders")...)
+	deliver = append(deliver, shortstr("order.created")...)
+
+	cases := []struct {
+		frame []byte
+		want  *Method
+	}{
+		{
+			publish(1, "orders", "order.created"),
+			&Method{ID: BasicPublish, Exchange: "orders", RoutingKey: "order.created"},
+		},
+		{
+			NewMethod(1, BasicDeliver, deliver),
+			&Method{ID: BasicDeliver, ConsumerTag: "ctag-1", DeliveryTag: 9, Exchange: "orders", RoutingKey: "order.created"},
+		},
+		{
+			NewNack(1, 7, true, true),
+			&Method{ID: BasicNack, DeliveryTag: 7, Multiple: true, Requeue: true},
+		},
+		{
+			NewClose(1, 404, "NOT_FOUND", BasicPublish),
+			&Method{ID: ChannelClose, ReplyCode: 404, ReplyText: "NOT_FOUND"},
+		},
+	}
+	for _, c := range cases {
+		f, ok := ParseFrame(c.frame)
+		if !ok || f.Type != FrameMethod || f.Channel != 1 {
+			t.Fatalf("Want method frame on channel 1, got %+v", f)
+		}
+		m, ok := ParseMethod(f.Payload)
+		if !ok || !reflect.DeepEqual(m, c.want) {
+			t.Fatalf("Want %+v, got %+v", c.want, m)
+		}
+	}
+
+	if _, ok := ParseMethod([]byte{0, 60, 0, 40, 0}); ok {
+		t.Fatal("Want truncated basic.publish to fail")
+	}
+}
+
+func TestReplyCode(t *testing.T) {
+	if code, ok := ParseReplyCode("not_found"); !ok || code != 404 || HardError(code) {
+		t.Fatal("Want NOT_FOUND to be a soft error 404, got", code)
+	}
+	if code, ok := ParseReplyCode("320"); !ok || !HardError(code) || ReplyText(code) != "CONNECTION_FORCED" {
+		t.Fatal("Want CONNECTION_FORCED to be a hard error, got", code)
+	}
+	if _, ok := ParseReplyCode("999"); ok {
+		t.Fatal("Want unknown reply code to fail")
+	}
+	if name := MethodName(BasicDeliver); name != "basic.deliver" {
+		t.Fatal("Want basic.deliver, got", name)
+	}
+}
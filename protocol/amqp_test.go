@@ -0,0 +1,192 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/amqp"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// amqpShortstr encodes a short string
+func amqpShortstr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// amqpPublishMethod encodes a basic.publish
+func amqpPublishMethod(channel uint16, exchange string, key string) []byte {
+	args := append([]byte{0, 0}, amqpShortstr(exchange)...)
+	args = append(args, amqpShortstr(key)...)
+	return amqp.NewMethod(channel, amqp.BasicPublish, append(args, 0))
+}
+
+// amqpPublish encodes a basic.publish and its content
+func amqpPublish(channel uint16, exchange string, key string) []byte {
+	b := amqpPublishMethod(channel, exchange, key)
+	b = append(b, amqp.NewFrame(amqp.FrameHeader, channel, []byte{0, 60, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0})...)
+	return append(b, amqp.NewFrame(amqp.FrameBody, channel, []byte("{}"))...)
+}
+
+// amqpQueueDeclare encodes a queue.declare
+func amqpQueueDeclare(channel uint16, queue string) []byte {
+	args := append([]byte{0, 0}, amqpShortstr(queue)...)
+	return amqp.NewMethod(channel, amqp.QueueDeclare, append(args, 0, 0, 0, 0, 0))
+}
+
+// setupLocalAMQP starts a fake AMQP broker, which confirms every message
+// and opens and closes channels
+func setupLocalAMQP(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(amqp.Split())
+
+		published := uint64(0)
+		for s.Scan() {
+			f, ok := amqp.ParseFrame(s.Bytes())
+			if !ok || f.Type != amqp.FrameMethod {
+				continue
+			}
+			m, _ := amqp.ParseMethod(f.Payload)
+			switch m.ID {
+			case amqp.ConfirmSelect:
+				c.Write(amqp.NewMethod(f.Channel, amqp.ConfirmSelect+1, nil))
+			case amqp.BasicPublish:
+				published++
+				c.Write(amqp.NewAck(f.Channel, published, false))
+			case amqp.QueueDeclare:
+				args := append(amqpShortstr(m.Queue), 0, 0, 0, 0, 0, 0, 0, 0)
+				c.Write(amqp.NewMethod(f.Channel, amqp.QueueDeclareOk, args))
+			case amqp.ChannelOpen:
+				c.Write(amqp.NewMethod(f.Channel, amqp.ChannelOpen+1, []byte{0, 0, 0, 0}))
+			case amqp.ChannelClose:
+				c.Write(amqp.NewMethod(f.Channel, amqp.ChannelCloseOk, nil))
+			default:
+				// Anything unexpected fails the connection
+				c.Write(amqp.NewClose(0, 503, "COMMAND_INVALID", m.ID))
+			}
+		}
+	})
+}
+
+func TestAMQPProxy_Proxy(t *testing.T) {
+	brokerPort := 7749
+	setupLocalAMQP(brokerPort)
+
+	withholder := &symptom.AMQPSymptom{
+		WithholdAcks: true,
+		Exchange:     "^orders$",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Direction: "response"},
+		},
+	}
+	withholder.Setup()
+	closer := &symptom.AMQPSymptom{
+		Close: "NOT_FOUND",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Command: "^queue.declare$", Key: "^missing$"},
+		},
+	}
+	closer.Setup()
+
+	port := 7750
+	p := AMQPProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: brokerPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{withholder, closer})
+
+	waitForPort(brokerPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s := bufio.NewScanner(conn)
+	s.Split(amqp.Split())
+
+	read := func() (uint16, *amqp.Method) {
+		if !s.Scan() {
+			t.Fatal("Want frame, got", s.Err())
+		}
+		f, ok := amqp.ParseFrame(s.Bytes())
+		if !ok || f.Type != amqp.FrameMethod {
+			t.Fatalf("Want method frame, got %q", s.Bytes())
+		}
+		m, _ := amqp.ParseMethod(f.Payload)
+		return f.Channel, m
+	}
+
+	// Only the message published to events is confirmed
+	conn.Write(amqp.NewMethod(1, amqp.ConfirmSelect, []byte{0}))
+	if _, m := read(); m.ID != amqp.ConfirmSelect+1 {
+		t.Fatalf("Want confirm.select-ok, got %+v", m)
+	}
+	conn.Write(append(amqpPublish(1, "orders", "order.created"), amqpPublish(1, "events", "user.created")...))
+	if _, m := read(); m.ID != amqp.BasicAck || m.DeliveryTag != 2 {
+		t.Fatalf("Want basic.ack of message 2, got %+v", m)
+	}
+
+	// Declaring the missing queue closes the channel, which can be reopened
+	conn.Write(amqpQueueDeclare(2, "missing"))
+	if channel, m := read(); channel != 2 || m.ID != amqp.ChannelClose || m.ReplyCode != 404 {
+		t.Fatalf("Want channel.close of 404, got %+v", m)
+	}
+	conn.Write(amqp.NewMethod(2, amqp.ChannelCloseOk, nil))
+	conn.Write(amqp.NewMethod(2, amqp.ChannelOpen, []byte{0}))
+	if channel, m := read(); channel != 2 || m.ID != amqp.ChannelOpen+1 {
+		t.Fatalf("Want channel.open-ok, got %+v", m)
+	}
+	conn.Write(amqpQueueDeclare(2, "orders"))
+	if _, m := read(); m.ID != amqp.QueueDeclareOk || m.Queue != "orders" {
+		t.Fatalf("Want queue.declare-ok, got %+v", m)
+	}
+}
+
+func TestAMQPDecoder_Routes(t *testing.T) {
+	s := &amqpSession{channels: map[uint16]*amqpChannel{}}
+
+	// Publisher confirms are matched with the route of the message
+	s.decode(amqp.NewMethod(1, amqp.ConfirmSelect, []byte{0}), true)
+	s.decode(amqpPublishMethod(1, "orders", "order.created"), true)
+	msg := s.decode(amqp.NewAck(1, 1, false), false)
+	if msg.Command != "basic.ack" || msg.Key != "order.created" || msg.Fields["exchange"] != "orders" {
+		t.Fatalf("Want basic.ack of order.created, got %+v", msg)
+	}
+
+	// Deliveries are matched with the queue they were consumed from
+	consume := append([]byte{0, 0}, amqpShortstr("orders-queue")...)
+	consume = append(consume, amqpShortstr("")...)
+	s.decode(amqp.NewMethod(1, amqp.BasicConsume, append(consume, 0, 0, 0, 0, 0)), true)
+	s.decode(amqp.NewMethod(1, amqp.BasicConsumeOk, amqpShortstr("ctag-1")), false)
+
+	deliver := append(amqpShortstr("ctag-1"), 0, 0, 0, 0, 0, 0, 0, 5, 0)
+	deliver = append(deliver, amqpShortstr("orders")...)
+	deliver = append(deliver, amqpShortstr("order.created")...)
+	msg = s.decode(amqp.NewMethod(1, amqp.BasicDeliver, deliver), false)
+	if msg.Fields["queue"] != "orders-queue" || msg.Fields["delivery_tag"] != "5" {
+		t.Fatalf("Want basic.deliver from orders-queue, got %+v", msg)
+	}
+
+	body := s.decode(amqp.NewFrame(amqp.FrameBody, 1, []byte("{}")), false)
+	if body.Command != "basic.deliver" || body.Fields["frame"] != "body" || body.Fields["queue"] != "orders-queue" {
+		t.Fatalf("Want body of basic.deliver, got %+v", body)
+	}
+
+	msg = s.decode(amqp.NewAck(1, 5, true), true)
+	if msg.Fields["queue"] != "orders-queue" || len(s.channels[1].deliveries) != 0 {
+		t.Fatalf("Want basic.ack of orders-queue, got %+v", msg)
+	}
+}
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/dns"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// DNSProxy implements a DNS proxy over UDP and TCP. Queries and responses
+// are decoded, so that middlewares can target them by name and type.
+type DNSProxy struct {
+	Port      int    `required:"true"`
+	Host      string `required:"true" default:"localhost"`
+	ProxyHost string `required:"true" mapstructure:"proxy_host"`
+	ProxyPort int    `required:"true" mapstructure:"proxy_port"`
+	HexOutput bool   `mapstructure:"hex_output"`
+
+	// Network is the transport proxied: udp, tcp or, if empty, both
+	Network string `required:"false"`
+
+	// Timeout in ms to wait for the upstream resolver to answer a UDP query
+	Timeout int `required:"false"`
+
+	queryID    uint64
+	middleware []muxy.Middleware
+	tcp        *TCPProxy
+	udp        *net.UDPConn
+}
+
+// defaultDNSTimeout is the default time to wait for the upstream resolver
+const defaultDNSTimeout = 5 * time.Second
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &DNSProxy{}, nil
+	}, "dns_proxy")
+}
+
+// Setup the DNS proxy
+func (p *DNSProxy) Setup(middleware []muxy.Middleware) {
+	switch p.Network {
+	case "", "udp", "tcp":
+	default:
+		check(fmt.Errorf("invalid DNS network '%s', must be udp or tcp", p.Network))
+	}
+	p.middleware = middleware
+
+	if p.Network != "udp" {
+		p.tcp = &TCPProxy{
+			Port:       p.Port,
+			Host:       p.Host,
+			ProxyHost:  p.ProxyHost,
+			ProxyPort:  p.ProxyPort,
+			HexOutput:  p.HexOutput,
+			PacketSize: 4096,
+			Framing:    FramingConfig{Type: "length", LengthBytes: 2},
+			codec: func() codec {
+				return &dnsCodec{}
+			},
+		}
+		p.tcp.Setup(middleware)
+	}
+}
+
+// Teardown the DNS proxy
+func (p *DNSProxy) Teardown() {
+	if p.tcp != nil {
+		p.tcp.Teardown()
+	}
+	if p.udp != nil {
+		p.udp.Close()
+	}
+}
+
+// Proxy runs the DNS proxy
+func (p *DNSProxy) Proxy() {
+	log.Info("DNS Proxy proxying to %s:%d", p.ProxyHost, p.ProxyPort)
+	if p.Network == "tcp" {
+		p.tcp.Proxy()
+		return
+	}
+	if p.tcp != nil {
+		go p.tcp.Proxy()
+	}
+
+	laddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.Host, p.Port))
+	check(err)
+	raddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", p.ProxyHost, p.ProxyPort))
+	check(err)
+	p.udp, err = net.ListenUDP("udp", laddr)
+	check(err)
+
+	log.Info("DNS Proxy listening on %s", log.Colorize(log.BLUE, fmt.Sprintf("udp://%s:%d", p.Host, p.Port)))
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := p.udp.ReadFromUDP(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.Error("DNS Proxy read failed: %s", err.Error())
+			continue
+		}
+		go p.exchange(client, raddr, append([]byte(nil), buf[:n]...))
+	}
+}
+
+// exchange proxies a query received over UDP, and its response
+func (p *DNSProxy) exchange(client *net.UDPAddr, raddr *net.UDPAddr, query []byte) {
+	conn := &muxy.Connection{
+		ID:         atomic.AddUint64(&p.queryID, 1),
+		ClientAddr: client,
+		Opened:     time.Now(),
+		Direction:  muxy.DirectionRequest,
+	}
+	ctx := &muxy.Context{Bytes: query, Connection: conn, Message: dnsMessage(query, "udp")}
+	if p.HexOutput {
+		log.Trace("DNS Proxy query from %s: %x", client, query)
+	}
+	for _, middleware := range p.middleware {
+		middleware.HandleEvent(muxy.EventPreDispatch, ctx)
+	}
+	time.Sleep(conn.Delay)
+
+	if conn.Reply != nil {
+		p.reply(client, conn.Reply)
+	}
+	if len(ctx.Bytes) == 0 {
+		return
+	}
+
+	response, err := p.forward(raddr, ctx.Bytes)
+	if err != nil {
+		log.Error("DNS Proxy query failed: %s", err.Error())
+		return
+	}
+
+	rconn := *conn
+	rconn.Direction = muxy.DirectionResponse
+	rconn.Delay = 0
+	rconn.Reply = nil
+	rconn.SentBytes = uint64(len(ctx.Bytes))
+	rconn.ReceivedBytes = uint64(len(response))
+	ctx = &muxy.Context{Bytes: response, Connection: &rconn, Message: dnsMessage(response, "udp")}
+	for _, middleware := range p.middleware {
+		middleware.HandleEvent(muxy.EventPostDispatch, ctx)
+	}
+	time.Sleep(rconn.Delay)
+
+	if len(ctx.Bytes) > 0 {
+		p.reply(client, ctx.Bytes)
+	}
+}
+
+// forward sends a query to the upstream resolver, returning its response
+func (p *DNSProxy) forward(raddr *net.UDPAddr, query []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	timeout := defaultDNSTimeout
+	if p.Timeout > 0 {
+		timeout = time.Duration(p.Timeout) * time.Millisecond
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// reply sends a response to the client
+func (p *DNSProxy) reply(client *net.UDPAddr, b []byte) {
+	if _, err := p.udp.WriteToUDP(b, client); err != nil {
+		log.Error("DNS Proxy reply failed: %s", err.Error())
+	}
+}
+
+// dnsMessage decodes a DNS message, sent over the given transport. Its
+// Command is the type of its first question, and its Key the name.
+func dnsMessage(b []byte, transport string) *muxy.Message {
+	m, err := dns.Parse(b)
+	if err != nil {
+		log.Debug("DNS Proxy unable to decode message")
+		return nil
+	}
+
+	msg := &muxy.Message{
+		Protocol: "dns",
+		Fields: map[string]string{
+			"id":        strconv.Itoa(int(m.ID)),
+			"transport": transport,
+		},
+	}
+	if len(m.Questions) > 0 {
+		msg.Command = dns.TypeName(m.Questions[0].Type)
+		msg.Key = strings.ToLower(m.Questions[0].Name)
+	}
+	if m.Response() {
+		msg.Fields["rcode"] = dns.RcodeName(m.Rcode())
+		var answers []string
+		for _, ip := range m.Answers() {
+			answers = append(answers, ip.String())
+		}
+		msg.Fields["answers"] = strings.Join(answers, ",")
+	}
+	return msg
+}
+
+// dnsCodec decodes the length prefixed messages of DNS over TCP. Each
+// query is answered by one response.
+type dnsCodec struct{}
+
+// decode decodes a query or response
+func (c *dnsCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if len(b) < 2 {
+		return nil, false
+	}
+	msg := dnsMessage(b[2:], "tcp")
+	return msg, msg != nil || !request
+}
@@ -0,0 +1,355 @@
+// Package dns decodes DNS messages, and derives responses from them, for
+// use by the DNS Proxy and its Symptoms. Responses are built from the
+// bytes of the message they answer or amend, so that compressed names
+// remain valid without re-encoding the message.
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+// Flags of the message header
+const (
+	FlagResponse           = 1 << 15
+	FlagAuthoritative      = 1 << 10
+	FlagTruncated          = 1 << 9
+	FlagRecursionDesired   = 1 << 8
+	FlagRecursionAvailable = 1 << 7
+)
+
+// Response codes
+const (
+	RcodeSuccess        = 0
+	RcodeFormatError    = 1
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+	RcodeRefused        = 5
+)
+
+var rcodeNames = map[int]string{
+	RcodeSuccess:        "NOERROR",
+	RcodeFormatError:    "FORMERR",
+	RcodeServerFailure:  "SERVFAIL",
+	RcodeNameError:      "NXDOMAIN",
+	RcodeNotImplemented: "NOTIMP",
+	RcodeRefused:        "REFUSED",
+}
+
+// Resource record types
+const (
+	TypeA     = 1
+	TypeNS    = 2
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeMX    = 15
+	TypeTXT   = 16
+	TypeAAAA  = 28
+	TypeSRV   = 33
+	TypeOPT   = 41
+	TypeHTTPS = 65
+	TypeANY   = 255
+)
+
+var typeNames = map[uint16]string{
+	TypeA:     "A",
+	TypeNS:    "NS",
+	TypeCNAME: "CNAME",
+	TypeSOA:   "SOA",
+	TypePTR:   "PTR",
+	TypeMX:    "MX",
+	TypeTXT:   "TXT",
+	TypeAAAA:  "AAAA",
+	TypeSRV:   "SRV",
+	TypeOPT:   "OPT",
+	TypeHTTPS: "HTTPS",
+	TypeANY:   "ANY",
+}
+
+// headerSize is the size of the message header
+const headerSize = 12
+
+// errInvalid is returned for messages that cannot be decoded
+var errInvalid = errors.New("dns: invalid message")
+
+// RcodeName returns the name of a response code, e.g. "NXDOMAIN"
+func RcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// ParseRcode returns the response code with the given name
+func ParseRcode(name string) (int, bool) {
+	for rcode, n := range rcodeNames {
+		if n == strings.ToUpper(name) {
+			return rcode, true
+		}
+	}
+	return 0, false
+}
+
+// TypeName returns the name of a record type, e.g. "AAAA"
+func TypeName(t uint16) string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// Message is a decoded DNS message
+type Message struct {
+	ID        uint16
+	Flags     uint16
+	Questions []Question
+	Records   []Record
+
+	// questionEnd is the offset of the end of the question section
+	questionEnd int
+}
+
+// Question is an entry of the question section
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// Record is a resource record of the answer, authority or additional
+// sections. Its Data is as encoded, and may contain compressed names.
+type Record struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+
+	// ttlOffset is the offset of the TTL within the message
+	ttlOffset int
+}
+
+// Response returns true if the message is a response
+func (m *Message) Response() bool {
+	return m.Flags&FlagResponse != 0
+}
+
+// Truncated returns true if the message was truncated
+func (m *Message) Truncated() bool {
+	return m.Flags&FlagTruncated != 0
+}
+
+// Rcode returns the response code of the message
+func (m *Message) Rcode() int {
+	return int(m.Flags & 0xf)
+}
+
+// Parse decodes a DNS message
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerSize {
+		return nil, errInvalid
+	}
+
+	m := &Message{
+		ID:    binary.BigEndian.Uint16(b),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(b[4:]))
+	rrcount := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) +
+		int(binary.BigEndian.Uint16(b[10:]))
+
+	off := headerSize
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+4 > len(b) {
+			return nil, errInvalid
+		}
+		m.Questions = append(m.Questions, Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	m.questionEnd = off
+
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readName(b, off)
+		if err != nil || next+10 > len(b) {
+			return nil, errInvalid
+		}
+		size := int(binary.BigEndian.Uint16(b[next+8:]))
+		if next+10+size > len(b) {
+			return nil, errInvalid
+		}
+		m.Records = append(m.Records, Record{
+			Name:      name,
+			Type:      binary.BigEndian.Uint16(b[next:]),
+			Class:     binary.BigEndian.Uint16(b[next+2:]),
+			TTL:       binary.BigEndian.Uint32(b[next+4:]),
+			Data:      b[next+10 : next+10+size],
+			ttlOffset: next + 4,
+		})
+		off = next + 10 + size
+	}
+
+	return m, nil
+}
+
+// readName reads the, possibly compressed, name at off, returning it
+// without the trailing dot and the offset following it
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	// Each pointer must point backwards, so there can be no loops
+	for limit := off; ; {
+		if off >= len(b) {
+			return "", 0, errInvalid
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errInvalid
+			}
+			ptr := int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			if ptr >= limit {
+				return "", 0, errInvalid
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off, limit = ptr, ptr
+		case n&0xc0 != 0:
+			return "", 0, errInvalid
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errInvalid
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// Answers returns the addresses of the A and AAAA records of the message
+func (m *Message) Answers() []net.IP {
+	var ips []net.IP
+	for _, r := range m.Records {
+		if (r.Type == TypeA && len(r.Data) == net.IPv4len) || (r.Type == TypeAAAA && len(r.Data) == net.IPv6len) {
+			ips = append(ips, net.IP(r.Data))
+		}
+	}
+	return ips
+}
+
+// response returns the header and question section of m, given as b,
+// as a response with the given flags set and no records
+func (m *Message) response(b []byte, flags uint16) []byte {
+	r := append([]byte(nil), b[:m.questionEnd]...)
+	binary.BigEndian.PutUint16(r[2:], m.Flags|FlagResponse|flags)
+	binary.BigEndian.PutUint16(r[6:], 0)
+	binary.BigEndian.PutUint16(r[8:], 0)
+	binary.BigEndian.PutUint16(r[10:], 0)
+	return r
+}
+
+// NewError returns a response to the query m, given as b, with an error
+// response code such as RcodeNameError
+func NewError(b []byte, m *Message, rcode int) []byte {
+	r := m.response(b, FlagRecursionAvailable)
+	flags := binary.BigEndian.Uint16(r[2:])&^0xf | uint16(rcode&0xf)
+	binary.BigEndian.PutUint16(r[2:], flags)
+	return r
+}
+
+// NewAnswer returns a response to the query m, given as b, answering its
+// first question with those of ips that match its type, A or AAAA
+func NewAnswer(b []byte, m *Message, ips []net.IP, ttl uint32) []byte {
+	r := m.response(b, FlagRecursionAvailable)
+	if len(m.Questions) == 0 {
+		return r
+	}
+
+	q := m.Questions[0]
+	count := 0
+	for _, ip := range ips {
+		data := ip.To4()
+		if q.Type == TypeAAAA {
+			data = nil
+			if ip.To4() == nil {
+				data = ip.To16()
+			}
+		} else if q.Type != TypeA {
+			continue
+		}
+		if data == nil {
+			continue
+		}
+
+		// The name points to that of the first question
+		rr := make([]byte, 12, 12+len(data))
+		binary.BigEndian.PutUint16(rr, 0xc000|headerSize)
+		binary.BigEndian.PutUint16(rr[2:], q.Type)
+		binary.BigEndian.PutUint16(rr[4:], q.Class)
+		binary.BigEndian.PutUint32(rr[6:], ttl)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(data)))
+		r = append(r, append(rr, data...)...)
+		count++
+	}
+	binary.BigEndian.PutUint16(r[6:], uint16(count))
+	return r
+}
+
+// SetTTL returns a copy of the response m, given as b, with the TTL of
+// every record set to ttl
+func SetTTL(b []byte, m *Message, ttl uint32) []byte {
+	r := append([]byte(nil), b...)
+	for _, rr := range m.Records {
+		// The TTL of an OPT pseudo-record holds extended flags
+		if rr.Type != TypeOPT {
+			binary.BigEndian.PutUint32(r[rr.ttlOffset:], ttl)
+		}
+	}
+	return r
+}
+
+// Truncate returns the response m, given as b, truncated to its header
+// and question section, so that clients retry over TCP
+func Truncate(b []byte, m *Message) []byte {
+	return m.response(b, FlagTruncated)
+}
+
+// Frame prefixes a message with its length, as sent over TCP
+func Frame(b []byte) []byte {
+	f := make([]byte, 2, 2+len(b))
+	binary.BigEndian.PutUint16(f, uint16(len(b)))
+	return append(f, b...)
+}
+
+// NewQuery encodes a recursive query for a name and record type
+func NewQuery(id uint16, name string, qtype uint16) []byte {
+	b := make([]byte, headerSize, headerSize+len(name)+6)
+	binary.BigEndian.PutUint16(b, id)
+	binary.BigEndian.PutUint16(b[2:], FlagRecursionDesired)
+	binary.BigEndian.PutUint16(b[4:], 1)
+
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	b = append(b, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return b
+}
@@ -0,0 +1,126 @@
+package dns
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	query := NewQuery(7, "www.example.com.", TypeA)
+	m, err := Parse(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 7 || m.Response() || m.Flags&FlagRecursionDesired == 0 {
+		t.Fatalf("Want recursive query 7, got %+v", m)
+	}
+	want := []Question{{Name: "www.example.com", Type: TypeA, Class: 1}}
+	if !reflect.DeepEqual(m.Questions, want) {
+		t.Fatalf("Want %v, got %v", want, m.Questions)
+	}
+
+	if _, err := Parse(query[:len(query)-2]); err == nil {
+		t.Fatal("Want truncated query to be invalid")
+	}
+}
+
+func TestParse_Compression(t *testing.T) {
+	query := NewQuery(1, "example.com", TypeA)
+	m, _ := Parse(query)
+	b := NewAnswer(query, m, []net.IP{net.ParseIP("10.0.0.1")}, 30)
+
+	r, err := Parse(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Records) != 1 || r.Records[0].Name != "example.com" || r.Records[0].TTL != 30 {
+		t.Fatalf("Want answer for example.com, got %+v", r.Records)
+	}
+
+	// Pointers must point backwards
+	loop := append([]byte(nil), b...)
+	binary.BigEndian.PutUint16(loop[headerSize:], 0xc000|headerSize)
+	if _, err := Parse(loop); err == nil {
+		t.Fatal("Want looping name to be invalid")
+	}
+}
+
+func TestNewError(t *testing.T) {
+	query := NewQuery(3, "missing.example.com", TypeAAAA)
+	m, _ := Parse(query)
+
+	r, err := Parse(NewError(query, m, RcodeNameError))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 3 || !r.Response() || r.Rcode() != RcodeNameError || len(r.Questions) != 1 || len(r.Records) != 0 {
+		t.Fatalf("Want NXDOMAIN response to 3, got %+v", r)
+	}
+}
+
+func TestNewAnswer(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("::1"), net.ParseIP("10.0.0.2")}
+
+	cases := []struct {
+		qtype uint16
+		want  []net.IP
+	}{
+		{TypeA, []net.IP{ips[0].To4(), ips[2].To4()}},
+		{TypeAAAA, []net.IP{ips[1]}},
+		{TypeMX, nil},
+	}
+	for _, c := range cases {
+		query := NewQuery(1, "example.com", c.qtype)
+		m, _ := Parse(query)
+		r, err := Parse(NewAnswer(query, m, ips, 60))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Answers(); !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("Want %v for %s, got %v", c.want, TypeName(c.qtype), got)
+		}
+	}
+}
+
+func TestSetTTL(t *testing.T) {
+	query := NewQuery(1, "example.com", TypeA)
+	m, _ := Parse(query)
+	b := NewAnswer(query, m, []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")}, 300)
+	r, _ := Parse(b)
+
+	r, err := Parse(SetTTL(b, r, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rr := range r.Records {
+		if rr.TTL != 0 {
+			t.Fatal("Want TTL of 0, got", rr.TTL)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	query := NewQuery(1, "example.com", TypeA)
+	m, _ := Parse(query)
+	b := NewAnswer(query, m, []net.IP{net.ParseIP("10.0.0.1")}, 300)
+	r, _ := Parse(b)
+
+	r, err := Parse(Truncate(b, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Truncated() || len(r.Questions) != 1 || len(r.Records) != 0 {
+		t.Fatalf("Want truncated response, got %+v", r)
+	}
+}
+
+func TestParseRcode(t *testing.T) {
+	if rcode, ok := ParseRcode("servfail"); !ok || rcode != RcodeServerFailure {
+		t.Fatal("Want SERVFAIL, got", rcode, ok)
+	}
+	if _, ok := ParseRcode("oops"); ok {
+		t.Fatal("Want unknown rcode to be invalid")
+	}
+}
@@ -0,0 +1,141 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/dns"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// resolve answers a query with 10.0.0.1
+func resolve(query []byte) []byte {
+	m, err := dns.Parse(query)
+	if err != nil {
+		return nil
+	}
+	return dns.NewAnswer(query, m, []net.IP{net.ParseIP("10.0.0.1")}, 300)
+}
+
+// setupLocalResolver starts a fake resolver over UDP and TCP, which
+// answers every query with 10.0.0.1
+func setupLocalResolver(port int) {
+	udp, err := net.ListenPacket("udp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(resolve(buf[:n]), addr)
+		}
+	}()
+
+	prototest.Serve(port, func(c net.Conn) {
+		for {
+			size := make([]byte, 2)
+			if _, err := io.ReadFull(c, size); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(size))
+			if _, err := io.ReadFull(c, query); err != nil {
+				return
+			}
+			c.Write(dns.Frame(resolve(query)))
+		}
+	})
+}
+
+func TestDNSProxy_Proxy(t *testing.T) {
+	resolverPort := 7753
+	setupLocalResolver(resolverPort)
+
+	failer := &symptom.DNSSymptom{
+		Rcode: "NXDOMAIN",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Key: "^missing\\."},
+		},
+	}
+	failer.Setup()
+	truncater := &symptom.DNSSymptom{Truncate: true}
+	truncater.Setup()
+
+	port := 7754
+	p := DNSProxy{
+		Port:      port,
+		Host:      "localhost",
+		ProxyHost: "localhost",
+		ProxyPort: resolverPort,
+	}
+	p.Setup([]muxy.Middleware{failer, truncater})
+	go p.Proxy()
+	waitForPort(port, t)
+	defer p.Teardown()
+
+	udp, err := net.Dial("udp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+
+	query := func(conn net.Conn, id uint16, name string) *dns.Message {
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		var b []byte
+		if conn == tcp {
+			conn.Write(dns.Frame(dns.NewQuery(id, name, dns.TypeA)))
+			size := make([]byte, 2)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				t.Fatal(err)
+			}
+			b = make([]byte, binary.BigEndian.Uint16(size))
+			if _, err := io.ReadFull(conn, b); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			conn.Write(dns.NewQuery(id, name, dns.TypeA))
+			b = make([]byte, 512)
+			n, err := conn.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b = b[:n]
+		}
+
+		m, err := dns.Parse(b)
+		if err != nil || m.ID != id {
+			t.Fatalf("Want response %d, got %q %v", id, b, err)
+		}
+		return m
+	}
+
+	if m := query(udp, 1, "missing.example.com"); m.Rcode() != dns.RcodeNameError {
+		t.Fatal("Want NXDOMAIN over UDP, got", dns.RcodeName(m.Rcode()))
+	}
+	if m := query(tcp, 2, "missing.example.com"); m.Rcode() != dns.RcodeNameError {
+		t.Fatal("Want NXDOMAIN over TCP, got", dns.RcodeName(m.Rcode()))
+	}
+
+	// Responses over UDP are truncated, so the client retries over TCP
+	if m := query(udp, 3, "www.example.com"); !m.Truncated() || len(m.Answers()) != 0 {
+		t.Fatalf("Want truncated response over UDP, got %+v", m)
+	}
+	if m := query(tcp, 4, "www.example.com"); m.Truncated() || len(m.Answers()) != 1 {
+		t.Fatalf("Want answer over TCP, got %+v", m)
+	}
+}
@@ -0,0 +1,235 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// defaultMaxMessageSize is the largest message buffered by a framer when
+// no max_size is configured
+const defaultMaxMessageSize = 64 * 1024
+
+// FramingConfig describes how a TCP stream is split into whole messages
+// before being handed to middlewares.
+type FramingConfig struct {
+	// Type is one of newline, length, fixed or regex.
+	// If empty, messages are passed on as they are read from the socket.
+	Type string
+
+	// LengthBytes is the size of the length prefix for length framing: 1, 2 or 4.
+	// The length excludes the prefix itself.
+	LengthBytes int `mapstructure:"length_bytes"`
+
+	// Endian is the byte order of the length prefix: big (default) or little
+	Endian string
+
+	// Size is the size of each message for fixed framing
+	Size int
+
+	// Pattern is the regular expression that terminates each message
+	// for regex framing
+	Pattern string
+
+	// MaxSize is the largest message that will be buffered. Larger messages
+	// are passed on in pieces of at most MaxSize bytes.
+	MaxSize int `mapstructure:"max_size"`
+}
+
+// splitter returns a factory for the split function used to frame
+// each direction of a connection, or nil if framing is disabled
+func (c FramingConfig) splitter() (func(request bool) bufio.SplitFunc, error) {
+	max := c.MaxSize
+	if max <= 0 {
+		max = defaultMaxMessageSize
+	}
+
+	switch c.Type {
+	case "":
+		return nil, nil
+	case "newline":
+		return func(bool) bufio.SplitFunc {
+			return delimiterSplit(func(data []byte) int {
+				if i := bytes.IndexByte(data, '\n'); i >= 0 {
+					return i + 1
+				}
+				return -1
+			}, max)
+		}, nil
+	case "regex":
+		if c.Pattern == "" {
+			return nil, fmt.Errorf("regex framing requires a pattern")
+		}
+		re, err := regexp.Compile(c.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		return func(bool) bufio.SplitFunc {
+			return delimiterSplit(func(data []byte) int {
+				if loc := re.FindIndex(data); loc != nil && loc[1] > 0 {
+					return loc[1]
+				}
+				return -1
+			}, max)
+		}, nil
+	case "fixed":
+		if c.Size <= 0 || c.Size > max {
+			return nil, fmt.Errorf("fixed framing requires a positive size no larger than %d", max)
+		}
+		return func(bool) bufio.SplitFunc {
+			return fixedSplit(c.Size)
+		}, nil
+	case "length":
+		var order binary.ByteOrder
+		switch c.Endian {
+		case "", "big":
+			order = binary.BigEndian
+		case "little":
+			order = binary.LittleEndian
+		default:
+			return nil, fmt.Errorf("invalid length prefix endianness '%s'", c.Endian)
+		}
+		if c.LengthBytes != 1 && c.LengthBytes != 2 && c.LengthBytes != 4 {
+			return nil, fmt.Errorf("invalid length prefix size %d, must be 1, 2 or 4", c.LengthBytes)
+		}
+		return func(bool) bufio.SplitFunc {
+			return lengthSplit(c.LengthBytes, order, max)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown framing type '%s'", c.Type)
+}
+
+// delimiterSplit frames messages ending at the index returned by end,
+// which returns -1 if no message is complete
+func delimiterSplit(end func([]byte) int, max int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := end(data); i > 0 {
+			if i > max {
+				return max, data[:max], nil
+			}
+			return i, data[:i], nil
+		}
+		if len(data) >= max {
+			return max, data[:max], nil
+		}
+		return flush(data, atEOF)
+	}
+}
+
+// fixedSplit frames messages of exactly size bytes
+func fixedSplit(size int) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) >= size {
+			return size, data[:size], nil
+		}
+		return flush(data, atEOF)
+	}
+}
+
+// lengthSplit frames messages with a length prefix of size bytes
+func lengthSplit(size int, order binary.ByteOrder, max int) bufio.SplitFunc {
+	// remaining counts the bytes left of a message larger than max
+	remaining := 0
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if remaining > 0 {
+			n := remaining
+			if n > max {
+				n = max
+			}
+			if len(data) < n {
+				return flush(data, atEOF)
+			}
+			remaining -= n
+			return n, data[:n], nil
+		}
+
+		if len(data) < size {
+			return flush(data, atEOF)
+		}
+
+		var length int
+		switch size {
+		case 1:
+			length = int(data[0])
+		case 2:
+			length = int(order.Uint16(data))
+		case 4:
+			length = int(order.Uint32(data))
+		}
+
+		total := size + length
+		if total > max {
+			if len(data) < max {
+				return flush(data, atEOF)
+			}
+			remaining = total - max
+			return max, data[:max], nil
+		}
+
+		if len(data) < total {
+			return flush(data, atEOF)
+		}
+		return total, data[:total], nil
+	}
+}
+
+// flush requests more data, or passes on a partial message at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// framer reads whole messages from one side of a connection
+type framer interface {
+	ReadMessage() ([]byte, error)
+}
+
+// rawFramer passes on whatever is read from the socket, up to packetsize bytes
+type rawFramer struct {
+	src  io.Reader
+	buff []byte
+}
+
+func (f *rawFramer) ReadMessage() ([]byte, error) {
+	n, err := f.src.Read(f.buff)
+	return f.buff[:n], err
+}
+
+// scanFramer reads messages delimited by a split function
+type scanFramer struct {
+	scanner *bufio.Scanner
+}
+
+func (f *scanFramer) ReadMessage() ([]byte, error) {
+	if f.scanner.Scan() {
+		return f.scanner.Bytes(), nil
+	}
+	if err := f.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// newFramer creates a framer reading from src. A nil split function
+// reads raw packets of up to packetsize bytes.
+func newFramer(src io.Reader, split bufio.SplitFunc, packetsize int, max int) framer {
+	if split == nil {
+		return &rawFramer{src: src, buff: make([]byte, packetsize)}
+	}
+
+	if max <= 0 {
+		max = defaultMaxMessageSize
+	}
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 0, packetsize), max)
+	scanner.Split(split)
+
+	return &scanFramer{scanner: scanner}
+}
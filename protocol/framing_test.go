@@ -0,0 +1,124 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+func readAll(t *testing.T, f framer) []string {
+	var messages []string
+	for {
+		b, err := f.ReadMessage()
+		if len(b) > 0 {
+			messages = append(messages, string(b))
+		}
+		if err == io.EOF {
+			return messages
+		}
+		if err != nil {
+			t.Fatal("Got error, want nil", err)
+		}
+	}
+}
+
+func frame(t *testing.T, c FramingConfig, input []byte) []string {
+	splitter, err := c.splitter()
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+
+	// A 1 byte reader ensures messages are assembled across reads
+	src := iotest.OneByteReader(bytes.NewReader(input))
+	return readAll(t, newFramer(src, splitter(true), 64, c.MaxSize))
+}
+
+func TestFraming_Newline(t *testing.T) {
+	got := frame(t, FramingConfig{Type: "newline"}, []byte("SET foo bar\r\nGET foo\r\npartial"))
+	want := []string{"SET foo bar\r\n", "GET foo\r\n", "partial"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_Regex(t *testing.T) {
+	got := frame(t, FramingConfig{Type: "regex", Pattern: "END;"}, []byte("oneEND;twoEND;"))
+	want := []string{"oneEND;", "twoEND;"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_Fixed(t *testing.T) {
+	got := frame(t, FramingConfig{Type: "fixed", Size: 3}, []byte("abcdefgh"))
+	want := []string{"abc", "def", "gh"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_Length(t *testing.T) {
+	got := frame(t, FramingConfig{Type: "length", LengthBytes: 2}, []byte("\x00\x03abc\x00\x01d"))
+	want := []string{"\x00\x03abc", "\x00\x01d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+
+	got = frame(t, FramingConfig{Type: "length", LengthBytes: 4, Endian: "little"}, []byte("\x02\x00\x00\x00ab\x01\x00\x00\x00c"))
+	want = []string{"\x02\x00\x00\x00ab", "\x01\x00\x00\x00c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+
+	got = frame(t, FramingConfig{Type: "length", LengthBytes: 1}, []byte("\x01a\x02bc"))
+	want = []string{"\x01a", "\x02bc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_MaxSize(t *testing.T) {
+	got := frame(t, FramingConfig{Type: "length", LengthBytes: 1, MaxSize: 4}, []byte("\x06abcdef\x01g"))
+	want := []string{"\x06abc", "def", "\x01g"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+
+	got = frame(t, FramingConfig{Type: "newline", MaxSize: 4}, []byte("abcdef\n"))
+	want = []string{"abcd", "ef\n"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_Raw(t *testing.T) {
+	splitter, err := FramingConfig{}.splitter()
+	if err != nil || splitter != nil {
+		t.Fatal("Want no splitter, got", err)
+	}
+
+	got := readAll(t, newFramer(bytes.NewReader([]byte("abcdef")), nil, 4, 0))
+	want := []string{"abcd", "ef"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("Want", want, "got", got)
+	}
+}
+
+func TestFraming_Invalid(t *testing.T) {
+	testCases := []FramingConfig{
+		FramingConfig{Type: "unknown"},
+		FramingConfig{Type: "regex"},
+		FramingConfig{Type: "regex", Pattern: "("},
+		FramingConfig{Type: "fixed"},
+		FramingConfig{Type: "length", LengthBytes: 3},
+		FramingConfig{Type: "length", LengthBytes: 2, Endian: "middle"},
+	}
+
+	for _, c := range testCases {
+		if _, err := c.splitter(); err == nil {
+			t.Fatal("Want error for framing config", c, "got nil")
+		}
+	}
+}
@@ -1,5 +1,5 @@
 // Package protocol contains all of the available protocols:
-// TCP, HTTP and the HTTP reverse proxy component.
+// TCP, HTTP, Redis and the HTTP reverse proxy component.
 //
 // All protocols support plugins (e.g. Middlewares and Symptoms)
 // to interfere with their behaviour.
@@ -10,6 +10,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"time"
 
@@ -66,7 +67,10 @@ type HTTPProxy struct {
 	ProxyClientSslKey   string      `required:"false" mapstructure:"proxy_client_ssl_key"`
 	ProxyClientSslCa    string      `required:"false" mapstructure:"proxy_client_ssl_ca"`
 	ProxyRules          []ProxyRule `required:"false" mapstructure:"proxy_rules"`
+	MaxConnections      int         `required:"false" mapstructure:"max_connections"`
+	Overflow            string      `required:"false" mapstructure:"overflow"`
 	middleware          []muxy.Middleware
+	limiter             *connLimiter
 }
 
 func init() {
@@ -100,6 +104,12 @@ func (p *HTTPProxy) Setup(middleware []muxy.Middleware) {
 	} else {
 		p.ProxyRules = append(p.ProxyRules, p.defaultProxyRule())
 	}
+
+	limiter, err := newConnLimiter(p.MaxConnections, p.Overflow)
+	if err != nil {
+		log.Fatalf("Error setting up HTTP Proxy: %s", err.Error())
+	}
+	p.limiter = limiter
 }
 
 // Teardown shuts down the middleware
@@ -180,6 +190,11 @@ func (p *HTTPProxy) Proxy() {
 
 	})
 
+	if p.limiter != nil {
+		p.serveLimited(mux)
+		return
+	}
+
 	if p.Protocol == "https" {
 		checkHTTPServerError(err)
 		checkHTTPServerError(http.ListenAndServeTLS(fmt.Sprintf("%s:%d", p.Host, p.Port), p.ProxySslCertificate, p.ProxySslKey, mux))
@@ -188,6 +203,22 @@ func (p *HTTPProxy) Proxy() {
 	}
 }
 
+// serveLimited serves the proxy, limiting the number of concurrent connections
+func (p *HTTPProxy) serveLimited(handler http.Handler) {
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", p.Host, p.Port))
+	if err != nil {
+		checkHTTPServerError(err)
+		return
+	}
+	listener = &limitListener{Listener: listener, limiter: p.limiter}
+
+	if p.Protocol == "https" {
+		checkHTTPServerError(http.ServeTLS(listener, handler, p.ProxySslCertificate, p.ProxySslKey))
+	} else {
+		checkHTTPServerError(http.Serve(listener, handler))
+	}
+}
+
 func checkHTTPServerError(err error) {
 	if err != nil {
 		log.Error("ListenAndServe error: ", err.Error())
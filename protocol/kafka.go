@@ -0,0 +1,253 @@
+package protocol
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/kafka"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// KafkaProxy implements a Kafka aware TCP proxy. Request headers are
+// decoded, so that middlewares can target requests by API and topic, and
+// the brokers advertised to clients are rewritten so that they continue
+// to connect through the proxy.
+type KafkaProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// AdvertisedHost and AdvertisedPort are the address of this proxy
+	// given to clients in place of the broker's. Default to Host and Port
+	AdvertisedHost string `required:"false" mapstructure:"advertised_host"`
+	AdvertisedPort int    `required:"false" mapstructure:"advertised_port"`
+
+	// Brokers maps the addresses of other brokers to those of the proxies
+	// in front of them, e.g. "kafka-2:9092": "localhost:19093". If empty,
+	// every broker is advertised as this proxy.
+	Brokers map[string]string `required:"false"`
+
+	// MaxSize is the largest request or response that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultKafkaMaxSize is the default largest request or response, matching
+// the socket.request.max.bytes default of Kafka
+const defaultKafkaMaxSize = 100 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &KafkaProxy{}, nil
+	}, "kafka_proxy")
+}
+
+// Setup the Kafka proxy
+func (p *KafkaProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultKafkaMaxSize
+	}
+
+	advertiser := &kafkaAdvertiser{
+		target:  net.JoinHostPort(p.ProxyHost, strconv.Itoa(p.ProxyPort)),
+		host:    p.AdvertisedHost,
+		port:    p.AdvertisedPort,
+		brokers: p.Brokers,
+	}
+	p.setup("Kafka Proxy", FramingConfig{Type: "length", LengthBytes: 4, MaxSize: max + 4}, nil, func() codec {
+		return &kafkaCodec{}
+	}, append(append([]muxy.Middleware{}, middleware...), advertiser))
+
+	// Host is defaulted by setup
+	if advertiser.host == "" {
+		advertiser.host = p.Host
+	}
+	if advertiser.port == 0 {
+		advertiser.port = p.Port
+	}
+}
+
+// kafkaCodec decodes the headers of requests and responses. Responses are
+// returned in the order requests are made, and every request is answered
+// except a Produce that does not require acknowledgement.
+type kafkaCodec struct {
+	// remaining counts the bytes left of a message larger than the
+	// largest that will be decoded, for requests and responses
+	remaining [2]int
+}
+
+// decode decodes a request or response
+func (c *kafkaCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	remaining := &c.remaining[0]
+	if request {
+		remaining = &c.remaining[1]
+	}
+	if *remaining > 0 {
+		*remaining -= len(b)
+		return nil, false
+	}
+	if size := kafka.Size(b); size > len(b)-4 {
+		*remaining = size - (len(b) - 4)
+	}
+
+	if request {
+		return c.decodeRequest(b)
+	}
+	return c.decodeResponse(b, req)
+}
+
+func (c *kafkaCodec) decodeRequest(b []byte) (*muxy.Message, bool) {
+	h, body, ok := kafka.ParseRequest(b)
+	if !ok {
+		log.Debug("Kafka Proxy unable to decode request")
+		return nil, false
+	}
+
+	msg := &muxy.Message{
+		Protocol: "kafka",
+		Command:  kafka.APIName(h.APIKey),
+		Fields: map[string]string{
+			"api_key":        strconv.Itoa(int(h.APIKey)),
+			"version":        strconv.Itoa(int(h.APIVersion)),
+			"correlation_id": strconv.Itoa(int(h.CorrelationID)),
+			"client_id":      h.ClientID,
+		},
+	}
+
+	if h.APIKey == kafka.Produce {
+		produce, err := kafka.ParseProduceRequest(h.APIVersion, body)
+		if err != nil {
+			log.Debug("Kafka Proxy unable to decode Produce request: %s", err)
+			return msg, true
+		}
+
+		var topics []string
+		for _, t := range produce.Topics {
+			topics = append(topics, t.Name)
+		}
+		if len(topics) > 0 {
+			msg.Key = topics[0]
+		}
+		msg.Fields["topics"] = strings.Join(topics, ",")
+		msg.Fields["acks"] = strconv.Itoa(int(produce.Acks))
+
+		// Brokers do not respond when acks are not required
+		if produce.Acks == 0 {
+			return msg, false
+		}
+	}
+	return msg, true
+}
+
+func (c *kafkaCodec) decodeResponse(b []byte, req *muxy.Message) (*muxy.Message, bool) {
+	msg := &muxy.Message{Protocol: "kafka", Fields: map[string]string{}}
+	if req == nil {
+		log.Debug("Kafka Proxy received a response without a request")
+		return msg, true
+	}
+
+	msg.Command = req.Command
+	msg.Key = req.Key
+	msg.Pipelined = req.Pipelined
+	for k, v := range req.Fields {
+		msg.Fields[k] = v
+	}
+
+	key, _ := strconv.Atoi(req.Fields["api_key"])
+	version, _ := strconv.Atoi(req.Fields["version"])
+	correlationID, _, ok := kafka.ParseResponse(b, int16(key), int16(version))
+	if !ok {
+		log.Debug("Kafka Proxy unable to decode response")
+	} else if strconv.Itoa(int(correlationID)) != req.Fields["correlation_id"] {
+		log.Debug("Kafka Proxy received response %d out of order", correlationID)
+	}
+	return msg, true
+}
+
+// kafkaAdvertiser rewrites the brokers and coordinators in Metadata and
+// FindCoordinator responses to the proxies in front of them
+type kafkaAdvertiser struct {
+	// target is the address of the proxied broker
+	target string
+
+	// host and port are the address of this proxy
+	host string
+	port int
+
+	// brokers are the proxies in front of other brokers
+	brokers map[string]string
+}
+
+// Setup sets up the middleware
+func (m *kafkaAdvertiser) Setup() {}
+
+// Teardown shuts down the middleware
+func (m *kafkaAdvertiser) Teardown() {}
+
+// HandleEvent rewrites the addresses in responses to the proxy
+func (m *kafkaAdvertiser) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPostDispatch || ctx.Message == nil || ctx.Message.Protocol != "kafka" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if ctx.Message.Command != "Metadata" && ctx.Message.Command != "FindCoordinator" {
+		return
+	}
+
+	key, _ := strconv.Atoi(ctx.Message.Fields["api_key"])
+	v, _ := strconv.Atoi(ctx.Message.Fields["version"])
+	version := int16(v)
+	correlationID, body, ok := kafka.ParseResponse(ctx.Bytes, int16(key), version)
+	if !ok {
+		return
+	}
+
+	switch key {
+	case kafka.Metadata:
+		metadata, err := kafka.ParseMetadataResponse(version, body)
+		if err != nil {
+			log.Debug("Kafka Proxy unable to decode Metadata response: %s", err)
+			return
+		}
+		for i := range metadata.Brokers {
+			b := &metadata.Brokers[i]
+			b.Host, b.Port = m.advertise(b.Host, b.Port)
+		}
+		body = metadata.Encode()
+	case kafka.FindCoordinator:
+		coordinator, err := kafka.ParseFindCoordinatorResponse(version, body)
+		if err != nil {
+			log.Debug("Kafka Proxy unable to decode FindCoordinator response: %s", err)
+			return
+		}
+		for i := range coordinator.Coordinators {
+			c := &coordinator.Coordinators[i]
+			if c.NodeID >= 0 {
+				c.Host, c.Port = m.advertise(c.Host, c.Port)
+			}
+		}
+		body = coordinator.Encode()
+	}
+
+	ctx.Bytes = kafka.NewResponse(correlationID, int16(key), version, body)
+}
+
+// advertise returns the address of the proxy in front of a broker
+func (m *kafkaAdvertiser) advertise(host string, port int32) (string, int32) {
+	addr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	if len(m.brokers) == 0 || addr == m.target {
+		return m.host, int32(m.port)
+	}
+
+	proxy, ok := m.brokers[addr]
+	if !ok {
+		return host, port
+	}
+	h, p, err := net.SplitHostPort(proxy)
+	if err != nil {
+		log.Error("Kafka Proxy invalid broker address '%s'", proxy)
+		return host, port
+	}
+	n, _ := strconv.Atoi(p)
+	return h, int32(n)
+}
@@ -0,0 +1,248 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errShort is returned when a message ends before all its fields are read
+var errShort = errors.New("kafka: message too short")
+
+// reader decodes the primitive types of the protocol. Flexible versions
+// use compact (varint length) strings and arrays, and tagged fields.
+// Once an error occurs, reads return zero values and err is set.
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errShort
+		r.b = nil
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *reader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *reader) bool() bool {
+	return r.int8() != 0
+}
+
+func (r *reader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *reader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *reader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *reader) uuid() (id [16]byte) {
+	if b := r.next(16); b != nil {
+		copy(id[:], b)
+	}
+	return id
+}
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errShort
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+// length reads the length of a string, bytes or array, which is -1 if null
+func (r *reader) length(flexible bool, array bool) int {
+	switch {
+	case flexible:
+		return int(r.uvarint()) - 1
+	case array:
+		return int(r.int32())
+	}
+	return int(r.int16())
+}
+
+func (r *reader) nullableString(flexible bool) *string {
+	n := r.length(flexible, false)
+	if n < 0 {
+		return nil
+	}
+	s := string(r.next(n))
+	return &s
+}
+
+func (r *reader) string(flexible bool) string {
+	if s := r.nullableString(flexible); s != nil {
+		return *s
+	}
+	return ""
+}
+
+// bytes reads nullable bytes, which have a 32 bit length unless flexible
+func (r *reader) bytes(flexible bool) []byte {
+	n := r.length(flexible, true)
+	if n < 0 {
+		return nil
+	}
+	return r.next(n)
+}
+
+func (r *reader) arrayLength(flexible bool) int {
+	n := r.length(flexible, true)
+	if n > len(r.b) {
+		// Every element takes at least a byte
+		r.err = errShort
+		r.b = nil
+		return 0
+	}
+	return n
+}
+
+func (r *reader) int32s(flexible bool) []int32 {
+	n := r.arrayLength(flexible)
+	if n < 0 {
+		return nil
+	}
+	v := make([]int32, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		v = append(v, r.int32())
+	}
+	return v
+}
+
+// tags reads the tagged fields of a flexible version, which are kept as
+// they were encoded
+func (r *reader) tags(flexible bool) []byte {
+	if !flexible || r.err != nil {
+		return nil
+	}
+	start := r.b
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		r.uvarint()
+		r.next(int(r.uvarint()))
+	}
+	if r.err != nil {
+		return nil
+	}
+	return start[:len(start)-len(r.b)]
+}
+
+// writer encodes the primitive types of the protocol
+type writer struct {
+	b []byte
+}
+
+func (w *writer) int8(v int8) {
+	w.b = append(w.b, byte(v))
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.int8(1)
+	} else {
+		w.int8(0)
+	}
+}
+
+func (w *writer) int16(v int16) {
+	w.b = append(w.b, byte(v>>8), byte(v))
+}
+
+func (w *writer) int32(v int32) {
+	w.b = append(w.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *writer) int64(v int64) {
+	w.int32(int32(v >> 32))
+	w.int32(int32(v))
+}
+
+func (w *writer) uuid(id [16]byte) {
+	w.b = append(w.b, id[:]...)
+}
+
+func (w *writer) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	w.b = append(w.b, buf[:n]...)
+}
+
+func (w *writer) length(n int, flexible bool, array bool) {
+	switch {
+	case flexible:
+		w.uvarint(uint64(n + 1))
+	case array:
+		w.int32(int32(n))
+	default:
+		w.int16(int16(n))
+	}
+}
+
+func (w *writer) nullableString(s *string, flexible bool) {
+	if s == nil {
+		w.length(-1, flexible, false)
+		return
+	}
+	w.string(*s, flexible)
+}
+
+func (w *writer) string(s string, flexible bool) {
+	w.length(len(s), flexible, false)
+	w.b = append(w.b, s...)
+}
+
+func (w *writer) int32s(v []int32, flexible bool) {
+	if v == nil {
+		w.length(-1, flexible, true)
+		return
+	}
+	w.length(len(v), flexible, true)
+	for _, i := range v {
+		w.int32(i)
+	}
+}
+
+// tags writes tagged fields read by reader.tags, or none
+func (w *writer) tags(tags []byte, flexible bool) {
+	if !flexible {
+		return
+	}
+	if len(tags) == 0 {
+		w.uvarint(0)
+		return
+	}
+	w.b = append(w.b, tags...)
+}
@@ -0,0 +1,218 @@
+// Package kafka decodes and encodes the messages of the Kafka protocol used
+// by the Kafka Proxy and its Symptoms: the request and response headers of
+// every API, and the bodies of Produce, Metadata and FindCoordinator.
+package kafka
+
+import (
+	"encoding/binary"
+	"strconv"
+)
+
+// API keys of the requests decoded or encoded by this package
+const (
+	Produce         = 0
+	Fetch           = 1
+	Metadata        = 3
+	FindCoordinator = 10
+	SaslHandshake   = 17
+	APIVersions     = 18
+)
+
+// api describes a request type: its name and the first version using
+// the flexible encoding, or -1 if none does
+type api struct {
+	name     string
+	flexible int16
+}
+
+var apis = map[int16]api{
+	0:  {"Produce", 9},
+	1:  {"Fetch", 12},
+	2:  {"ListOffsets", 6},
+	3:  {"Metadata", 9},
+	4:  {"LeaderAndIsr", 4},
+	5:  {"StopReplica", 2},
+	6:  {"UpdateMetadata", 6},
+	7:  {"ControlledShutdown", 3},
+	8:  {"OffsetCommit", 8},
+	9:  {"OffsetFetch", 6},
+	10: {"FindCoordinator", 3},
+	11: {"JoinGroup", 6},
+	12: {"Heartbeat", 4},
+	13: {"LeaveGroup", 4},
+	14: {"SyncGroup", 4},
+	15: {"DescribeGroups", 5},
+	16: {"ListGroups", 3},
+	17: {"SaslHandshake", -1},
+	18: {"ApiVersions", 3},
+	19: {"CreateTopics", 5},
+	20: {"DeleteTopics", 4},
+	21: {"DeleteRecords", 2},
+	22: {"InitProducerId", 2},
+	23: {"OffsetForLeaderEpoch", 4},
+	24: {"AddPartitionsToTxn", 3},
+	25: {"AddOffsetsToTxn", 3},
+	26: {"EndTxn", 3},
+	27: {"WriteTxnMarkers", 1},
+	28: {"TxnOffsetCommit", 3},
+	29: {"DescribeAcls", 2},
+	30: {"CreateAcls", 2},
+	31: {"DeleteAcls", 2},
+	32: {"DescribeConfigs", 4},
+	33: {"AlterConfigs", 2},
+	34: {"AlterReplicaLogDirs", 2},
+	35: {"DescribeLogDirs", 2},
+	36: {"SaslAuthenticate", 2},
+	37: {"CreatePartitions", 2},
+	42: {"DeleteGroups", 2},
+	43: {"ElectLeaders", 2},
+	44: {"IncrementalAlterConfigs", 1},
+	47: {"OffsetDelete", -1},
+	60: {"DescribeCluster", 0},
+	61: {"DescribeProducers", 0},
+	68: {"ConsumerGroupHeartbeat", 0},
+}
+
+// APIName returns the name of a request type, e.g. "Produce"
+func APIName(key int16) string {
+	if a, ok := apis[key]; ok {
+		return a.name
+	}
+	return "Unknown"
+}
+
+// Flexible returns true if the version of a request type uses the
+// flexible encoding. Request types newer than those known are assumed
+// to be flexible, as all since KIP-482 are.
+func Flexible(key int16, version int16) bool {
+	if a, ok := apis[key]; ok {
+		return a.flexible >= 0 && version >= a.flexible
+	}
+	return key >= 48
+}
+
+// Error codes returned by brokers
+var errorCodes = map[string]int16{
+	"UNKNOWN_SERVER_ERROR":             -1,
+	"NONE":                             0,
+	"OFFSET_OUT_OF_RANGE":              1,
+	"CORRUPT_MESSAGE":                  2,
+	"UNKNOWN_TOPIC_OR_PARTITION":       3,
+	"LEADER_NOT_AVAILABLE":             5,
+	"NOT_LEADER_OR_FOLLOWER":           6,
+	"REQUEST_TIMED_OUT":                7,
+	"BROKER_NOT_AVAILABLE":             8,
+	"REPLICA_NOT_AVAILABLE":            9,
+	"MESSAGE_TOO_LARGE":                10,
+	"NETWORK_EXCEPTION":                13,
+	"COORDINATOR_LOAD_IN_PROGRESS":     14,
+	"COORDINATOR_NOT_AVAILABLE":        15,
+	"NOT_COORDINATOR":                  16,
+	"RECORD_LIST_TOO_LARGE":            18,
+	"NOT_ENOUGH_REPLICAS":              19,
+	"NOT_ENOUGH_REPLICAS_AFTER_APPEND": 20,
+	"INVALID_REQUIRED_ACKS":            21,
+	"TOPIC_AUTHORIZATION_FAILED":       29,
+	"CLUSTER_AUTHORIZATION_FAILED":     31,
+	"POLICY_VIOLATION":                 44,
+	"OUT_OF_ORDER_SEQUENCE_NUMBER":     45,
+	"DUPLICATE_SEQUENCE_NUMBER":        46,
+	"INVALID_PRODUCER_EPOCH":           47,
+	"KAFKA_STORAGE_ERROR":              56,
+	"THROTTLING_QUOTA_EXCEEDED":        89,
+}
+
+// ErrorCode returns the code of an error given by name, such as
+// NOT_LEADER_OR_FOLLOWER, or number
+func ErrorCode(name string) (int16, bool) {
+	if code, ok := errorCodes[name]; ok {
+		return code, true
+	}
+	code, err := strconv.ParseInt(name, 10, 16)
+	return int16(code), err == nil
+}
+
+// RequestHeader is the header of a request
+type RequestHeader struct {
+	APIKey        int16
+	APIVersion    int16
+	CorrelationID int32
+	ClientID      string
+}
+
+// Size returns the size of the message following the size prefix of b,
+// or -1 if b is too short to have one
+func Size(b []byte) int {
+	if len(b) < 4 {
+		return -1
+	}
+	return int(binary.BigEndian.Uint32(b))
+}
+
+// ParseRequest decodes the header of a request, including its size
+// prefix, returning it and the body of the request
+func ParseRequest(b []byte) (RequestHeader, []byte, bool) {
+	var h RequestHeader
+	if len(b) < 4 || Size(b) != len(b)-4 {
+		return h, nil, false
+	}
+
+	r := &reader{b: b[4:]}
+	h.APIKey = r.int16()
+	h.APIVersion = r.int16()
+	h.CorrelationID = r.int32()
+
+	// The client id is never compact, though followed by tagged fields
+	h.ClientID = r.string(false)
+	r.tags(Flexible(h.APIKey, h.APIVersion))
+	if r.err != nil {
+		return h, nil, false
+	}
+	return h, r.b, true
+}
+
+// responseFlexible returns true if the response header has tagged fields.
+// ApiVersions responses never do, so that clients can always decode them.
+func responseFlexible(key int16, version int16) bool {
+	return key != APIVersions && Flexible(key, version)
+}
+
+// ParseResponse decodes the header of the response to a request of the
+// given type and version, returning its correlation id and body
+func ParseResponse(b []byte, key int16, version int16) (int32, []byte, bool) {
+	if len(b) < 4 || Size(b) != len(b)-4 {
+		return 0, nil, false
+	}
+
+	r := &reader{b: b[4:]}
+	correlationID := r.int32()
+	r.tags(responseFlexible(key, version))
+	if r.err != nil {
+		return 0, nil, false
+	}
+	return correlationID, r.b, true
+}
+
+// NewResponse encodes a response to a request of the given type and
+// version, with its size prefix
+func NewResponse(correlationID int32, key int16, version int16, body []byte) []byte {
+	w := &writer{b: make([]byte, 4, 9+len(body))}
+	w.int32(correlationID)
+	w.tags(nil, responseFlexible(key, version))
+	w.b = append(w.b, body...)
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+	return w.b
+}
+
+// NewRequest encodes a request with its size prefix
+func NewRequest(h RequestHeader, body []byte) []byte {
+	w := &writer{b: make([]byte, 4, 16+len(h.ClientID)+len(body))}
+	w.int16(h.APIKey)
+	w.int16(h.APIVersion)
+	w.int32(h.CorrelationID)
+	w.string(h.ClientID, false)
+	w.tags(nil, Flexible(h.APIKey, h.APIVersion))
+	w.b = append(w.b, body...)
+	binary.BigEndian.PutUint32(w.b, uint32(len(w.b)-4))
+	return w.b
+}
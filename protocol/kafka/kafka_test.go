@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	for _, version := range []int16{7, 9} {
+		want := RequestHeader{APIKey: Produce, APIVersion: version, CorrelationID: 42, ClientID: "muxy"}
+		h, body, ok := ParseRequest(NewRequest(want, []byte("body")))
+		if !ok || h != want || string(body) != "body" {
+			t.Fatalf("Want %v with body, got %v %q %v", want, h, body, ok)
+		}
+	}
+
+	if _, _, ok := ParseRequest([]byte{0, 0, 0, 9, 0, 0}); ok {
+		t.Fatal("Want truncated request to be invalid")
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	cases := []struct {
+		key     int16
+		version int16
+		size    int
+	}{
+		{Metadata, 8, 4},
+		{Metadata, 9, 5},
+		// ApiVersions responses never have tagged fields in their header
+		{APIVersions, 3, 4},
+	}
+	for _, c := range cases {
+		b := NewResponse(7, c.key, c.version, []byte("body"))
+		if len(b) != 4+c.size+4 {
+			t.Fatalf("Want header of %d bytes for %s v%d, got %q", c.size, APIName(c.key), c.version, b)
+		}
+		correlationID, body, ok := ParseResponse(b, c.key, c.version)
+		if !ok || correlationID != 7 || string(body) != "body" {
+			t.Fatal("Want correlation id 7 with body, got", correlationID, body, ok)
+		}
+	}
+}
+
+func TestParseShort(t *testing.T) {
+	// Partial messages are flushed when the connection ends
+	for _, b := range [][]byte{nil, {0}, {0, 0, 0}, {0, 0, 0, 9}, {0, 0, 0, 9, 0, 0}} {
+		if _, _, ok := ParseRequest(b); ok {
+			t.Fatalf("Want request %v to be invalid", b)
+		}
+		if _, _, ok := ParseResponse(b, Metadata, 9); ok {
+			t.Fatalf("Want response %v to be invalid", b)
+		}
+	}
+}
+
+func TestFlexible(t *testing.T) {
+	if Flexible(Produce, 8) || !Flexible(Produce, 9) {
+		t.Fatal("Want Produce flexible from version 9")
+	}
+	if Flexible(SaslHandshake, 1) {
+		t.Fatal("Want SaslHandshake never flexible")
+	}
+	if !Flexible(1000, 0) {
+		t.Fatal("Want unknown request types flexible")
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	if code, ok := ErrorCode("NOT_ENOUGH_REPLICAS"); !ok || code != 19 {
+		t.Fatal("Want code 19, got", code, ok)
+	}
+	if code, ok := ErrorCode("7"); !ok || code != 7 {
+		t.Fatal("Want code 7, got", code, ok)
+	}
+	if _, ok := ErrorCode("NOT_AN_ERROR"); ok {
+		t.Fatal("Want unknown error to be invalid")
+	}
+}
+
+func TestProduceRequest(t *testing.T) {
+	id := "tx"
+	for _, version := range []int16{0, 3, 9} {
+		want := &ProduceRequest{
+			Acks:    -1,
+			Timeout: 1000,
+			Topics: []ProduceTopic{
+				{Name: "orders", Partitions: []int32{0, 2}},
+				{Name: "events", Partitions: []int32{1}},
+			},
+		}
+		if version >= 3 {
+			want.TransactionalID = &id
+		}
+
+		got, err := ParseProduceRequest(version, want.Encode(version))
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("Want %+v from v%d, got %+v %v", want, version, got, err)
+		}
+	}
+}
+
+func TestNewProduceResponse(t *testing.T) {
+	req := &ProduceRequest{Topics: []ProduceTopic{{Name: "orders", Partitions: []int32{3}}}}
+
+	for _, version := range []int16{0, 8, 9} {
+		flexible := Flexible(Produce, version)
+		r := &reader{b: NewProduceResponse(version, req, 6)}
+
+		if n := r.arrayLength(flexible); n != 1 {
+			t.Fatal("Want 1 topic, got", n)
+		}
+		if name := r.string(flexible); name != "orders" {
+			t.Fatal("Want topic orders, got", name)
+		}
+		if n := r.arrayLength(flexible); n != 1 {
+			t.Fatal("Want 1 partition, got", n)
+		}
+		if p, code := r.int32(), r.int16(); p != 3 || code != 6 {
+			t.Fatalf("Want partition 3 to fail with 6 in v%d, got %d %d", version, p, code)
+		}
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+	}
+}
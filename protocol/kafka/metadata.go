@@ -0,0 +1,281 @@
+package kafka
+
+// MetadataResponse is the body of a Metadata response. Tags hold the
+// tagged fields of flexible versions, which are encoded as they were read.
+type MetadataResponse struct {
+	Version                     int16
+	ThrottleTime                int32
+	Brokers                     []Broker
+	ClusterID                   *string
+	ControllerID                int32
+	Topics                      []TopicMetadata
+	ClusterAuthorizedOperations int32
+	ErrorCode                   int16
+	Tags                        []byte
+}
+
+// Broker is a broker in a Metadata response
+type Broker struct {
+	NodeID int32
+	Host   string
+	Port   int32
+	Rack   *string
+	Tags   []byte
+}
+
+// TopicMetadata is a topic in a Metadata response
+type TopicMetadata struct {
+	ErrorCode            int16
+	Name                 *string
+	TopicID              [16]byte
+	IsInternal           bool
+	Partitions           []PartitionMetadata
+	AuthorizedOperations int32
+	Tags                 []byte
+}
+
+// PartitionMetadata is a partition of a topic in a Metadata response
+type PartitionMetadata struct {
+	ErrorCode       int16
+	Index           int32
+	Leader          int32
+	LeaderEpoch     int32
+	Replicas        []int32
+	ISR             []int32
+	OfflineReplicas []int32
+	Tags            []byte
+}
+
+// ParseMetadataResponse decodes the body of a Metadata response
+func ParseMetadataResponse(version int16, body []byte) (*MetadataResponse, error) {
+	flexible := Flexible(Metadata, version)
+	r := &reader{b: body}
+	m := &MetadataResponse{Version: version, ControllerID: -1}
+
+	if version >= 3 {
+		m.ThrottleTime = r.int32()
+	}
+
+	n := r.arrayLength(flexible)
+	for i := 0; i < n && r.err == nil; i++ {
+		b := Broker{NodeID: r.int32(), Host: r.string(flexible), Port: r.int32()}
+		if version >= 1 {
+			b.Rack = r.nullableString(flexible)
+		}
+		b.Tags = r.tags(flexible)
+		m.Brokers = append(m.Brokers, b)
+	}
+
+	if version >= 2 {
+		m.ClusterID = r.nullableString(flexible)
+	}
+	if version >= 1 {
+		m.ControllerID = r.int32()
+	}
+
+	n = r.arrayLength(flexible)
+	for i := 0; i < n && r.err == nil; i++ {
+		t := TopicMetadata{ErrorCode: r.int16(), Name: r.nullableString(flexible)}
+		if version >= 10 {
+			t.TopicID = r.uuid()
+		}
+		if version >= 1 {
+			t.IsInternal = r.bool()
+		}
+
+		p := r.arrayLength(flexible)
+		for j := 0; j < p && r.err == nil; j++ {
+			pm := PartitionMetadata{ErrorCode: r.int16(), Index: r.int32(), Leader: r.int32()}
+			if version >= 7 {
+				pm.LeaderEpoch = r.int32()
+			}
+			pm.Replicas = r.int32s(flexible)
+			pm.ISR = r.int32s(flexible)
+			if version >= 5 {
+				pm.OfflineReplicas = r.int32s(flexible)
+			}
+			pm.Tags = r.tags(flexible)
+			t.Partitions = append(t.Partitions, pm)
+		}
+
+		if version >= 8 {
+			t.AuthorizedOperations = r.int32()
+		}
+		t.Tags = r.tags(flexible)
+		m.Topics = append(m.Topics, t)
+	}
+
+	if version >= 8 && version <= 10 {
+		m.ClusterAuthorizedOperations = r.int32()
+	}
+	if version >= 13 {
+		m.ErrorCode = r.int16()
+	}
+	m.Tags = r.tags(flexible)
+
+	return m, r.err
+}
+
+// Encode encodes the body of the Metadata response
+func (m *MetadataResponse) Encode() []byte {
+	version := m.Version
+	flexible := Flexible(Metadata, version)
+	w := &writer{}
+
+	if version >= 3 {
+		w.int32(m.ThrottleTime)
+	}
+
+	w.length(len(m.Brokers), flexible, true)
+	for _, b := range m.Brokers {
+		w.int32(b.NodeID)
+		w.string(b.Host, flexible)
+		w.int32(b.Port)
+		if version >= 1 {
+			w.nullableString(b.Rack, flexible)
+		}
+		w.tags(b.Tags, flexible)
+	}
+
+	if version >= 2 {
+		w.nullableString(m.ClusterID, flexible)
+	}
+	if version >= 1 {
+		w.int32(m.ControllerID)
+	}
+
+	w.length(len(m.Topics), flexible, true)
+	for _, t := range m.Topics {
+		w.int16(t.ErrorCode)
+		w.nullableString(t.Name, flexible)
+		if version >= 10 {
+			w.uuid(t.TopicID)
+		}
+		if version >= 1 {
+			w.bool(t.IsInternal)
+		}
+
+		w.length(len(t.Partitions), flexible, true)
+		for _, p := range t.Partitions {
+			w.int16(p.ErrorCode)
+			w.int32(p.Index)
+			w.int32(p.Leader)
+			if version >= 7 {
+				w.int32(p.LeaderEpoch)
+			}
+			w.int32s(p.Replicas, flexible)
+			w.int32s(p.ISR, flexible)
+			if version >= 5 {
+				w.int32s(p.OfflineReplicas, flexible)
+			}
+			w.tags(p.Tags, flexible)
+		}
+
+		if version >= 8 {
+			w.int32(t.AuthorizedOperations)
+		}
+		w.tags(t.Tags, flexible)
+	}
+
+	if version >= 8 && version <= 10 {
+		w.int32(m.ClusterAuthorizedOperations)
+	}
+	if version >= 13 {
+		w.int16(m.ErrorCode)
+	}
+	w.tags(m.Tags, flexible)
+	return w.b
+}
+
+// FindCoordinatorResponse is the body of a FindCoordinator response.
+// Versions before 4 have a single coordinator, without a key.
+type FindCoordinatorResponse struct {
+	Version      int16
+	ThrottleTime int32
+	Coordinators []Coordinator
+	Tags         []byte
+}
+
+// Coordinator is a coordinator in a FindCoordinator response
+type Coordinator struct {
+	Key          string
+	NodeID       int32
+	Host         string
+	Port         int32
+	ErrorCode    int16
+	ErrorMessage *string
+	Tags         []byte
+}
+
+// ParseFindCoordinatorResponse decodes the body of a FindCoordinator response
+func ParseFindCoordinatorResponse(version int16, body []byte) (*FindCoordinatorResponse, error) {
+	flexible := Flexible(FindCoordinator, version)
+	r := &reader{b: body}
+	f := &FindCoordinatorResponse{Version: version}
+
+	if version >= 1 {
+		f.ThrottleTime = r.int32()
+	}
+
+	if version < 4 {
+		var c Coordinator
+		c.ErrorCode = r.int16()
+		if version >= 1 {
+			c.ErrorMessage = r.nullableString(flexible)
+		}
+		c.NodeID = r.int32()
+		c.Host = r.string(flexible)
+		c.Port = r.int32()
+		f.Coordinators = []Coordinator{c}
+	} else {
+		n := r.arrayLength(flexible)
+		for i := 0; i < n && r.err == nil; i++ {
+			c := Coordinator{Key: r.string(flexible), NodeID: r.int32(), Host: r.string(flexible), Port: r.int32()}
+			c.ErrorCode = r.int16()
+			c.ErrorMessage = r.nullableString(flexible)
+			c.Tags = r.tags(flexible)
+			f.Coordinators = append(f.Coordinators, c)
+		}
+	}
+	f.Tags = r.tags(flexible)
+
+	return f, r.err
+}
+
+// Encode encodes the body of the FindCoordinator response
+func (f *FindCoordinatorResponse) Encode() []byte {
+	version := f.Version
+	flexible := Flexible(FindCoordinator, version)
+	w := &writer{}
+
+	if version >= 1 {
+		w.int32(f.ThrottleTime)
+	}
+
+	if version < 4 {
+		var c Coordinator
+		if len(f.Coordinators) > 0 {
+			c = f.Coordinators[0]
+		}
+		w.int16(c.ErrorCode)
+		if version >= 1 {
+			w.nullableString(c.ErrorMessage, flexible)
+		}
+		w.int32(c.NodeID)
+		w.string(c.Host, flexible)
+		w.int32(c.Port)
+	} else {
+		w.length(len(f.Coordinators), flexible, true)
+		for _, c := range f.Coordinators {
+			w.string(c.Key, flexible)
+			w.int32(c.NodeID)
+			w.string(c.Host, flexible)
+			w.int32(c.Port)
+			w.int16(c.ErrorCode)
+			w.nullableString(c.ErrorMessage, flexible)
+			w.tags(c.Tags, flexible)
+		}
+	}
+	w.tags(f.Tags, flexible)
+	return w.b
+}
@@ -0,0 +1,115 @@
+package kafka
+
+import (
+	"reflect"
+	"testing"
+)
+
+// metadata returns a Metadata response using the fields of version
+func metadata(version int16) *MetadataResponse {
+	rack := "eu-west-1a"
+	cluster := "cluster"
+	name := "orders"
+
+	m := &MetadataResponse{
+		Version:      version,
+		ControllerID: -1,
+		Brokers: []Broker{
+			{NodeID: 1, Host: "kafka-1", Port: 9092},
+			{NodeID: 2, Host: "kafka-2", Port: 9092},
+		},
+		Topics: []TopicMetadata{{
+			Name: &name,
+			Partitions: []PartitionMetadata{
+				{Index: 0, Leader: 1, Replicas: []int32{1, 2}, ISR: []int32{1, 2}},
+				{Index: 1, Leader: 2, Replicas: []int32{2, 1}, ISR: []int32{2}},
+			},
+		}},
+	}
+	if version >= 1 {
+		m.ControllerID = 1
+		m.Brokers[0].Rack = &rack
+		m.Topics[0].IsInternal = true
+	}
+	if version >= 2 {
+		m.ClusterID = &cluster
+	}
+	if version >= 3 {
+		m.ThrottleTime = 10
+	}
+	for i := range m.Topics[0].Partitions {
+		p := &m.Topics[0].Partitions[i]
+		if version >= 5 {
+			p.OfflineReplicas = []int32{}
+		}
+		if version >= 7 {
+			p.LeaderEpoch = 5
+		}
+	}
+	if version >= 8 {
+		m.Topics[0].AuthorizedOperations = -2147483648
+		if version <= 10 {
+			m.ClusterAuthorizedOperations = -2147483648
+		}
+	}
+	if version >= 9 {
+		m.Brokers[1].Tags = []byte{1, 0, 1, 'x'}
+	}
+	if version >= 10 {
+		m.Topics[0].TopicID = [16]byte{1, 2, 3}
+	}
+	if version >= 13 {
+		m.ErrorCode = 0
+	}
+	return m
+}
+
+func TestMetadataResponse(t *testing.T) {
+	for version := int16(0); version <= 13; version++ {
+		want := metadata(version)
+		got, err := ParseMetadataResponse(version, want.Encode())
+		if err != nil {
+			t.Fatalf("Want v%d to decode, got %v", version, err)
+		}
+
+		// Tagged fields are encoded as they were read
+		if version >= 9 {
+			want.Tags = []byte{0}
+			want.Brokers[0].Tags = []byte{0}
+			want.Topics[0].Tags = []byte{0}
+			for i := range want.Topics[0].Partitions {
+				want.Topics[0].Partitions[i].Tags = []byte{0}
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Want v%d %+v, got %+v", version, want, got)
+		}
+	}
+
+	if _, err := ParseMetadataResponse(1, metadata(1).Encode()[:20]); err == nil {
+		t.Fatal("Want truncated response to fail")
+	}
+}
+
+func TestFindCoordinatorResponse(t *testing.T) {
+	for _, version := range []int16{0, 2, 3, 4} {
+		want := &FindCoordinatorResponse{
+			Version:      version,
+			Coordinators: []Coordinator{{NodeID: 1, Host: "kafka-1", Port: 9092}},
+		}
+		if version >= 4 {
+			want.Coordinators[0].Key = "group"
+		}
+		if version >= 3 {
+			want.Tags = []byte{0}
+		}
+		if version >= 4 {
+			want.Coordinators[0].Tags = []byte{0}
+		}
+
+		got, err := ParseFindCoordinatorResponse(version, want.Encode())
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("Want v%d %+v, got %+v %v", version, want, got, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package kafka
+
+// ProduceRequest is the body of a Produce request, without its records
+type ProduceRequest struct {
+	TransactionalID *string
+	Acks            int16
+	Timeout         int32
+	Topics          []ProduceTopic
+}
+
+// ProduceTopic is a topic produced to, and its partitions. From version 13
+// topics are identified by TopicID rather than Name.
+type ProduceTopic struct {
+	Name       string
+	TopicID    [16]byte
+	Partitions []int32
+}
+
+// ParseProduceRequest decodes the body of a Produce request
+func ParseProduceRequest(version int16, body []byte) (*ProduceRequest, error) {
+	flexible := Flexible(Produce, version)
+	r := &reader{b: body}
+	p := &ProduceRequest{}
+
+	if version >= 3 {
+		p.TransactionalID = r.nullableString(flexible)
+	}
+	p.Acks = r.int16()
+	p.Timeout = r.int32()
+
+	n := r.arrayLength(flexible)
+	for i := 0; i < n && r.err == nil; i++ {
+		var t ProduceTopic
+		if version >= 13 {
+			t.TopicID = r.uuid()
+		} else {
+			t.Name = r.string(flexible)
+		}
+
+		m := r.arrayLength(flexible)
+		for j := 0; j < m && r.err == nil; j++ {
+			t.Partitions = append(t.Partitions, r.int32())
+			r.bytes(flexible)
+			r.tags(flexible)
+		}
+		r.tags(flexible)
+		p.Topics = append(p.Topics, t)
+	}
+	r.tags(flexible)
+
+	return p, r.err
+}
+
+// Encode encodes the body of the Produce request, with no records
+func (p *ProduceRequest) Encode(version int16) []byte {
+	flexible := Flexible(Produce, version)
+	w := &writer{}
+
+	if version >= 3 {
+		w.nullableString(p.TransactionalID, flexible)
+	}
+	w.int16(p.Acks)
+	w.int32(p.Timeout)
+
+	w.length(len(p.Topics), flexible, true)
+	for _, t := range p.Topics {
+		if version >= 13 {
+			w.uuid(t.TopicID)
+		} else {
+			w.string(t.Name, flexible)
+		}
+
+		w.length(len(t.Partitions), flexible, true)
+		for _, partition := range t.Partitions {
+			w.int32(partition)
+			w.length(-1, flexible, true) // records
+			w.tags(nil, flexible)
+		}
+		w.tags(nil, flexible)
+	}
+	w.tags(nil, flexible)
+	return w.b
+}
+
+// NewProduceResponse encodes the body of a Produce response failing every
+// partition of the request with the given error code
+func NewProduceResponse(version int16, req *ProduceRequest, code int16) []byte {
+	flexible := Flexible(Produce, version)
+	w := &writer{}
+
+	w.length(len(req.Topics), flexible, true)
+	for _, t := range req.Topics {
+		if version >= 13 {
+			w.uuid(t.TopicID)
+		} else {
+			w.string(t.Name, flexible)
+		}
+
+		w.length(len(t.Partitions), flexible, true)
+		for _, p := range t.Partitions {
+			w.int32(p)
+			w.int16(code)
+			w.int64(-1) // base offset
+			if version >= 2 {
+				w.int64(-1) // log append time
+			}
+			if version >= 5 {
+				w.int64(-1) // log start offset
+			}
+			if version >= 8 {
+				w.length(0, flexible, true) // record errors
+				w.nullableString(nil, flexible)
+			}
+			w.tags(nil, flexible)
+		}
+		w.tags(nil, flexible)
+	}
+
+	if version >= 1 {
+		w.int32(0) // throttle time
+	}
+	w.tags(nil, flexible)
+	return w.b
+}
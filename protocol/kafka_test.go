@@ -0,0 +1,161 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/kafka"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// kafkaMetadata is the Metadata returned by the fake Kafka broker
+func kafkaMetadata(host string, port int32) *kafka.MetadataResponse {
+	name := "orders"
+	return &kafka.MetadataResponse{
+		Version:      1,
+		ControllerID: 1,
+		Brokers:      []kafka.Broker{{NodeID: 1, Host: host, Port: port}},
+		Topics: []kafka.TopicMetadata{{
+			Name:       &name,
+			Partitions: []kafka.PartitionMetadata{{Index: 0, Leader: 1, Replicas: []int32{1}, ISR: []int32{1}}},
+		}},
+	}
+}
+
+// setupLocalKafka starts a fake Kafka broker, which answers Metadata
+// requests and accepts every Produce
+func setupLocalKafka(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(lengthSplit(4, binary.BigEndian, defaultMaxMessageSize))
+
+		for s.Scan() {
+			h, body, _ := kafka.ParseRequest(s.Bytes())
+			switch h.APIKey {
+			case kafka.Metadata:
+				c.Write(kafka.NewResponse(h.CorrelationID, h.APIKey, h.APIVersion,
+					kafkaMetadata("kafka-1", 9092).Encode()))
+			case kafka.Produce:
+				req, _ := kafka.ParseProduceRequest(h.APIVersion, body)
+				c.Write(kafka.NewResponse(h.CorrelationID, h.APIKey, h.APIVersion,
+					kafka.NewProduceResponse(h.APIVersion, req, 0)))
+			}
+		}
+	})
+}
+
+func TestKafkaProxy_Proxy(t *testing.T) {
+	kafkaPort := 7755
+	setupLocalKafka(kafkaPort)
+
+	failer := &symptom.KafkaSymptom{
+		Error: "NOT_LEADER_OR_FOLLOWER",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Key: "^orders$"},
+		},
+	}
+	failer.Setup()
+
+	port := 7756
+	p := KafkaProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: kafkaPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{failer})
+
+	waitForPort(kafkaPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	read := func(key int16, version int16) (int32, []byte) {
+		size := make([]byte, 4)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 4+binary.BigEndian.Uint32(size))
+		copy(b, size)
+		if _, err := io.ReadFull(conn, b[4:]); err != nil {
+			t.Fatal(err)
+		}
+		correlationID, body, ok := kafka.ParseResponse(b, key, version)
+		if !ok {
+			t.Fatalf("Want response, got %q", b)
+		}
+		return correlationID, body
+	}
+
+	// Brokers are advertised as the proxy
+	conn.Write(kafka.NewRequest(kafka.RequestHeader{APIKey: kafka.Metadata, APIVersion: 1, CorrelationID: 1}, []byte{0, 0, 0, 0}))
+	correlationID, body := read(kafka.Metadata, 1)
+	m, err := kafka.ParseMetadataResponse(1, body)
+	if err != nil || correlationID != 1 {
+		t.Fatal("Want Metadata response 1, got", correlationID, err)
+	}
+	if b := m.Brokers[0]; b.Host != "localhost" || b.Port != int32(port) {
+		t.Fatalf("Want broker advertised as localhost:%d, got %s:%d", port, b.Host, b.Port)
+	}
+
+	// Produce requests to orders fail, in order with those that do not
+	produce := func(id int32, topic string) ([]byte, *kafka.ProduceRequest) {
+		req := &kafka.ProduceRequest{Acks: 1, Topics: []kafka.ProduceTopic{{Name: topic, Partitions: []int32{0}}}}
+		h := kafka.RequestHeader{APIKey: kafka.Produce, APIVersion: 7, CorrelationID: id}
+		return kafka.NewRequest(h, req.Encode(7)), req
+	}
+	events, eventsReq := produce(2, "events")
+	orders, ordersReq := produce(3, "orders")
+	conn.Write(append(events, orders...))
+
+	for _, want := range []struct {
+		id   int32
+		req  *kafka.ProduceRequest
+		code int16
+	}{{2, eventsReq, 0}, {3, ordersReq, 6}} {
+		correlationID, body := read(kafka.Produce, 7)
+		if correlationID != want.id || string(body) != string(kafka.NewProduceResponse(7, want.req, want.code)) {
+			t.Fatalf("Want response %d with error %d, got %d %q", want.id, want.code, correlationID, body)
+		}
+	}
+}
+
+func TestKafkaAdvertiser_Brokers(t *testing.T) {
+	m := &kafkaAdvertiser{
+		target:  "kafka-1:9092",
+		host:    "localhost",
+		port:    19092,
+		brokers: map[string]string{"kafka-2:9092": "localhost:19093"},
+	}
+
+	cases := []struct {
+		host     string
+		port     int32
+		wantHost string
+		wantPort int32
+	}{
+		{"kafka-1", 9092, "localhost", 19092},
+		{"kafka-2", 9092, "localhost", 19093},
+		{"kafka-3", 9092, "kafka-3", 9092},
+	}
+	for _, c := range cases {
+		if host, port := m.advertise(c.host, c.port); host != c.wantHost || port != c.wantPort {
+			t.Fatalf("Want %s:%d advertised as %s:%d, got %s:%d", c.host, c.port, c.wantHost, c.wantPort, host, port)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/layout"
+)
+
+// layoutDecoder decodes the fields of each message, as described by the
+// Layout of a TCP Proxy, before it is given to middlewares
+type layoutDecoder struct {
+	layout *layout.Layout
+}
+
+// layoutKey identifies the layout state of a connection in its Values
+type layoutKey struct{}
+
+// layoutState counts the bytes left of messages larger than the largest
+// passed on whole, for requests and responses, so that the pieces that
+// follow the first are not decoded as messages of their own
+type layoutState struct {
+	remaining [2]int
+}
+
+// Setup sets up the middleware
+func (m *layoutDecoder) Setup() {}
+
+// Teardown shuts down the middleware
+func (m *layoutDecoder) Teardown() {}
+
+// HandleEvent decodes the message in ctx. Its Command and Key are those
+// of the fields named by the layout, and its Value the layout itself, so
+// that symptoms may rewrite its fields. The pieces that follow the first of
+// a message too large to be passed on whole are not decoded.
+func (m *layoutDecoder) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+	if len(ctx.Bytes) == 0 {
+		return
+	}
+	if m.continues(e, ctx) {
+		return
+	}
+
+	fields := m.layout.Decode(ctx.Bytes)
+	ctx.Message = &muxy.Message{
+		Protocol: "binary",
+		Fields:   fields,
+		Value:    m.layout,
+	}
+	if m.layout.Command != "" {
+		ctx.Message.Command = fields[m.layout.Command]
+	}
+	if m.layout.Key != "" {
+		ctx.Message.Key = fields[m.layout.Key]
+	}
+}
+
+// continues returns true if the message in ctx continues a larger message,
+// rather than starting one
+func (m *layoutDecoder) continues(e muxy.ProxyEvent, ctx *muxy.Context) bool {
+	if ctx.Connection == nil || ctx.Connection.Values == nil {
+		return false
+	}
+	v, _ := ctx.Connection.Values.LoadOrStore(layoutKey{}, &layoutState{})
+	remaining := &v.(*layoutState).remaining[0]
+	if e == muxy.EventPostDispatch {
+		remaining = &v.(*layoutState).remaining[1]
+	}
+
+	if *remaining > 0 {
+		*remaining -= len(ctx.Bytes)
+		return true
+	}
+	if size, ok := m.layout.Size(ctx.Bytes); ok && size > len(ctx.Bytes) {
+		*remaining = size - len(ctx.Bytes)
+	}
+	return false
+}
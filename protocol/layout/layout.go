@@ -0,0 +1,292 @@
+// Package layout decodes and encodes the fields of binary messages, as
+// described by a declarative layout, for use by the TCP Proxy and its
+// Symptoms.
+package layout
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Types of field
+const (
+	TypeUint   = "uint"
+	TypeInt    = "int"
+	TypeString = "string"
+	TypeBytes  = "bytes"
+)
+
+// Field is a field of a message, at a fixed offset from its start
+type Field struct {
+	Name   string
+	Offset int
+	Size   int
+
+	// Type is one of uint (default), int, string or bytes. Integers are
+	// 1, 2, 4 or 8 bytes, while strings are padded with NULs.
+	Type string
+
+	// Endian is the byte order of an integer: big (default) or little
+	Endian string
+}
+
+// Layout describes the fields of the messages of a binary protocol
+type Layout struct {
+	// Fields of each message
+	Fields []Field
+
+	// Length names the field holding the size of each message, by which
+	// the stream is split into messages
+	Length string
+
+	// LengthAdjust is added to the value of Length to give the size of
+	// the whole message, e.g. the size of the header when it is excluded
+	LengthAdjust int `mapstructure:"length_adjust"`
+
+	// Command and Key name the fields given as the command and key of
+	// each message, for command and key matching rules
+	Command string
+	Key     string
+}
+
+// Validate checks the layout, returning the first problem found
+func (l *Layout) Validate() error {
+	names := map[string]bool{}
+	for _, f := range l.Fields {
+		if f.Name == "" {
+			return fmt.Errorf("layout field at offset %d has no name", f.Offset)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("layout field '%s' is defined twice", f.Name)
+		}
+		names[f.Name] = true
+
+		if f.Offset < 0 {
+			return fmt.Errorf("layout field '%s' has a negative offset", f.Name)
+		}
+		switch f.kind() {
+		case TypeUint, TypeInt:
+			if f.Size != 1 && f.Size != 2 && f.Size != 4 && f.Size != 8 {
+				return fmt.Errorf("layout field '%s' has invalid size %d, must be 1, 2, 4 or 8", f.Name, f.Size)
+			}
+		case TypeString, TypeBytes:
+			if f.Size <= 0 {
+				return fmt.Errorf("layout field '%s' has invalid size %d", f.Name, f.Size)
+			}
+		default:
+			return fmt.Errorf("layout field '%s' has unknown type '%s'", f.Name, f.Type)
+		}
+		if f.Endian != "" && f.Endian != "big" && f.Endian != "little" {
+			return fmt.Errorf("layout field '%s' has invalid endianness '%s'", f.Name, f.Endian)
+		}
+	}
+
+	if l.Length != "" {
+		f, ok := l.Field(l.Length)
+		if !ok {
+			return fmt.Errorf("layout length field '%s' is not defined", l.Length)
+		}
+		if f.kind() != TypeUint {
+			return fmt.Errorf("layout length field '%s' must be a uint", l.Length)
+		}
+	}
+	for _, name := range []string{l.Command, l.Key} {
+		if _, ok := l.Field(name); name != "" && !ok {
+			return fmt.Errorf("layout field '%s' is not defined", name)
+		}
+	}
+	return nil
+}
+
+// Field returns the field with the given name
+func (l *Layout) Field(name string) (Field, bool) {
+	for _, f := range l.Fields {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Field{}, false
+}
+
+// kind returns the type of the field, defaulting to uint
+func (f Field) kind() string {
+	if f.Type == "" {
+		return TypeUint
+	}
+	return f.Type
+}
+
+// order returns the byte order of the field
+func (f Field) order() binary.ByteOrder {
+	if f.Endian == "little" {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// end returns the offset following the field
+func (f Field) end() int {
+	return f.Offset + f.Size
+}
+
+// Split splits a stream into messages by their Length field. Messages
+// larger than max are passed on in pieces of at most max bytes.
+func (l *Layout) Split(max int) bufio.SplitFunc {
+	// remaining counts the bytes left of a message larger than max
+	remaining := 0
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if remaining > 0 {
+			n := remaining
+			if n > max {
+				n = max
+			}
+			if len(data) < n {
+				return flush(data, atEOF)
+			}
+			remaining -= n
+			return n, data[:n], nil
+		}
+
+		total, ok := l.Size(data)
+		if !ok {
+			return flush(data, atEOF)
+		}
+		if total > max {
+			if len(data) < max {
+				return flush(data, atEOF)
+			}
+			remaining = total - max
+			return max, data[:max], nil
+		}
+
+		if len(data) < total {
+			return flush(data, atEOF)
+		}
+		return total, data[:total], nil
+	}
+}
+
+// Size returns the size of the message at the start of b by its Length
+// field. It returns false if there is no Length, or b is too short to
+// hold it.
+func (l *Layout) Size(b []byte) (int, bool) {
+	length, ok := l.Field(l.Length)
+	if !ok || len(b) < length.end() {
+		return 0, false
+	}
+
+	// Lengths too short to hold the length itself are taken to end
+	// the message there, so that the stream makes progress
+	total := int(uintValue(b, length)) + l.LengthAdjust
+	if total < length.end() {
+		total = length.end()
+	}
+	return total, true
+}
+
+// flush requests more data, or passes on a partial message at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Decode returns the value of each field held by the message b. Integers
+// are given in decimal, strings without their padding and bytes in hex.
+func (l *Layout) Decode(b []byte) map[string]string {
+	fields := map[string]string{}
+	for _, f := range l.Fields {
+		if f.end() > len(b) {
+			continue
+		}
+		switch f.kind() {
+		case TypeUint:
+			fields[f.Name] = strconv.FormatUint(uintValue(b, f), 10)
+		case TypeInt:
+			// Sign extend from the size of the field
+			shift := uint(64 - 8*f.Size)
+			fields[f.Name] = strconv.FormatInt(int64(uintValue(b, f)<<shift)>>shift, 10)
+		case TypeString:
+			fields[f.Name] = strings.TrimRight(string(b[f.Offset:f.end()]), "\x00")
+		case TypeBytes:
+			fields[f.Name] = hex.EncodeToString(b[f.Offset:f.end()])
+		}
+	}
+	return fields
+}
+
+// uintValue returns the unsigned integer held by the field f of b
+func uintValue(b []byte, f Field) uint64 {
+	b = b[f.Offset:f.end()]
+	switch f.Size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(f.order().Uint16(b))
+	case 4:
+		return uint64(f.order().Uint32(b))
+	}
+	return f.order().Uint64(b)
+}
+
+// Set returns a copy of the message b with the named field set to value,
+// given as it is decoded. Strings and bytes are truncated or padded with
+// NULs to the size of the field.
+func (l *Layout) Set(b []byte, name string, value string) ([]byte, error) {
+	f, ok := l.Field(name)
+	if !ok {
+		return nil, fmt.Errorf("layout field '%s' is not defined", name)
+	}
+	if f.end() > len(b) {
+		return nil, fmt.Errorf("layout field '%s' is beyond the end of the message", name)
+	}
+
+	encoded := make([]byte, 8)
+	switch f.kind() {
+	case TypeUint, TypeInt:
+		var v uint64
+		var err error
+		if f.kind() == TypeUint {
+			v, err = strconv.ParseUint(value, 0, 8*f.Size)
+		} else {
+			var i int64
+			i, err = strconv.ParseInt(value, 0, 8*f.Size)
+			v = uint64(i)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("layout field '%s' cannot be set to '%s'", name, value)
+		}
+		switch f.Size {
+		case 1:
+			encoded[0] = byte(v)
+		case 2:
+			f.order().PutUint16(encoded, uint16(v))
+		case 4:
+			f.order().PutUint32(encoded, uint32(v))
+		case 8:
+			f.order().PutUint64(encoded, v)
+		}
+	case TypeString:
+		encoded = []byte(value)
+	case TypeBytes:
+		var err error
+		encoded, err = hex.DecodeString(strings.Replace(value, " ", "", -1))
+		if err != nil {
+			return nil, fmt.Errorf("layout field '%s' cannot be set to '%s'", name, value)
+		}
+	}
+
+	r := append([]byte(nil), b...)
+	field := r[f.Offset:f.end()]
+	for i := range field {
+		field[i] = 0
+	}
+	copy(field, encoded)
+	return r, nil
+}
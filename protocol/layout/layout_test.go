@@ -0,0 +1,141 @@
+package layout
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+// header is a message header of a magic, length of the body, status,
+// signed offset, NUL padded name and id
+var header = &Layout{
+	Fields: []Field{
+		{Name: "magic", Offset: 0, Size: 2, Type: "bytes"},
+		{Name: "length", Offset: 2, Size: 2, Endian: "little"},
+		{Name: "status", Offset: 4, Size: 1},
+		{Name: "delta", Offset: 5, Size: 2, Type: "int"},
+		{Name: "name", Offset: 7, Size: 4, Type: "string"},
+		{Name: "id", Offset: 11, Size: 4},
+	},
+	Length:       "length",
+	LengthAdjust: 15,
+	Command:      "name",
+	Key:          "id",
+}
+
+func message(body string) []byte {
+	b := []byte{0xca, 0xfe, byte(len(body)), 0, 1, 0xff, 0xfe, 'p', 'i', 'n', 'g', 0, 0, 0, 7}
+	return append(b, body...)
+}
+
+func TestValidate(t *testing.T) {
+	if err := header.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []*Layout{
+		{Fields: []Field{{Offset: 0, Size: 1}}},
+		{Fields: []Field{{Name: "a", Size: 1}, {Name: "a", Size: 1}}},
+		{Fields: []Field{{Name: "a", Size: 3}}},
+		{Fields: []Field{{Name: "a", Size: 0, Type: "string"}}},
+		{Fields: []Field{{Name: "a", Size: 1, Type: "float"}}},
+		{Fields: []Field{{Name: "a", Size: 2, Endian: "middle"}}},
+		{Fields: []Field{{Name: "a", Size: 2, Type: "int"}}, Length: "a"},
+		{Fields: []Field{{Name: "a", Size: 2}}, Length: "b"},
+		{Fields: []Field{{Name: "a", Size: 2}}, Command: "b"},
+	}
+	for _, l := range invalid {
+		if err := l.Validate(); err == nil {
+			t.Fatalf("Want %+v to be invalid", l)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	want := [][]byte{message("hello"), message(""), message("world!")}
+	got := prototest.Scan(header.Split(1024), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	// Larger messages are passed on in pieces
+	in := append(message("hello world"), message("!")...)
+	got = prototest.Scan(header.Split(16), in)
+	if !bytes.Equal(bytes.Join(got, nil), in) || len(got[0]) != 16 || !bytes.Equal(got[len(got)-1], message("!")) {
+		t.Fatalf("Want message split after 16 bytes, got %q", got)
+	}
+}
+
+func TestSize(t *testing.T) {
+	if size, ok := header.Size(message("hello")[:4]); !ok || size != 20 {
+		t.Fatalf("Want size 20 from the header, got %d", size)
+	}
+	if _, ok := header.Size(message("hello")[:3]); ok {
+		t.Fatal("Want no size for a message too short to hold its length")
+	}
+	if _, ok := (&Layout{Fields: header.Fields}).Size(message("hello")); ok {
+		t.Fatal("Want no size for a layout without a length")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	want := map[string]string{
+		"magic":  "cafe",
+		"length": "5",
+		"status": "1",
+		"delta":  "-2",
+		"name":   "ping",
+		"id":     "7",
+	}
+	if got := header.Decode(message("hello")); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %v, got %v", want, got)
+	}
+
+	// Fields beyond the end of a message are omitted
+	if got := header.Decode(message("")[:9]); len(got) != 4 {
+		t.Fatalf("Want 4 fields, got %v", got)
+	}
+}
+
+func TestSet(t *testing.T) {
+	b := message("hello")
+	cases := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"status", "3", "3"},
+		{"status", "0xff", "255"},
+		{"delta", "-300", "-300"},
+		{"name", "pong!", "pong"},
+		{"name", "ok", "ok"},
+		{"magic", "be ef", "beef"},
+		{"length", "1000", "1000"},
+	}
+	for _, c := range cases {
+		got, err := header.Set(b, c.name, c.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := header.Decode(got)[c.name]; v != c.want {
+			t.Fatalf("Want %s set to %s, got %s", c.name, c.want, v)
+		}
+		if len(got) != len(b) || !bytes.Equal(got[15:], []byte("hello")) {
+			t.Fatalf("Want only %s changed, got %q", c.name, got)
+		}
+	}
+	if !bytes.Equal(b, message("hello")) {
+		t.Fatal("Want message to be copied, got", b)
+	}
+
+	for _, c := range [][2]string{{"status", "256"}, {"delta", "x"}, {"magic", "zz"}, {"missing", "1"}} {
+		if _, err := header.Set(b, c[0], c[1]); err == nil {
+			t.Fatalf("Want error setting %s to %s", c[0], c[1])
+		}
+	}
+	if _, err := header.Set(b[:4], "status", "1"); err == nil {
+		t.Fatal("Want error setting a field beyond the end of the message")
+	}
+}
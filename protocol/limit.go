@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/mefellows/muxy/log"
+)
+
+// Behaviours when a proxy's max_connections is exceeded
+const (
+	// OverflowQueue stops accepting connections until one closes, so that new
+	// clients queue in the listen backlog and eventually time out connecting
+	OverflowQueue = "queue"
+
+	// OverflowRefuse accepts, then immediately resets new connections
+	OverflowRefuse = "refuse"
+
+	// OverflowHang accepts new connections, but never serves them
+	OverflowHang = "hang"
+
+	// OverflowClose accepts, then immediately closes new connections
+	OverflowClose = "close"
+)
+
+// connLimiter limits the number of concurrent connections on a proxy
+type connLimiter struct {
+	overflow string
+	slots    chan struct{}
+}
+
+// newConnLimiter creates a limiter allowing max concurrent connections,
+// or returns nil if max is not positive
+func newConnLimiter(max int, overflow string) (*connLimiter, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+
+	switch overflow {
+	case "":
+		overflow = OverflowQueue
+	case OverflowQueue, OverflowRefuse, OverflowHang, OverflowClose:
+	default:
+		return nil, fmt.Errorf("unknown connection overflow behaviour '%s'", overflow)
+	}
+
+	return &connLimiter{
+		overflow: overflow,
+		slots:    make(chan struct{}, max),
+	}, nil
+}
+
+// queueing returns true if new connections should wait for a free slot
+// before they are accepted
+func (l *connLimiter) queueing() bool {
+	return l.overflow == OverflowQueue
+}
+
+// wait blocks until a connection slot is free, and takes it
+func (l *connLimiter) wait() {
+	l.slots <- struct{}{}
+}
+
+// admit takes a connection slot for an accepted connection, returning false
+// and applying the overflow behaviour to it if none are free
+func (l *connLimiter) admit(conn net.Conn) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	log.Info("Connection limit of %d reached, applying '%s' to %s", cap(l.slots), l.overflow, conn.RemoteAddr().String())
+	switch l.overflow {
+	case OverflowRefuse:
+		if tcp, ok := conn.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		conn.Close()
+	case OverflowHang:
+		go func() {
+			io.Copy(ioutil.Discard, conn)
+			conn.Close()
+		}()
+	default:
+		conn.Close()
+	}
+	return false
+}
+
+// release frees a connection slot
+func (l *connLimiter) release() {
+	<-l.slots
+}
+
+// limitListener is a net.Listener that limits the number of concurrent
+// connections it accepts
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+// Accept waits for and returns the next connection within the limit
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		if l.limiter.queueing() {
+			l.limiter.wait()
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if l.limiter.queueing() {
+				l.limiter.release()
+			}
+			return nil, err
+		}
+
+		if l.limiter.queueing() || l.limiter.admit(conn) {
+			return &limitedConn{Conn: conn, release: l.limiter.release}, nil
+		}
+	}
+}
+
+// limitedConn releases its connection slot when closed
+type limitedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -0,0 +1,142 @@
+package protocol
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter_New(t *testing.T) {
+	l, err := newConnLimiter(0, "")
+	if l != nil || err != nil {
+		t.Fatal("Want no limiter when unlimited, got", l, err)
+	}
+
+	l, err = newConnLimiter(1, "")
+	if err != nil || l.overflow != OverflowQueue {
+		t.Fatal("Want queue by default, got", l, err)
+	}
+
+	if _, err = newConnLimiter(1, "explode"); err == nil {
+		t.Fatal("Want error for unknown overflow behaviour, got nil")
+	}
+}
+
+func listenLimited(t *testing.T, max int, overflow string) net.Listener {
+	limiter, err := newConnLimiter(max, overflow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &limitListener{Listener: l, limiter: limiter}
+}
+
+func TestLimitListener_Overflow(t *testing.T) {
+	for _, overflow := range []string{OverflowRefuse, OverflowClose} {
+		l := listenLimited(t, 1, overflow)
+		defer l.Close()
+
+		accepted := make(chan net.Conn, 2)
+		go func() {
+			for {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- c
+			}
+		}()
+
+		first, _ := net.Dial("tcp", l.Addr().String())
+		defer first.Close()
+		c := <-accepted
+
+		// Connections over the limit are terminated
+		second, _ := net.Dial("tcp", l.Addr().String())
+		second.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if _, err := second.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Want connection over the limit to be terminated, got nil")
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			t.Fatal("Want connection over the limit to be terminated, got timeout")
+		}
+		second.Close()
+
+		// ...until a slot is released
+		c.Close()
+		third, _ := net.Dial("tcp", l.Addr().String())
+		defer third.Close()
+		select {
+		case <-accepted:
+		case <-time.After(1 * time.Second):
+			t.Fatal("Want connection to be accepted once a slot is free")
+		}
+	}
+}
+
+func TestLimitListener_Queue(t *testing.T) {
+	l := listenLimited(t, 1, OverflowQueue)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, _ := net.Dial("tcp", l.Addr().String())
+	defer first.Close()
+	c := <-accepted
+
+	second, _ := net.Dial("tcp", l.Addr().String())
+	defer second.Close()
+	select {
+	case <-accepted:
+		t.Fatal("Want connection over the limit to wait in the backlog")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	c.Close()
+	select {
+	case <-accepted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Want queued connection to be accepted once a slot is free")
+	}
+}
+
+func TestLimitListener_Hang(t *testing.T) {
+	l := listenLimited(t, 1, OverflowHang)
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, _ := net.Dial("tcp", l.Addr().String())
+	defer first.Close()
+	<-accepted
+
+	// Accepted, but never served
+	second, _ := net.Dial("tcp", l.Addr().String())
+	defer second.Close()
+	second.Write([]byte("hello?"))
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := second.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Fatal("Want connection over the limit to hang, got", err)
+	}
+}
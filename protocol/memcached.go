@@ -0,0 +1,146 @@
+package protocol
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/memcached"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// MemcachedProxy implements a memcached aware TCP proxy, for the text,
+// meta and binary protocols. Commands are decoded, so that middlewares can
+// target them by command and key.
+type MemcachedProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest command or reply that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultMemcachedMaxSize is the default largest command or reply. Replies
+// to multigets hold many values, each of up to the 1MB item size limit.
+const defaultMemcachedMaxSize = 64 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MemcachedProxy{}, nil
+	}, "memcached_proxy")
+}
+
+// Setup the memcached proxy
+func (p *MemcachedProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultMemcachedMaxSize
+	}
+
+	p.setup("Memcached Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		if request {
+			return memcached.SplitRequest()
+		}
+		return memcached.SplitResponse()
+	}, func() codec {
+		return &memcachedCodec{quiet: map[uint32]*muxy.Message{}}
+	}, middleware)
+}
+
+// memcachedCodec decodes commands, into a *memcached.Request, and their
+// replies. Quiet commands are only answered on failure, or on a hit, ahead
+// of the reply to the next command that is not quiet.
+type memcachedCodec struct {
+	// quiet holds the binary quiet commands awaiting the reply to a later
+	// command, by opaque
+	quiet map[uint32]*muxy.Message
+}
+
+// decode decodes a command or reply
+func (c *memcachedCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if request {
+		r, ok := memcached.ParseRequest(b)
+		if !ok {
+			log.Debug("Memcached Proxy unable to decode command")
+			return nil, true
+		}
+
+		msg := &muxy.Message{
+			Protocol: "memcached",
+			Command:  r.Command,
+			Fields: map[string]string{
+				"protocol": "text",
+				"keys":     strings.Join(r.Keys, " "),
+				"quiet":    strconv.FormatBool(r.Quiet),
+				"noreply":  strconv.FormatBool(r.NoReply),
+			},
+			Value: r,
+		}
+		if len(r.Keys) > 0 {
+			msg.Key = r.Keys[0]
+		}
+		if r.Binary {
+			msg.Fields["protocol"] = "binary"
+			msg.Fields["opaque"] = strconv.FormatUint(uint64(r.Opaque), 10)
+			if r.Quiet {
+				c.quiet[r.Opaque] = msg
+			}
+		}
+		return msg, !r.Quiet && !r.NoReply && r.Command != "quit"
+	}
+
+	if p, ok := memcached.ParseBinary(b); ok {
+		opaque := strconv.FormatUint(uint64(p.Opaque), 10)
+
+		// Replies to quiet commands have an opaque of their own
+		if req == nil || req.Fields["opaque"] != opaque {
+			msg := memcachedReply(c.quiet[p.Opaque])
+			delete(c.quiet, p.Opaque)
+			if msg.Command == "" {
+				msg.Command = memcached.OpcodeName(p.Opcode)
+				msg.Key = string(p.Key)
+				msg.Fields["protocol"] = "binary"
+				msg.Fields["opaque"] = opaque
+			}
+			msg.Fields["status"] = memcached.StatusName(p.Status)
+			return msg, false
+		}
+
+		// Quiet commands before this one have been answered, if at all
+		for opaque := range c.quiet {
+			delete(c.quiet, opaque)
+		}
+
+		msg := memcachedReply(req)
+		msg.Fields["status"] = memcached.StatusName(p.Status)
+
+		// Statistics are sent one per reply, up to one without a key
+		return msg, p.Opcode != memcached.OpStat || len(p.Key) == 0
+	}
+
+	msg := memcachedReply(req)
+	reply := memcached.Reply(b)
+	msg.Fields["reply"] = reply
+
+	// Replies to quiet meta commands precede the MN of a no-op
+	if req != nil && req.Command == "mn" && reply != "MN" {
+		return msg, false
+	}
+	return msg, true
+}
+
+// memcachedReply creates the message of a reply to req
+func memcachedReply(req *muxy.Message) *muxy.Message {
+	msg := &muxy.Message{Protocol: "memcached", Fields: map[string]string{}}
+	if req != nil {
+		msg.Command = req.Command
+		msg.Key = req.Key
+		msg.Pipelined = req.Pipelined
+		msg.Value = req.Value
+		for k, v := range req.Fields {
+			msg.Fields[k] = v
+		}
+	}
+	return msg
+}
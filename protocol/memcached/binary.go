@@ -0,0 +1,234 @@
+package memcached
+
+import (
+	"encoding/binary"
+)
+
+// Magic bytes of binary requests and responses
+const (
+	MagicRequest  = 0x80
+	MagicResponse = 0x81
+)
+
+// headerSize is the size of a binary header
+const headerSize = 24
+
+// Binary opcodes
+const (
+	OpGet        = 0x00
+	OpSet        = 0x01
+	OpAdd        = 0x02
+	OpReplace    = 0x03
+	OpDelete     = 0x04
+	OpIncrement  = 0x05
+	OpDecrement  = 0x06
+	OpQuit       = 0x07
+	OpFlush      = 0x08
+	OpGetQ       = 0x09
+	OpNoop       = 0x0a
+	OpVersion    = 0x0b
+	OpGetK       = 0x0c
+	OpGetKQ      = 0x0d
+	OpAppend     = 0x0e
+	OpPrepend    = 0x0f
+	OpStat       = 0x10
+	OpSetQ       = 0x11
+	OpAddQ       = 0x12
+	OpReplaceQ   = 0x13
+	OpDeleteQ    = 0x14
+	OpIncrementQ = 0x15
+	OpDecrementQ = 0x16
+	OpQuitQ      = 0x17
+	OpFlushQ     = 0x18
+	OpAppendQ    = 0x19
+	OpPrependQ   = 0x1a
+	OpTouch      = 0x1c
+	OpGAT        = 0x1d
+	OpGATQ       = 0x1e
+	OpGATK       = 0x23
+	OpGATKQ      = 0x24
+)
+
+var opcodeNames = map[byte]string{
+	OpGet:        "get",
+	OpSet:        "set",
+	OpAdd:        "add",
+	OpReplace:    "replace",
+	OpDelete:     "delete",
+	OpIncrement:  "increment",
+	OpDecrement:  "decrement",
+	OpQuit:       "quit",
+	OpFlush:      "flush",
+	OpGetQ:       "getq",
+	OpNoop:       "noop",
+	OpVersion:    "version",
+	OpGetK:       "getk",
+	OpGetKQ:      "getkq",
+	OpAppend:     "append",
+	OpPrepend:    "prepend",
+	OpStat:       "stat",
+	OpSetQ:       "setq",
+	OpAddQ:       "addq",
+	OpReplaceQ:   "replaceq",
+	OpDeleteQ:    "deleteq",
+	OpIncrementQ: "incrementq",
+	OpDecrementQ: "decrementq",
+	OpQuitQ:      "quitq",
+	OpFlushQ:     "flushq",
+	OpAppendQ:    "appendq",
+	OpPrependQ:   "prependq",
+	OpTouch:      "touch",
+	OpGAT:        "gat",
+	OpGATQ:       "gatq",
+	OpGATK:       "gatk",
+	OpGATKQ:      "gatkq",
+}
+
+// quietOpcodes only reply on failure, or to gets on a hit
+var quietOpcodes = map[byte]bool{
+	OpGetQ:       true,
+	OpGetKQ:      true,
+	OpSetQ:       true,
+	OpAddQ:       true,
+	OpReplaceQ:   true,
+	OpDeleteQ:    true,
+	OpIncrementQ: true,
+	OpDecrementQ: true,
+	OpQuitQ:      true,
+	OpFlushQ:     true,
+	OpAppendQ:    true,
+	OpPrependQ:   true,
+	OpGATQ:       true,
+	OpGATKQ:      true,
+}
+
+// retrievalOpcodes look up values
+var retrievalOpcodes = map[byte]bool{
+	OpGet:   true,
+	OpGetQ:  true,
+	OpGetK:  true,
+	OpGetKQ: true,
+	OpGAT:   true,
+	OpGATQ:  true,
+	OpGATK:  true,
+	OpGATKQ: true,
+}
+
+// Binary response statuses
+const (
+	StatusOK             = 0x0000
+	StatusKeyNotFound    = 0x0001
+	StatusKeyExists      = 0x0002
+	StatusTooLarge       = 0x0003
+	StatusInvalid        = 0x0004
+	StatusNotStored      = 0x0005
+	StatusUnknownCommand = 0x0081
+	StatusOutOfMemory    = 0x0082
+	StatusInternalError  = 0x0084
+	StatusBusy           = 0x0085
+	StatusTemporary      = 0x0086
+)
+
+var statusNames = map[uint16]string{
+	StatusOK:             "NO_ERROR",
+	StatusKeyNotFound:    "KEY_NOT_FOUND",
+	StatusKeyExists:      "KEY_EXISTS",
+	StatusTooLarge:       "VALUE_TOO_LARGE",
+	StatusInvalid:        "INVALID_ARGUMENTS",
+	StatusNotStored:      "ITEM_NOT_STORED",
+	StatusUnknownCommand: "UNKNOWN_COMMAND",
+	StatusOutOfMemory:    "OUT_OF_MEMORY",
+	StatusInternalError:  "INTERNAL_ERROR",
+	StatusBusy:           "BUSY",
+	StatusTemporary:      "TEMPORARY_FAILURE",
+}
+
+// OpcodeName returns the name of a binary opcode, e.g. "getkq"
+func OpcodeName(op byte) string {
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// StatusName returns the name of a binary status, e.g. "KEY_NOT_FOUND"
+func StatusName(status uint16) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// splitBinary splits a binary request or response
+func splitBinary(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < headerSize {
+		return flush(data, atEOF)
+	}
+	size := headerSize + int(binary.BigEndian.Uint32(data[8:]))
+	if len(data) < size {
+		return flush(data, atEOF)
+	}
+	return size, data[:size], nil
+}
+
+// Packet is a decoded binary request or response
+type Packet struct {
+	Magic  byte
+	Opcode byte
+
+	// Status of a response, or the vbucket of a request
+	Status uint16
+	Opaque uint32
+	CAS    uint64
+	Extras []byte
+	Key    []byte
+	Value  []byte
+}
+
+// ParseBinary decodes a binary request or response
+func ParseBinary(b []byte) (*Packet, bool) {
+	if len(b) < headerSize || (b[0] != MagicRequest && b[0] != MagicResponse) {
+		return nil, false
+	}
+	keylen := int(binary.BigEndian.Uint16(b[2:]))
+	extlen := int(b[4])
+	bodylen := int(binary.BigEndian.Uint32(b[8:]))
+	if headerSize+bodylen != len(b) || keylen+extlen > bodylen {
+		return nil, false
+	}
+
+	body := b[headerSize:]
+	return &Packet{
+		Magic:  b[0],
+		Opcode: b[1],
+		Status: binary.BigEndian.Uint16(b[6:]),
+		Opaque: binary.BigEndian.Uint32(b[12:]),
+		CAS:    binary.BigEndian.Uint64(b[16:]),
+		Extras: body[:extlen],
+		Key:    body[extlen : extlen+keylen],
+		Value:  body[extlen+keylen:],
+	}, true
+}
+
+// Encode encodes a binary packet
+func (p *Packet) Encode() []byte {
+	b := make([]byte, headerSize, headerSize+len(p.Extras)+len(p.Key)+len(p.Value))
+	b[0] = p.Magic
+	b[1] = p.Opcode
+	binary.BigEndian.PutUint16(b[2:], uint16(len(p.Key)))
+	b[4] = byte(len(p.Extras))
+	binary.BigEndian.PutUint16(b[6:], p.Status)
+	binary.BigEndian.PutUint32(b[8:], uint32(len(p.Extras)+len(p.Key)+len(p.Value)))
+	binary.BigEndian.PutUint32(b[12:], p.Opaque)
+	binary.BigEndian.PutUint64(b[16:], p.CAS)
+	b = append(b, p.Extras...)
+	b = append(b, p.Key...)
+	return append(b, p.Value...)
+}
+
+// NewBinaryError encodes a response to a binary request with an error
+// status and message
+func NewBinaryError(opcode byte, opaque uint32, status uint16, msg string) []byte {
+	p := &Packet{Magic: MagicResponse, Opcode: opcode, Status: status, Opaque: opaque, Value: []byte(msg)}
+	return p.Encode()
+}
@@ -0,0 +1,89 @@
+package memcached
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func binaryGet(opcode byte, key string, opaque uint32) []byte {
+	p := &Packet{Magic: MagicRequest, Opcode: opcode, Opaque: opaque, Key: []byte(key)}
+	return p.Encode()
+}
+
+func TestSplitRequest(t *testing.T) {
+	want := [][]byte{
+		[]byte("set user:1 0 60 5\r\nalice\r\n"),
+		[]byte("get user:1 user:2\r\n"),
+		[]byte("ms user:3 3 T60\r\nbob\r\n"),
+		binaryGet(OpGetKQ, "user:1", 1),
+		binaryGet(OpNoop, "", 2),
+	}
+	got := prototest.Scan(SplitRequest(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestSplitResponse(t *testing.T) {
+	want := [][]byte{
+		[]byte("STORED\r\n"),
+		[]byte("VALUE user:1 0 5\r\nalice\r\nVALUE user:2 0 7\r\nEND\r\n\r\nEND\r\n"),
+		[]byte("STAT pid 1\r\nSTAT uptime 10\r\nEND\r\n"),
+		[]byte("VA 3 t60\r\nbob\r\n"),
+		(&Packet{Magic: MagicResponse, Opcode: OpGetK, Key: []byte("user:1"), Value: []byte("alice")}).Encode(),
+	}
+	got := prototest.Scan(SplitResponse(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	cases := map[string]*Request{
+		"get user:1 user:2\r\n":         {Command: "get", Keys: []string{"user:1", "user:2"}},
+		"gat 60 user:1\r\n":             {Command: "gat", Keys: []string{"user:1"}},
+		"set user:1 0 0 1 noreply\r\n1": {Command: "set", Keys: []string{"user:1"}, NoReply: true},
+		"mg user:1 v q\r\n":             {Command: "mg", Keys: []string{"user:1"}, Quiet: true},
+		"version\r\n":                   {Command: "version"},
+	}
+	for b, want := range cases {
+		r, ok := ParseRequest([]byte(b))
+		if !ok || !reflect.DeepEqual(r, want) {
+			t.Fatalf("Want %q to be %+v, got %+v", b, want, r)
+		}
+	}
+
+	r, ok := ParseRequest(binaryGet(OpGetKQ, "user:1", 7))
+	want := &Request{Command: "getkq", Keys: []string{"user:1"}, Binary: true, Opcode: OpGetKQ, Opaque: 7, Quiet: true}
+	if !ok || !reflect.DeepEqual(r, want) || !r.Retrieval() {
+		t.Fatalf("Want %+v, got %+v", want, r)
+	}
+}
+
+func TestRemoveValues(t *testing.T) {
+	b := []byte("VALUE user:1 0 5\r\nalice\r\nVALUE session:1 0 3\r\nabc\r\nEND\r\n")
+	if keys := ValueKeys(b); !reflect.DeepEqual(keys, []string{"user:1", "session:1"}) {
+		t.Fatal("Want keys user:1 and session:1, got", keys)
+	}
+
+	got := RemoveValues(b, func(key string) bool { return key == "session:1" })
+	if string(got) != "VALUE user:1 0 5\r\nalice\r\nEND\r\n" {
+		t.Fatalf("Want session:1 removed, got %q", got)
+	}
+	if reply := Reply(got); reply != "VALUE" {
+		t.Fatal("Want VALUE reply, got", reply)
+	}
+}
+
+func TestBinaryError(t *testing.T) {
+	p, ok := ParseBinary(NewBinaryError(OpSet, 9, StatusOutOfMemory, "Out of memory"))
+	if !ok || p.Magic != MagicResponse || p.Opcode != OpSet || p.Opaque != 9 || StatusName(p.Status) != "OUT_OF_MEMORY" {
+		t.Fatalf("Want out of memory response, got %+v", p)
+	}
+	if string(p.Value) != "Out of memory" {
+		t.Fatalf("Want message, got %q", p.Value)
+	}
+}
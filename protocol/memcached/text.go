@@ -0,0 +1,279 @@
+// Package memcached decodes and encodes the commands and replies of the
+// memcached text, meta and binary protocols, for use by the Memcached
+// Proxy and its Symptoms.
+package memcached
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// crlf terminates each line of the text protocol
+var crlf = []byte("\r\n")
+
+// storage are the text commands followed by a data block, with the index
+// of the argument holding its size
+var storage = map[string]int{
+	"set":     4,
+	"add":     4,
+	"replace": 4,
+	"append":  4,
+	"prepend": 4,
+	"cas":     4,
+	"ms":      2,
+}
+
+// retrieval are the text commands that return values, with the index
+// of their first key
+var retrieval = map[string]int{
+	"get":  1,
+	"gets": 1,
+	"gat":  2,
+	"gats": 2,
+	"mg":   1,
+}
+
+// Request is a decoded command
+type Request struct {
+	// Command is the name of a text command, e.g. "get", or binary
+	// opcode, e.g. "getkq"
+	Command string
+	Keys    []string
+
+	// Binary is true for the binary protocol, which identifies each
+	// request by its Opaque
+	Binary bool
+	Opcode byte
+	Opaque uint32
+
+	// Quiet is true if the server only replies on failure, or to binary
+	// and meta gets on a hit
+	Quiet bool
+
+	// NoReply is true if the server never replies to the text command
+	NoReply bool
+}
+
+// Retrieval returns true if the request looks up values
+func (r *Request) Retrieval() bool {
+	if r.Binary {
+		return retrievalOpcodes[r.Opcode]
+	}
+	_, ok := retrieval[r.Command]
+	return ok
+}
+
+// SplitRequest splits a stream of text or binary commands, along with
+// their data blocks
+func SplitRequest() bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		if data[0] == MagicRequest {
+			return splitBinary(data, atEOF)
+		}
+
+		end := bytes.Index(data, crlf)
+		if end < 0 {
+			return flush(data, atEOF)
+		}
+		size := end + 2
+		fields := strings.Fields(string(data[:end]))
+		if len(fields) > 0 {
+			if i, ok := storage[fields[0]]; ok && len(fields) > i {
+				if n, err := strconv.Atoi(fields[i]); err == nil && n >= 0 {
+					size += n + 2
+				}
+			}
+		}
+		if len(data) < size {
+			return flush(data, atEOF)
+		}
+		return size, data[:size], nil
+	}
+}
+
+// SplitResponse splits a stream of text or binary replies. Each text
+// reply is split whole, including every value of a multiget up to its END.
+func SplitResponse() bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		if data[0] == MagicResponse {
+			return splitBinary(data, atEOF)
+		}
+
+		size, ok := replySize(data)
+		if !ok {
+			return flush(data, atEOF)
+		}
+		return size, data[:size], nil
+	}
+}
+
+// replySize returns the size of the text reply at the start of data, or
+// false if data does not hold all of it
+func replySize(data []byte) (int, bool) {
+	pos := 0
+	for {
+		end := bytes.Index(data[pos:], crlf)
+		if end < 0 {
+			return 0, false
+		}
+		line := string(data[pos : pos+end])
+		next := pos + end + 2
+
+		fields := strings.Fields(line)
+		word := ""
+		if len(fields) > 0 {
+			word = fields[0]
+		}
+		switch word {
+		case "VALUE", "CONFIG":
+			// Values are followed by more, until the END
+			if len(fields) < 4 {
+				return next, true
+			}
+			n, err := strconv.Atoi(fields[3])
+			if err != nil || n < 0 {
+				return next, true
+			}
+			pos = next + n + 2
+			if len(data) < pos {
+				return 0, false
+			}
+		case "STAT", "ITEM":
+			pos = next
+		case "VA":
+			if len(fields) < 2 {
+				return next, true
+			}
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n < 0 {
+				return next, true
+			}
+			if len(data) < next+n+2 {
+				return 0, false
+			}
+			return next + n + 2, true
+		default:
+			return next, true
+		}
+	}
+}
+
+// flush requests more data, or passes on a partial message at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// ParseRequest decodes a text or binary command
+func ParseRequest(b []byte) (*Request, bool) {
+	if len(b) > 0 && b[0] == MagicRequest {
+		p, ok := ParseBinary(b)
+		if !ok {
+			return nil, false
+		}
+		r := &Request{
+			Command: OpcodeName(p.Opcode),
+			Binary:  true,
+			Opcode:  p.Opcode,
+			Opaque:  p.Opaque,
+			Quiet:   quietOpcodes[p.Opcode],
+		}
+		if len(p.Key) > 0 {
+			r.Keys = []string{string(p.Key)}
+		}
+		return r, true
+	}
+
+	end := bytes.Index(b, crlf)
+	if end < 0 {
+		return nil, false
+	}
+	fields := strings.Fields(string(b[:end]))
+	if len(fields) == 0 {
+		return nil, false
+	}
+
+	r := &Request{Command: strings.ToLower(fields[0])}
+	switch r.Command {
+	case "get", "gets", "gat", "gats":
+		r.Keys = fields[retrieval[r.Command]:]
+	case "set", "add", "replace", "append", "prepend", "cas", "delete", "incr", "decr", "touch":
+		if len(fields) > 1 {
+			r.Keys = fields[1:2]
+		}
+		r.NoReply = fields[len(fields)-1] == "noreply"
+	case "mg", "ms", "md", "ma":
+		if len(fields) > 1 {
+			r.Keys = fields[1:2]
+		}
+		for _, flag := range fields[2:] {
+			if flag == "q" {
+				r.Quiet = true
+			}
+		}
+	}
+	return r, true
+}
+
+// Reply returns the first word of a text reply, e.g. "STORED" or "VALUE"
+func Reply(b []byte) string {
+	end := bytes.IndexAny(b, " \r")
+	if end < 0 {
+		return string(b)
+	}
+	return string(b[:end])
+}
+
+// ValueKeys returns the keys of the values in a text reply to a get
+func ValueKeys(b []byte) []string {
+	var keys []string
+	forEachValue(b, func(key string, block []byte) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// RemoveValues returns a copy of a text reply to a get, without the
+// values for which miss returns true
+func RemoveValues(b []byte, miss func(key string) bool) []byte {
+	out := make([]byte, 0, len(b))
+	rest := forEachValue(b, func(key string, block []byte) {
+		if !miss(key) {
+			out = append(out, block...)
+		}
+	})
+	return append(out, rest...)
+}
+
+// forEachValue calls f with the key and encoded block of each VALUE of a
+// text reply, returning the remainder of the reply
+func forEachValue(b []byte, f func(key string, block []byte)) []byte {
+	for bytes.HasPrefix(b, []byte("VALUE ")) {
+		end := bytes.Index(b, crlf)
+		if end < 0 {
+			break
+		}
+		fields := strings.Fields(string(b[:end]))
+		if len(fields) < 4 {
+			break
+		}
+		n, err := strconv.Atoi(fields[3])
+		size := end + 2 + n + 2
+		if err != nil || n < 0 || len(b) < size {
+			break
+		}
+		f(fields[1], b[:size])
+		b = b[size:]
+	}
+	return b
+}
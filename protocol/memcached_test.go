@@ -0,0 +1,167 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/memcached"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// setupLocalMemcached starts a fake memcached server, which speaks enough
+// of the text and binary protocols to store and get values
+func setupLocalMemcached(port int) {
+	values := map[string]string{"user:1": "alice", "session:1": "abc"}
+
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(memcached.SplitRequest())
+
+		for s.Scan() {
+			if p, ok := memcached.ParseBinary(s.Bytes()); ok {
+				reply := &memcached.Packet{Magic: memcached.MagicResponse, Opcode: p.Opcode, Opaque: p.Opaque}
+				if p.Opcode == memcached.OpGetKQ {
+					value, ok := values[string(p.Key)]
+					if !ok {
+						continue
+					}
+					reply.Key, reply.Value = p.Key, []byte(value)
+				}
+				c.Write(reply.Encode())
+				continue
+			}
+
+			fields := strings.Fields(strings.SplitN(s.Text(), "\r\n", 2)[0])
+			switch fields[0] {
+			case "set":
+				io.WriteString(c, "STORED\r\n")
+			case "get":
+				for _, key := range fields[1:] {
+					if value, ok := values[key]; ok {
+						fmt.Fprintf(c, "VALUE %s 0 %d\r\n%s\r\n", key, len(value), value)
+					}
+				}
+				io.WriteString(c, "END\r\n")
+			}
+		}
+	})
+}
+
+func TestMemcachedProxy_Proxy(t *testing.T) {
+	serverPort := 7747
+	setupLocalMemcached(serverPort)
+
+	misser := &symptom.MemcachedSymptom{
+		Miss: true,
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Key: "^session:"},
+		},
+	}
+	misser.Setup()
+	failer := &symptom.MemcachedSymptom{
+		Error: "OUT_OF_MEMORY",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Command: "^set$", Key: "^big:"},
+		},
+	}
+	failer.Setup()
+
+	port := 7748
+	p := MemcachedProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: serverPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{misser, failer})
+
+	waitForPort(serverPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s := bufio.NewScanner(conn)
+	s.Split(memcached.SplitResponse())
+
+	read := func() string {
+		if !s.Scan() {
+			t.Fatal("Want reply, got", s.Err())
+		}
+		return s.Text()
+	}
+
+	// Replies to failed sets are kept in order with those forwarded
+	io.WriteString(conn, "set user:2 0 0 3\r\nbob\r\nset big:1 0 0 3\r\nbig\r\nset user:3 0 0 3\r\neve\r\n")
+	for _, want := range []string{"STORED\r\n", "SERVER_ERROR out of memory storing object\r\n", "STORED\r\n"} {
+		if got := read(); got != want {
+			t.Fatalf("Want %q, got %q", want, got)
+		}
+	}
+
+	io.WriteString(conn, "get user:1 session:1\r\n")
+	if got, want := read(), "VALUE user:1 0 5\r\nalice\r\nEND\r\n"; got != want {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	// Quiet binary gets of sessions are not answered
+	getkq := func(key string, opaque uint32) []byte {
+		p := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpGetKQ, Opaque: opaque, Key: []byte(key)}
+		return p.Encode()
+	}
+	noop := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpNoop, Opaque: 3}
+	conn.Write(append(append(getkq("session:1", 1), getkq("user:1", 2)...), noop.Encode()...))
+
+	for _, want := range []struct {
+		opaque uint32
+		key    string
+	}{{2, "user:1"}, {3, ""}} {
+		p, ok := memcached.ParseBinary([]byte(read()))
+		if !ok || p.Opaque != want.opaque || string(p.Key) != want.key {
+			t.Fatalf("Want reply %d for %q, got %+v", want.opaque, want.key, p)
+		}
+	}
+}
+
+func TestMemcachedCodec_Quiet(t *testing.T) {
+	c := &memcachedCodec{quiet: map[uint32]*muxy.Message{}}
+
+	getq := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpGetQ, Opaque: 1, Key: []byte("user:1")}
+	msg, expecting := c.decode(getq.Encode(), true, nil)
+	if expecting || msg.Command != "getq" || msg.Key != "user:1" || msg.Fields["protocol"] != "binary" {
+		t.Fatalf("Want quiet getq of user:1, got %+v", msg)
+	}
+	noop := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpNoop, Opaque: 2}
+	req, _ := c.decode(noop.Encode(), true, nil)
+
+	// Hits of GetQ have no key, so are matched with the command by opaque
+	hit := &memcached.Packet{Magic: memcached.MagicResponse, Opcode: memcached.OpGetQ, Opaque: 1, Value: []byte("alice")}
+	msg, answered := c.decode(hit.Encode(), false, req)
+	if answered || msg.Command != "getq" || msg.Key != "user:1" || msg.Fields["status"] != "NO_ERROR" {
+		t.Fatalf("Want hit of user:1, got %+v", msg)
+	}
+
+	noop.Magic = memcached.MagicResponse
+	msg, answered = c.decode(noop.Encode(), false, req)
+	if !answered || msg.Command != "noop" {
+		t.Fatalf("Want noop answered, got %+v", msg)
+	}
+
+	msg, expecting = c.decode([]byte("set user:1 0 0 1 noreply\r\n1\r\n"), true, nil)
+	if expecting || msg.Fields["noreply"] != "true" {
+		t.Fatalf("Want set without reply, got %+v", msg)
+	}
+}
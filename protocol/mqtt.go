@@ -0,0 +1,179 @@
+package protocol
+
+import (
+	"bufio"
+	"strconv"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mqtt"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// MQTTProxy implements an MQTT aware TCP proxy. Control packets are
+// decoded, so that middlewares can target them by type and topic.
+type MQTTProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest packet that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultMQTTMaxSize is the default largest packet, matching the largest
+// remaining length MQTT allows and its fixed header
+const defaultMQTTMaxSize = 268435455 + 5
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MQTTProxy{}, nil
+	}, "mqtt_proxy")
+}
+
+// Setup the MQTT proxy
+func (p *MQTTProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultMQTTMaxSize
+	}
+
+	p.setup("MQTT Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		return mqtt.Split()
+	}, func() codec {
+		return &mqttCodec{
+			version:  mqtt.Version311,
+			outbound: map[uint16]string{},
+			inbound:  map[uint16]string{},
+			aliases:  [2]map[uint16]string{{}, {}},
+		}
+	}, middleware)
+}
+
+// mqttCodec decodes control packets, tracking the topic of each QoS 1 and
+// 2 message in flight so that their acknowledgements can be matched by
+// topic. Only CONNECT is answered by a reply of its own; other packets
+// flow independently in either direction.
+type mqttCodec struct {
+	version   byte
+	clientID  string
+	keepAlive uint16
+
+	// outbound are the topics of messages published by the client, and
+	// inbound those published to it, by packet identifier
+	outbound map[uint16]string
+	inbound  map[uint16]string
+
+	// aliases are the topics of MQTT 5 topic aliases, set by the client
+	// and the server respectively
+	aliases [2]map[uint16]string
+}
+
+// decode decodes a control packet from the client or the server
+func (c *mqttCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	p, ok := mqtt.Parse(b)
+	if !ok {
+		log.Debug("MQTT Proxy unable to decode packet")
+		return nil, false
+	}
+
+	msg := &muxy.Message{
+		Protocol: "mqtt",
+		Command:  mqtt.PacketName(p.Type),
+		Fields:   map[string]string{},
+	}
+
+	// Messages published by the client are acknowledged by the server
+	published, acked := c.outbound, c.inbound
+	if !request {
+		published, acked = c.inbound, c.outbound
+	}
+
+	switch p.Type {
+	case mqtt.Connect:
+		connect, ok := mqtt.ParseConnect(p.Body)
+		if !ok {
+			log.Debug("MQTT Proxy unable to decode CONNECT")
+			return msg, true
+		}
+		c.version = connect.Version
+		c.clientID = connect.ClientID
+		c.keepAlive = connect.KeepAlive
+		msg.Key = connect.ClientID
+		msg.Fields["username"] = connect.Username
+		c.fields(msg)
+		return msg, true
+	case mqtt.ConnAck:
+		msg.Fields["reason_code"] = strconv.Itoa(int(p.ReasonCode()))
+		c.fields(msg)
+		return msg, true
+	case mqtt.Publish:
+		pub, ok := mqtt.ParsePublish(p)
+		if !ok {
+			log.Debug("MQTT Proxy unable to decode PUBLISH")
+			break
+		}
+		msg.Key = c.topic(pub, p, request)
+		msg.Fields["qos"] = strconv.Itoa(int(pub.QoS))
+		msg.Fields["retain"] = strconv.FormatBool(pub.Retain)
+		msg.Fields["dup"] = strconv.FormatBool(pub.Dup)
+		if pub.QoS > 0 {
+			msg.Fields["packet_id"] = strconv.Itoa(int(pub.PacketID))
+			published[pub.PacketID] = msg.Key
+		}
+	case mqtt.PubAck, mqtt.PubRec, mqtt.PubComp:
+		id, _ := p.PacketID()
+		msg.Key = acked[id]
+		msg.Fields["packet_id"] = strconv.Itoa(int(id))
+		msg.Fields["reason_code"] = strconv.Itoa(int(p.ReasonCode()))
+
+		// A failed PUBREC ends the exchange
+		if p.Type != mqtt.PubRec || p.ReasonCode() >= 0x80 {
+			delete(acked, id)
+		}
+	case mqtt.PubRel:
+		id, _ := p.PacketID()
+		msg.Key = published[id]
+		msg.Fields["packet_id"] = strconv.Itoa(int(id))
+	case mqtt.Subscribe, mqtt.Unsubscribe:
+		id, _ := p.PacketID()
+		msg.Fields["packet_id"] = strconv.Itoa(int(id))
+		if filters, ok := mqtt.ParseSubscribe(p, c.version); ok {
+			msg.Key = filters[0]
+		}
+	case mqtt.SubAck, mqtt.UnsubAck:
+		id, _ := p.PacketID()
+		msg.Fields["packet_id"] = strconv.Itoa(int(id))
+	case mqtt.Disconnect:
+		msg.Fields["reason_code"] = strconv.Itoa(int(p.ReasonCode()))
+	}
+
+	c.fields(msg)
+	return msg, false
+}
+
+// fields adds the details of the session to msg
+func (c *mqttCodec) fields(msg *muxy.Message) {
+	msg.Fields["version"] = strconv.Itoa(int(c.version))
+	msg.Fields["client_id"] = c.clientID
+	msg.Fields["keep_alive"] = strconv.Itoa(int(c.keepAlive))
+}
+
+// topic returns the topic of a PUBLISH, resolving MQTT 5 topic aliases
+func (c *mqttCodec) topic(pub *mqtt.PublishPacket, p *mqtt.Packet, request bool) string {
+	if c.version < mqtt.Version5 {
+		return pub.Topic
+	}
+	alias, ok := mqtt.TopicAlias(p)
+	if !ok {
+		return pub.Topic
+	}
+
+	aliases := c.aliases[1]
+	if request {
+		aliases = c.aliases[0]
+	}
+	if pub.Topic != "" {
+		aliases[alias] = pub.Topic
+		return pub.Topic
+	}
+	return aliases[alias]
+}
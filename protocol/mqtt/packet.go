@@ -0,0 +1,540 @@
+// Package mqtt decodes and encodes the control packets of MQTT 3.1, 3.1.1
+// and 5, for use by the MQTT Proxy and its Symptoms.
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// Types of control packet
+const (
+	Connect     = 1
+	ConnAck     = 2
+	Publish     = 3
+	PubAck      = 4
+	PubRec      = 5
+	PubRel      = 6
+	PubComp     = 7
+	Subscribe   = 8
+	SubAck      = 9
+	Unsubscribe = 10
+	UnsubAck    = 11
+	PingReq     = 12
+	PingResp    = 13
+	Disconnect  = 14
+	Auth        = 15
+)
+
+var packetNames = map[byte]string{
+	Connect:     "CONNECT",
+	ConnAck:     "CONNACK",
+	Publish:     "PUBLISH",
+	PubAck:      "PUBACK",
+	PubRec:      "PUBREC",
+	PubRel:      "PUBREL",
+	PubComp:     "PUBCOMP",
+	Subscribe:   "SUBSCRIBE",
+	SubAck:      "SUBACK",
+	Unsubscribe: "UNSUBSCRIBE",
+	UnsubAck:    "UNSUBACK",
+	PingReq:     "PINGREQ",
+	PingResp:    "PINGRESP",
+	Disconnect:  "DISCONNECT",
+	Auth:        "AUTH",
+}
+
+// Protocol levels
+const (
+	Version31  = 3
+	Version311 = 4
+	Version5   = 5
+)
+
+// Reason codes of MQTT 5 used by the proxy
+const (
+	ReasonKeepAliveTimeout = 0x8d
+)
+
+// reasonCodes are the MQTT 5 reason codes of a CONNACK, by name, along
+// with the nearest MQTT 3.1.1 return code
+var reasonCodes = map[string]struct {
+	code   byte
+	legacy byte
+}{
+	"UNSPECIFIED_ERROR":             {0x80, 3},
+	"MALFORMED_PACKET":              {0x81, 3},
+	"PROTOCOL_ERROR":                {0x82, 3},
+	"IMPLEMENTATION_SPECIFIC_ERROR": {0x83, 3},
+	"UNSUPPORTED_PROTOCOL_VERSION":  {0x84, 1},
+	"CLIENT_IDENTIFIER_NOT_VALID":   {0x85, 2},
+	"BAD_USER_NAME_OR_PASSWORD":     {0x86, 4},
+	"NOT_AUTHORIZED":                {0x87, 5},
+	"SERVER_UNAVAILABLE":            {0x88, 3},
+	"SERVER_BUSY":                   {0x89, 3},
+	"BANNED":                        {0x8a, 5},
+	"BAD_AUTHENTICATION_METHOD":     {0x8c, 4},
+	"TOPIC_NAME_INVALID":            {0x90, 3},
+	"PACKET_TOO_LARGE":              {0x95, 3},
+	"QUOTA_EXCEEDED":                {0x97, 3},
+	"PAYLOAD_FORMAT_INVALID":        {0x99, 3},
+	"RETAIN_NOT_SUPPORTED":          {0x9a, 3},
+	"QOS_NOT_SUPPORTED":             {0x9b, 3},
+	"USE_ANOTHER_SERVER":            {0x9c, 3},
+	"SERVER_MOVED":                  {0x9d, 3},
+	"CONNECTION_RATE_EXCEEDED":      {0x9f, 3},
+}
+
+// legacyCodes are the MQTT 3.1.1 CONNACK return codes, as MQTT 5 reason codes
+var legacyCodes = map[byte]byte{
+	1: 0x84,
+	2: 0x85,
+	3: 0x88,
+	4: 0x86,
+	5: 0x87,
+}
+
+// PacketName returns the name of a packet type, e.g. "PUBLISH"
+func PacketName(t byte) string {
+	if name, ok := packetNames[t]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// ParseReasonCode returns the MQTT 5 CONNACK reason code with the given
+// name, e.g. NOT_AUTHORIZED, or number. MQTT 3.1.1 return codes (1 to 5)
+// are given as their MQTT 5 equivalent.
+func ParseReasonCode(s string) (byte, bool) {
+	if r, ok := reasonCodes[strings.ToUpper(s)]; ok {
+		return r.code, true
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil {
+		return 0, false
+	}
+	if code, ok := legacyCodes[byte(n)]; ok {
+		return code, true
+	}
+	for _, r := range reasonCodes {
+		if r.code == byte(n) {
+			return r.code, true
+		}
+	}
+	return 0, false
+}
+
+// ConnAckCode returns the CONNACK code for a reason code in the given
+// protocol version. Clients before MQTT 5 are given the nearest return code.
+func ConnAckCode(version byte, reason byte) byte {
+	if version >= Version5 {
+		return reason
+	}
+	for _, r := range reasonCodes {
+		if r.code == reason {
+			return r.legacy
+		}
+	}
+	return 3
+}
+
+// Split splits a stream into control packets. Streams that are not MQTT,
+// such as TLS, are passed on as they are read.
+func Split() bufio.SplitFunc {
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		if raw || !validHeader(data[0]) {
+			raw = true
+			return len(data), data, nil
+		}
+
+		length, n, ok := readVarInt(data[1:])
+		if !ok {
+			if n < 0 {
+				raw = true
+				return len(data), data, nil
+			}
+			return flush(data, atEOF)
+		}
+		size := 1 + n + length
+		if len(data) < size {
+			return flush(data, atEOF)
+		}
+		return size, data[:size], nil
+	}
+}
+
+// validHeader returns true if the first byte of a fixed header has a
+// packet type and the flags required of it
+func validHeader(h byte) bool {
+	switch h >> 4 {
+	case 0:
+		return false
+	case Publish:
+		return h>>1&3 != 3
+	case PubRel, Subscribe, Unsubscribe:
+		return h&0xf == 2
+	}
+	return h&0xf == 0
+}
+
+// flush requests more data, or passes on a partial packet at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// readVarInt reads a variable byte integer, returning it and its size.
+// The size is negative if the integer is malformed, or zero if b is too
+// short to hold it.
+func readVarInt(b []byte) (int, int, bool) {
+	value, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		if i >= len(b) {
+			return 0, 0, false
+		}
+		value |= int(b[i]&0x7f) << shift
+		if b[i]&0x80 == 0 {
+			return value, i + 1, true
+		}
+		shift += 7
+	}
+	return 0, -1, false
+}
+
+// appendVarInt appends a variable byte integer to b
+func appendVarInt(b []byte, n int) []byte {
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// Packet is a control packet, split into its fixed header and the
+// remainder of the packet
+type Packet struct {
+	Type  byte
+	Flags byte
+	Body  []byte
+}
+
+// Parse decodes the fixed header of a control packet
+func Parse(b []byte) (*Packet, bool) {
+	if len(b) < 2 || !validHeader(b[0]) {
+		return nil, false
+	}
+	length, n, ok := readVarInt(b[1:])
+	if !ok || 1+n+length != len(b) {
+		return nil, false
+	}
+	return &Packet{Type: b[0] >> 4, Flags: b[0] & 0xf, Body: b[1+n:]}, true
+}
+
+// NewPacket encodes a control packet
+func NewPacket(t byte, flags byte, body []byte) []byte {
+	b := appendVarInt([]byte{t<<4 | flags&0xf}, len(body))
+	return append(b, body...)
+}
+
+// PacketID returns the packet identifier of an acknowledgement, SUBSCRIBE
+// or UNSUBSCRIBE packet
+func (p *Packet) PacketID() (uint16, bool) {
+	if len(p.Body) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(p.Body), true
+}
+
+// ReasonCode returns the reason code of an MQTT 5 acknowledgement or
+// DISCONNECT, or the return code of a CONNACK. Success is assumed if the
+// packet has none.
+func (p *Packet) ReasonCode() byte {
+	switch p.Type {
+	case ConnAck:
+		if len(p.Body) >= 2 {
+			return p.Body[1]
+		}
+	case PubAck, PubRec, PubRel, PubComp:
+		if len(p.Body) >= 3 {
+			return p.Body[2]
+		}
+	case Disconnect, Auth:
+		if len(p.Body) >= 1 {
+			return p.Body[0]
+		}
+	}
+	return 0
+}
+
+// readString reads a length prefixed string from b, returning it and
+// the remainder of b
+func readString(b []byte) (string, []byte, bool) {
+	if len(b) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, false
+	}
+	return string(b[2 : 2+n]), b[2+n:], true
+}
+
+// skipProperties skips the properties of an MQTT 5 packet
+func skipProperties(b []byte) ([]byte, bool) {
+	length, n, ok := readVarInt(b)
+	if !ok || len(b) < n+length {
+		return nil, false
+	}
+	return b[n+length:], true
+}
+
+// ConnectPacket is a decoded CONNECT packet
+type ConnectPacket struct {
+	Version   byte
+	KeepAlive uint16
+	ClientID  string
+	Username  string
+}
+
+// ParseConnect decodes the body of a CONNECT packet
+func ParseConnect(body []byte) (*ConnectPacket, bool) {
+	name, b, ok := readString(body)
+	if !ok || (name != "MQTT" && name != "MQIsdp") || len(b) < 4 {
+		return nil, false
+	}
+	c := &ConnectPacket{Version: b[0], KeepAlive: binary.BigEndian.Uint16(b[2:])}
+	flags := b[1]
+	b = b[4:]
+
+	if c.Version >= Version5 {
+		if b, ok = skipProperties(b); !ok {
+			return nil, false
+		}
+	}
+	if c.ClientID, b, ok = readString(b); !ok {
+		return nil, false
+	}
+
+	// Will
+	if flags&0x04 != 0 {
+		if c.Version >= Version5 {
+			if b, ok = skipProperties(b); !ok {
+				return nil, false
+			}
+		}
+		if _, b, ok = readString(b); !ok {
+			return nil, false
+		}
+		if _, b, ok = readString(b); !ok {
+			return nil, false
+		}
+	}
+	if flags&0x80 != 0 {
+		if c.Username, _, ok = readString(b); !ok {
+			return nil, false
+		}
+	}
+	return c, true
+}
+
+// PublishPacket is a decoded PUBLISH packet
+type PublishPacket struct {
+	Topic    string
+	QoS      byte
+	Retain   bool
+	Dup      bool
+	PacketID uint16
+}
+
+// ParsePublish decodes a PUBLISH packet. Packets of QoS 1 and 2 have an
+// identifier. The topic is empty if an MQTT 5 topic alias is used.
+func ParsePublish(p *Packet) (*PublishPacket, bool) {
+	pub := &PublishPacket{
+		QoS:    p.Flags >> 1 & 3,
+		Retain: p.Flags&1 != 0,
+		Dup:    p.Flags&8 != 0,
+	}
+	topic, b, ok := readString(p.Body)
+	if !ok || pub.QoS > 2 {
+		return nil, false
+	}
+	pub.Topic = topic
+	if pub.QoS > 0 {
+		if len(b) < 2 {
+			return nil, false
+		}
+		pub.PacketID = binary.BigEndian.Uint16(b)
+	}
+	return pub, true
+}
+
+// TopicAlias returns the topic alias of an MQTT 5 PUBLISH, if it has one
+func TopicAlias(p *Packet) (uint16, bool) {
+	_, b, ok := readString(p.Body)
+	if !ok {
+		return 0, false
+	}
+	if p.Flags>>1&3 > 0 {
+		if len(b) < 2 {
+			return 0, false
+		}
+		b = b[2:]
+	}
+
+	length, n, ok := readVarInt(b)
+	if !ok || len(b) < n+length {
+		return 0, false
+	}
+	props := b[n : n+length]
+	// Properties of a PUBLISH are skipped by their type, until the alias
+	for len(props) > 0 {
+		id := props[0]
+		props = props[1:]
+
+		size := 0
+		switch id {
+		case 0x01:
+			size = 1
+		case 0x23:
+			if len(props) < 2 {
+				return 0, false
+			}
+			return binary.BigEndian.Uint16(props), true
+		case 0x02:
+			size = 4
+		case 0x03, 0x08, 0x09:
+			if len(props) < 2 {
+				return 0, false
+			}
+			size = 2 + int(binary.BigEndian.Uint16(props))
+		case 0x26:
+			_, rest, ok := readString(props)
+			if ok {
+				_, rest, ok = readString(rest)
+			}
+			if !ok {
+				return 0, false
+			}
+			size = len(props) - len(rest)
+		case 0x0b:
+			_, m, ok := readVarInt(props)
+			if !ok {
+				return 0, false
+			}
+			size = m
+		default:
+			return 0, false
+		}
+		if len(props) < size {
+			return 0, false
+		}
+		props = props[size:]
+	}
+	return 0, false
+}
+
+// ParseSubscribe decodes the topic filters of a SUBSCRIBE or UNSUBSCRIBE
+// packet
+func ParseSubscribe(p *Packet, version byte) ([]string, bool) {
+	if len(p.Body) < 2 {
+		return nil, false
+	}
+	b := p.Body[2:]
+	var ok bool
+	if version >= Version5 {
+		if b, ok = skipProperties(b); !ok {
+			return nil, false
+		}
+	}
+
+	var filters []string
+	for len(b) > 0 {
+		var filter string
+		if filter, b, ok = readString(b); !ok {
+			return nil, false
+		}
+		filters = append(filters, filter)
+
+		// Subscription options
+		if p.Type == Subscribe {
+			if len(b) < 1 {
+				return nil, false
+			}
+			b = b[1:]
+		}
+	}
+	return filters, len(filters) > 0
+}
+
+// NewConnAck encodes a CONNACK refusing or accepting a connection, with
+// the code for the client's protocol version
+func NewConnAck(version byte, code byte) []byte {
+	body := []byte{0, code}
+	if version >= Version5 {
+		body = append(body, 0)
+	}
+	return NewPacket(ConnAck, 0, body)
+}
+
+// NewDisconnect encodes a DISCONNECT sent by the server. Only MQTT 5
+// servers send a DISCONNECT, so it is nil for earlier versions.
+func NewDisconnect(version byte, reason byte) []byte {
+	if version < Version5 {
+		return nil
+	}
+	return NewPacket(Disconnect, 0, []byte{reason, 0})
+}
+
+// ValidFilter returns true if the topic filter is well formed: wildcards
+// occupy a whole level, and # is the last
+func ValidFilter(filter string) bool {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return filter != ""
+}
+
+// MatchTopic returns true if the topic name matches the topic filter,
+// which may contain the + and # wildcards. Filters starting with a
+// wildcard do not match topics starting with $.
+func MatchTopic(filter string, topic string) bool {
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, level := range f {
+		if level == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if level != "+" && level != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
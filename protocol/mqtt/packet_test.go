@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func str(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func connect(version byte, clientID string, username string) []byte {
+	body := append(str("MQTT"), version, 0x02, 0, 30)
+	if username != "" {
+		body[len(body)-3] |= 0x80
+	}
+	if version >= Version5 {
+		body = append(body, 0)
+	}
+	body = append(body, str(clientID)...)
+	if username != "" {
+		body = append(body, str(username)...)
+	}
+	return NewPacket(Connect, 0, body)
+}
+
+func publish(topic string, qos byte, id uint16, payload string) []byte {
+	body := str(topic)
+	if qos > 0 {
+		body = append(body, byte(id>>8), byte(id))
+	}
+	return NewPacket(Publish, qos<<1, append(body, payload...))
+}
+
+func TestSplit(t *testing.T) {
+	want := [][]byte{
+		connect(Version311, "sensor-1", ""),
+		publish("sensors/1/temp", 1, 7, strings.Repeat("x", 300)),
+		NewPacket(PingReq, 0, nil),
+	}
+	got := prototest.Scan(Split(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	// TLS is passed on as it is read
+	got = prototest.Scan(Split(), []byte{0x16, 0x03, 0x01, 0x00})
+	if len(got) != 4 {
+		t.Fatalf("Want TLS passed on as read, got %q", got)
+	}
+}
+
+func TestParseConnect(t *testing.T) {
+	for _, version := range []byte{Version311, Version5} {
+		p, ok := Parse(connect(version, "sensor-1", "muxy"))
+		if !ok || p.Type != Connect {
+			t.Fatal("Want CONNECT, got", p)
+		}
+		c, ok := ParseConnect(p.Body)
+		want := &ConnectPacket{Version: version, KeepAlive: 30, ClientID: "sensor-1", Username: "muxy"}
+		if !ok || !reflect.DeepEqual(c, want) {
+			t.Fatalf("Want %+v, got %+v", want, c)
+		}
+	}
+}
+
+func TestParsePublish(t *testing.T) {
+	p, _ := Parse(publish("sensors/1/temp", 2, 9, "21.5"))
+	pub, ok := ParsePublish(p)
+	want := &PublishPacket{Topic: "sensors/1/temp", QoS: 2, PacketID: 9}
+	if !ok || !reflect.DeepEqual(pub, want) {
+		t.Fatalf("Want %+v, got %+v", want, pub)
+	}
+}
+
+func TestTopicAlias(t *testing.T) {
+	props := append([]byte{0x26}, str("unit")...)
+	props = append(props, str("celsius")...)
+	props = append(props, 0x23, 0, 3)
+	body := append(str("sensors/1/temp"), 0, 9, byte(len(props)))
+	p, _ := Parse(NewPacket(Publish, 1<<1, append(append(body, props...), "21.5"...)))
+
+	if alias, ok := TopicAlias(p); !ok || alias != 3 {
+		t.Fatal("Want topic alias 3, got", alias)
+	}
+	p, _ = Parse(publish("sensors/1/temp", 0, 0, "\x0021.5"))
+	if _, ok := TopicAlias(p); ok {
+		t.Fatal("Want no topic alias")
+	}
+}
+
+func TestParseSubscribe(t *testing.T) {
+	body := append([]byte{0, 1, 0}, str("sensors/#")...)
+	body = append(body, 1)
+	body = append(body, str("alerts/+")...)
+	body = append(body, 0)
+	p, _ := Parse(NewPacket(Subscribe, 2, body))
+
+	filters, ok := ParseSubscribe(p, Version5)
+	if !ok || !reflect.DeepEqual(filters, []string{"sensors/#", "alerts/+"}) {
+		t.Fatal("Want sensors/# and alerts/+, got", filters)
+	}
+}
+
+func TestReasonCode(t *testing.T) {
+	cases := map[string]byte{
+		"NOT_AUTHORIZED": 0x87,
+		"server_busy":    0x89,
+		"0x86":           0x86,
+		"5":              0x87,
+	}
+	for name, want := range cases {
+		if code, ok := ParseReasonCode(name); !ok || code != want {
+			t.Fatalf("Want %s to be %#x, got %#x", name, want, code)
+		}
+	}
+	if _, ok := ParseReasonCode("0x00"); ok {
+		t.Fatal("Want success to be rejected")
+	}
+
+	if code := ConnAckCode(Version311, 0x87); code != 5 {
+		t.Fatal("Want not authorized return code 5, got", code)
+	}
+	if code := ConnAckCode(Version5, 0x87); code != 0x87 {
+		t.Fatal("Want not authorized reason code 0x87, got", code)
+	}
+
+	p, _ := Parse(NewConnAck(Version5, 0x87))
+	if p.Type != ConnAck || p.ReasonCode() != 0x87 {
+		t.Fatal("Want CONNACK of 0x87, got", p)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{"sensors/1/temp", "sensors/1/temp", true},
+		{"sensors/+/temp", "sensors/1/temp", true},
+		{"sensors/+/temp", "sensors/1/humidity", false},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/1/temp", true},
+		{"sensors/+", "sensors/1/temp", false},
+		{"#", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, c := range cases {
+		if !ValidFilter(c.filter) {
+			t.Fatal("Want valid filter", c.filter)
+		}
+		if got := MatchTopic(c.filter, c.topic); got != c.want {
+			t.Fatalf("Want %s matching %s to be %v", c.filter, c.topic, c.want)
+		}
+	}
+}
+
+func TestValidFilter(t *testing.T) {
+	for _, filter := range []string{"", "sensors/#/temp", "sensors/1+", "sensors#"} {
+		if ValidFilter(filter) {
+			t.Fatal("Want invalid filter", filter)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mqtt"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// mqttString encodes a length prefixed string
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+// mqttConnect encodes an MQTT 3.1.1 CONNECT
+func mqttConnect(clientID string) []byte {
+	body := append(mqttString("MQTT"), mqtt.Version311, 0x02, 0, 30)
+	return mqtt.NewPacket(mqtt.Connect, 0, append(body, mqttString(clientID)...))
+}
+
+// mqttPublish encodes a QoS 1 PUBLISH
+func mqttPublish(topic string, id uint16) []byte {
+	body := append(mqttString(topic), byte(id>>8), byte(id))
+	return mqtt.NewPacket(mqtt.Publish, 1<<1, append(body, "payload"...))
+}
+
+// setupLocalMQTT starts a fake MQTT broker, which accepts every connection
+// and message
+func setupLocalMQTT(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(mqtt.Split())
+
+		for s.Scan() {
+			p, _ := mqtt.Parse(s.Bytes())
+			switch p.Type {
+			case mqtt.Connect:
+				c.Write(mqtt.NewConnAck(mqtt.Version311, 0))
+			case mqtt.Publish:
+				pub, _ := mqtt.ParsePublish(p)
+				c.Write(mqtt.NewPacket(mqtt.PubAck, 0, []byte{byte(pub.PacketID >> 8), byte(pub.PacketID)}))
+			case mqtt.PingReq:
+				c.Write(mqtt.NewPacket(mqtt.PingResp, 0, nil))
+			}
+		}
+	})
+}
+
+func TestMQTTProxy_Proxy(t *testing.T) {
+	brokerPort := 7751
+	setupLocalMQTT(brokerPort)
+
+	withholder := &symptom.MQTTSymptom{WithholdAcks: true, Topic: "alerts/#"}
+	withholder.Setup()
+	rejecter := &symptom.MQTTSymptom{
+		Reject: "NOT_AUTHORIZED",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Key: "^banned-"},
+		},
+	}
+	rejecter.Setup()
+
+	port := 7752
+	p := MQTTProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: brokerPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{withholder, rejecter})
+
+	waitForPort(brokerPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	dial := func() (net.Conn, *bufio.Scanner) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		s := bufio.NewScanner(conn)
+		s.Split(mqtt.Split())
+		return conn, s
+	}
+	read := func(s *bufio.Scanner) *mqtt.Packet {
+		if !s.Scan() {
+			t.Fatal("Want packet, got", s.Err())
+		}
+		p, ok := mqtt.Parse(s.Bytes())
+		if !ok {
+			t.Fatalf("Want packet, got %q", s.Bytes())
+		}
+		return p
+	}
+
+	// Banned clients are refused, and disconnected
+	conn, s := dial()
+	defer conn.Close()
+	conn.Write(mqttConnect("banned-1"))
+	if p := read(s); p.Type != mqtt.ConnAck || p.ReasonCode() != 5 {
+		t.Fatal("Want CONNACK refusing the connection, got", p)
+	}
+	if s.Scan() {
+		t.Fatal("Want connection closed")
+	}
+
+	conn, s = dial()
+	defer conn.Close()
+	conn.Write(mqttConnect("sensor-1"))
+	if p := read(s); p.Type != mqtt.ConnAck || p.ReasonCode() != 0 {
+		t.Fatal("Want CONNACK accepting the connection, got", p)
+	}
+
+	// Only the message published to sensors is acknowledged
+	conn.Write(append(mqttPublish("alerts/fire", 1), mqttPublish("sensors/1/temp", 2)...))
+	p2 := read(s)
+	if id, _ := p2.PacketID(); p2.Type != mqtt.PubAck || id != 2 {
+		t.Fatal("Want PUBACK of message 2, got", p2)
+	}
+
+	conn.Write(mqtt.NewPacket(mqtt.PingReq, 0, nil))
+	if p := read(s); p.Type != mqtt.PingResp {
+		t.Fatal("Want PINGRESP, got", p)
+	}
+}
+
+func TestMQTTCodec_Acks(t *testing.T) {
+	c := &mqttCodec{
+		version:  mqtt.Version311,
+		outbound: map[uint16]string{},
+		inbound:  map[uint16]string{},
+		aliases:  [2]map[uint16]string{{}, {}},
+	}
+
+	msg, expecting := c.decode(mqttConnect("sensor-1"), true, nil)
+	if !expecting || msg.Command != "CONNECT" || msg.Key != "sensor-1" {
+		t.Fatalf("Want CONNECT expecting a CONNACK, got %+v", msg)
+	}
+
+	// Messages are tracked in each direction by their packet identifier
+	c.decode(mqttPublish("sensors/1/temp", 7), true, nil)
+	c.decode(mqttPublish("commands/1/reboot", 7), false, nil)
+
+	msg, _ = c.decode(mqtt.NewPacket(mqtt.PubAck, 0, []byte{0, 7}), false, nil)
+	if msg.Command != "PUBACK" || msg.Key != "sensors/1/temp" {
+		t.Fatalf("Want PUBACK of sensors/1/temp, got %+v", msg)
+	}
+	msg, _ = c.decode(mqtt.NewPacket(mqtt.PubRec, 0, []byte{0, 7}), true, nil)
+	if msg.Command != "PUBREC" || msg.Key != "commands/1/reboot" {
+		t.Fatalf("Want PUBREC of commands/1/reboot, got %+v", msg)
+	}
+	if len(c.outbound) != 0 || len(c.inbound) != 1 {
+		t.Fatal("Want only the QoS 2 message in flight, got", c.outbound, c.inbound)
+	}
+
+	c.decode(mqtt.NewPacket(mqtt.PubRel, 2, []byte{0, 7}), false, nil)
+	msg, _ = c.decode(mqtt.NewPacket(mqtt.PubComp, 0, []byte{0, 7}), true, nil)
+	if msg.Key != "commands/1/reboot" || len(c.inbound) != 0 {
+		t.Fatalf("Want PUBCOMP to complete commands/1/reboot, got %+v", msg)
+	}
+}
@@ -0,0 +1,372 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mysql"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// MySQLProxy implements a MySQL aware TCP proxy. Packets are decoded, so
+// that middlewares can target statements by their SQL, and the packets of
+// their results by type.
+type MySQLProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MySQLProxy{}, nil
+	}, "mysql_proxy")
+}
+
+// Setup the MySQL proxy
+func (p *MySQLProxy) Setup(middleware []muxy.Middleware) {
+	p.setup("MySQL Proxy", FramingConfig{MaxSize: mysql.MaxPayload + 4}, func(request bool) bufio.SplitFunc {
+		if request {
+			return mysql.SplitClient()
+		}
+		return mysql.SplitServer()
+	}, func() codec {
+		return &mysqlCodec{statements: map[uint32]string{}}
+	}, middleware)
+}
+
+// Phases of a MySQL session
+const (
+	mysqlHandshake = iota
+	mysqlAuth
+	mysqlCommand
+)
+
+// States of the decoding of a command's response
+const (
+	mysqlFirst = iota
+	mysqlColumns
+	mysqlColumnsEOF
+	mysqlRows
+	mysqlParams
+	mysqlParamsEOF
+	mysqlPrepareColumns
+	mysqlPrepareColumnsEOF
+	mysqlFieldList
+	mysqlInfile
+)
+
+// mysqlCodec decodes the packets of a session, tracking its capabilities,
+// prepared statements and the progress of each response
+type mysqlCodec struct {
+	phase     int
+	encrypted bool
+
+	// serverCaps are the capabilities of the server, and caps those
+	// shared by the client and server
+	serverCaps uint32
+	caps       uint32
+
+	// statements are the SQL of each prepared statement
+	statements map[uint32]string
+
+	// state of the response being decoded
+	state   int
+	columns uint64
+	params  uint64
+	rows    int
+
+	// continued is true for each direction while a payload
+	// is split across packets
+	requestContinued  bool
+	responseContinued bool
+}
+
+// decode decodes a client or server packet. Commands are answered by the
+// packet that completes their response, such as the EOF after a result set.
+func (c *mysqlCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if c.encrypted {
+		return nil, false
+	}
+
+	seq, payload, ok := mysql.Packet(b)
+	if !ok {
+		log.Debug("MySQL Proxy unable to decode packet")
+		return nil, false
+	}
+
+	// The remainder of a large payload
+	continued := &c.responseContinued
+	if request {
+		continued = &c.requestContinued
+	}
+	if *continued {
+		*continued = len(payload) == mysql.MaxPayload
+		return nil, false
+	}
+	*continued = len(payload) == mysql.MaxPayload
+
+	if request {
+		return c.decodeClient(seq, payload)
+	}
+	return c.decodeServer(seq, payload, req)
+}
+
+func (c *mysqlCodec) decodeClient(seq byte, payload []byte) (*muxy.Message, bool) {
+	msg := &muxy.Message{
+		Protocol: "mysql",
+		Fields:   map[string]string{"seq": strconv.Itoa(int(seq))},
+	}
+
+	switch c.phase {
+	case mysqlHandshake:
+		if len(payload) == 32 && binary.LittleEndian.Uint32(payload)&mysql.ClientSSL != 0 {
+			c.encrypted = true
+			msg.Command = "SSLRequest"
+			return msg, false
+		}
+
+		caps, user, db, _ := mysql.HandshakeResponse(payload)
+		c.caps = caps & c.serverCaps
+		c.phase = mysqlAuth
+		msg.Command = "HandshakeResponse"
+		msg.Key = db
+		msg.Fields["user"] = user
+		msg.Fields["database"] = db
+		return msg, true
+	case mysqlAuth:
+		msg.Command = "AuthData"
+		return msg, false
+	}
+
+	// Packets that do not start a command, such as LOCAL INFILE data
+	if seq != 0 || len(payload) == 0 {
+		msg.Command = "Data"
+		return msg, false
+	}
+
+	cmd := payload[0]
+	msg.Command = mysql.CommandName(cmd)
+	switch cmd {
+	case mysql.ComQuery, mysql.ComStmtPrepare:
+		msg.Fields["sql"] = string(payload[1:])
+	case mysql.ComInitDB:
+		msg.Key = string(payload[1:])
+	case mysql.ComStmtExecute, mysql.ComStmtSendLongData, mysql.ComStmtClose,
+		mysql.ComStmtReset, mysql.ComStmtFetch:
+		if len(payload) < 5 {
+			break
+		}
+		id := binary.LittleEndian.Uint32(payload[1:])
+		msg.Key = strconv.FormatUint(uint64(id), 10)
+		msg.Fields["statement"] = msg.Key
+		msg.Fields["sql"] = c.statements[id]
+		if cmd == mysql.ComStmtClose {
+			delete(c.statements, id)
+		}
+	}
+
+	switch cmd {
+	case mysql.ComQuit, mysql.ComStmtSendLongData, mysql.ComStmtClose:
+		return msg, false
+	}
+	return msg, true
+}
+
+func (c *mysqlCodec) decodeServer(seq byte, payload []byte, req *muxy.Message) (*muxy.Message, bool) {
+	msg := &muxy.Message{Protocol: "mysql", Fields: map[string]string{}}
+	if req != nil {
+		msg.Command = req.Command
+		msg.Key = req.Key
+		msg.Pipelined = req.Pipelined
+		for k, v := range req.Fields {
+			msg.Fields[k] = v
+		}
+	}
+	msg.Fields["seq"] = strconv.Itoa(int(seq))
+
+	if len(payload) == 0 {
+		return msg, false
+	}
+	header := payload[0]
+	if header == mysql.ERR {
+		code, _, _ := mysql.Error(payload)
+		msg.Fields["type"] = "ERR"
+		msg.Fields["error"] = strconv.Itoa(int(code))
+	}
+
+	switch c.phase {
+	case mysqlHandshake:
+		if header != mysql.ERR {
+			msg.Fields["type"] = "Handshake"
+			msg.Fields["version"], c.serverCaps, _ = mysql.Handshake(payload)
+		}
+		return msg, false
+	case mysqlAuth:
+		switch header {
+		case mysql.OK:
+			msg.Fields["type"] = "OK"
+			c.phase = mysqlCommand
+		case mysql.ERR:
+		case mysql.EOF:
+			msg.Fields["type"] = "AuthSwitch"
+			return msg, false
+		default:
+			msg.Fields["type"] = "AuthMoreData"
+			return msg, false
+		}
+		return msg, true
+	}
+
+	if req == nil {
+		msg.Fields["type"] = "Unknown"
+		return msg, true
+	}
+
+	complete := c.response(msg, req.Command, header, payload)
+	if complete {
+		c.state = mysqlFirst
+		c.rows = 0
+	}
+	return msg, complete
+}
+
+// response advances the decoding of the response to command, returning
+// true once it is complete
+func (c *mysqlCodec) response(msg *muxy.Message, command string, header byte, payload []byte) bool {
+	deprecateEOF := c.caps&mysql.ClientDeprecateEOF != 0
+
+	if header == mysql.ERR {
+		return true
+	}
+
+	switch c.state {
+	case mysqlFirst:
+		switch {
+		case command == "COM_STMT_PREPARE" && header == mysql.OK && len(payload) >= 9:
+			msg.Fields["type"] = "PrepareOK"
+			id := binary.LittleEndian.Uint32(payload[1:])
+			c.statements[id] = msg.Fields["sql"]
+			msg.Fields["statement"] = strconv.FormatUint(uint64(id), 10)
+			c.columns = uint64(binary.LittleEndian.Uint16(payload[5:]))
+			c.params = uint64(binary.LittleEndian.Uint16(payload[7:]))
+			return c.prepared(deprecateEOF)
+		case command == "COM_CHANGE_USER" && header != mysql.OK:
+			msg.Fields["type"] = "AuthSwitch"
+			return false
+		case command == "COM_STATISTICS":
+			msg.Fields["type"] = "Statistics"
+			return true
+		case header == mysql.OK:
+			msg.Fields["type"] = "OK"
+			return c.more(payload)
+		case header == mysql.LocalInfile:
+			msg.Fields["type"] = "LocalInfile"
+			c.state = mysqlInfile
+			return false
+		case mysql.IsEOF(payload, deprecateEOF):
+			msg.Fields["type"] = "EOF"
+			return c.more(payload)
+		case command == "COM_FIELD_LIST":
+			msg.Fields["type"] = "Column"
+			c.state = mysqlFieldList
+			return false
+		case command == "COM_STMT_FETCH":
+			c.state = mysqlRows
+			return c.row(msg, payload, deprecateEOF)
+		}
+
+		msg.Fields["type"] = "ColumnCount"
+		c.columns, _ = mysql.LengthEncodedInt(payload)
+		c.state = mysqlColumns
+		if c.columns == 0 {
+			c.state = mysqlRows
+		}
+	case mysqlColumns:
+		msg.Fields["type"] = "Column"
+		if c.columns--; c.columns == 0 {
+			c.state = mysqlColumnsEOF
+			if deprecateEOF {
+				c.state = mysqlRows
+			}
+		}
+	case mysqlColumnsEOF:
+		msg.Fields["type"] = "EOF"
+		c.state = mysqlRows
+	case mysqlRows:
+		return c.row(msg, payload, deprecateEOF)
+	case mysqlParams:
+		msg.Fields["type"] = "Param"
+		if c.params--; c.params == 0 {
+			if !deprecateEOF {
+				c.state = mysqlParamsEOF
+				return false
+			}
+			return c.prepared(deprecateEOF)
+		}
+	case mysqlParamsEOF:
+		msg.Fields["type"] = "EOF"
+		return c.prepared(deprecateEOF)
+	case mysqlPrepareColumns:
+		msg.Fields["type"] = "Column"
+		if c.columns--; c.columns == 0 {
+			if !deprecateEOF {
+				c.state = mysqlPrepareColumnsEOF
+				return false
+			}
+			return true
+		}
+	case mysqlPrepareColumnsEOF:
+		msg.Fields["type"] = "EOF"
+		return true
+	case mysqlFieldList:
+		if mysql.IsEOF(payload, deprecateEOF) {
+			msg.Fields["type"] = "EOF"
+			return true
+		}
+		msg.Fields["type"] = "Column"
+	case mysqlInfile:
+		msg.Fields["type"] = "OK"
+		return true
+	}
+	return false
+}
+
+// row decodes a row of a result set, or the packet that ends it
+func (c *mysqlCodec) row(msg *muxy.Message, payload []byte, deprecateEOF bool) bool {
+	if mysql.IsEOF(payload, deprecateEOF) {
+		msg.Fields["type"] = "EOF"
+		msg.Fields["rows"] = strconv.Itoa(c.rows)
+		c.rows = 0
+		return c.more(payload)
+	}
+
+	c.rows++
+	msg.Fields["type"] = "Row"
+	msg.Fields["row"] = strconv.Itoa(c.rows)
+	return false
+}
+
+// prepared advances past the parameter and column definitions of a
+// prepared statement, returning true if none remain
+func (c *mysqlCodec) prepared(deprecateEOF bool) bool {
+	switch {
+	case c.params > 0:
+		c.state = mysqlParams
+	case c.columns > 0:
+		c.state = mysqlPrepareColumns
+	default:
+		return true
+	}
+	return false
+}
+
+// more returns true unless the OK or EOF packet says more results follow
+func (c *mysqlCodec) more(payload []byte) bool {
+	if mysql.Status(payload)&mysql.ServerMoreResultsExists != 0 {
+		c.state = mysqlFirst
+		return false
+	}
+	return true
+}
@@ -0,0 +1,314 @@
+// Package mysql decodes and encodes the packets of the MySQL client/server
+// protocol, for use by the MySQL Proxy and its Symptoms.
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+)
+
+// MaxPayload is the largest payload of a single packet. Larger payloads
+// are split across packets, all but the last of which are this size.
+const MaxPayload = 0xffffff
+
+// Commands sent by the client
+const (
+	ComQuit             = 0x01
+	ComInitDB           = 0x02
+	ComQuery            = 0x03
+	ComFieldList        = 0x04
+	ComStatistics       = 0x09
+	ComPing             = 0x0e
+	ComChangeUser       = 0x11
+	ComStmtPrepare      = 0x16
+	ComStmtExecute      = 0x17
+	ComStmtSendLongData = 0x18
+	ComStmtClose        = 0x19
+	ComStmtReset        = 0x1a
+	ComSetOption        = 0x1b
+	ComStmtFetch        = 0x1c
+	ComResetConnection  = 0x1f
+)
+
+// Headers of the generic packets sent by the server
+const (
+	OK          = 0x00
+	AuthMore    = 0x01
+	LocalInfile = 0xfb
+	EOF         = 0xfe
+	ERR         = 0xff
+)
+
+// Capability flags
+const (
+	ClientConnectWithDB     = 0x00000008
+	ClientProtocol41        = 0x00000200
+	ClientSSL               = 0x00000800
+	ClientDeprecateEOF      = 0x01000000
+	ServerMoreResultsExists = 0x0008
+)
+
+var commandNames = map[byte]string{
+	ComQuit:             "COM_QUIT",
+	ComInitDB:           "COM_INIT_DB",
+	ComQuery:            "COM_QUERY",
+	ComFieldList:        "COM_FIELD_LIST",
+	ComStatistics:       "COM_STATISTICS",
+	ComPing:             "COM_PING",
+	ComChangeUser:       "COM_CHANGE_USER",
+	ComStmtPrepare:      "COM_STMT_PREPARE",
+	ComStmtExecute:      "COM_STMT_EXECUTE",
+	ComStmtSendLongData: "COM_STMT_SEND_LONG_DATA",
+	ComStmtClose:        "COM_STMT_CLOSE",
+	ComStmtReset:        "COM_STMT_RESET",
+	ComSetOption:        "COM_SET_OPTION",
+	ComStmtFetch:        "COM_STMT_FETCH",
+	ComResetConnection:  "COM_RESET_CONNECTION",
+}
+
+// CommandName returns the name of a command, e.g. "COM_QUERY"
+func CommandName(c byte) string {
+	if name, ok := commandNames[c]; ok {
+		return name
+	}
+	return "COM_UNKNOWN"
+}
+
+// SplitClient returns a bufio.SplitFunc framing the packets sent by a
+// client. Once a client requests SSL, data is passed on as it is read.
+func SplitClient() bufio.SplitFunc {
+	first := true
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if raw && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		n, packet, err := splitPacket(data, atEOF)
+		if n > 0 && first {
+			first = false
+			// The SSLRequest is a truncated HandshakeResponse
+			if _, payload, ok := Packet(packet); ok && len(payload) == 32 &&
+				binary.LittleEndian.Uint32(payload)&ClientSSL != 0 {
+				raw = true
+			}
+		}
+		return n, packet, err
+	}
+}
+
+// SplitServer returns a bufio.SplitFunc framing the packets sent by a
+// server. Once a TLS handshake is seen, data is passed on as it is read.
+func SplitServer() bufio.SplitFunc {
+	first := true
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		// A TLS handshake record follows the initial handshake
+		if raw || (!first && len(data) >= 2 && data[0] == 0x16 && data[1] == 0x03) {
+			raw = true
+			return len(data), data, nil
+		}
+
+		n, packet, err := splitPacket(data, atEOF)
+		if n > 0 {
+			first = false
+		}
+		return n, packet, err
+	}
+}
+
+// splitPacket frames a packet with its header
+func splitPacket(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < 4 {
+		return flush(data, atEOF)
+	}
+	size := 4 + int(uint32(data[0])|uint32(data[1])<<8|uint32(data[2])<<16)
+	if len(data) < size {
+		return flush(data, atEOF)
+	}
+	return size, data[:size], nil
+}
+
+// flush requests more data, or passes on a partial packet at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Packet splits a packet into its sequence id and payload
+func Packet(b []byte) (byte, []byte, bool) {
+	if len(b) < 4 || 4+int(uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16) != len(b) {
+		return 0, nil, false
+	}
+	return b[3], b[4:], true
+}
+
+// NewPacket encodes a packet with the given sequence id
+func NewPacket(seq byte, payload []byte) []byte {
+	b := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	return append(b, payload...)
+}
+
+// LengthEncodedInt decodes a length-encoded integer, returning it and
+// the number of bytes read, or 0 if it is invalid
+func LengthEncodedInt(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfc:
+		if len(b) >= 3 {
+			return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+		}
+	case 0xfd:
+		if len(b) >= 4 {
+			return uint64(b[1]) | uint64(b[2])<<8 | uint64(b[3])<<16, 4
+		}
+	case 0xfe:
+		if len(b) >= 9 {
+			return binary.LittleEndian.Uint64(b[1:]), 9
+		}
+	case 0xfb, 0xff:
+	default:
+		return uint64(b[0]), 1
+	}
+	return 0, 0
+}
+
+// Handshake decodes the initial handshake sent by the server, returning
+// its version and capabilities
+func Handshake(payload []byte) (string, uint32, bool) {
+	if len(payload) < 1 || payload[0] != 10 {
+		return "", 0, false
+	}
+	i := bytes.IndexByte(payload[1:], 0)
+	if i < 0 {
+		return "", 0, false
+	}
+	version := string(payload[1 : 1+i])
+
+	// connection id (4), auth data (8), filler (1), capabilities (2)
+	rest := payload[2+i:]
+	if len(rest) < 15 {
+		return version, 0, false
+	}
+	caps := uint32(binary.LittleEndian.Uint16(rest[13:]))
+
+	// charset (1), status (2), upper capabilities (2)
+	if len(rest) >= 20 {
+		caps |= uint32(binary.LittleEndian.Uint16(rest[18:])) << 16
+	}
+	return version, caps, true
+}
+
+// HandshakeResponse decodes the client's response to the handshake,
+// returning its capabilities, user and database
+func HandshakeResponse(payload []byte) (uint32, string, string, bool) {
+	if len(payload) < 32 {
+		return 0, "", "", false
+	}
+	caps := binary.LittleEndian.Uint32(payload)
+	if caps&ClientProtocol41 == 0 {
+		return caps, "", "", false
+	}
+
+	rest := payload[32:]
+	user, rest := nullString(rest)
+
+	// The auth response is length-encoded, or prefixed by its length
+	var auth uint64
+	n := 1
+	if len(rest) > 0 {
+		auth, n = LengthEncodedInt(rest)
+	}
+	if n == 0 || uint64(len(rest)) < uint64(n)+auth {
+		return caps, user, "", true
+	}
+	rest = rest[uint64(n)+auth:]
+
+	var db string
+	if caps&ClientConnectWithDB != 0 {
+		db, _ = nullString(rest)
+	}
+	return caps, user, db, true
+}
+
+// nullString reads a null terminated string from b, returning it and
+// the remainder of b
+func nullString(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
+
+// IsEOF returns true if payload is an EOF packet, or the OK packet that
+// replaces it when the ClientDeprecateEOF capability is used
+func IsEOF(payload []byte, deprecateEOF bool) bool {
+	if len(payload) == 0 || payload[0] != EOF {
+		return false
+	}
+	if deprecateEOF {
+		return len(payload) < MaxPayload
+	}
+	return len(payload) < 9
+}
+
+// Status returns the server status flags of an OK or EOF packet
+func Status(payload []byte) uint16 {
+	if len(payload) == 0 {
+		return 0
+	}
+
+	// EOF: header (1), warnings (2), status (2)
+	if payload[0] == EOF && len(payload) == 5 {
+		return binary.LittleEndian.Uint16(payload[3:])
+	}
+
+	// OK: header (1), affected rows, last insert id, status (2)
+	rest := payload[1:]
+	for i := 0; i < 2; i++ {
+		_, n := LengthEncodedInt(rest)
+		if n == 0 {
+			return 0
+		}
+		rest = rest[n:]
+	}
+	if len(rest) < 2 {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(rest)
+}
+
+// Error decodes an ERR packet into its error code, SQL state and message
+func Error(payload []byte) (uint16, string, string) {
+	if len(payload) < 3 || payload[0] != ERR {
+		return 0, "", ""
+	}
+	code := binary.LittleEndian.Uint16(payload[1:])
+	rest := payload[3:]
+	state := ""
+	if len(rest) >= 6 && rest[0] == '#' {
+		state = string(rest[1:6])
+		rest = rest[6:]
+	}
+	return code, state, string(rest)
+}
+
+// NewError encodes an ERR packet with the given sequence id
+func NewError(seq byte, code uint16, state string, msg string) []byte {
+	payload := []byte{ERR, byte(code), byte(code >> 8), '#'}
+	payload = append(payload, (state + "HY000")[:5]...)
+	payload = append(payload, msg...)
+	return NewPacket(seq, payload)
+}
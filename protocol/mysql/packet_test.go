@@ -0,0 +1,157 @@
+package mysql
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+// handshakeResponse encodes a HandshakeResponse41 with the given capabilities
+func handshakeResponse(caps uint32, user string, db string) []byte {
+	payload := make([]byte, 32)
+	binary.LittleEndian.PutUint32(payload, caps|ClientProtocol41)
+	payload = append(payload, user...)
+	payload = append(payload, 0, 3, 'a', 'b', 'c')
+	payload = append(payload, db...)
+	return append(payload, 0)
+}
+
+func TestSplitClient(t *testing.T) {
+	want := [][]byte{
+		NewPacket(1, handshakeResponse(ClientConnectWithDB, "muxy", "test")),
+		NewPacket(0, []byte("\x03SELECT 1")),
+		NewPacket(0, []byte{ComQuit}),
+	}
+	got := prototest.Scan(SplitClient(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestSplitClient_SSL(t *testing.T) {
+	ssl := make([]byte, 32)
+	binary.LittleEndian.PutUint32(ssl, ClientSSL|ClientProtocol41)
+
+	s := bufio.NewScanner(bytes.NewReader(append(NewPacket(1, ssl), 0x16, 0x03, 0x01, 0x00, 0x05)))
+	s.Split(SplitClient())
+	var got [][]byte
+	for s.Scan() {
+		got = append(got, append([]byte(nil), s.Bytes()...))
+	}
+	if len(got) != 2 || !bytes.Equal(got[1], []byte{0x16, 0x03, 0x01, 0x00, 0x05}) {
+		t.Fatalf("Want SSLRequest then raw TLS, got %q", got)
+	}
+}
+
+func TestSplitServer(t *testing.T) {
+	want := [][]byte{
+		NewPacket(0, []byte("\x0a8.0.0\x00")),
+		NewPacket(2, []byte{OK, 0, 0, 2, 0, 0, 0}),
+	}
+	got := prototest.Scan(SplitServer(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestPacket(t *testing.T) {
+	seq, payload, ok := Packet(NewPacket(3, []byte("abc")))
+	if !ok || seq != 3 || string(payload) != "abc" {
+		t.Fatal("Want packet 3 'abc', got", seq, payload, ok)
+	}
+	if _, _, ok := Packet([]byte{5, 0, 0, 0, 'a'}); ok {
+		t.Fatal("Want truncated packet to be invalid")
+	}
+}
+
+func TestLengthEncodedInt(t *testing.T) {
+	cases := []struct {
+		b []byte
+		v uint64
+		n int
+	}{
+		{[]byte{0x05}, 5, 1},
+		{[]byte{0xfc, 0x01, 0x02}, 0x0201, 3},
+		{[]byte{0xfd, 0x01, 0x02, 0x03}, 0x030201, 4},
+		{[]byte{0xfe, 1, 0, 0, 0, 0, 0, 0, 0}, 1, 9},
+		{[]byte{0xfc, 0x01}, 0, 0},
+		{[]byte{0xfb}, 0, 0},
+	}
+	for _, c := range cases {
+		if v, n := LengthEncodedInt(c.b); v != c.v || n != c.n {
+			t.Fatalf("Want %d (%d bytes) from %x, got %d (%d bytes)", c.v, c.n, c.b, v, n)
+		}
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	payload := []byte("\x0a8.0.36\x00")
+	payload = append(payload, 1, 0, 0, 0)                   // connection id
+	payload = append(payload, []byte("12345678")...)        // auth data
+	payload = append(payload, 0)                            // filler
+	payload = append(payload, 0x08, 0x02)                   // capabilities
+	payload = append(payload, 0xff, 0x02, 0x00, 0x00, 0x01) // charset, status, upper capabilities
+
+	version, caps, ok := Handshake(payload)
+	if !ok || version != "8.0.36" || caps != ClientDeprecateEOF|ClientProtocol41|ClientConnectWithDB {
+		t.Fatalf("Want 8.0.36 and capabilities, got %q %x %v", version, caps, ok)
+	}
+}
+
+func TestHandshakeResponse(t *testing.T) {
+	caps, user, db, ok := HandshakeResponse(handshakeResponse(ClientConnectWithDB, "muxy", "test"))
+	if !ok || caps&ClientConnectWithDB == 0 || user != "muxy" || db != "test" {
+		t.Fatal("Want user muxy and database test, got", user, db, ok)
+	}
+}
+
+func TestIsEOF(t *testing.T) {
+	eof := []byte{EOF, 0, 0, 2, 0}
+	if !IsEOF(eof, false) || !IsEOF(eof, true) {
+		t.Fatal("Want EOF packet")
+	}
+	if IsEOF([]byte{EOF, 1, 2, 3, 4, 5, 6, 7, 8, 9}, false) {
+		t.Fatal("Want a long 0xfe row not to be EOF")
+	}
+	if IsEOF([]byte{OK, 0, 0}, true) {
+		t.Fatal("Want OK not to be EOF")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	if s := Status([]byte{EOF, 0, 0, ServerMoreResultsExists, 0}); s != ServerMoreResultsExists {
+		t.Fatal("Want more results from EOF, got", s)
+	}
+	if s := Status([]byte{OK, 1, 0, ServerMoreResultsExists | 2, 0, 0, 0}); s&ServerMoreResultsExists == 0 {
+		t.Fatal("Want more results from OK, got", s)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	b := NewError(1, 1213, "40001", "Deadlock found")
+	seq, payload, ok := Packet(b)
+	if !ok || seq != 1 {
+		t.Fatal("Want packet 1, got", seq, ok)
+	}
+	code, state, msg := Error(payload)
+	if code != 1213 || state != "40001" || msg != "Deadlock found" {
+		t.Fatal("Want 1213 40001 Deadlock found, got", code, state, msg)
+	}
+
+	if _, state, _ := Error(NewError(1, 1, "", "")[4:]); state != "HY000" {
+		t.Fatal("Want default SQL state HY000, got", state)
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	if n := CommandName(ComStmtExecute); n != "COM_STMT_EXECUTE" {
+		t.Fatal("Want COM_STMT_EXECUTE, got", n)
+	}
+	if n := CommandName(0xee); n != "COM_UNKNOWN" {
+		t.Fatal("Want COM_UNKNOWN, got", n)
+	}
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mysql"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// mysqlGreeting is the initial handshake of the fake MySQL server
+func mysqlGreeting() []byte {
+	payload := []byte("\x0a8.0.36\x00\x01\x00\x00\x0012345678\x00")
+	caps := make([]byte, 2)
+	binary.LittleEndian.PutUint16(caps, mysql.ClientProtocol41|mysql.ClientConnectWithDB)
+	return mysql.NewPacket(0, append(payload, caps...))
+}
+
+// mysqlResultSet is the single column, three row result set returned by
+// the fake MySQL server
+func mysqlResultSet() [][]byte {
+	eof := []byte{mysql.EOF, 0, 0, 2, 0}
+	return [][]byte{
+		mysql.NewPacket(1, []byte{1}),
+		mysql.NewPacket(2, []byte("\x03def\x00\x00\x00\x01n\x00")),
+		mysql.NewPacket(3, eof),
+		mysql.NewPacket(4, []byte("\x01a")),
+		mysql.NewPacket(5, []byte("\x01b")),
+		mysql.NewPacket(6, []byte("\x01c")),
+		mysql.NewPacket(7, eof),
+	}
+}
+
+// setupLocalMySQL starts a fake MySQL server, which trusts every client,
+// returns a result set for each SELECT and an OK for other statements
+func setupLocalMySQL(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		c.Write(mysqlGreeting())
+
+		s := bufio.NewScanner(c)
+		s.Split(mysql.SplitClient())
+		if !s.Scan() {
+			return
+		}
+		c.Write(mysql.NewPacket(2, []byte{mysql.OK, 0, 0, 2, 0, 0, 0}))
+
+		for s.Scan() {
+			_, payload, _ := mysql.Packet(s.Bytes())
+			if len(payload) == 0 || payload[0] != mysql.ComQuery {
+				return
+			}
+			if strings.HasPrefix(string(payload[1:]), "SELECT") {
+				c.Write(bytes.Join(mysqlResultSet(), nil))
+			} else {
+				c.Write(mysql.NewPacket(1, []byte{mysql.OK, 1, 0, 2, 0, 0, 0}))
+			}
+		}
+	})
+}
+
+func TestMySQLProxy_Proxy(t *testing.T) {
+	mysqlPort := 7757
+	setupLocalMySQL(mysqlPort)
+
+	failer := &symptom.MySQLSymptom{
+		Error: 1213,
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Query: "^UPDATE"},
+		},
+	}
+	failer.Setup()
+	truncater := &symptom.MySQLSymptom{
+		MaxRows: 1,
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Query: "^SELECT"},
+		},
+	}
+	truncater.Setup()
+
+	port := 7758
+	p := MySQLProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: mysqlPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{failer, truncater})
+
+	waitForPort(mysqlPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	expect := func(want ...[]byte) {
+		w := bytes.Join(want, nil)
+		buf := make([]byte, len(w))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Want %q, got %q %v", w, buf, err)
+		}
+		if !bytes.Equal(buf, w) {
+			t.Fatalf("Want %q, got %q", w, buf)
+		}
+	}
+
+	expect(mysqlGreeting())
+	response := make([]byte, 32)
+	binary.LittleEndian.PutUint32(response, mysql.ClientProtocol41)
+	conn.Write(mysql.NewPacket(1, append(response, "muxy\x00\x00"...)))
+	expect(mysql.NewPacket(2, []byte{mysql.OK, 0, 0, 2, 0, 0, 0}))
+
+	failure := mysql.NewError(1, 1213, "40001", "Deadlock found when trying to get lock; try restarting transaction")
+
+	conn.Write(mysql.NewPacket(0, []byte("\x03UPDATE accounts SET balance = 0")))
+	expect(failure)
+
+	// Truncated result sets end after the last row sent, and errors
+	// for pipelined statements follow them
+	rs := mysqlResultSet()
+	conn.Write(mysql.NewPacket(0, []byte("\x03SELECT n FROM t")))
+	conn.Write(mysql.NewPacket(0, []byte("\x03UPDATE accounts SET balance = 1")))
+	expect(rs[0], rs[1], rs[2], rs[3], mysql.NewPacket(5, []byte{mysql.EOF, 0, 0, 2, 0}), failure)
+}
+
+func TestMySQLCodec_PreparedStatement(t *testing.T) {
+	c := &mysqlCodec{phase: mysqlCommand, statements: map[uint32]string{}}
+
+	prepare, expecting := c.decode(mysql.NewPacket(0, []byte("\x16SELECT ?")), true, nil)
+	if !expecting || prepare.Command != "COM_STMT_PREPARE" || prepare.Fields["sql"] != "SELECT ?" {
+		t.Fatal("Want COM_STMT_PREPARE of SELECT ?, got", prepare)
+	}
+
+	// Statement 7, with one column and one parameter
+	replies := [][]byte{
+		mysql.NewPacket(1, []byte{mysql.OK, 7, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0}),
+		mysql.NewPacket(2, []byte("\x03def\x00\x00\x00\x01?\x00")),
+		mysql.NewPacket(3, []byte{mysql.EOF, 0, 0, 2, 0}),
+		mysql.NewPacket(4, []byte("\x03def\x00\x00\x00\x01n\x00")),
+		mysql.NewPacket(5, []byte{mysql.EOF, 0, 0, 2, 0}),
+	}
+	for i, b := range replies {
+		msg, answered := c.decode(b, false, prepare)
+		if answered != (i == len(replies)-1) {
+			t.Fatalf("Want only the last packet to answer, got %v for %q", answered, msg.Fields["type"])
+		}
+	}
+
+	execute, expecting := c.decode(mysql.NewPacket(0, []byte("\x17\x07\x00\x00\x00\x00\x01\x00\x00\x00")), true, nil)
+	if !expecting || execute.Key != "7" || execute.Fields["sql"] != "SELECT ?" {
+		t.Fatal("Want COM_STMT_EXECUTE of SELECT ?, got", execute)
+	}
+
+	closed, expecting := c.decode(mysql.NewPacket(0, []byte("\x19\x07\x00\x00\x00")), true, nil)
+	if expecting || closed.Fields["sql"] != "SELECT ?" || len(c.statements) != 0 {
+		t.Fatal("Want COM_STMT_CLOSE to forget the statement without a reply, got", closed, c.statements)
+	}
+}
@@ -0,0 +1,233 @@
+package protocol
+
+import (
+	"bufio"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/postgres"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// PostgresProxy implements a PostgreSQL aware TCP proxy. Messages are
+// decoded, so that middlewares can target queries by their SQL or
+// prepared statement name.
+type PostgresProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest message that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultPostgresMaxSize is the default largest message, matching the
+// largest field value Postgres supports
+const defaultPostgresMaxSize = 1024 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &PostgresProxy{}, nil
+	}, "postgres_proxy")
+}
+
+// Setup the Postgres proxy
+func (p *PostgresProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultPostgresMaxSize
+	}
+
+	p.setup("Postgres Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		if request {
+			return postgres.SplitFrontend()
+		}
+		return postgres.SplitBackend()
+	}, func() codec {
+		return &postgresCodec{
+			startup:    true,
+			status:     'I',
+			statements: map[string]string{},
+			portals:    map[string]string{},
+		}
+	}, middleware)
+}
+
+// postgresCodec decodes frontend and backend messages, tracking prepared
+// statements and the transaction status of the session
+type postgresCodec struct {
+	// startup is true until the client has sent its StartupMessage
+	startup bool
+
+	// encrypted is true once the session has switched to SSL or GSSAPI
+	encrypted bool
+
+	// status is the transaction status of the last ReadyForQuery
+	status byte
+
+	// statements are the SQL of each prepared statement, and portals
+	// the prepared statement each portal is bound to
+	statements map[string]string
+	portals    map[string]string
+
+	// cycle is the last Execute of the extended query cycle in progress
+	cycle *muxy.Message
+}
+
+// decode decodes a frontend or backend message. Requests are answered when
+// the server is next ready for a query, so the messages of an extended query
+// are answered along with the Sync that ends it.
+func (c *postgresCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if c.encrypted {
+		return nil, false
+	}
+	if request {
+		return c.decodeFrontend(b)
+	}
+	return c.decodeBackend(b, req)
+}
+
+// message creates a message with the given command
+func (c *postgresCodec) message(command string) *muxy.Message {
+	return &muxy.Message{
+		Protocol: "postgres",
+		Command:  command,
+		Fields:   map[string]string{"status": string(c.status)},
+	}
+}
+
+func (c *postgresCodec) decodeFrontend(b []byte) (*muxy.Message, bool) {
+	if c.startup {
+		code, params, ok := postgres.Startup(b)
+		if !ok {
+			log.Debug("Postgres Proxy unable to decode startup message")
+			return nil, false
+		}
+
+		switch code {
+		case postgres.SSLRequest:
+			return c.message("SSLRequest"), true
+		case postgres.GSSENCRequest:
+			return c.message("GSSENCRequest"), true
+		case postgres.CancelRequest:
+			c.startup = false
+			return c.message("CancelRequest"), false
+		}
+
+		c.startup = false
+		msg := c.message("StartupMessage")
+		msg.Key = params["database"]
+		msg.Fields["user"] = params["user"]
+		msg.Fields["database"] = params["database"]
+		return msg, true
+	}
+
+	t, body, ok := postgres.Typed(b)
+	if !ok {
+		log.Debug("Postgres Proxy unable to decode message")
+		return nil, false
+	}
+
+	msg := c.message(postgres.FrontendName(t))
+	switch t {
+	case postgres.Query:
+		msg.Fields["sql"], _ = postgres.String(body)
+		return msg, true
+	case postgres.Parse:
+		name, rest := postgres.String(body)
+		sql, _ := postgres.String(rest)
+		c.statements[name] = sql
+		c.statement(msg, name)
+	case postgres.Bind:
+		portal, rest := postgres.String(body)
+		name, _ := postgres.String(rest)
+		c.portals[portal] = name
+		c.statement(msg, name)
+		msg.Fields["portal"] = portal
+	case postgres.Execute:
+		portal, _ := postgres.String(body)
+		c.statement(msg, c.portals[portal])
+		msg.Fields["portal"] = portal
+		c.cycle = msg
+	case postgres.Describe, postgres.Close:
+		if len(body) == 0 {
+			break
+		}
+		name, _ := postgres.String(body[1:])
+		if body[0] == 'P' {
+			msg.Fields["portal"] = name
+			name = c.portals[name]
+		}
+		c.statement(msg, name)
+		if t == postgres.Close {
+			if body[0] == 'P' {
+				delete(c.portals, msg.Fields["portal"])
+			} else {
+				delete(c.statements, name)
+			}
+		}
+	case postgres.Sync:
+		// Sync carries the statement executed by the cycle it ends
+		if c.cycle != nil {
+			msg.Key = c.cycle.Key
+			for k, v := range c.cycle.Fields {
+				if k != "status" {
+					msg.Fields[k] = v
+				}
+			}
+			c.cycle = nil
+		}
+		return msg, true
+	case postgres.FunctionCall:
+		return msg, true
+	}
+
+	return msg, false
+}
+
+// statement sets the prepared statement, and its SQL, of msg
+func (c *postgresCodec) statement(msg *muxy.Message, name string) {
+	msg.Key = name
+	msg.Fields["statement"] = name
+	msg.Fields["sql"] = c.statements[name]
+}
+
+func (c *postgresCodec) decodeBackend(b []byte, req *muxy.Message) (*muxy.Message, bool) {
+	msg := &muxy.Message{Protocol: "postgres", Fields: map[string]string{}}
+	if req != nil {
+		msg.Command = req.Command
+		msg.Key = req.Key
+		msg.Pipelined = req.Pipelined
+		for k, v := range req.Fields {
+			msg.Fields[k] = v
+		}
+	}
+
+	// The single byte response to an encryption request
+	if len(b) == 1 && req != nil && (req.Command == "SSLRequest" || req.Command == "GSSENCRequest") {
+		if b[0] != 'N' {
+			c.encrypted = true
+		}
+		msg.Fields["type"] = string(b)
+		return msg, true
+	}
+
+	t, body, ok := postgres.Typed(b)
+	if !ok {
+		log.Debug("Postgres Proxy unable to decode message")
+		return nil, false
+	}
+
+	msg.Fields["type"] = postgres.BackendName(t)
+	switch t {
+	case postgres.ErrorResponse:
+		fields := postgres.ErrorFields(body)
+		msg.Fields["severity"] = fields['S']
+		msg.Fields["sqlstate"] = fields['C']
+	case postgres.ReadyForQuery:
+		if len(body) > 0 {
+			c.status = body[0]
+		}
+		msg.Fields["status"] = string(c.status)
+		return msg, true
+	}
+	return msg, false
+}
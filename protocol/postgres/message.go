@@ -0,0 +1,291 @@
+// Package postgres decodes and encodes the messages of the PostgreSQL
+// frontend/backend protocol, for use by the Postgres Proxy and its Symptoms.
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+)
+
+// Codes identifying the startup messages, which have no type byte
+const (
+	ProtocolVersion3 = 196608
+	CancelRequest    = 80877102
+	SSLRequest       = 80877103
+	GSSENCRequest    = 80877104
+)
+
+// Types of frontend (client) message
+const (
+	Bind         = 'B'
+	Close        = 'C'
+	CopyData     = 'd'
+	CopyDone     = 'c'
+	CopyFail     = 'f'
+	Describe     = 'D'
+	Execute      = 'E'
+	Flush        = 'H'
+	FunctionCall = 'F'
+	Parse        = 'P'
+	Password     = 'p'
+	Query        = 'Q'
+	Sync         = 'S'
+	Terminate    = 'X'
+)
+
+// Types of backend (server) message
+const (
+	Authentication       = 'R'
+	BackendKeyData       = 'K'
+	BindComplete         = '2'
+	CloseComplete        = '3'
+	CommandComplete      = 'C'
+	DataRow              = 'D'
+	EmptyQueryResponse   = 'I'
+	ErrorResponse        = 'E'
+	NoData               = 'n'
+	NoticeResponse       = 'N'
+	NotificationResponse = 'A'
+	ParameterDescription = 't'
+	ParameterStatus      = 'S'
+	ParseComplete        = '1'
+	PortalSuspended      = 's'
+	ReadyForQuery        = 'Z'
+	RowDescription       = 'T'
+)
+
+var frontendNames = map[byte]string{
+	Bind:         "Bind",
+	Close:        "Close",
+	CopyData:     "CopyData",
+	CopyDone:     "CopyDone",
+	CopyFail:     "CopyFail",
+	Describe:     "Describe",
+	Execute:      "Execute",
+	Flush:        "Flush",
+	FunctionCall: "FunctionCall",
+	Parse:        "Parse",
+	Password:     "Password",
+	Query:        "Query",
+	Sync:         "Sync",
+	Terminate:    "Terminate",
+}
+
+var backendNames = map[byte]string{
+	Authentication:       "Authentication",
+	BackendKeyData:       "BackendKeyData",
+	BindComplete:         "BindComplete",
+	CloseComplete:        "CloseComplete",
+	CommandComplete:      "CommandComplete",
+	CopyData:             "CopyData",
+	CopyDone:             "CopyDone",
+	DataRow:              "DataRow",
+	EmptyQueryResponse:   "EmptyQueryResponse",
+	ErrorResponse:        "ErrorResponse",
+	NoData:               "NoData",
+	NoticeResponse:       "NoticeResponse",
+	NotificationResponse: "NotificationResponse",
+	ParameterDescription: "ParameterDescription",
+	ParameterStatus:      "ParameterStatus",
+	ParseComplete:        "ParseComplete",
+	PortalSuspended:      "PortalSuspended",
+	ReadyForQuery:        "ReadyForQuery",
+	RowDescription:       "RowDescription",
+	'G':                  "CopyInResponse",
+	'H':                  "CopyOutResponse",
+	'W':                  "CopyBothResponse",
+	'v':                  "NegotiateProtocolVersion",
+}
+
+// FrontendName returns the name of a frontend message type, e.g. "Query"
+func FrontendName(t byte) string {
+	if name, ok := frontendNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// BackendName returns the name of a backend message type, e.g. "DataRow"
+func BackendName(t byte) string {
+	if name, ok := backendNames[t]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// SplitFrontend returns a bufio.SplitFunc framing the messages sent by a
+// client. Once a connection switches to TLS, data is passed on as it is read.
+func SplitFrontend() bufio.SplitFunc {
+	startup := true
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		// A TLS handshake record follows an accepted SSLRequest
+		if raw || (startup && data[0] == 0x16) {
+			raw = true
+			return len(data), data, nil
+		}
+
+		if !startup {
+			return splitTyped(data, atEOF)
+		}
+
+		if len(data) < 8 {
+			return flush(data, atEOF)
+		}
+		length := int(binary.BigEndian.Uint32(data))
+		if length < 8 {
+			raw = true
+			return len(data), data, nil
+		}
+		if len(data) < length {
+			return flush(data, atEOF)
+		}
+
+		// Encryption requests are followed by another startup message
+		if code := binary.BigEndian.Uint32(data[4:]); code != SSLRequest && code != GSSENCRequest {
+			startup = false
+		}
+		return length, data[:length], nil
+	}
+}
+
+// SplitBackend returns a bufio.SplitFunc framing the messages sent by a
+// server. The single byte responses to encryption requests are framed alone,
+// and once a connection switches to TLS, data is passed on as it is read.
+func SplitBackend() bufio.SplitFunc {
+	start := true
+	raw := false
+
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if len(data) == 0 {
+			return 0, nil, nil
+		}
+		if raw {
+			return len(data), data, nil
+		}
+
+		if start {
+			switch {
+			case data[0] == 'S' || data[0] == 'G':
+				// The server accepted SSL or GSSAPI encryption
+				raw = true
+				return len(data), data, nil
+			case data[0] == 'N' && (len(data) == 1 || data[1] != 0):
+				// The server declined encryption
+				return 1, data[:1], nil
+			}
+			start = false
+		}
+
+		return splitTyped(data, atEOF)
+	}
+}
+
+// splitTyped frames a message with a type byte and length
+func splitTyped(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < 5 {
+		return flush(data, atEOF)
+	}
+	length := int(binary.BigEndian.Uint32(data[1:]))
+	if length < 4 {
+		return len(data), data, nil
+	}
+	if len(data) < length+1 {
+		return flush(data, atEOF)
+	}
+	return length + 1, data[:length+1], nil
+}
+
+// flush requests more data, or passes on a partial message at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Typed splits a message with a type byte into its type and body
+func Typed(b []byte) (byte, []byte, bool) {
+	if len(b) < 5 || int(binary.BigEndian.Uint32(b[1:]))+1 != len(b) {
+		return 0, nil, false
+	}
+	return b[0], b[5:], true
+}
+
+// Startup decodes a startup message into its code, e.g. SSLRequest,
+// and, for the StartupMessage, its parameters such as "user"
+func Startup(b []byte) (uint32, map[string]string, bool) {
+	if len(b) < 8 || int(binary.BigEndian.Uint32(b)) != len(b) {
+		return 0, nil, false
+	}
+	code := binary.BigEndian.Uint32(b[4:])
+	if code != ProtocolVersion3 {
+		return code, nil, true
+	}
+
+	params := map[string]string{}
+	body := b[8:]
+	for len(body) > 0 && body[0] != 0 {
+		var name, value string
+		name, body = String(body)
+		value, body = String(body)
+		params[name] = value
+	}
+	return code, params, true
+}
+
+// String reads a null terminated string from b, returning it and the
+// remainder of b
+func String(b []byte) (string, []byte) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return string(b), nil
+	}
+	return string(b[:i]), b[i+1:]
+}
+
+// ErrorFields decodes the fields of an ErrorResponse or NoticeResponse
+// body, keyed by their type, e.g. 'C' for the SQLSTATE code
+func ErrorFields(body []byte) map[byte]string {
+	fields := map[byte]string{}
+	for len(body) > 0 && body[0] != 0 {
+		t := body[0]
+		fields[t], body = String(body[1:])
+	}
+	return fields
+}
+
+// message encodes a message with a type byte
+func message(t byte, body []byte) []byte {
+	b := make([]byte, 5, 5+len(body))
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:], uint32(4+len(body)))
+	return append(b, body...)
+}
+
+// NewErrorResponse encodes an ErrorResponse
+func NewErrorResponse(severity string, code string, msg string) []byte {
+	var body bytes.Buffer
+	for _, f := range []struct {
+		t byte
+		v string
+	}{{'S', severity}, {'V', severity}, {'C', code}, {'M', msg}} {
+		body.WriteByte(f.t)
+		body.WriteString(f.v)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0)
+	return message(ErrorResponse, body.Bytes())
+}
+
+// NewReadyForQuery encodes a ReadyForQuery with the transaction status
+// given: 'I' (idle), 'T' (in a transaction) or 'E' (in a failed transaction)
+func NewReadyForQuery(status byte) []byte {
+	return message(ReadyForQuery, []byte{status})
+}
@@ -0,0 +1,106 @@
+package postgres
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func startup(code uint32, params ...string) []byte {
+	var body bytes.Buffer
+	for _, p := range params {
+		body.WriteString(p)
+		body.WriteByte(0)
+	}
+	if len(params) > 0 {
+		body.WriteByte(0)
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(8+body.Len()))
+	binary.BigEndian.PutUint32(b[4:], code)
+	return append(b, body.Bytes()...)
+}
+
+func query(sql string) []byte {
+	return message(Query, append([]byte(sql), 0))
+}
+
+func TestSplitFrontend(t *testing.T) {
+	want := [][]byte{
+		startup(SSLRequest),
+		startup(ProtocolVersion3, "user", "muxy", "database", "test"),
+		query("SELECT 1"),
+		message(Sync, nil),
+	}
+	got := prototest.Scan(SplitFrontend(), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	// TLS is passed on as is
+	tls := append(startup(SSLRequest), 0x16, 0x03, 0x01, 0x00)
+	got = prototest.Scan(SplitFrontend(), tls)
+	if len(got) != 5 || !bytes.Equal(got[0], startup(SSLRequest)) {
+		t.Fatalf("Want SSLRequest then raw bytes, got %q", got)
+	}
+}
+
+func TestSplitBackend(t *testing.T) {
+	ready := NewReadyForQuery('I')
+	got := prototest.Scan(SplitBackend(), append([]byte("N"), ready...))
+	want := [][]byte{[]byte("N"), ready}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+
+	got = prototest.Scan(SplitBackend(), []byte("S\x16\x03"))
+	if len(got) != 3 {
+		t.Fatalf("Want raw bytes after SSL is accepted, got %q", got)
+	}
+}
+
+func TestStartup(t *testing.T) {
+	code, params, ok := Startup(startup(ProtocolVersion3, "user", "muxy", "database", "test"))
+	if !ok || code != ProtocolVersion3 || params["user"] != "muxy" || params["database"] != "test" {
+		t.Fatal("Want StartupMessage for muxy@test, got", code, params, ok)
+	}
+
+	code, _, ok = Startup(startup(CancelRequest))
+	if !ok || code != CancelRequest {
+		t.Fatal("Want CancelRequest, got", code, ok)
+	}
+
+	if _, _, ok = Startup([]byte{0, 0, 0, 9, 1}); ok {
+		t.Fatal("Want invalid startup message to fail")
+	}
+}
+
+func TestTyped(t *testing.T) {
+	typ, body, ok := Typed(query("SELECT 1"))
+	if !ok || typ != Query || string(body) != "SELECT 1\x00" {
+		t.Fatal("Want Query, got", typ, body, ok)
+	}
+	if FrontendName(typ) != "Query" || BackendName(typ) != "Unknown" {
+		t.Fatal("Want Query frontend message name, got", FrontendName(typ))
+	}
+
+	if _, _, ok := Typed([]byte{'Q', 0, 0, 0, 9}); ok {
+		t.Fatal("Want truncated message to fail")
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	typ, body, ok := Typed(NewErrorResponse("ERROR", "40001", "could not serialize access"))
+	if !ok || typ != ErrorResponse {
+		t.Fatal("Want ErrorResponse, got", typ, ok)
+	}
+
+	fields := ErrorFields(body)
+	want := map[byte]string{'S': "ERROR", 'V': "ERROR", 'C': "40001", 'M': "could not serialize access"}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatal("Want", want, "got", fields)
+	}
+}
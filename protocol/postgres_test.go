@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/postgres"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// pgMessage encodes a message with a type byte
+func pgMessage(t byte, body string) []byte {
+	b := make([]byte, 5)
+	b[0] = t
+	binary.BigEndian.PutUint32(b[1:], uint32(4+len(body)))
+	return append(b, body...)
+}
+
+// setupLocalPostgres starts a fake Postgres server, which trusts every
+// client and completes every query without returning rows
+func setupLocalPostgres(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(postgres.SplitFrontend())
+
+		if !s.Scan() {
+			return
+		}
+		c.Write(pgMessage(postgres.Authentication, "\x00\x00\x00\x00"))
+		c.Write(postgres.NewReadyForQuery('I'))
+
+		for s.Scan() {
+			t, _, _ := postgres.Typed(s.Bytes())
+			switch t {
+			case postgres.Query:
+				c.Write(pgMessage(postgres.CommandComplete, "SELECT 1\x00"))
+				c.Write(postgres.NewReadyForQuery('I'))
+			case postgres.Parse:
+				c.Write(pgMessage(postgres.ParseComplete, ""))
+			case postgres.Bind:
+				c.Write(pgMessage(postgres.BindComplete, ""))
+			case postgres.Execute:
+				c.Write(pgMessage(postgres.CommandComplete, "UPDATE 1\x00"))
+			case postgres.Sync:
+				c.Write(postgres.NewReadyForQuery('I'))
+			}
+		}
+	})
+}
+
+func TestPostgresProxy_Proxy(t *testing.T) {
+	pgPort := 7759
+	setupLocalPostgres(pgPort)
+
+	failer := &symptom.PostgresSymptom{
+		Error: "40001",
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Query: "^UPDATE"},
+		},
+	}
+	failer.Setup()
+
+	port := 7760
+	p := PostgresProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: pgPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{failer})
+
+	waitForPort(pgPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	expect := func(want ...[]byte) {
+		w := bytes.Join(want, nil)
+		buf := make([]byte, len(w))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatalf("Want %q, got %q %v", w, buf, err)
+		}
+		if !bytes.Equal(buf, w) {
+			t.Fatalf("Want %q, got %q", w, buf)
+		}
+	}
+
+	startup := []byte("\x00\x00\x00\x13\x00\x03\x00\x00user\x00muxy\x00\x00")
+	conn.Write(startup)
+	expect(pgMessage(postgres.Authentication, "\x00\x00\x00\x00"), postgres.NewReadyForQuery('I'))
+
+	failure := postgres.NewErrorResponse("ERROR", "40001", "could not serialize access due to concurrent update")
+
+	// Simple queries
+	conn.Write(pgMessage(postgres.Query, "UPDATE accounts SET balance = 0\x00"))
+	expect(failure, postgres.NewReadyForQuery('I'))
+
+	// Extended queries fail just before the server is ready again
+	conn.Write(bytes.Join([][]byte{
+		pgMessage(postgres.Parse, "s1\x00UPDATE accounts SET balance = $1\x00\x00\x00"),
+		pgMessage(postgres.Bind, "\x00s1\x00\x00\x00\x00\x00\x00\x00"),
+		pgMessage(postgres.Execute, "\x00\x00\x00\x00\x00"),
+		pgMessage(postgres.Sync, ""),
+		pgMessage(postgres.Query, "SELECT 1\x00"),
+	}, nil))
+	expect(
+		pgMessage(postgres.ParseComplete, ""),
+		pgMessage(postgres.BindComplete, ""),
+		failure,
+		postgres.NewReadyForQuery('I'),
+		pgMessage(postgres.CommandComplete, "SELECT 1\x00"),
+		postgres.NewReadyForQuery('I'),
+	)
+}
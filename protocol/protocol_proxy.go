@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+)
+
+// ProtocolProxy holds the options shared by the protocol-aware TCP proxies,
+// such as the Redis Proxy, which embed it and run a TCP proxy that splits
+// and decodes the messages of their protocol.
+//
+// It is squashed into the configuration of each proxy, so plugo does not
+// see its tags: setup applies the default Host and checks the mandatory
+// fields instead.
+type ProtocolProxy struct {
+	Port            int    `required:"true"`
+	Host            string `required:"true" default:"localhost"`
+	ProxyHost       string `required:"true" mapstructure:"proxy_host"`
+	ProxyPort       int    `required:"true" mapstructure:"proxy_port"`
+	NaglesAlgorithm bool   `mapstructure:"nagles_algorithm"`
+	HexOutput       bool   `mapstructure:"hex_output"`
+
+	// MaxConnections limits the number of concurrent connections. Zero is unlimited
+	MaxConnections int `required:"false" mapstructure:"max_connections"`
+
+	// Overflow is the behaviour once MaxConnections is reached:
+	// queue (default), refuse, hang or close
+	Overflow string `required:"false" mapstructure:"overflow"`
+
+	name string
+	tcp  *TCPProxy
+}
+
+// setup creates and sets up the TCP proxy of the named protocol-aware
+// proxy. Messages are split by splitter, or by framing when it is nil, and
+// decoded for middlewares by the codec created for each connection, if any.
+func (p *ProtocolProxy) setup(name string, framing FramingConfig, splitter func(request bool) bufio.SplitFunc, newCodec func() codec, middleware []muxy.Middleware) {
+	if p.Host == "" {
+		p.Host = "localhost"
+	}
+	switch {
+	case p.Port == 0:
+		check(fmt.Errorf("%s: port has not been set", name))
+	case p.ProxyHost == "":
+		check(fmt.Errorf("%s: proxy_host has not been set", name))
+	case p.ProxyPort == 0:
+		check(fmt.Errorf("%s: proxy_port has not been set", name))
+	}
+
+	p.name = name
+	p.tcp = &TCPProxy{
+		Port:            p.Port,
+		Host:            p.Host,
+		ProxyHost:       p.ProxyHost,
+		ProxyPort:       p.ProxyPort,
+		NaglesAlgorithm: p.NaglesAlgorithm,
+		HexOutput:       p.HexOutput,
+		PacketSize:      4096,
+		Framing:         framing,
+		MaxConnections:  p.MaxConnections,
+		Overflow:        p.Overflow,
+		splitter:        splitter,
+		codec:           newCodec,
+	}
+	p.tcp.Setup(middleware)
+}
+
+// Teardown the proxy
+func (p *ProtocolProxy) Teardown() {
+	p.tcp.Teardown()
+}
+
+// Proxy runs the proxy
+func (p *ProtocolProxy) Proxy() {
+	log.Info("%s proxying to %s:%d", p.name, p.ProxyHost, p.ProxyPort)
+	p.tcp.Proxy()
+}
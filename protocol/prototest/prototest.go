@@ -0,0 +1,48 @@
+// Package prototest provides helpers for the tests of the protocol
+// proxies and their decoders.
+package prototest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"testing/iotest"
+)
+
+// Scan splits in into messages with split, reading a byte at a time so
+// that messages are assembled across reads
+func Scan(split bufio.SplitFunc, in []byte) [][]byte {
+	s := bufio.NewScanner(iotest.OneByteReader(bytes.NewReader(in)))
+	s.Split(split)
+	var out [][]byte
+	for s.Scan() {
+		out = append(out, append([]byte(nil), s.Bytes()...))
+	}
+	return out
+}
+
+// Serve starts a fake server on port of localhost, which handles each
+// connection it accepts with handle, closing it once handle returns
+func Serve(port int, handle func(c net.Conn)) {
+	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		defer l.Close()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Fatal(err)
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				handle(c)
+			}(conn)
+		}
+	}()
+}
@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"bufio"
+	"strconv"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/redis"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// RedisProxy implements a Redis aware TCP proxy. Commands and replies are
+// decoded, so that middlewares can target them by command and key.
+type RedisProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest command or reply that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultRedisMaxSize is the default largest command or reply, matching
+// the proto-max-bulk-len default of Redis
+const defaultRedisMaxSize = 512 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &RedisProxy{}, nil
+	}, "redis_proxy")
+}
+
+// Setup the Redis proxy
+func (p *RedisProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultRedisMaxSize
+	}
+
+	p.setup("Redis Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		if request {
+			return redis.SplitRequest
+		}
+		return redis.SplitReply
+	}, func() codec {
+		return &redisCodec{version: 2}
+	}, middleware)
+}
+
+// redisCodec decodes RESP commands and replies, tracking the protocol
+// version negotiated by HELLO
+type redisCodec struct {
+	version int
+	hello   int
+}
+
+// decode decodes a command, into a *redis.Command, or a reply, into
+// a redis.Value
+func (c *redisCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if request {
+		v, err := redis.ParseRequest(b)
+		if err != nil {
+			log.Debug("Redis Proxy unable to decode command: %s", err.Error())
+			return nil, true
+		}
+		cmd, err := redis.ParseCommand(v)
+		if err != nil {
+			log.Debug("Redis Proxy unable to decode command: %s", err.Error())
+			return nil, true
+		}
+
+		if cmd.Name == "HELLO" && len(cmd.Args) > 0 {
+			c.hello, _ = strconv.Atoi(cmd.Args[0])
+		}
+
+		return &muxy.Message{
+			Protocol: "redis",
+			Command:  cmd.Name,
+			Key:      cmd.Key(),
+			Fields:   map[string]string{"resp": strconv.Itoa(c.version)},
+			Value:    cmd,
+		}, true
+	}
+
+	v, err := redis.Parse(b)
+	if err != nil {
+		log.Debug("Redis Proxy unable to decode reply: %s", err.Error())
+		return nil, true
+	}
+
+	// Pushes, and RESP2 Pub/Sub messages, are not replies to a command
+	if v.Type == redis.Push || isPubSubMessage(v) {
+		return &muxy.Message{Protocol: "redis", Value: v}, false
+	}
+
+	msg := &muxy.Message{Protocol: "redis", Value: v}
+	if req != nil {
+		msg.Command = req.Command
+		msg.Key = req.Key
+		msg.Fields = req.Fields
+		msg.Pipelined = req.Pipelined
+
+		if req.Command == "HELLO" && v.Type != redis.Error && c.hello > 0 {
+			c.version = c.hello
+		}
+	}
+	return msg, true
+}
+
+// isPubSubMessage returns true for messages delivered to RESP2 subscribers
+func isPubSubMessage(v redis.Value) bool {
+	if v.Type != redis.Array || len(v.Elems) == 0 {
+		return false
+	}
+	switch v.Elems[0].Str {
+	case "message", "pmessage", "smessage":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,131 @@
+package redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Command is a decoded request from a client
+type Command struct {
+	// Name of the command in upper case, e.g. "GET"
+	Name string
+
+	// Args are the arguments that follow the name
+	Args []string
+
+	// Keys are the keys the command operates on
+	Keys []string
+}
+
+// keyless are the commands that do not operate on keys
+var keyless = map[string]bool{
+	"ACL": true, "AUTH": true, "BGREWRITEAOF": true, "BGSAVE": true,
+	"CLIENT": true, "CLUSTER": true, "COMMAND": true, "CONFIG": true,
+	"DBSIZE": true, "DEBUG": true, "DISCARD": true, "ECHO": true,
+	"EXEC": true, "FLUSHALL": true, "FLUSHDB": true, "FUNCTION": true,
+	"HELLO": true, "INFO": true, "KEYS": true, "LASTSAVE": true,
+	"LATENCY": true, "MODULE": true, "MONITOR": true, "MULTI": true,
+	"PING": true, "PSUBSCRIBE": true, "PUBLISH": true, "PUBSUB": true,
+	"PUNSUBSCRIBE": true, "QUIT": true, "RANDOMKEY": true, "READONLY": true,
+	"READWRITE": true, "REPLICAOF": true, "RESET": true, "ROLE": true,
+	"SAVE": true, "SCAN": true, "SCRIPT": true, "SELECT": true,
+	"SHUTDOWN": true, "SLAVEOF": true, "SLOWLOG": true, "SPUBLISH": true,
+	"SSUBSCRIBE": true, "SUBSCRIBE": true, "SUNSUBSCRIBE": true,
+	"SWAPDB": true, "TIME": true, "UNSUBSCRIBE": true, "UNWATCH": true,
+	"WAIT": true,
+}
+
+// ParseCommand decodes a request, which must be an array of strings
+func ParseCommand(v Value) (*Command, error) {
+	if v.Type != Array || len(v.Elems) == 0 {
+		return nil, fmt.Errorf("request is not a command")
+	}
+
+	args := make([]string, len(v.Elems))
+	for i, elem := range v.Elems {
+		if elem.Type != BulkString && elem.Type != SimpleString {
+			return nil, fmt.Errorf("command argument %d is not a string", i)
+		}
+		args[i] = elem.Str
+	}
+
+	c := &Command{Name: strings.ToUpper(args[0]), Args: args[1:]}
+	c.Keys = keys(c.Name, c.Args)
+	return c, nil
+}
+
+// Key returns the first key of the command, if it has one
+func (c *Command) Key() string {
+	if len(c.Keys) == 0 {
+		return ""
+	}
+	return c.Keys[0]
+}
+
+// keys returns the keys in the arguments of the named command
+func keys(name string, args []string) []string {
+	if keyless[name] || len(args) == 0 {
+		return nil
+	}
+
+	switch name {
+	case "DEL", "UNLINK", "EXISTS", "MGET", "TOUCH", "WATCH", "PFCOUNT",
+		"SINTER", "SUNION", "SDIFF":
+		return args
+	case "MSET", "MSETNX":
+		var keys []string
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+		}
+		return keys
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX":
+		return args[:len(args)-1]
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		if len(args) < 2 {
+			return nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 || len(args) < 2+n {
+			return nil
+		}
+		return args[2 : 2+n]
+	case "XREAD", "XREADGROUP":
+		for i, arg := range args {
+			if strings.ToUpper(arg) == "STREAMS" {
+				streams := args[i+1:]
+				return streams[:len(streams)/2]
+			}
+		}
+		return nil
+	}
+
+	return args[:1]
+}
+
+// Slot returns the Redis Cluster hash slot of key
+func Slot(key string) int {
+	// Only the hash tag, if any, is hashed
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % 16384)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
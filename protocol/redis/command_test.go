@@ -0,0 +1,65 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+)
+
+func command(args ...string) Value {
+	v := Value{Type: Array}
+	for _, arg := range args {
+		v.Elems = append(v.Elems, Value{Type: BulkString, Str: arg})
+	}
+	return v
+}
+
+func TestParseCommand(t *testing.T) {
+	testCases := []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"get", "foo"}, []string{"foo"}},
+		{[]string{"PING"}, nil},
+		{[]string{"SELECT", "1"}, nil},
+		{[]string{"MGET", "a", "b"}, []string{"a", "b"}},
+		{[]string{"MSET", "a", "1", "b", "2"}, []string{"a", "b"}},
+		{[]string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"EVAL", "return 1", "2", "a", "b", "c"}, []string{"a", "b"}},
+		{[]string{"EVAL", "return 1", "0"}, nil},
+		{[]string{"XREAD", "COUNT", "2", "STREAMS", "s1", "s2", "0", "0"}, []string{"s1", "s2"}},
+	}
+
+	for _, tc := range testCases {
+		cmd, err := ParseCommand(command(tc.args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cmd.Keys, tc.keys) {
+			t.Fatal("Want keys", tc.keys, "for", tc.args, "got", cmd.Keys)
+		}
+	}
+
+	cmd, _ := ParseCommand(command("get", "foo"))
+	if cmd.Name != "GET" || cmd.Key() != "foo" {
+		t.Fatal("Want GET foo, got", cmd.Name, cmd.Key())
+	}
+
+	if _, err := ParseCommand(Value{Type: SimpleString, Str: "OK"}); err == nil {
+		t.Fatal("Want error for non array command, got nil")
+	}
+}
+
+func TestSlot(t *testing.T) {
+	testCases := map[string]int{
+		"foo":             12182,
+		"123456789":       12739,
+		"{user1000}.a":    Slot("user1000"),
+		"{user1000}.b{x}": Slot("user1000"),
+	}
+
+	for key, want := range testCases {
+		if got := Slot(key); got != want {
+			t.Fatal("Want slot", want, "for", key, "got", got)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Package redis decodes and encodes the Redis Serialization Protocol
+// (RESP2 and RESP3), for use by the Redis Proxy and its Symptoms.
+package redis
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Types of RESP value, identified by their first byte
+const (
+	SimpleString   = '+'
+	Error          = '-'
+	Integer        = ':'
+	BulkString     = '$'
+	Array          = '*'
+	Null           = '_'
+	Boolean        = '#'
+	Double         = ','
+	BigNumber      = '('
+	BulkError      = '!'
+	VerbatimString = '='
+	Map            = '%'
+	Set            = '~'
+	Attribute      = '|'
+	Push           = '>'
+)
+
+// errIncomplete is returned when more data is needed to decode a value
+var errIncomplete = errors.New("incomplete RESP value")
+
+// Value is a decoded RESP value
+type Value struct {
+	// Type is the first byte of the value, e.g. BulkString
+	Type byte
+
+	// Str is the content of string, error and number values
+	Str string
+
+	// Int is the value of Integer values
+	Int int64
+
+	// Elems are the elements of aggregate values. Maps hold
+	// alternating keys and values.
+	Elems []Value
+
+	// IsNull is true for the Null type, and RESP2 null bulk strings and arrays
+	IsNull bool
+}
+
+// Parse decodes a single, complete RESP value from b
+func Parse(b []byte) (Value, error) {
+	v, n, err := parse(b, 0)
+	if err == errIncomplete {
+		return v, fmt.Errorf("truncated RESP value")
+	}
+	if err == nil && n != len(b) {
+		err = fmt.Errorf("unexpected data after RESP value")
+	}
+	return v, err
+}
+
+// ParseRequest decodes a request from a client, which is either an array
+// of bulk strings or an inline command
+func ParseRequest(b []byte) (Value, error) {
+	if len(b) > 0 && b[0] != Array {
+		return parseInline(b), nil
+	}
+	return Parse(b)
+}
+
+// SplitRequest is a bufio.SplitFunc framing each request sent by a client
+func SplitRequest(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) > 0 && data[0] != Array {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			return i + 1, data[:i+1], nil
+		}
+		return flush(data, atEOF)
+	}
+	return SplitReply(data, atEOF)
+}
+
+// SplitReply is a bufio.SplitFunc framing each value sent by a server
+func SplitReply(data []byte, atEOF bool) (int, []byte, error) {
+	_, n, err := parse(data, 0)
+	switch err {
+	case nil:
+		return n, data[:n], nil
+	case errIncomplete:
+		return flush(data, atEOF)
+	}
+
+	// Pass on anything that cannot be decoded as is
+	return len(data), data, nil
+}
+
+// flush requests more data, or passes on a partial value at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// parseInline decodes an inline command, e.g. "PING\r\n"
+func parseInline(b []byte) Value {
+	v := Value{Type: Array}
+	for _, arg := range strings.Fields(string(b)) {
+		v.Elems = append(v.Elems, Value{Type: BulkString, Str: arg})
+	}
+	return v
+}
+
+// line reads a CRLF terminated line starting at pos, returning it and
+// the position following it
+func line(b []byte, pos int) (string, int, error) {
+	i := bytes.Index(b[pos:], []byte("\r\n"))
+	if i < 0 {
+		return "", 0, errIncomplete
+	}
+	return string(b[pos : pos+i]), pos + i + 2, nil
+}
+
+// parse decodes the value starting at pos, returning it and the position
+// following it
+func parse(b []byte, pos int) (Value, int, error) {
+	if pos >= len(b) {
+		return Value{}, 0, errIncomplete
+	}
+
+	v := Value{Type: b[pos]}
+	s, next, err := line(b, pos+1)
+	if err != nil {
+		return v, 0, err
+	}
+
+	switch v.Type {
+	case SimpleString, Error, Boolean, Double, BigNumber:
+		v.Str = s
+		return v, next, nil
+	case Null:
+		v.IsNull = true
+		return v, next, nil
+	case Integer:
+		v.Int, err = strconv.ParseInt(s, 10, 64)
+		v.Str = s
+		return v, next, err
+	case BulkString, BulkError, VerbatimString:
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			return v, 0, fmt.Errorf("invalid RESP length '%s'", s)
+		}
+		if size < 0 {
+			v.IsNull = true
+			return v, next, nil
+		}
+		if len(b) < next+size+2 {
+			return v, 0, errIncomplete
+		}
+		v.Str = string(b[next : next+size])
+		return v, next + size + 2, nil
+	case Array, Set, Push, Map, Attribute:
+		count, err := strconv.Atoi(s)
+		if err != nil {
+			return v, 0, fmt.Errorf("invalid RESP length '%s'", s)
+		}
+		if count < 0 {
+			v.IsNull = true
+			return v, next, nil
+		}
+		if v.Type == Map || v.Type == Attribute {
+			count *= 2
+		}
+		for i := 0; i < count; i++ {
+			var elem Value
+			elem, next, err = parse(b, next)
+			if err != nil {
+				return v, 0, err
+			}
+			v.Elems = append(v.Elems, elem)
+		}
+
+		// Attributes annotate the value that follows them
+		if v.Type == Attribute {
+			return parse(b, next)
+		}
+		return v, next, nil
+	}
+
+	return v, 0, fmt.Errorf("unknown RESP type '%c'", v.Type)
+}
+
+// Encode encodes v in RESP
+func Encode(v Value) []byte {
+	var b bytes.Buffer
+	encode(&b, v)
+	return b.Bytes()
+}
+
+func encode(b *bytes.Buffer, v Value) {
+	b.WriteByte(v.Type)
+
+	switch v.Type {
+	case Null:
+	case Integer:
+		b.WriteString(strconv.FormatInt(v.Int, 10))
+	case BulkString, BulkError, VerbatimString:
+		if v.IsNull {
+			b.WriteString("-1")
+			break
+		}
+		fmt.Fprintf(b, "%d\r\n%s", len(v.Str), v.Str)
+	case Array, Set, Push, Map, Attribute:
+		if v.IsNull {
+			b.WriteString("-1")
+			break
+		}
+		count := len(v.Elems)
+		if v.Type == Map || v.Type == Attribute {
+			count /= 2
+		}
+		fmt.Fprintf(b, "%d\r\n", count)
+		for _, elem := range v.Elems {
+			encode(b, elem)
+		}
+		return
+	default:
+		b.WriteString(v.Str)
+	}
+	b.WriteString("\r\n")
+}
+
+// ErrorReply returns an error reply with the given message,
+// e.g. "ERR unknown command"
+func ErrorReply(msg string) []byte {
+	return Encode(Value{Type: Error, Str: strings.Replace(msg, "\r\n", " ", -1)})
+}
+
+// NilReply returns a null reply for the given protocol version
+func NilReply(version int) []byte {
+	if version >= 3 {
+		return Encode(Value{Type: Null, IsNull: true})
+	}
+	return Encode(Value{Type: BulkString, IsNull: true})
+}
@@ -0,0 +1,101 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func TestParse(t *testing.T) {
+	testCases := map[string]Value{
+		"+OK\r\n":                    Value{Type: SimpleString, Str: "OK"},
+		"-ERR oops\r\n":              Value{Type: Error, Str: "ERR oops"},
+		":42\r\n":                    Value{Type: Integer, Str: "42", Int: 42},
+		"$3\r\nfoo\r\n":              Value{Type: BulkString, Str: "foo"},
+		"$-1\r\n":                    Value{Type: BulkString, IsNull: true},
+		"*-1\r\n":                    Value{Type: Array, IsNull: true},
+		"_\r\n":                      Value{Type: Null, IsNull: true},
+		"#t\r\n":                     Value{Type: Boolean, Str: "t"},
+		"$4\r\na\r\nb\r\n":           Value{Type: BulkString, Str: "a\r\nb"},
+		"|1\r\n+ttl\r\n:3\r\n:1\r\n": Value{Type: Integer, Str: "1", Int: 1},
+		"*2\r\n$3\r\nfoo\r\n*1\r\n:1\r\n": Value{Type: Array, Elems: []Value{
+			Value{Type: BulkString, Str: "foo"},
+			Value{Type: Array, Elems: []Value{Value{Type: Integer, Str: "1", Int: 1}}},
+		}},
+		"%1\r\n+a\r\n:1\r\n": Value{Type: Map, Elems: []Value{
+			Value{Type: SimpleString, Str: "a"},
+			Value{Type: Integer, Str: "1", Int: 1},
+		}},
+	}
+
+	for in, want := range testCases {
+		v, err := Parse([]byte(in))
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", in, err)
+		}
+		if !reflect.DeepEqual(v, want) {
+			t.Fatal("Want", want, "got", v)
+		}
+	}
+
+	for _, in := range []string{"$3\r\nfo", "*2\r\n:1\r\n", "?\r\n", ":1\r\n:2\r\n"} {
+		if _, err := Parse([]byte(in)); err == nil {
+			t.Fatalf("Want error parsing %q, got nil", in)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	v, err := ParseRequest([]byte("set foo  bar\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := ParseCommand(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Name != "SET" || !reflect.DeepEqual(cmd.Args, []string{"foo", "bar"}) {
+		t.Fatal("Want SET foo bar, got", cmd)
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for _, in := range []string{
+		"+OK\r\n",
+		":-7\r\n",
+		"$3\r\nfoo\r\n",
+		"$-1\r\n",
+		"_\r\n",
+		"*2\r\n$3\r\nfoo\r\n%1\r\n+a\r\n:1\r\n",
+	} {
+		v, _ := Parse([]byte(in))
+		if got := string(Encode(v)); got != in {
+			t.Fatalf("Want %q, got %q", in, got)
+		}
+	}
+
+	if got := string(ErrorReply("ERR bad\r\nthing")); got != "-ERR bad thing\r\n" {
+		t.Fatalf("Want single line error, got %q", got)
+	}
+	if got := string(NilReply(2)); got != "$-1\r\n" {
+		t.Fatalf("Want RESP2 nil, got %q", got)
+	}
+	if got := string(NilReply(3)); got != "_\r\n" {
+		t.Fatalf("Want RESP3 nil, got %q", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	requests := prototest.Scan(SplitRequest, []byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\nPING\r\n*1\r\n$4\r\nPING\r\n"))
+	want := [][]byte{[]byte("*2\r\n$3\r\nGET\r\n$1\r\na\r\n"), []byte("PING\r\n"), []byte("*1\r\n$4\r\nPING\r\n")}
+	if !reflect.DeepEqual(requests, want) {
+		t.Fatalf("Want %q, got %q", want, requests)
+	}
+
+	replies := prototest.Scan(SplitReply, []byte("+OK\r\n*2\r\n$1\r\na\r\n$-1\r\n>2\r\n+a\r\n+b\r\n$3\r\nab"))
+	want = [][]byte{[]byte("+OK\r\n"), []byte("*2\r\n$1\r\na\r\n$-1\r\n"), []byte(">2\r\n+a\r\n+b\r\n"), []byte("$3\r\nab")}
+	if !reflect.DeepEqual(replies, want) {
+		t.Fatalf("Want %q, got %q", want, replies)
+	}
+}
@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/protocol/redis"
+)
+
+// setupLocalRedis starts a fake Redis server, which replies to GET with
+// the key, and to anything else with +OK
+func setupLocalRedis(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		s := bufio.NewScanner(c)
+		s.Split(redis.SplitRequest)
+		for s.Scan() {
+			v, _ := redis.ParseRequest(s.Bytes())
+			cmd, err := redis.ParseCommand(v)
+			reply := "+OK\r\n"
+			if err == nil && cmd.Name == "GET" {
+				reply = string(redis.Encode(redis.Value{Type: redis.BulkString, Str: cmd.Key()}))
+			}
+			io.WriteString(c, reply)
+		}
+	})
+}
+
+// redisFaker answers GET b with an error, and drops the reply to GET c
+type redisFaker struct{}
+
+func (m *redisFaker) Setup()    {}
+func (m *redisFaker) Teardown() {}
+func (m *redisFaker) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Message == nil {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && ctx.Message.Key == "b":
+		ctx.Bytes = nil
+		ctx.Connection.Reply = redis.ErrorReply("ERR b")
+	case e == muxy.EventPostDispatch && ctx.Message.Key == "c":
+		ctx.Bytes = nil
+	}
+}
+
+func TestRedisProxy_Proxy(t *testing.T) {
+	redisPort := 7761
+	setupLocalRedis(redisPort)
+
+	port := 7762
+	faker := &redisFaker{}
+	p := RedisProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: redisPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{faker})
+
+	waitForPort(redisPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Pipeline commands, answered by the target, on its behalf, or not at all
+	io.WriteString(conn, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n*2\r\n$3\r\nGET\r\n$1\r\nb\r\n*2\r\n$3\r\nGET\r\n$1\r\nc\r\n"+
+		"*2\r\n$3\r\nGET\r\n$1\r\nb\r\nPING\r\n")
+
+	want := "$1\r\na\r\n-ERR b\r\n-ERR b\r\n+OK\r\n"
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal("Want replies", want, "got error", err, "after", string(buf))
+	}
+	if string(buf) != want {
+		t.Fatalf("Want %q, got %q", want, buf)
+	}
+
+	// A command outside a pipeline is answered immediately
+	io.WriteString(conn, "GET b\r\n")
+	buf = make([]byte, len("-ERR b\r\n"))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "-ERR b\r\n" {
+		t.Fatalf("Want error reply, got %q %v", buf, err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mefellows/muxy/log"
@@ -21,6 +22,9 @@ import (
 // Since it has handle to the response object, it can manipulate the content
 type FilterFunc func(*http.Request, *http.Response)
 
+// exchanges counts the requests proxied, numbering the exchange of each
+var exchanges uint64
+
 // onExitFlushLoop is a callback set by tests to detect the state of the
 // flushLoop() goroutine.
 var onExitFlushLoop func()
@@ -81,11 +85,11 @@ func NewSingleHostReverseProxy(target *url.URL) *ReverseProxy {
 	return &ReverseProxy{Director: director}
 }
 
+// copyHeader copies headers, keeping the case of their keys, which
+// middlewares may set other than canonically
 func copyHeader(dst, src http.Header) {
 	for k, vv := range src {
-		for _, v := range vv {
-			dst.Add(k, v)
-		}
+		dst[k] = append(dst[k], vv...)
 	}
 }
 
@@ -191,16 +195,27 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Fire Pre-dispatch middleware event
-	ctx := &muxy.Context{Request: outreq}
+	exchange := atomic.AddUint64(&exchanges, 1)
+	ctx := &muxy.Context{Request: outreq, ResponseWriter: rw, Exchange: exchange}
 	for _, middleware := range p.Middleware {
 		middleware.HandleEvent(muxy.EventPreDispatch, ctx)
 	}
-	res, err := transport.RoundTrip(outreq)
-	if err != nil {
-		log.Error("http: proxy error: %v", err)
-		rw.WriteHeader(http.StatusInternalServerError)
+	if ctx.Hijacked {
 		return
 	}
+
+	// A middleware may respond in place of the target, in which case the
+	// request is never sent
+	res := ctx.Response
+	if res == nil {
+		var err error
+		res, err = transport.RoundTrip(outreq)
+		if err != nil {
+			log.Error("http: proxy error: %v", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
 	defer res.Body.Close()
 
 	// Fire Post-dispatch middleware event
@@ -209,11 +224,15 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		Response:       res,
 		ResponseWriter: rw,
 		Bytes:          nil,
+		Exchange:       exchange,
 	}
 
 	for _, middleware := range p.Middleware {
 		middleware.HandleEvent(muxy.EventPostDispatch, ctx)
 	}
+	if ctx.Hijacked {
+		return
+	}
 
 	copyHeader(rw.Header(), res.Header)
 
@@ -228,22 +247,27 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	rw.WriteHeader(res.StatusCode)
-	if len(res.Trailer) > 0 {
+	if len(res.Trailer) > 0 || ctx.Flush {
 		// Force chunking if we saw a response trailer.
 		// This prevents net/http from calculating the length for short
 		// bodies and adding a Content-Length.
+		// Middlewares may also ask for the headers to be sent at once.
 		if fl, ok := rw.(http.Flusher); ok {
 			fl.Flush()
 		}
 	}
 
-	p.copyResponse(rw, res.Body)
+	p.copyResponse(rw, res.Body, ctx.Flush)
 	res.Body.Close() // close now, instead of defer, to populate res.Trailer
 	copyHeader(rw.Header(), res.Trailer)
 }
 
-func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader) {
-	if p.FlushInterval != 0 {
+// copyResponse copies the response body to the client. If flush is set,
+// each part of the body is sent as it is read.
+func (p *ReverseProxy) copyResponse(dst io.Writer, src io.Reader, flush bool) {
+	if wf, ok := dst.(writeFlusher); ok && flush {
+		dst = &flushWriter{wf}
+	} else if p.FlushInterval != 0 {
 		if wf, ok := dst.(writeFlusher); ok {
 			mlw := &maxLatencyWriter{
 				dst:     wf,
@@ -264,6 +288,17 @@ type writeFlusher interface {
 	http.Flusher
 }
 
+// flushWriter flushes each write
+type flushWriter struct {
+	dst writeFlusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.dst.Write(p)
+	f.dst.Flush()
+	return n, err
+}
+
 type maxLatencyWriter struct {
 	dst     writeFlusher
 	latency time.Duration
@@ -9,6 +9,7 @@ package protocol
 import (
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -17,6 +18,9 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/symptom"
 )
 
 const fakeHopHeader = "X-Fake-Hop-Header-For-Test"
@@ -183,6 +187,257 @@ func TestReverseProxyQuery(t *testing.T) {
 	}
 }
 
+func TestReverseProxyAbort(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hi"))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, afterDispatch := range []bool{false, true} {
+		requests = 0
+		abort := &symptom.HTTPAbortSymptom{
+			Responses:     []symptom.AbortResponse{{Status: 503, Body: "unavailable", RetryAfter: 5}},
+			AfterDispatch: afterDispatch,
+		}
+		abort.Setup()
+		proxyHandler := NewSingleHostReverseProxy(backendURL)
+		proxyHandler.Middleware = []muxy.Middleware{abort}
+		frontend := httptest.NewServer(proxyHandler)
+
+		req, _ := http.NewRequest("GET", frontend.URL, nil)
+		req.Close = true
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		bodyBytes, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		frontend.Close()
+
+		if res.StatusCode != 503 || string(bodyBytes) != "unavailable" || res.Header.Get("Retry-After") != "5" {
+			t.Errorf("got %d %q; expected 503 \"unavailable\"", res.StatusCode, bodyBytes)
+		}
+		if expected := map[bool]int{false: 0, true: 1}[afterDispatch]; requests != expected {
+			t.Errorf("backend got %d requests; expected %d", requests, expected)
+		}
+	}
+}
+
+func TestReverseProxyHeaderCase(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Version", "v1")
+		w.Write([]byte("hi"))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperer := &symptom.HTTPTampererSymptom{
+		Response: symptom.ResponseConfig{
+			Headers:      map[string]string{"x-request-ID": "abc"},
+			PreserveCase: true,
+			Faults:       []symptom.HeaderFault{{Type: symptom.HeaderFaultDuplicate, Header: "X-Version", Value: "v2"}},
+		},
+	}
+	tamperer.Setup()
+	proxyHandler := NewSingleHostReverseProxy(backendURL)
+	proxyHandler.Middleware = []muxy.Middleware{tamperer}
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n"))
+	response, _ := ioutil.ReadAll(conn)
+
+	for _, line := range []string{"x-request-ID: abc\r\n", "X-Version: v1\r\n", "X-Version: v2\r\n"} {
+		if !strings.Contains(string(response), line) {
+			t.Errorf("expected response to contain %q, got %q", line, response)
+		}
+	}
+}
+
+func TestReverseProxySlow(t *testing.T) {
+	received := make(chan time.Duration, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ioutil.ReadAll(r.Body)
+		received <- time.Since(start)
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &symptom.HTTPSlowSymptom{Hold: 100, ResponseInterval: 20, RequestInterval: 20, RequestChunk: 2}
+	slow.Setup()
+	proxyHandler := NewSingleHostReverseProxy(backendURL)
+	proxyHandler.Middleware = []muxy.Middleware{slow}
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	start := time.Now()
+	res, err := http.Post(frontend.URL, "text/plain", strings.NewReader("abcdef"))
+	if err != nil {
+		t.Fatalf("Post: %v", err)
+	}
+	headers := time.Since(start)
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	body := time.Since(start) - headers
+
+	if string(bodyBytes) != "hello" {
+		t.Errorf("got body %q; expected %q", bodyBytes, "hello")
+	}
+	if elapsed := <-received; elapsed < 40*time.Millisecond {
+		t.Errorf("backend read request body in %v; expected it to be slowed", elapsed)
+	}
+	if body < 200*time.Millisecond {
+		t.Errorf("got body %v after headers; expected it to be held and dribbled", body)
+	}
+}
+
+func TestReverseProxyViolation(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	violation := &symptom.HTTPViolationSymptom{Violation: symptom.ViolationChunkSize}
+	violation.Setup()
+	proxyHandler := NewSingleHostReverseProxy(backendURL)
+	proxyHandler.Middleware = []muxy.Middleware{violation}
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	_, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err == nil {
+		t.Errorf("expected reading a body of the wrong chunk size to fail")
+	}
+	if requests != 1 {
+		t.Errorf("backend got %d requests; expected 1", requests)
+	}
+
+	// The early response is sent before the request body, which is never
+	// read, and the request is not sent to the backend
+	requests = 0
+	violation = &symptom.HTTPViolationSymptom{Violation: symptom.ViolationEarlyResponse, Body: "too large"}
+	violation.Setup()
+	proxyHandler.Middleware = []muxy.Middleware{violation}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(frontend.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 1000000\r\n\r\n"))
+	response, _ := ioutil.ReadAll(conn)
+
+	if !strings.HasPrefix(string(response), "HTTP/1.1 413 Request Entity Too Large\r\n") || !strings.HasSuffix(string(response), "too large") {
+		t.Errorf("got %q; expected an early 413 response", response)
+	}
+	if requests != 0 {
+		t.Errorf("backend got %d requests; expected 0", requests)
+	}
+}
+
+func TestReverseProxyRedirect(t *testing.T) {
+	requests := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirect := &symptom.HTTPRedirectSymptom{Status: 308, Length: 3}
+	redirect.Setup()
+	proxyHandler := NewSingleHostReverseProxy(backendURL)
+	proxyHandler.Middleware = []muxy.Middleware{redirect}
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	res, err := http.Get(frontend.URL + "/items?a=1")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	bodyBytes, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(bodyBytes) != "a=1" || requests != 1 {
+		t.Errorf("got query %q after %d requests; expected \"a=1\" after 1", bodyBytes, requests)
+	}
+
+	redirect = &symptom.HTTPRedirectSymptom{Loop: true}
+	redirect.Setup()
+	proxyHandler.Middleware = []muxy.Middleware{redirect}
+	if _, err = http.Get(frontend.URL); err == nil {
+		t.Errorf("expected a redirect loop to fail")
+	}
+}
+
+func TestReverseProxyRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hi"))
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := &symptom.HTTPRateLimitSymptom{Limit: 2, Window: 60000, Mode: symptom.RateLimitFixedWindow}
+	limit.Setup()
+	proxyHandler := NewSingleHostReverseProxy(backendURL)
+	proxyHandler.Middleware = []muxy.Middleware{limit}
+	frontend := httptest.NewServer(proxyHandler)
+	defer frontend.Close()
+
+	var statuses []int
+	var remaining []string
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(frontend.URL)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		res.Body.Close()
+		statuses = append(statuses, res.StatusCode)
+		remaining = append(remaining, res.Header.Get("X-RateLimit-Remaining"))
+	}
+
+	if !reflect.DeepEqual(statuses, []int{200, 200, 429}) || !reflect.DeepEqual(remaining, []string{"1", "0", "0"}) {
+		t.Errorf("got statuses %v and remaining %v; expected the third request to be limited", statuses, remaining)
+	}
+}
+
 func TestReverseProxyFlushInterval(t *testing.T) {
 	const expected = "hi"
 	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"sync"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+// codec decodes the messages of a request/reply protocol for a
+// protocol-aware proxy. A codec is created for each connection, so that
+// it may track the state of the session, and is never used concurrently.
+type codec interface {
+	// decode decodes a message from the client (request) or the target.
+	// Replies are given the request they answer, if any is outstanding.
+	//
+	// For requests, it returns false if the request is answered as part of
+	// the reply to a later request, such as a Postgres Execute before its
+	// Sync. For replies, it returns false if the message does not complete
+	// the reply to the request, such as a server push or a Postgres DataRow.
+	decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool)
+}
+
+// sessionMiddleware wraps the given middleware with the session middlewares
+// that decode each message, and keep the replies to a connection's requests
+// in order
+func sessionMiddleware(newCodec func() codec, middleware []muxy.Middleware) []muxy.Middleware {
+	wrapped := []muxy.Middleware{&sessionDecoder{newCodec: newCodec}}
+	wrapped = append(wrapped, middleware...)
+	return append(wrapped, &sessionSequencer{})
+}
+
+// sessionKey identifies the session of a connection in its Values
+type sessionKey struct{}
+
+// exchange is a request awaiting its reply
+type exchange struct {
+	request *muxy.Message
+
+	// reply is sent on behalf of the target. It is nil for
+	// requests that were forwarded.
+	reply []byte
+
+	// prefix holds replies on behalf of the target to the requests
+	// answered along with this one, sent just before its reply completes
+	prefix []byte
+}
+
+// session holds the requests of a connection that are awaiting a reply,
+// in the order they were sent
+type session struct {
+	codec   codec
+	lock    sync.Mutex
+	pending []*exchange
+
+	// expecting is true if the request being handled is answered
+	// by a reply of its own
+	expecting bool
+
+	// deferred holds replies to requests answered along with a later one
+	deferred []byte
+
+	// answered is the exchange completed by the reply being handled
+	answered *exchange
+}
+
+// sessionOf returns the session of the connection in ctx, if there is one
+func sessionOf(ctx *muxy.Context) *session {
+	if ctx.Connection == nil || ctx.Connection.Values == nil {
+		return nil
+	}
+	if s, ok := ctx.Connection.Values.Load(sessionKey{}); ok {
+		return s.(*session)
+	}
+	return nil
+}
+
+// sessionDecoder decodes each message before it is given to middlewares
+type sessionDecoder struct {
+	newCodec func() codec
+}
+
+// Setup sets up the middleware
+func (m *sessionDecoder) Setup() {}
+
+// Teardown shuts down the middleware
+func (m *sessionDecoder) Teardown() {}
+
+// HandleEvent decodes the message in ctx. Replies are matched with the
+// oldest outstanding request, which is removed from the session.
+func (m *sessionDecoder) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Connection.Values == nil || len(ctx.Bytes) == 0 {
+		return
+	}
+
+	v, _ := ctx.Connection.Values.LoadOrStore(sessionKey{}, &session{codec: m.newCodec()})
+	s := v.(*session)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch e {
+	case muxy.EventPreDispatch:
+		msg, expecting := s.codec.decode(ctx.Bytes, true, nil)
+		s.expecting = expecting
+		if msg != nil && len(s.pending) > 0 {
+			msg.Pipelined = true
+			for _, x := range s.pending {
+				x.request.Pipelined = true
+			}
+		}
+		ctx.Message = msg
+	case muxy.EventPostDispatch:
+		var req *muxy.Message
+		if len(s.pending) > 0 {
+			r := *s.pending[0].request
+			req = &r
+		}
+		msg, answered := s.codec.decode(ctx.Bytes, false, req)
+		if answered && req != nil {
+			s.answered = s.pending[0]
+			s.pending = s.pending[1:]
+		}
+		ctx.Message = msg
+	}
+}
+
+// sessionSequencer records each request after it has been handled by
+// middlewares, so that replies sent on behalf of the target are delivered
+// in the order their requests were made
+type sessionSequencer struct{}
+
+// Setup sets up the middleware
+func (m *sessionSequencer) Setup() {}
+
+// Teardown shuts down the middleware
+func (m *sessionSequencer) Teardown() {}
+
+// HandleEvent queues forwarded requests and replies made on behalf of the
+// target, and releases queued replies once the requests before them are
+// answered
+func (m *sessionSequencer) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	s := sessionOf(ctx)
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	switch e {
+	case muxy.EventPreDispatch:
+		if ctx.Message == nil {
+			return
+		}
+
+		// Replies are sent immediately on a connection that is being faulted
+		reply := ctx.Connection.Reply
+		if reply != nil && ctx.Connection.Fault != muxy.FaultNone {
+			return
+		}
+
+		if !s.expecting {
+			if reply != nil {
+				s.deferred = append(s.deferred, reply...)
+				ctx.Connection.Reply = nil
+			}
+			return
+		}
+
+		req := *ctx.Message
+		if len(ctx.Bytes) > 0 {
+			s.pending = append(s.pending, &exchange{request: &req, prefix: s.deferred})
+			s.deferred = nil
+		}
+		if reply != nil {
+			reply = append(s.deferred, reply...)
+			s.deferred = nil
+			if len(s.pending) > 0 {
+				s.pending = append(s.pending, &exchange{request: &req, reply: reply})
+				reply = nil
+			}
+			ctx.Connection.Reply = reply
+		}
+	case muxy.EventPostDispatch:
+		if s.answered != nil {
+			if len(s.answered.prefix) > 0 {
+				ctx.Bytes = append(s.answered.prefix[:len(s.answered.prefix):len(s.answered.prefix)], ctx.Bytes...)
+			}
+			s.answered = nil
+		}
+
+		for len(s.pending) > 0 && s.pending[0].reply != nil {
+			// Copy, rather than append to, the framer's buffer
+			ctx.Bytes = append(ctx.Bytes[:len(ctx.Bytes):len(ctx.Bytes)], s.pending[0].reply...)
+			s.pending = s.pending[1:]
+		}
+	}
+}
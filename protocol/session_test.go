@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+// lineCodec decodes each message as a command named by its content.
+// Requests starting with '+' are answered along with the next request,
+// and messages from the target starting with '>' do not answer a request.
+type lineCodec struct{}
+
+func (c *lineCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if request && b[0] == '+' {
+		return &muxy.Message{Command: string(b)}, false
+	}
+	if !request && b[0] == '>' {
+		return &muxy.Message{}, false
+	}
+	if !request && req != nil {
+		return req, true
+	}
+	return &muxy.Message{Command: string(b)}, true
+}
+
+func TestSession(t *testing.T) {
+	middleware := sessionMiddleware(func() codec { return &lineCodec{} }, nil)
+	conn := &muxy.Connection{Values: &sync.Map{}}
+
+	send := func(e muxy.ProxyEvent, b string, reply string) *muxy.Context {
+		c := *conn
+		ctx := &muxy.Context{Bytes: []byte(b), Connection: &c}
+		middleware[0].HandleEvent(e, ctx)
+		if reply != "" {
+			ctx.Bytes = nil
+			ctx.Connection.Reply = []byte(reply)
+		}
+		middleware[1].HandleEvent(e, ctx)
+		return ctx
+	}
+
+	// Replies on behalf of the target are immediate, with nothing outstanding
+	ctx := send(muxy.EventPreDispatch, "a", "A")
+	if string(ctx.Connection.Reply) != "A" || ctx.Message.Pipelined {
+		t.Fatal("Want immediate reply outside a pipeline, got", string(ctx.Connection.Reply))
+	}
+
+	// ...and otherwise wait for the requests before them to be answered
+	send(muxy.EventPreDispatch, "b", "")
+	ctx = send(muxy.EventPreDispatch, "c", "C")
+	if ctx.Connection.Reply != nil || !ctx.Message.Pipelined {
+		t.Fatal("Want queued reply, got", string(ctx.Connection.Reply))
+	}
+	send(muxy.EventPreDispatch, "d", "")
+
+	ctx = send(muxy.EventPostDispatch, ">push", "")
+	if string(ctx.Bytes) != ">push" {
+		t.Fatal("Want push to be passed on, got", string(ctx.Bytes))
+	}
+
+	ctx = send(muxy.EventPostDispatch, "B", "")
+	if string(ctx.Bytes) != "BC" || ctx.Message.Command != "b" || !ctx.Message.Pipelined {
+		t.Fatal("Want reply to b followed by queued reply, got", string(ctx.Bytes), ctx.Message)
+	}
+
+	ctx = send(muxy.EventPostDispatch, "D", "")
+	if string(ctx.Bytes) != "D" || ctx.Message.Command != "d" {
+		t.Fatal("Want reply to d, got", string(ctx.Bytes), ctx.Message)
+	}
+
+	// Replies to requests answered along with a later one precede its reply
+	ctx = send(muxy.EventPreDispatch, "+e", "E")
+	if ctx.Connection.Reply != nil {
+		t.Fatal("Want deferred reply, got", string(ctx.Connection.Reply))
+	}
+	send(muxy.EventPreDispatch, "f", "")
+
+	ctx = send(muxy.EventPostDispatch, "F", "")
+	if string(ctx.Bytes) != "EF" {
+		t.Fatal("Want deferred reply before reply to f, got", string(ctx.Bytes))
+	}
+}
@@ -0,0 +1,194 @@
+package protocol
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/smtp"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// SMTPProxy implements an SMTP aware TCP proxy. The dialogue is decoded,
+// so that middlewares can target its commands, and the message sent after
+// DATA, by sender and recipient.
+type SMTPProxy struct {
+	ProtocolProxy `mapstructure:",squash"`
+
+	// MaxSize is the largest line, reply or BDAT chunk that will be decoded
+	MaxSize int `required:"false" mapstructure:"max_size"`
+}
+
+// defaultSMTPMaxSize is the default largest line, reply or BDAT chunk
+const defaultSMTPMaxSize = 16 * 1024 * 1024
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &SMTPProxy{}, nil
+	}, "smtp_proxy")
+}
+
+// Setup the SMTP proxy
+func (p *SMTPProxy) Setup(middleware []muxy.Middleware) {
+	max := p.MaxSize
+	if max <= 0 {
+		max = defaultSMTPMaxSize
+	}
+
+	p.setup("SMTP Proxy", FramingConfig{MaxSize: max}, func(request bool) bufio.SplitFunc {
+		if request {
+			return smtp.SplitCommand(max)
+		}
+		return smtp.SplitReply(max)
+	}, func() codec {
+		return &smtpCodec{}
+	}, middleware)
+}
+
+// smtpCodec decodes the dialogue of a session, tracking the sender and
+// recipients of the mail transaction in progress. Each command is answered
+// by one reply, and lines of a message by the reply to the line ending it.
+type smtpCodec struct {
+	greeted bool
+
+	// encrypted is true once STARTTLS has been accepted
+	encrypted bool
+
+	// data is true while the lines of a message are sent, after DATA is
+	// accepted, and auth while the client answers an AUTH challenge
+	data bool
+	auth bool
+
+	// size counts the bytes of the message sent so far, and chunk the
+	// bytes left of a BDAT chunk larger than a single message
+	size  int
+	chunk int
+
+	helo       string
+	sender     string
+	recipients []string
+}
+
+// decode decodes a command or reply. Lines of a message have the command
+// MESSAGE, the last being the "." that ends it.
+func (c *smtpCodec) decode(b []byte, request bool, req *muxy.Message) (*muxy.Message, bool) {
+	if c.encrypted {
+		return nil, false
+	}
+	if request {
+		return c.decodeCommand(b)
+	}
+	return c.decodeReply(b, req)
+}
+
+func (c *smtpCodec) decodeCommand(b []byte) (*muxy.Message, bool) {
+	msg := &muxy.Message{Protocol: "smtp", Fields: map[string]string{}}
+
+	switch {
+	case c.chunk > 0:
+		msg.Command = "BDAT"
+		msg.Fields["part"] = "content"
+		c.chunk -= len(b)
+		c.fields(msg)
+		return msg, false
+	case c.data:
+		msg.Command = "MESSAGE"
+		msg.Fields["offset"] = strconv.Itoa(c.size)
+		c.size += len(b)
+		c.fields(msg)
+		if string(b) != ".\r\n" {
+			msg.Fields["part"] = "content"
+			return msg, false
+		}
+		msg.Fields["part"] = "end"
+		c.data = false
+		c.reset()
+		return msg, true
+	case c.auth:
+		msg.Command = "AUTH"
+		msg.Fields["part"] = "response"
+		c.auth = false
+		c.fields(msg)
+		return msg, true
+	}
+
+	cmd := smtp.ParseCommand(b)
+	msg.Command = cmd.Verb
+	switch cmd.Verb {
+	case "HELO", "EHLO", "LHLO":
+		c.helo = cmd.Arg
+		c.reset()
+		msg.Key = cmd.Arg
+	case "MAIL":
+		c.reset()
+		c.sender = cmd.Address
+		msg.Key = cmd.Address
+	case "RCPT":
+		c.recipients = append(c.recipients, cmd.Address)
+		msg.Key = cmd.Address
+	case "RSET":
+		c.reset()
+	case "BDAT":
+		n, last := cmd.ChunkSize()
+		line := strings.Index(string(b), "\r\n") + 2
+		c.chunk = line + n - len(b)
+		msg.Fields["offset"] = strconv.Itoa(c.size)
+		msg.Fields["last"] = strconv.FormatBool(last)
+		c.size += n
+		c.fields(msg)
+		if last {
+			c.reset()
+		}
+		return msg, true
+	}
+	c.fields(msg)
+	return msg, true
+}
+
+func (c *smtpCodec) decodeReply(b []byte, req *muxy.Message) (*muxy.Message, bool) {
+	msg := &muxy.Message{Protocol: "smtp", Fields: map[string]string{}}
+	if req != nil {
+		msg.Command = req.Command
+		msg.Key = req.Key
+		msg.Pipelined = req.Pipelined
+		for k, v := range req.Fields {
+			msg.Fields[k] = v
+		}
+	}
+	code := smtp.ReplyCode(b)
+	msg.Fields["code"] = strconv.Itoa(code)
+
+	// The greeting, and replies such as a 421 on a timeout, answer nothing
+	if !c.greeted || req == nil {
+		c.greeted = true
+		msg.Command = ""
+		msg.Key = ""
+		return msg, false
+	}
+
+	switch req.Command {
+	case "DATA":
+		c.data = code == 354
+		c.size = 0
+	case "AUTH":
+		c.auth = code == 334
+	case "STARTTLS":
+		c.encrypted = code == 220
+	}
+	return msg, true
+}
+
+// fields sets the fields of msg from the state of the session
+func (c *smtpCodec) fields(msg *muxy.Message) {
+	msg.Fields["helo"] = c.helo
+	msg.Fields["sender"] = c.sender
+	msg.Fields["recipients"] = strings.Join(c.recipients, ",")
+}
+
+// reset ends the mail transaction in progress
+func (c *smtpCodec) reset() {
+	c.sender = ""
+	c.recipients = nil
+	c.size = 0
+}
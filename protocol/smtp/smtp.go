@@ -0,0 +1,281 @@
+// Package smtp decodes and encodes the commands and replies of the SMTP
+// dialogue, for use by the SMTP Proxy and its Symptoms.
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// crlf terminates each line of the dialogue
+var crlf = []byte("\r\n")
+
+// tlsHandshake is the first byte of a TLS record carrying a handshake
+const tlsHandshake = 0x16
+
+// replyTexts are the default texts of common reply codes
+var replyTexts = map[int]string{
+	421: "4.3.2 Service not available, closing transmission channel",
+	450: "4.2.0 Requested mail action not taken: mailbox unavailable",
+	451: "4.3.0 Requested action aborted: local error in processing",
+	452: "4.3.1 Requested action not taken: insufficient system storage",
+	454: "4.7.0 TLS not available due to temporary reason",
+	550: "5.1.1 Requested action not taken: mailbox unavailable",
+	551: "5.1.6 User not local",
+	552: "5.3.4 Requested mail action aborted: exceeded storage allocation",
+	553: "5.1.3 Requested action not taken: mailbox name not allowed",
+	554: "5.7.1 Transaction failed",
+}
+
+// ReplyText returns the default text of a reply code
+func ReplyText(code int) string {
+	if text, ok := replyTexts[code]; ok {
+		return text
+	}
+	if code >= 500 {
+		return "5.0.0 Permanent failure"
+	}
+	return "4.0.0 Temporary failure"
+}
+
+// NewReply encodes a single line reply
+func NewReply(code int, text string) []byte {
+	return []byte(strconv.Itoa(code) + " " + text + "\r\n")
+}
+
+// SplitCommand splits a stream of commands. Each line is split on its
+// own, including those of a message sent after DATA, while BDAT commands
+// are split along with their chunk. Once the client starts a TLS
+// handshake, the stream is passed on as it is read.
+func SplitCommand(max int) bufio.SplitFunc {
+	// data is true after a DATA command, until the line ending the
+	// message, so that lines of the message are not taken as commands
+	data := false
+	raw := false
+
+	// remaining counts the bytes left of a chunk larger than max
+	remaining := 0
+
+	return func(b []byte, atEOF bool) (int, []byte, error) {
+		if len(b) == 0 {
+			return 0, nil, nil
+		}
+		if raw {
+			return len(b), b, nil
+		}
+		if remaining > 0 {
+			n := len(b)
+			if n > remaining {
+				n = remaining
+			}
+			remaining -= n
+			return n, b[:n], nil
+		}
+		if !data && b[0] == tlsHandshake {
+			raw = true
+			return len(b), b, nil
+		}
+
+		end := bytes.Index(b, crlf)
+		if end < 0 {
+			if len(b) >= max {
+				return max, b[:max], nil
+			}
+			return flush(b, atEOF)
+		}
+		size := end + 2
+
+		if data {
+			data = !bytes.Equal(b[:end], []byte("."))
+			return size, b[:size], nil
+		}
+
+		c := ParseCommand(b[:size])
+		switch c.Verb {
+		case "DATA":
+			data = true
+		case "BDAT":
+			n, _ := c.ChunkSize()
+			total := size + n
+			if total > max {
+				if len(b) < max {
+					return flush(b, atEOF)
+				}
+				remaining = total - max
+				return max, b[:max], nil
+			}
+			if len(b) < total {
+				return flush(b, atEOF)
+			}
+			size = total
+		}
+		return size, b[:size], nil
+	}
+}
+
+// SplitReply splits a stream of replies, including every line of a
+// multiline reply. Once the server starts a TLS handshake, the stream is
+// passed on as it is read.
+func SplitReply(max int) bufio.SplitFunc {
+	raw := false
+
+	return func(b []byte, atEOF bool) (int, []byte, error) {
+		if len(b) == 0 {
+			return 0, nil, nil
+		}
+		if raw || b[0] < '0' || b[0] > '9' {
+			raw = true
+			return len(b), b, nil
+		}
+
+		pos := 0
+		for {
+			end := bytes.Index(b[pos:], crlf)
+			if end < 0 {
+				if len(b) >= max {
+					return max, b[:max], nil
+				}
+				return flush(b, atEOF)
+			}
+			line := b[pos : pos+end]
+			pos += end + 2
+
+			// Lines but the last have a hyphen after the code
+			if len(line) < 4 || line[3] != '-' {
+				return pos, b[:pos], nil
+			}
+		}
+	}
+}
+
+// flush requests more data, or passes on a partial message at EOF
+func flush(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Command is a decoded command
+type Command struct {
+	// Verb is the upper case name of the command, e.g. "RCPT"
+	Verb string
+
+	// Arg is the remainder of the command line
+	Arg string
+
+	// Address is the mailbox of a MAIL or RCPT command, without its
+	// angle brackets
+	Address string
+}
+
+// ParseCommand decodes a command line
+func ParseCommand(b []byte) Command {
+	line := strings.TrimRight(string(b), "\r\n")
+	var c Command
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		c.Verb, c.Arg = line[:i], strings.TrimSpace(line[i+1:])
+	} else {
+		c.Verb = line
+	}
+	c.Verb = strings.ToUpper(c.Verb)
+
+	switch c.Verb {
+	case "MAIL":
+		c.Address = address(c.Arg, "FROM:")
+	case "RCPT":
+		c.Address = address(c.Arg, "TO:")
+	}
+	return c
+}
+
+// address returns the mailbox of a MAIL FROM or RCPT TO argument, with
+// the given prefix
+func address(arg string, prefix string) string {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return ""
+	}
+	arg = strings.TrimSpace(arg[len(prefix):])
+	if strings.HasPrefix(arg, "<") {
+		if i := strings.IndexByte(arg, '>'); i >= 0 {
+			return arg[1:i]
+		}
+	}
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
+
+// ChunkSize returns the size of the chunk of a BDAT command, and true
+// if it is the last
+func (c Command) ChunkSize() (int, bool) {
+	fields := strings.Fields(c.Arg)
+	if len(fields) == 0 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(fields[0])
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, len(fields) > 1 && strings.EqualFold(fields[1], "LAST")
+}
+
+// ReplyCode returns the code of a reply, or zero if it has none
+func ReplyCode(b []byte) int {
+	if len(b) < 3 {
+		return 0
+	}
+	code, err := strconv.Atoi(string(b[:3]))
+	if err != nil {
+		return 0
+	}
+	return code
+}
+
+// Extensions returns the keywords of the extensions advertised by an
+// EHLO reply, in upper case
+func Extensions(b []byte) []string {
+	var exts []string
+	lines := strings.Split(strings.TrimRight(string(b), "\r\n"), "\r\n")
+	for _, line := range lines[1:] {
+		if len(line) > 4 {
+			fields := strings.Fields(line[4:])
+			if len(fields) > 0 {
+				exts = append(exts, strings.ToUpper(fields[0]))
+			}
+		}
+	}
+	return exts
+}
+
+// RemoveExtension returns an EHLO reply without the given extension
+func RemoveExtension(b []byte, ext string) []byte {
+	lines := strings.Split(strings.TrimRight(string(b), "\r\n"), "\r\n")
+	kept := lines[:1]
+	for _, line := range lines[1:] {
+		if len(line) > 4 {
+			fields := strings.Fields(line[4:])
+			if len(fields) > 0 && strings.EqualFold(fields[0], ext) {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+
+	var r bytes.Buffer
+	for i, line := range kept {
+		if len(line) > 3 {
+			sep := byte('-')
+			if i == len(kept)-1 {
+				sep = ' '
+			}
+			line = line[:3] + string(sep) + line[4:]
+		}
+		r.WriteString(line)
+		r.Write(crlf)
+	}
+	return r.Bytes()
+}
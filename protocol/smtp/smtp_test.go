@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/mefellows/muxy/protocol/prototest"
+)
+
+func TestSplitCommand(t *testing.T) {
+	want := [][]byte{
+		[]byte("EHLO client.example.com\r\n"),
+		[]byte("MAIL FROM:<alice@example.com>\r\n"),
+		[]byte("DATA\r\n"),
+		[]byte("Subject: hi\r\n"),
+		[]byte("BDAT 5\r\n"),
+		[]byte(".\r\n"),
+		[]byte("BDAT 10 LAST\r\nhi\r\nBDAT\r\n"),
+		[]byte("QUIT\r\n"),
+	}
+	got := prototest.Scan(SplitCommand(1024), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestSplitCommand_Large(t *testing.T) {
+	want := [][]byte{
+		[]byte("BDAT 12 LAST\r\n"),
+		[]byte("hello world!"),
+		[]byte("QUIT\r\n"),
+	}
+	in := bytes.Join(want, nil)
+	got := prototest.Scan(SplitCommand(16), in)
+	if !bytes.Equal(bytes.Join(got, nil), in) || !bytes.Equal(got[0], in[:16]) || !bytes.Equal(got[len(got)-1], want[2]) {
+		t.Fatalf("Want chunk split after 16 bytes, got %q", got)
+	}
+}
+
+func TestSplitCommand_TLS(t *testing.T) {
+	in := []byte("STARTTLS\r\n\x16\x03\x01\x00\x05hello\r\n")
+	got := prototest.Scan(SplitCommand(1024), in)
+	if !bytes.Equal(got[0], []byte("STARTTLS\r\n")) || !bytes.Equal(bytes.Join(got[1:], nil), in[10:]) {
+		t.Fatalf("Want handshake passed on, got %q", got)
+	}
+	for _, b := range got[1:] {
+		if bytes.HasSuffix(b, []byte("\r\n")) && len(b) > 2 {
+			t.Fatalf("Want handshake not split into lines, got %q", got)
+		}
+	}
+}
+
+func TestSplitReply(t *testing.T) {
+	want := [][]byte{
+		[]byte("220 mail.example.com ESMTP\r\n"),
+		[]byte("250-mail.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n"),
+		[]byte("354 End data with <CR><LF>.<CR><LF>\r\n"),
+	}
+	got := prototest.Scan(SplitReply(1024), bytes.Join(want, nil))
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Want %q, got %q", want, got)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		line string
+		want Command
+	}{
+		{"mail from:<Alice@example.com> SIZE=100\r\n", Command{Verb: "MAIL", Arg: "from:<Alice@example.com> SIZE=100", Address: "Alice@example.com"}},
+		{"RCPT TO: bob@example.com\r\n", Command{Verb: "RCPT", Arg: "TO: bob@example.com", Address: "bob@example.com"}},
+		{"MAIL FROM:<>\r\n", Command{Verb: "MAIL", Arg: "FROM:<>"}},
+		{"DATA\r\n", Command{Verb: "DATA"}},
+	}
+	for _, c := range cases {
+		if got := ParseCommand([]byte(c.line)); got != c.want {
+			t.Fatalf("Want %+v for %q, got %+v", c.want, c.line, got)
+		}
+	}
+
+	if n, last := ParseCommand([]byte("BDAT 100 last\r\n")).ChunkSize(); n != 100 || !last {
+		t.Fatal("Want last chunk of 100 bytes, got", n, last)
+	}
+}
+
+func TestRemoveExtension(t *testing.T) {
+	cases := []struct {
+		reply string
+		want  string
+	}{
+		{
+			"250-mail.example.com\r\n250-STARTTLS\r\n250 SIZE 1000\r\n",
+			"250-mail.example.com\r\n250 SIZE 1000\r\n",
+		},
+		{
+			"250-mail.example.com\r\n250-SIZE 1000\r\n250 STARTTLS\r\n",
+			"250-mail.example.com\r\n250 SIZE 1000\r\n",
+		},
+		{
+			"250-mail.example.com\r\n250 STARTTLS\r\n",
+			"250 mail.example.com\r\n",
+		},
+	}
+	for _, c := range cases {
+		if got := string(RemoveExtension([]byte(c.reply), "STARTTLS")); got != c.want {
+			t.Fatalf("Want %q, got %q", c.want, got)
+		}
+	}
+
+	if got := Extensions([]byte(cases[0].reply)); !reflect.DeepEqual(got, []string{"STARTTLS", "SIZE"}) {
+		t.Fatal("Want STARTTLS and SIZE, got", got)
+	}
+}
@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/prototest"
+	"github.com/mefellows/muxy/protocol/smtp"
+	"github.com/mefellows/muxy/symptom"
+)
+
+// setupLocalSMTP starts a fake SMTP server, which accepts all mail
+func setupLocalSMTP(port int) {
+	prototest.Serve(port, func(c net.Conn) {
+		r := bufio.NewReader(c)
+		io.WriteString(c, "220 mail.example.com ESMTP\r\n")
+
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if data {
+				if line == ".\r\n" {
+					data = false
+					io.WriteString(c, "250 2.0.0 Ok: queued\r\n")
+				}
+				continue
+			}
+
+			switch smtp.ParseCommand([]byte(line)).Verb {
+			case "EHLO":
+				io.WriteString(c, "250-mail.example.com\r\n250-PIPELINING\r\n250-STARTTLS\r\n250 SIZE 1000\r\n")
+			case "DATA":
+				data = true
+				io.WriteString(c, "354 End data with <CR><LF>.<CR><LF>\r\n")
+			case "QUIT":
+				io.WriteString(c, "221 Bye\r\n")
+				return
+			default:
+				io.WriteString(c, "250 2.1.0 Ok\r\n")
+			}
+		}
+	})
+}
+
+func TestSMTPProxy_Proxy(t *testing.T) {
+	serverPort := 7745
+	setupLocalSMTP(serverPort)
+
+	rejecter := &symptom.SMTPSymptom{
+		Code:      550,
+		Stage:     "rcpt",
+		Recipient: "^blocked@",
+	}
+	rejecter.Setup()
+	dropper := &symptom.SMTPSymptom{DropStartTLS: true}
+	dropper.Setup()
+
+	port := 7746
+	p := SMTPProxy{
+		ProtocolProxy: ProtocolProxy{
+			Port:      port,
+			Host:      "localhost",
+			ProxyHost: "localhost",
+			ProxyPort: serverPort,
+		},
+	}
+	p.Setup([]muxy.Middleware{rejecter, dropper})
+
+	waitForPort(serverPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	s := bufio.NewScanner(conn)
+	s.Split(smtp.SplitReply(1024))
+
+	read := func(want string) {
+		if !s.Scan() {
+			t.Fatal("Want reply, got", s.Err())
+		}
+		if !strings.HasPrefix(s.Text(), want) {
+			t.Fatalf("Want %q, got %q", want, s.Text())
+		}
+	}
+
+	read("220 ")
+	io.WriteString(conn, "EHLO client.example.com\r\n")
+	read("250-mail.example.com\r\n250-PIPELINING\r\n250 SIZE 1000\r\n")
+
+	// Replies to rejected recipients are kept in order with those forwarded
+	io.WriteString(conn, "MAIL FROM:<alerts@example.com>\r\nRCPT TO:<ops@example.com>\r\nRCPT TO:<blocked@example.com>\r\nDATA\r\n")
+	read("250 ")
+	read("250 ")
+	read("550 5.1.1 ")
+	read("354 ")
+
+	io.WriteString(conn, "Subject: disk full\r\n\r\nRCPT TO:<blocked@example.com>\r\n.\r\n")
+	read("250 2.0.0 Ok: queued")
+
+	io.WriteString(conn, "STARTTLS\r\n")
+	read("454 4.7.0 ")
+}
+
+func TestSMTPCodec_Transaction(t *testing.T) {
+	c := &smtpCodec{}
+	command := func(line string) (*muxy.Message, bool) {
+		return c.decode([]byte(line), true, nil)
+	}
+	reply := func(line string, req *muxy.Message) (*muxy.Message, bool) {
+		return c.decode([]byte(line), false, req)
+	}
+
+	if msg, answered := reply("220 mail.example.com ESMTP\r\n", nil); answered || msg.Fields["code"] != "220" {
+		t.Fatalf("Want greeting answering nothing, got %+v", msg)
+	}
+
+	command("EHLO client.example.com\r\n")
+	command("MAIL FROM:<alerts@example.com>\r\n")
+	rcpt, expecting := command("RCPT TO:<ops@example.com>\r\n")
+	if !expecting || rcpt.Key != "ops@example.com" || rcpt.Fields["sender"] != "alerts@example.com" {
+		t.Fatalf("Want RCPT of ops from alerts, got %+v", rcpt)
+	}
+	data, _ := command("DATA\r\n")
+	if data.Fields["recipients"] != "ops@example.com" || data.Fields["helo"] != "client.example.com" {
+		t.Fatalf("Want DATA to ops, got %+v", data)
+	}
+
+	// Lines of the message are only sent once DATA is accepted
+	if msg, answered := reply("354 Go ahead\r\n", data); !answered || msg.Command != "DATA" {
+		t.Fatalf("Want DATA answered, got %+v", msg)
+	}
+	command("Subject: hi\r\n")
+	msg, expecting := command("QUIT\r\n")
+	if expecting || msg.Command != "MESSAGE" || msg.Fields["part"] != "content" || msg.Fields["offset"] != "13" {
+		t.Fatalf("Want line of the message at 13, got %+v", msg)
+	}
+	end, expecting := command(".\r\n")
+	if !expecting || end.Command != "MESSAGE" || end.Fields["part"] != "end" || end.Fields["sender"] != "alerts@example.com" {
+		t.Fatalf("Want end of the message, got %+v", end)
+	}
+	reply("250 Ok: queued\r\n", end)
+
+	if msg, _ := command("MAIL FROM:<>\r\n"); msg.Fields["recipients"] != "" {
+		t.Fatalf("Want a new transaction, got %+v", msg)
+	}
+
+	tls, _ := command("STARTTLS\r\n")
+	reply("220 Ready to start TLS\r\n", tls)
+	if msg, _ := command("\x16\x03\x01"); msg != nil {
+		t.Fatalf("Want encrypted session not decoded, got %+v", msg)
+	}
+}
@@ -1,12 +1,17 @@
 package protocol
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mefellows/muxy/log"
 	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/layout"
 	"github.com/mefellows/plugo/plugo"
 )
 
@@ -19,8 +24,31 @@ type TCPProxy struct {
 	NaglesAlgorithm bool   `mapstructure:"nagles_algorithm"`
 	HexOutput       bool   `mapstructure:"hex_output"`
 	PacketSize      int    `mapstructure:"packet_size" default:"64" required:"true"`
-	connID          uint64
-	middleware      []muxy.Middleware
+
+	// Framing splits the stream into whole messages before middlewares
+	// are applied, instead of passing on each packet as it is read
+	Framing FramingConfig `required:"false" mapstructure:"framing"`
+
+	// Layout describes the fields of the messages of a binary protocol,
+	// which are decoded for middlewares. A length field also splits the
+	// stream into messages, in place of Framing.
+	Layout layout.Layout `required:"false" mapstructure:"layout"`
+
+	// MaxConnections limits the number of concurrent connections. Zero is unlimited
+	MaxConnections int `required:"false" mapstructure:"max_connections"`
+
+	// Overflow is the behaviour once MaxConnections is reached:
+	// queue (default), refuse, hang or close
+	Overflow string `required:"false" mapstructure:"overflow"`
+
+	connID     uint64
+	middleware []muxy.Middleware
+	splitter   func(request bool) bufio.SplitFunc
+	limiter    *connLimiter
+
+	// codec, if set, creates the codec used to decode the messages of
+	// each connection for protocol-aware proxies
+	codec func() codec
 }
 
 func init() {
@@ -38,6 +66,35 @@ var check = func(err error) {
 // Setup the TCP proxy
 func (p *TCPProxy) Setup(middleware []muxy.Middleware) {
 	p.middleware = middleware
+	if p.codec != nil {
+		p.middleware = sessionMiddleware(p.codec, middleware)
+	}
+	if len(p.Layout.Fields) > 0 {
+		check(p.Layout.Validate())
+		p.middleware = append([]muxy.Middleware{&layoutDecoder{layout: &p.Layout}}, p.middleware...)
+	}
+
+	if p.splitter == nil && p.Layout.Length != "" {
+		if p.Framing.Type != "" {
+			check(fmt.Errorf("framing cannot be used with a layout length"))
+		}
+		max := p.Framing.MaxSize
+		if max <= 0 {
+			max = defaultMaxMessageSize
+		}
+		p.splitter = func(bool) bufio.SplitFunc {
+			return p.Layout.Split(max)
+		}
+	}
+	if p.splitter == nil {
+		splitter, err := p.Framing.splitter()
+		check(err)
+		p.splitter = splitter
+	}
+
+	limiter, err := newConnLimiter(p.MaxConnections, p.Overflow)
+	check(err)
+	p.limiter = limiter
 }
 
 // Teardown the TCP proxy
@@ -56,20 +113,36 @@ func (p *TCPProxy) Proxy() {
 
 	for {
 		log.Info("TCP Proxy proxy listening on %s", log.Colorize(log.BLUE, fmt.Sprintf("tcp://%s:%d", p.Host, p.Port)))
+		if p.limiter != nil && p.limiter.queueing() {
+			p.limiter.wait()
+		}
 		conn, err := listener.AcceptTCP()
 		if err != nil {
 			log.Error("Failed to accept connection", err)
+			if p.limiter != nil && p.limiter.queueing() {
+				p.limiter.release()
+			}
+			continue
+		}
+		if p.limiter != nil && !p.limiter.queueing() && !p.limiter.admit(conn) {
 			continue
 		}
 		p.connID++
 
 		p := &proxy{
+			id:         p.connID,
+			opened:     time.Now(),
 			lconn:      conn,
 			laddr:      laddr,
 			raddr:      raddr,
 			packetsize: p.PacketSize,
+			maxsize:    p.Framing.MaxSize,
+			values:     &sync.Map{},
+			limiter:    p.limiter,
+			splitter:   p.splitter,
 			erred:      false,
-			errsig:     make(chan bool),
+			errsig:     make(chan bool, 1),
+			done:       make(chan bool),
 			prefix:     fmt.Sprintf("Connection #%03d ", p.connID),
 			hex:        p.HexOutput,
 			nagles:     p.NaglesAlgorithm,
@@ -79,9 +152,11 @@ func (p *TCPProxy) Proxy() {
 	}
 }
 
-//A proxy represents a pair of connections and their state
+// A proxy represents a pair of connections and their state
 type proxy struct {
 	middleware    []muxy.Middleware
+	id            uint64
+	opened        time.Time
 	sentBytes     uint64
 	receivedBytes uint64
 	laddr, raddr  *net.TCPAddr
@@ -89,23 +164,78 @@ type proxy struct {
 	protocol      string
 	erred         bool
 	errsig        chan bool
+	done          chan bool
 	prefix        string
 	matcher       func([]byte)
 	replacer      func([]byte) []byte
 	nagles        bool
 	hex           bool
 	packetsize    int
+	maxsize       int
+	values        *sync.Map
+	limiter       *connLimiter
+	splitter      func(request bool) bufio.SplitFunc
+
+	// replyLock serialises responses from the target with replies
+	// sent to the client on its behalf
+	replyLock sync.Mutex
+
+	// lock protects the connection state below, which may be
+	// modified by either pipe or a scheduled fault
+	lock          sync.Mutex
+	pendingFault  muxy.ConnectionFault
+	faultBudget   uint64
+	requestFault  muxy.ConnectionFault
+	responseFault muxy.ConnectionFault
+	requestEnded  bool
 }
 
-func (p *proxy) err(s string, err error) {
+// close signals the connection to shut down, returning false if
+// it has already been signalled
+func (p *proxy) close() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
 	if p.erred {
+		return false
+	}
+	p.errsig <- true
+	p.erred = true
+	return true
+}
+
+// closed returns true once the connection has been signalled to shut down
+func (p *proxy) closed() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.erred
+}
+
+func (p *proxy) err(s string, err error) {
+	if !p.close() {
 		return
 	}
 	if err != io.EOF {
 		log.Warn(p.prefix+s+"%v: ", err)
 	}
-	p.errsig <- true
-	p.erred = true
+}
+
+// connection returns a snapshot of the connection state for a middleware event
+func (p *proxy) connection() *muxy.Connection {
+	return &muxy.Connection{
+		Values:        p.values,
+		ID:            p.id,
+		ClientAddr:    p.lconn.RemoteAddr(),
+		Opened:        p.opened,
+		SentBytes:     atomic.LoadUint64(&p.sentBytes),
+		ReceivedBytes: atomic.LoadUint64(&p.receivedBytes),
+	}
+}
+
+func (p *proxy) handleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	for _, middleware := range p.middleware {
+		log.Trace("TCP Proxy applying middleware %v", middleware)
+		middleware.HandleEvent(e, ctx)
+	}
 }
 
 func (p *proxy) start() {
@@ -113,6 +243,24 @@ func (p *proxy) start() {
 	log.Trace("TCP Proxy Starting TCP Proxy")
 
 	defer p.lconn.Close()
+	if p.limiter != nil {
+		defer p.limiter.release()
+	}
+
+	// give middlewares the chance to fault the connection before dialing
+	ctx := &muxy.Context{Connection: p.connection()}
+	p.handleEvent(muxy.EventConnect, ctx)
+	c := ctx.Connection
+
+	switch {
+	case c.Fault == muxy.FaultRefuse:
+		log.Info(p.prefix+"TCP Proxy refusing connection from %s", p.lconn.RemoteAddr().String())
+		p.lconn.SetLinger(0)
+		return
+	case c.Fault == muxy.FaultClose && c.FaultDelay == 0 && c.FaultAfterBytes == 0:
+		log.Info(p.prefix+"TCP Proxy closing connection from %s", p.lconn.RemoteAddr().String())
+		return
+	}
 
 	// connect to remote
 	log.Info("Connecting to %v", p.raddr)
@@ -133,34 +281,161 @@ func (p *proxy) start() {
 	// display both ends
 	log.Info("TCP Proxy opened %s >>> %s", p.lconn.RemoteAddr().String(), p.rconn.RemoteAddr().String())
 
+	// arm any fault requested on connect
+	if c.Fault != muxy.FaultNone {
+		if c.FaultAfterBytes > 0 {
+			p.lock.Lock()
+			p.pendingFault = c.Fault
+			p.faultBudget = c.FaultAfterBytes
+			p.lock.Unlock()
+		} else if c.FaultDelay > 0 {
+			timer := time.AfterFunc(c.FaultDelay, func() {
+				p.applyFault(c.Fault)
+			})
+			defer timer.Stop()
+		} else {
+			p.applyFault(c.Fault)
+		}
+	}
+
 	// bidirectional copy
 	go p.pipe(p.lconn, p.rconn)
 	go p.pipe(p.rconn, p.lconn)
 
 	//wait for close...
 	<-p.errsig
+	close(p.done)
+
+	log.Info("TCP Proxy closed (%d bytes sent, %d bytes received)", atomic.LoadUint64(&p.sentBytes), atomic.LoadUint64(&p.receivedBytes))
+}
 
-	log.Info("TCP Proxy closed (%d bytes sent, %d bytes received)", p.sentBytes, p.receivedBytes)
+// applyFault applies a connection-level fault to the proxied connection
+func (p *proxy) applyFault(f muxy.ConnectionFault) {
+	log.Info(p.prefix+"TCP Proxy applying connection fault '%s'", f)
+
+	switch f {
+	case muxy.FaultReset, muxy.FaultRefuse:
+		p.lconn.SetLinger(0)
+		if p.rconn != nil {
+			p.rconn.SetLinger(0)
+		}
+		p.close()
+	case muxy.FaultClose:
+		p.close()
+	case muxy.FaultHalfCloseRequest, muxy.FaultStallRequest:
+		p.lock.Lock()
+		p.requestFault = f
+		p.lock.Unlock()
+		if f == muxy.FaultHalfCloseRequest && p.rconn != nil {
+			p.rconn.CloseWrite()
+		}
+	case muxy.FaultHalfCloseResponse, muxy.FaultStallResponse:
+		p.lock.Lock()
+		p.responseFault = f
+		ended := p.requestEnded
+		p.lock.Unlock()
+		if f == muxy.FaultHalfCloseResponse {
+			p.lconn.CloseWrite()
+		}
+		if ended {
+			p.close()
+		}
+	}
+}
+
+// halted returns true if the given direction should no longer be forwarded.
+// Stalled directions block until the connection is closed.
+func (p *proxy) halted(islocal bool) bool {
+	p.lock.Lock()
+	f := p.responseFault
+	if islocal {
+		f = p.requestFault
+	}
+	p.lock.Unlock()
+
+	switch f {
+	case muxy.FaultStallRequest, muxy.FaultStallResponse:
+		<-p.done
+		return true
+	case muxy.FaultHalfCloseRequest, muxy.FaultHalfCloseResponse:
+		return true
+	}
+	return false
+}
+
+// limit truncates b to the bytes remaining before a pending fault is due,
+// returning the fault if it should now be applied
+func (p *proxy) limit(b []byte) ([]byte, muxy.ConnectionFault) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.pendingFault == muxy.FaultNone {
+		return b, muxy.FaultNone
+	}
+
+	if uint64(len(b)) < p.faultBudget {
+		p.faultBudget -= uint64(len(b))
+		return b, muxy.FaultNone
+	}
+
+	b = b[:p.faultBudget]
+	f := p.pendingFault
+	p.pendingFault = muxy.FaultNone
+	p.faultBudget = 0
+	return b, f
 }
 
 func (p *proxy) pipe(src io.Reader, dst io.Writer) {
 	// Direction of traffic
 	islocal := src == p.lconn
 
-	buff := make([]byte, p.packetsize)
+	var split bufio.SplitFunc
+	if p.splitter != nil {
+		split = p.splitter(islocal)
+	}
+	framer := newFramer(src, split, p.packetsize, p.maxsize)
+
+	direction := muxy.DirectionResponse
+	if islocal {
+		direction = muxy.DirectionRequest
+	}
+	var offset uint64
+	var queue chan delivery
+	var delivered chan bool
+	defer func() {
+		if queue != nil {
+			close(queue)
+		}
+	}()
+
+	var readErr error
 	done := false
 	for !done {
-		n, readErr := src.Read(buff)
-		if readErr != nil || n == 0 {
-			if !islocal {
-				p.err("TCP Proxy read failed: ", readErr)
-			}
+		if p.halted(islocal) {
+			return
+		}
+
+		var b []byte
+		b, readErr = framer.ReadMessage()
+		if readErr != nil || len(b) == 0 {
 			done = true
 		}
 
-		b := buff[:n]
+		if p.halted(islocal) {
+			return
+		}
+
+		// Replies sent on behalf of the target must not overtake
+		// a response while it is being handled
+		if !islocal {
+			p.replyLock.Lock()
+		}
+
+		ctx := &muxy.Context{Bytes: b, Connection: p.connection()}
+		ctx.Connection.Direction = direction
+		ctx.Connection.Offset = offset
+		offset += uint64(len(b))
 
-		ctx := &muxy.Context{Bytes: b}
 		for _, middleware := range p.middleware {
 			log.Trace("TCP Proxy applying middleware %v", middleware)
 			if islocal {
@@ -173,17 +448,130 @@ func (p *proxy) pipe(src io.Reader, dst io.Writer) {
 			b = ctx.Bytes
 		}
 
-		n, err := dst.Write(b)
-		if err != nil {
-			log.Error("TCP Proxy write failed: %s", err.Error())
-			p.err("TCP Proxy write failed '%s'\n", err)
+		// Once a message is delayed, all that follow it must queue behind it
+		if ctx.Connection.Delay > 0 && queue == nil {
+			queue = make(chan delivery, deliveryQueueSize)
+			delivered = make(chan bool)
+			go p.deliver(queue, delivered, dst, islocal)
+		}
+		if queue != nil {
+			if !islocal {
+				p.replyLock.Unlock()
+			}
+			d := delivery{
+				b:     append([]byte(nil), b...),
+				reply: ctx.Connection.Reply,
+				due:   time.Now().Add(ctx.Connection.Delay),
+				fault: ctx.Connection.Fault,
+			}
+			select {
+			case queue <- d:
+				continue
+			case <-p.done:
+				return
+			}
+		}
 
+		ok := p.forward(dst, b, ctx.Connection.Reply, ctx.Connection.Fault, islocal)
+		if !islocal {
+			p.replyLock.Unlock()
+		}
+		if !ok {
 			return
 		}
-		if islocal {
-			p.sentBytes += uint64(n)
-		} else {
-			p.receivedBytes += uint64(n)
+	}
+
+	// Delayed messages are delivered before the connection is closed
+	if queue != nil {
+		close(queue)
+		queue = nil
+		<-delivered
+	}
+	if !islocal || p.endRequest() {
+		p.err("TCP Proxy read failed: ", readErr)
+	}
+}
+
+// endRequest notes that the client has finished sending, returning true if
+// the connection should now be closed, as the response direction has been
+// halted and will not end it
+func (p *proxy) endRequest() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.requestEnded = true
+	return p.responseFault != muxy.FaultNone
+}
+
+// forward writes a message to dst, and any reply to the client, applying
+// any faults that are due. It returns false once the connection has closed.
+func (p *proxy) forward(dst io.Writer, b []byte, reply []byte, requested muxy.ConnectionFault, islocal bool) bool {
+	b, fault := p.limit(b)
+
+	n, err := dst.Write(b)
+	if err != nil {
+		log.Error("TCP Proxy write failed: %s", err.Error())
+		p.err("TCP Proxy write failed '%s'\n", err)
+
+		return false
+	}
+	if islocal {
+		atomic.AddUint64(&p.sentBytes, uint64(n))
+	} else {
+		atomic.AddUint64(&p.receivedBytes, uint64(n))
+	}
+
+	if fault != muxy.FaultNone {
+		p.applyFault(fault)
+	}
+	if len(reply) > 0 && islocal && !p.closed() {
+		p.replyLock.Lock()
+		_, err = p.lconn.Write(reply)
+		p.replyLock.Unlock()
+		if err != nil {
+			p.err("TCP Proxy reply failed '%s'\n", err)
+			return false
+		}
+	}
+	if requested != muxy.FaultNone {
+		p.applyFault(requested)
+	}
+	return !p.closed()
+}
+
+// deliveryQueueSize is the number of delayed messages that may be in flight
+// in each direction before reading is paused
+const deliveryQueueSize = 64
+
+// delivery is a delayed message awaiting forwarding
+type delivery struct {
+	b     []byte
+	reply []byte
+	due   time.Time
+	fault muxy.ConnectionFault
+}
+
+// deliver forwards queued messages to dst once they are due, in order,
+// closing delivered once it is done
+func (p *proxy) deliver(queue chan delivery, delivered chan bool, dst io.Writer, islocal bool) {
+	defer close(delivered)
+	for d := range queue {
+		if wait := d.due.Sub(time.Now()); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-p.done:
+				return
+			}
+		}
+
+		if !islocal {
+			p.replyLock.Lock()
+		}
+		ok := p.forward(dst, d.b, d.reply, d.fault, islocal)
+		if !islocal {
+			p.replyLock.Unlock()
+		}
+		if !ok {
+			return
 		}
 	}
 }
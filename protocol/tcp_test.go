@@ -3,7 +3,9 @@ package protocol
 import (
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 
@@ -12,6 +14,8 @@ import (
 	"net"
 
 	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/layout"
+	"github.com/mefellows/muxy/protocol/prototest"
 	"github.com/mefellows/muxy/symptom"
 )
 
@@ -162,6 +166,536 @@ func TestTCPProxy_ProxyWithMiddleware(t *testing.T) {
 	conn.CloseRead()
 }
 
+func TestTCPProxy_ProxyWithFraming(t *testing.T) {
+	proxyPort := 7769
+	setupLocalTCP(proxyPort)
+
+	// Truncate each whole line, rather than each packet
+	tamperer := &symptom.TCPTampererSymptom{
+		Response: symptom.TCPResponseConfig{
+			Truncate: true,
+		},
+	}
+	tamperer.Setup()
+
+	port := 7770
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 4,
+		Framing: FramingConfig{
+			Type: "newline",
+		},
+	}
+	p.Setup([]muxy.Middleware{tamperer})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+
+	message := "some message\n"
+	conn.Write([]byte(message))
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	want := "some messag"
+	var b = make([]byte, 1024)
+	i, err := io.ReadAtLeast(conn, b, len(want))
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b[:i]) != want {
+		t.Fatal("Want", want, "got", string(b[:i]))
+	}
+}
+
+func TestTCPProxy_ProxyWithLayout(t *testing.T) {
+	proxyPort := 7743
+	setupLocalTCP(proxyPort)
+
+	// Set the status of pings sent to the target
+	tamperer := &symptom.FieldTampererSymptom{
+		Set: map[string]interface{}{"status": 3},
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Command: "^ping$", Direction: "request"},
+		},
+	}
+	tamperer.Setup()
+
+	port := 7744
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 4,
+		Layout: layout.Layout{
+			Fields: []layout.Field{
+				{Name: "length", Offset: 0, Size: 2},
+				{Name: "status", Offset: 2, Size: 1},
+				{Name: "op", Offset: 3, Size: 4, Type: "string"},
+			},
+			Length:       "length",
+			LengthAdjust: 7,
+			Command:      "op",
+		},
+	}
+	p.Setup([]muxy.Middleware{tamperer})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+
+	ping := []byte("\x00\x02\x01pinghi")
+	quit := []byte("\x00\x00\x01quit")
+	conn.Write(append(append([]byte(nil), ping...), quit...))
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	want := "\x00\x02\x03pinghi\x00\x00\x01quit"
+	var b = make([]byte, 1024)
+	i, err := io.ReadAtLeast(conn, b, len(want))
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b[:i]) != want {
+		t.Fatalf("Want %q, got %q", want, b[:i])
+	}
+}
+
+func TestTCPProxy_ProxyWithLayoutLargeMessage(t *testing.T) {
+	proxyPort := 7741
+	setupLocalTCP(proxyPort)
+
+	tamperer := &symptom.FieldTampererSymptom{
+		Set: map[string]interface{}{"status": 3},
+		MatchingRules: []symptom.MatchingRule{
+			symptom.MatchingRule{Command: "^ping$", Direction: "request"},
+		},
+	}
+	tamperer.Setup()
+
+	port := 7742
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 4,
+		Framing:    FramingConfig{MaxSize: 8},
+		Layout: layout.Layout{
+			Fields: []layout.Field{
+				{Name: "length", Offset: 0, Size: 2},
+				{Name: "status", Offset: 2, Size: 1},
+				{Name: "op", Offset: 3, Size: 4, Type: "string"},
+			},
+			Length:       "length",
+			LengthAdjust: 7,
+			Command:      "op",
+		},
+	}
+	p.Setup([]muxy.Middleware{tamperer})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+
+	// The message is passed on in pieces of 8 bytes, the second of which
+	// would decode as a ping of its own
+	ping := []byte("\x00\x0a\x01pingabcdpinghi")
+	quit := []byte("\x00\x00\x01quit")
+	conn.Write(append(append([]byte(nil), ping...), quit...))
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	want := "\x00\x0a\x03pingabcdpinghi\x00\x00\x01quit"
+	var b = make([]byte, 1024)
+	i, err := io.ReadAtLeast(conn, b, len(want))
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b[:i]) != want {
+		t.Fatalf("Want %q, got %q", want, b[:i])
+	}
+}
+
+// recorder records the Connection of each non-empty message event
+type recorder struct {
+	events chan muxy.Connection
+}
+
+func (r *recorder) Setup()    {}
+func (r *recorder) Teardown() {}
+func (r *recorder) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventConnect && len(ctx.Bytes) > 0 {
+		r.events <- *ctx.Connection
+	}
+}
+
+func TestTCPProxy_ProxyMessageContext(t *testing.T) {
+	proxyPort := 7767
+	setupLocalTCP(proxyPort)
+
+	r := &recorder{events: make(chan muxy.Connection, 10)}
+	port := 7768
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 64,
+		Framing: FramingConfig{
+			Type: "fixed",
+			Size: 3,
+		},
+	}
+	p.Setup([]muxy.Middleware{r})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+	conn.Write([]byte("abcdef"))
+
+	var requests, responses []uint64
+	timeout := time.After(1 * time.Second)
+	for len(requests)+len(responses) < 4 {
+		select {
+		case c := <-r.events:
+			if c.ID == 1 {
+				t.Fatal("Want waitForPort connection to be ignored")
+			}
+			if c.Direction == muxy.DirectionRequest {
+				requests = append(requests, c.Offset)
+			} else {
+				responses = append(responses, c.Offset)
+			}
+		case <-timeout:
+			t.Fatal("Timeout waiting for message events")
+		}
+	}
+
+	if !reflect.DeepEqual(requests, []uint64{0, 3}) {
+		t.Fatal("Want request offsets [0 3], got", requests)
+	}
+	if !reflect.DeepEqual(responses, []uint64{0, 3}) {
+		t.Fatal("Want response offsets [0 3], got", responses)
+	}
+}
+
+// delayer delays delivery of every non-empty request message, or of
+// every response message if response is set
+type delayer struct {
+	delay    time.Duration
+	response bool
+}
+
+func (d *delayer) Setup()    {}
+func (d *delayer) Teardown() {}
+func (d *delayer) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	event := muxy.EventPreDispatch
+	if d.response {
+		event = muxy.EventPostDispatch
+	}
+	if e == event && len(ctx.Bytes) > 0 {
+		ctx.Connection.Delay = d.delay
+	}
+}
+
+func TestTCPProxy_ProxyWithDelay(t *testing.T) {
+	proxyPort := 7765
+	setupLocalTCP(proxyPort)
+
+	port := 7766
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 64,
+		Framing: FramingConfig{
+			Type: "fixed",
+			Size: 1,
+		},
+	}
+	p.Setup([]muxy.Middleware{&delayer{delay: 200 * time.Millisecond}})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+
+	// Each of the 5 messages is delayed, but not held up by those before it
+	start := time.Now()
+	message := "abcde"
+	conn.Write([]byte(message))
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var b = make([]byte, 1024)
+	i, err := io.ReadAtLeast(conn, b, len(message))
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b[:i]) != message {
+		t.Fatal("Want", message, "got", string(b[:i]))
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond || elapsed > 600*time.Millisecond {
+		t.Fatal("Want messages to be delayed ~200ms in total, took", elapsed)
+	}
+}
+
+func TestTCPProxy_ProxyWithDelayAndClose(t *testing.T) {
+	// The target sends a response, then closes the connection
+	proxyPort := 7780
+	prototest.Serve(proxyPort, func(c net.Conn) {
+		c.Write([]byte("hello"))
+	})
+
+	port := 7781
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 64,
+	}
+	p.Setup([]muxy.Middleware{&delayer{delay: 100 * time.Millisecond, response: true}})
+
+	go p.Proxy()
+	waitForPort(port, t)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The delayed response is delivered before the connection is closed
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b) != "hello" {
+		t.Fatal("Want hello, got", string(b))
+	}
+}
+
+func TestTCPProxy_ProxyWithMaxConnections(t *testing.T) {
+	proxyPort := 7763
+	setupLocalTCP(proxyPort)
+
+	port := 7764
+	p := TCPProxy{
+		Port:           port,
+		Host:           "localhost",
+		ProxyHost:      "localhost",
+		ProxyPort:      proxyPort,
+		PacketSize:     64,
+		MaxConnections: 1,
+		Overflow:       OverflowRefuse,
+	}
+	p.Setup([]muxy.Middleware{})
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+
+	// The connection made by waitForPort is held open, using the only slot
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, err := net.DialTCP("tcp", nil, remoteAddr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Fatal("Want connection to be refused, got nil")
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("Want connection to be refused, got timeout")
+	}
+}
+
+func TestTCPProxy_ProxyWithResetAfterBytes(t *testing.T) {
+	proxyPort := 7773
+	setupLocalTCP(proxyPort)
+
+	fault := &symptom.TCPFaultSymptom{
+		Fault:      "reset",
+		AfterBytes: 4,
+	}
+	fault.Setup()
+
+	port := 7774
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 64,
+		middleware: []muxy.Middleware{fault},
+	}
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	// waitForPort consumes connection #1
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, _ := net.DialTCP("tcp", nil, remoteAddr)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("some message"))
+	if err != nil {
+		t.Fatal("Got error, want nil")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	var b = make([]byte, 1024)
+	i, err := conn.Read(b)
+	if err == nil && i > 4 {
+		t.Fatal("Want at most 4 bytes before reset, got", i)
+	}
+	for err == nil {
+		_, err = conn.Read(b)
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("Want connection to be reset, got timeout")
+	}
+}
+
+func TestTCPProxy_ProxyWithHaltedResponse(t *testing.T) {
+	for i, name := range []string{"half_close", "stall"} {
+		// The target notes when its connection is closed
+		proxyPort := 7782 + 2*i
+		closed := make(chan bool, 10)
+		prototest.Serve(proxyPort, func(c net.Conn) {
+			ioutil.ReadAll(c)
+			closed <- true
+		})
+
+		fault := &symptom.TCPFaultSymptom{
+			Fault:     name,
+			Direction: "response",
+		}
+		fault.Setup()
+
+		port := proxyPort + 1
+		p := TCPProxy{
+			Port:       port,
+			Host:       "localhost",
+			ProxyHost:  "localhost",
+			ProxyPort:  proxyPort,
+			PacketSize: 64,
+			middleware: []muxy.Middleware{fault},
+		}
+
+		go p.Proxy()
+		waitForPort(port, t)
+
+		conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("some message"))
+		conn.Close()
+
+		// Once the client is done, nothing is left to end the connection
+		select {
+		case <-closed:
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Want connection to the target to be closed after %s of the response", name)
+		}
+	}
+}
+
+func TestTCPProxy_ProxyWithRefuse(t *testing.T) {
+	proxyPort := 7771
+	setupLocalTCP(proxyPort)
+
+	fault := &symptom.TCPFaultSymptom{
+		Fault: "refuse",
+	}
+	fault.Setup()
+
+	port := 7772
+	p := TCPProxy{
+		Port:       port,
+		Host:       "localhost",
+		ProxyHost:  "localhost",
+		ProxyPort:  proxyPort,
+		PacketSize: 64,
+		middleware: []muxy.Middleware{fault},
+	}
+
+	waitForPort(proxyPort, t)
+	go p.Proxy()
+	waitForPort(port, t)
+
+	remoteAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port))
+	conn, err := net.DialTCP("tcp", nil, remoteAddr)
+	if err != nil {
+		// Reset before the handshake completed
+		return
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(1 * time.Second))
+	var b = make([]byte, 1024)
+	_, err = conn.Read(b)
+	if err == nil {
+		t.Fatal("Want connection to be refused, got nil")
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		t.Fatal("Want connection to be refused, got timeout")
+	}
+}
+
+func TestTCPProxy_limit(t *testing.T) {
+	p := proxy{
+		pendingFault: muxy.FaultClose,
+		faultBudget:  5,
+	}
+
+	b, f := p.limit([]byte("abc"))
+	if string(b) != "abc" || f != muxy.FaultNone {
+		t.Fatal("Want 'abc' and no fault, got", string(b), f)
+	}
+
+	b, f = p.limit([]byte("defg"))
+	if string(b) != "de" || f != muxy.FaultClose {
+		t.Fatal("Want 'de' and close fault, got", string(b), f)
+	}
+
+	b, f = p.limit([]byte("hij"))
+	if string(b) != "hij" || f != muxy.FaultNone {
+		t.Fatal("Want 'hij' and no fault, got", string(b), f)
+	}
+}
+
 func TestTCPProxy_ProxyFail(t *testing.T) {
 	oldCheck := check
 	doneChan := make(chan bool, 1)
@@ -0,0 +1,64 @@
+package symptom
+
+import (
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// AcceptDelaySymptom delays servicing new TCP connections, emulating an
+// overloaded backend that is slow to accept them
+type AcceptDelaySymptom struct {
+	// Delay in ms before the connection is serviced
+	Delay         int            `required:"true" mapstructure:"delay"`
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &AcceptDelaySymptom{}, nil
+	}, "accept_delay")
+}
+
+// Setup sets up the plugin
+func (s *AcceptDelaySymptom) Setup() {
+	log.Debug("Accept Delay Symptom - Setup()")
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *AcceptDelaySymptom) Teardown() {
+	log.Debug("Accept Delay Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *AcceptDelaySymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventConnect || ctx.Connection == nil {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Accept Delay Symptom Hit")
+		s.Muck(ctx)
+	} else {
+		log.Trace("Accept Delay Symptom Miss")
+	}
+}
+
+// Muck delays the connection. The target is not dialed until it completes.
+func (s *AcceptDelaySymptom) Muck(ctx *muxy.Context) {
+	delay := time.Duration(s.Delay) * time.Millisecond
+	log.Debug("Accept Delay Symptom - delaying connection for %v", delay)
+	time.Sleep(delay)
+}
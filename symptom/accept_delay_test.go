@@ -0,0 +1,57 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func TestAcceptDelay_Setup(t *testing.T) {
+	s := AcceptDelaySymptom{}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestAcceptDelay_Teardown(t *testing.T) {
+	s := AcceptDelaySymptom{}
+	s.Teardown()
+}
+
+func TestAcceptDelay_HandleEvent(t *testing.T) {
+	s := AcceptDelaySymptom{Delay: 20}
+	s.Setup()
+
+	ctx := &muxy.Context{Connection: &muxy.Connection{ID: 1}}
+
+	start := time.Now()
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if elapsed := time.Since(start); elapsed >= 20*time.Millisecond {
+		t.Fatal("Want messages not to be delayed, took", elapsed)
+	}
+
+	start = time.Now()
+	s.HandleEvent(muxy.EventConnect, ctx)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Fatal("Want connection to be delayed 20ms, took", elapsed)
+	}
+}
+
+func TestAcceptDelay_HandleEventMiss(t *testing.T) {
+	s := AcceptDelaySymptom{
+		Delay: 1000,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Connection: 2},
+		},
+	}
+	s.Setup()
+
+	start := time.Now()
+	s.HandleEvent(muxy.EventConnect, &muxy.Context{Connection: &muxy.Connection{ID: 1}})
+	if elapsed := time.Since(start); elapsed >= 1000*time.Millisecond {
+		t.Fatal("Want connection not to be delayed, took", elapsed)
+	}
+}
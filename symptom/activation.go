@@ -0,0 +1,243 @@
+package symptom
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+)
+
+// maxExchanges is the number of exchanges behind the latest for which
+// decisions are remembered, so that their responses share the decision
+// made for their request. It also bounds the connections of which the
+// decisions of unanswered requests are remembered.
+const maxExchanges = 1024
+
+// maxActivationKeys is the number of keys for which the state of a pattern
+// is kept. Beyond it, the state of the least recently used key is forgotten.
+const maxActivationKeys = 10000
+
+// decision is whether a rule is active for an event, and the step of its
+// sequence, if it has one
+type decision struct {
+	active bool
+	step   string
+}
+
+// connectionKey identifies a connection, or UDP exchange, of a proxy
+type connectionKey struct {
+	values *sync.Map
+	id     uint64
+}
+
+// activation is the state of the activation pattern of a matching rule,
+// for one client or header value
+type activation struct {
+	// matched counts the requests matched by the rule
+	matched int
+
+	// started is the time of the first request matched by the rule, and
+	// used that of the latest
+	started time.Time
+	used    time.Time
+
+	// decisions are those made for recent HTTP exchanges
+	decisions map[uint64]decision
+
+	// unanswered are the decisions made for the request messages of recent
+	// connections, oldest first, to be shared by the responses to them
+	unanswered  map[connectionKey][]decision
+	connections []connectionKey
+}
+
+var (
+	activations     = map[*MatchingRule]map[string]*activation{}
+	activationsLock sync.Mutex
+)
+
+// stateful returns true if the rule activates by a pattern
+func (rule *MatchingRule) stateful() bool {
+	return rule.First > 0 || rule.Every > 0 || rule.FlapOn > 0 || rule.Sequence != ""
+}
+
+// activate returns true if the pattern of a matching rule activates it
+// for the event in ctx, along with the step of its sequence. Events of the
+// same exchange share one decision, so that a request and its response
+// count once: HTTP events by their Exchange, and the response messages of
+// a connection by the request messages they answer, in order.
+func activate(rule *MatchingRule, ctx muxy.Context) (bool, string) {
+	if !rule.stateful() {
+		return true, ""
+	}
+
+	activationsLock.Lock()
+	defer activationsLock.Unlock()
+
+	states, ok := activations[rule]
+	if !ok {
+		states = map[string]*activation{}
+		activations[rule] = states
+	}
+	key := activationKey(rule.Per, ctx)
+	state, ok := states[key]
+	if !ok {
+		forgetLeastRecent(states)
+		state = &activation{
+			started:    time.Now(),
+			decisions:  map[uint64]decision{},
+			unanswered: map[connectionKey][]decision{},
+		}
+		states[key] = state
+	}
+	state.used = time.Now()
+
+	if d, ok := state.shared(ctx); ok {
+		return d.active, d.step
+	}
+
+	state.matched++
+	d := rule.pattern(state.matched, time.Since(state.started))
+	log.Debug("MatchingRule activation of match #%d for '%s' is %v", state.matched, key, d.active)
+	state.share(ctx, d)
+	return d.active, d.step
+}
+
+// shared returns the decision made for an earlier event of the exchange
+// of ctx, if there is one
+func (state *activation) shared(ctx muxy.Context) (decision, bool) {
+	if ctx.Exchange != 0 {
+		d, ok := state.decisions[ctx.Exchange]
+		return d, ok
+	}
+	if ctx.Connection != nil && ctx.Connection.Direction == muxy.DirectionResponse {
+		conn := connectionKey{ctx.Connection.Values, ctx.Connection.ID}
+		if pending := state.unanswered[conn]; len(pending) > 0 {
+			state.unanswered[conn] = pending[1:]
+			return pending[0], true
+		}
+	}
+	return decision{}, false
+}
+
+// share keeps the decision made for ctx, for the later events of its
+// exchange
+func (state *activation) share(ctx muxy.Context, d decision) {
+	if ctx.Exchange != 0 {
+		state.decisions[ctx.Exchange] = d
+		for exchange := range state.decisions {
+			if exchange+maxExchanges < ctx.Exchange {
+				delete(state.decisions, exchange)
+			}
+		}
+		return
+	}
+	if ctx.Connection == nil || ctx.Connection.Direction != muxy.DirectionRequest {
+		return
+	}
+
+	conn := connectionKey{ctx.Connection.Values, ctx.Connection.ID}
+	pending, ok := state.unanswered[conn]
+	if !ok {
+		state.connections = append(state.connections, conn)
+		if len(state.connections) > maxExchanges {
+			delete(state.unanswered, state.connections[0])
+			state.connections = state.connections[1:]
+		}
+	}
+	if len(pending) >= maxExchanges {
+		pending = pending[1:]
+	}
+	state.unanswered[conn] = append(pending, d)
+}
+
+// forgetLeastRecent forgets the state of the least recently used key, once
+// there are too many
+func forgetLeastRecent(states map[string]*activation) {
+	if len(states) < maxActivationKeys {
+		return
+	}
+	var oldest string
+	var used time.Time
+	for key, state := range states {
+		if used.IsZero() || state.used.Before(used) {
+			oldest, used = key, state.used
+		}
+	}
+	delete(states, oldest)
+}
+
+// pattern returns the decision of the rule for the nth request it has
+// matched, elapsed after the first. Every pattern given must be active.
+func (rule *MatchingRule) pattern(n int, elapsed time.Duration) decision {
+	if rule.First > 0 && n > rule.First {
+		return decision{}
+	}
+	if rule.Every > 0 && n%rule.Every != 0 {
+		return decision{}
+	}
+	if rule.FlapOn > 0 {
+		period := time.Duration(rule.FlapOn+rule.FlapOff) * time.Millisecond
+		if elapsed%period >= time.Duration(rule.FlapOn)*time.Millisecond {
+			return decision{}
+		}
+	}
+	if rule.Sequence != "" {
+		steps := strings.Split(rule.Sequence, ",")
+		step := strings.TrimSpace(steps[(n-1)%len(steps)])
+		if strings.EqualFold(step, "ok") {
+			return decision{}
+		}
+		return decision{active: true, step: step}
+	}
+	return decision{active: true}
+}
+
+// activationKey returns the value by which the state of a pattern is kept:
+// the client IP address, a request header or path, or the key of a message
+func activationKey(per string, ctx muxy.Context) string {
+	switch {
+	case per == "client_ip":
+		if ctx.Request != nil {
+			return hostOf(ctx.Request.RemoteAddr)
+		}
+		if ctx.Connection != nil && ctx.Connection.ClientAddr != nil {
+			return hostOf(ctx.Connection.ClientAddr.String())
+		}
+	case strings.HasPrefix(per, "header:"):
+		if ctx.Request != nil {
+			return ctx.Request.Header.Get(strings.TrimPrefix(per, "header:"))
+		}
+	case per == "path":
+		if ctx.Request != nil && ctx.Request.URL != nil {
+			return ctx.Request.URL.Path
+		}
+	case per == "key":
+		if ctx.Message != nil {
+			return ctx.Message.Key
+		}
+	}
+	return ""
+}
+
+// validPer returns true if per is empty, or names a value by which
+// activationKey keeps state
+func validPer(per string) bool {
+	switch {
+	case per == "", per == "client_ip", per == "path", per == "key":
+		return true
+	case strings.HasPrefix(per, "header:"):
+		return strings.TrimPrefix(per, "header:") != ""
+	}
+	return false
+}
+
+// hostOf returns the host of addr, without its port
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,244 @@
+package symptom
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/amqp"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// AMQPSymptom closes the channels and connections of an AMQP Proxy, and
+// tampers with the delivery and acknowledgement of their messages
+type AMQPSymptom struct {
+	// Close fails matching methods with a reply code, by name or number,
+	// e.g. NOT_FOUND or CONNECTION_FORCED. Soft errors close the channel
+	// of the client's methods, and hard errors the connection.
+	Close string `required:"false"`
+
+	// WithholdAcks discards matching basic.ack methods: publisher
+	// confirms from the broker, or acknowledgements from consumers
+	WithholdAcks bool `required:"false" mapstructure:"withhold_acks"`
+
+	// Nack turns matching basic.ack methods into a basic.nack
+	Nack bool `required:"false"`
+
+	// Requeue asks the broker to requeue consumer messages given a Nack
+	Requeue bool `required:"false"`
+
+	// Delay in ms before matching basic.deliver and basic.get-ok methods,
+	// and their content, are sent to the client
+	Delay int `required:"false"`
+
+	// Exchange and Queue are regular expressions limiting the methods
+	// affected to those acting upon the matching exchanges and queues
+	Exchange string `required:"false"`
+	Queue    string `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	code     uint16
+	exchange *regexp.Regexp
+	queue    *regexp.Regexp
+}
+
+// amqpClosingKey identifies the closing state of a channel in the Values
+// of its connection
+type amqpClosingKey struct {
+	channel string
+}
+
+// amqpClosing tracks a channel closed on behalf of the client and broker,
+// whose frames are discarded until each has acknowledged the close
+type amqpClosing struct {
+	lock   sync.Mutex
+	client bool
+	broker bool
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &AMQPSymptom{}, nil
+	}, "amqp")
+}
+
+// Setup sets up the plugin
+func (s *AMQPSymptom) Setup() {
+	log.Debug("AMQP Symptom - Setup()")
+
+	if s.Close != "" {
+		code, ok := amqp.ParseReplyCode(s.Close)
+		if !ok || code == 200 {
+			fail("AMQP Symptom - Incorrectly specified reply code:", s.Close)
+		}
+		s.code = code
+	}
+	if s.Close == "" && !s.WithholdAcks && !s.Nack && s.Delay == 0 {
+		fail("AMQP Symptom - one of close, withhold_acks, nack or delay must be specified")
+	}
+
+	var err error
+	if s.exchange, err = regexp.Compile(s.Exchange); err != nil {
+		fail("AMQP Symptom - Incorrectly specified exchange:", err)
+	}
+	if s.queue, err = regexp.Compile(s.Queue); err != nil {
+		fail("AMQP Symptom - Incorrectly specified queue:", err)
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *AMQPSymptom) Teardown() {
+	log.Debug("AMQP Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Rules match the method with command, and its routing key, or else the
+// queue or exchange, with key.
+func (s *AMQPSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "amqp" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+	if discardClosing(ctx, e == muxy.EventPreDispatch) {
+		return
+	}
+
+	if ctx.Message.Fields["frame"] != "method" || !s.matchRoute(ctx.Message) || !s.applies(ctx.Message, e) {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("AMQP Symptom Hit")
+		s.Muck(ctx, e)
+	} else {
+		log.Trace("AMQP Symptom Miss")
+	}
+}
+
+// matchRoute returns true if the exchange and queue of msg match
+func (s *AMQPSymptom) matchRoute(msg *muxy.Message) bool {
+	if s.Exchange != "" && !s.exchange.MatchString(msg.Fields["exchange"]) {
+		return false
+	}
+	return s.Queue == "" || s.queue.MatchString(msg.Fields["queue"])
+}
+
+// applies returns true if the symptom affects the method in msg
+func (s *AMQPSymptom) applies(msg *muxy.Message, e muxy.ProxyEvent) bool {
+	switch msg.Command {
+	case "connection.close", "connection.close-ok", "channel.close", "channel.close-ok":
+		return false
+	case "basic.ack":
+		if s.WithholdAcks || s.Nack {
+			return true
+		}
+	case "basic.deliver", "basic.get-ok":
+		if s.Delay > 0 {
+			return true
+		}
+	}
+	return s.Close != "" && (e == muxy.EventPreDispatch || amqp.HardError(s.code))
+}
+
+// Muck closes the channel or connection, or withholds, flips or delays
+// the method
+func (s *AMQPSymptom) Muck(ctx *muxy.Context, e muxy.ProxyEvent) {
+	msg := ctx.Message
+	switch {
+	case msg.Command == "basic.ack" && s.WithholdAcks:
+		log.Debug("AMQP Symptom - withholding basic.ack of %s", msg.Key)
+		ctx.Bytes = nil
+	case msg.Command == "basic.ack" && s.Nack:
+		log.Debug("AMQP Symptom - replacing basic.ack of %s with basic.nack", msg.Key)
+		channel, _ := strconv.Atoi(msg.Fields["channel"])
+		tag, _ := strconv.ParseUint(msg.Fields["delivery_tag"], 10, 64)
+		ctx.Bytes = amqp.NewNack(uint16(channel), tag, msg.Fields["multiple"] == "true", s.Requeue)
+	case (msg.Command == "basic.deliver" || msg.Command == "basic.get-ok") && s.Delay > 0:
+		log.Debug("AMQP Symptom - delaying %s of %s by %dms", msg.Command, msg.Key, s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	default:
+		s.close(ctx, e == muxy.EventPreDispatch)
+	}
+}
+
+// close fails the method in ctx with the reply code, closing its channel
+// or the connection
+func (s *AMQPSymptom) close(ctx *muxy.Context, request bool) {
+	channel, _ := strconv.Atoi(ctx.Message.Fields["channel"])
+	method, _ := strconv.Atoi(ctx.Message.Fields["method_id"])
+	text := fmt.Sprintf("%s - injected by Muxy", amqp.ReplyText(s.code))
+
+	if channel == 0 || amqp.HardError(s.code) {
+		log.Debug("AMQP Symptom - closing connection on %s with %d", ctx.Message.Command, s.code)
+		frame := amqp.NewClose(0, s.code, text, uint32(method))
+		if request {
+			ctx.Bytes = nil
+			ctx.Connection.Reply = frame
+		} else {
+			ctx.Bytes = frame
+		}
+		ctx.Connection.Fault = muxy.FaultClose
+		return
+	}
+
+	// The channel is closed by the client as far as the broker is
+	// concerned, and by the broker as far as the client is
+	log.Debug("AMQP Symptom - closing channel %d on %s with %d", channel, ctx.Message.Command, s.code)
+	if ctx.Connection.Values != nil {
+		ctx.Connection.Values.Store(amqpClosingKey{ctx.Message.Fields["channel"]}, &amqpClosing{client: true, broker: true})
+	}
+	ctx.Bytes = amqp.NewClose(uint16(channel), 200, "Closed by Muxy", 0)
+	ctx.Connection.Reply = amqp.NewClose(uint16(channel), s.code, text, uint32(method))
+}
+
+// discardClosing discards the frames of a channel being closed by an AMQP
+// Symptom, until it has been closed on both sides. It returns true if the
+// frame was discarded.
+func discardClosing(ctx *muxy.Context, request bool) bool {
+	if ctx.Connection.Values == nil || ctx.Message.Fields["channel"] == "" {
+		return false
+	}
+	key := amqpClosingKey{ctx.Message.Fields["channel"]}
+	v, ok := ctx.Connection.Values.Load(key)
+	if !ok {
+		return false
+	}
+
+	c := v.(*amqpClosing)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := &c.broker
+	if request {
+		pending = &c.client
+	}
+	if !*pending {
+		return false
+	}
+
+	ctx.Bytes = nil
+	if ctx.Message.Command == "channel.close-ok" && ctx.Message.Fields["frame"] == "method" {
+		*pending = false
+		if !c.client && !c.broker {
+			ctx.Connection.Values.Delete(key)
+		}
+	}
+	return true
+}
@@ -0,0 +1,206 @@
+package symptom
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/amqp"
+)
+
+func amqpContext(command string, frame string, key string, direction muxy.Direction) *muxy.Context {
+	return &muxy.Context{
+		Bytes:      []byte("frame"),
+		Connection: &muxy.Connection{ID: 1, Direction: direction, Values: &sync.Map{}},
+		Message: &muxy.Message{
+			Protocol: "amqp",
+			Command:  command,
+			Key:      key,
+			Fields: map[string]string{
+				"frame":        frame,
+				"channel":      "1",
+				"method_id":    strconv.Itoa(amqp.BasicPublish),
+				"exchange":     "orders",
+				"routing_key":  key,
+				"queue":        "orders-queue",
+				"delivery_tag": "7",
+				"multiple":     "true",
+			},
+		},
+	}
+}
+
+// amqpMethod decodes the method frame in b
+func amqpMethod(t *testing.T, b []byte) (uint16, *amqp.Method) {
+	f, ok := amqp.ParseFrame(b)
+	if !ok {
+		t.Fatalf("Want frame, got %q", b)
+	}
+	m, ok := amqp.ParseMethod(f.Payload)
+	if !ok {
+		t.Fatalf("Want method, got %q", b)
+	}
+	return f.Channel, m
+}
+
+func TestAMQP_Setup(t *testing.T) {
+	s := AMQPSymptom{Close: "precondition_failed"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.code != 406 {
+		t.Fatal("Want reply code 406, got", s.code)
+	}
+}
+
+func TestAMQP_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := AMQPSymptom{}
+	s.Setup()
+	s = AMQPSymptom{Close: "REPLY_SUCCESS"}
+	s.Setup()
+	s = AMQPSymptom{Nack: true, Exchange: "("}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestAMQP_Teardown(t *testing.T) {
+	s := AMQPSymptom{}
+	s.Teardown()
+}
+
+func TestAMQP_WithholdAcks(t *testing.T) {
+	s := AMQPSymptom{WithholdAcks: true, Queue: "^orders-"}
+	s.Setup()
+
+	ctx := amqpContext("basic.ack", "method", "order.created", muxy.DirectionRequest)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil {
+		t.Fatal("Want basic.ack withheld")
+	}
+
+	ctx = amqpContext("basic.ack", "method", "order.created", muxy.DirectionRequest)
+	ctx.Message.Fields["queue"] = "events-queue"
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil {
+		t.Fatal("Want basic.ack of other queues forwarded")
+	}
+}
+
+func TestAMQP_Nack(t *testing.T) {
+	s := AMQPSymptom{Nack: true, Requeue: true}
+	s.Setup()
+
+	ctx := amqpContext("basic.ack", "method", "order.created", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	channel, m := amqpMethod(t, ctx.Bytes)
+	if channel != 1 || m.ID != amqp.BasicNack || m.DeliveryTag != 7 || !m.Multiple || !m.Requeue {
+		t.Fatalf("Want basic.nack of 7, got %+v", m)
+	}
+}
+
+func TestAMQP_Delay(t *testing.T) {
+	s := AMQPSymptom{Delay: 50}
+	s.Setup()
+
+	ctx := amqpContext("basic.deliver", "method", "order.created", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Connection.Delay != 50*time.Millisecond {
+		t.Fatal("Want basic.deliver delayed by 50ms, got", ctx.Connection.Delay)
+	}
+
+	// The content follows the method, so is not delayed again
+	ctx = amqpContext("basic.deliver", "body", "order.created", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want content not delayed, got", ctx.Connection.Delay)
+	}
+}
+
+func TestAMQP_CloseConnection(t *testing.T) {
+	s := AMQPSymptom{Close: "CONNECTION_FORCED"}
+	s.Setup()
+
+	ctx := amqpContext("basic.deliver", "method", "order.created", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	channel, m := amqpMethod(t, ctx.Bytes)
+	if channel != 0 || m.ID != amqp.ConnectionClose || m.ReplyCode != 320 {
+		t.Fatalf("Want connection.close of 320, got %+v", m)
+	}
+	if ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection closed, got", ctx.Connection.Fault)
+	}
+}
+
+func TestAMQP_CloseChannel(t *testing.T) {
+	s := AMQPSymptom{
+		Close: "NOT_FOUND",
+		MatchingRules: []MatchingRule{
+			MatchingRule{Command: "^basic.publish$"},
+		},
+	}
+	s.Setup()
+
+	// Soft errors only fail the client's methods
+	ctx := amqpContext("basic.deliver", "method", "order.created", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if string(ctx.Bytes) != "frame" {
+		t.Fatal("Want basic.deliver forwarded")
+	}
+
+	ctx = amqpContext("basic.publish", "method", "order.created", muxy.DirectionRequest)
+	values := ctx.Connection.Values
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+
+	channel, m := amqpMethod(t, ctx.Connection.Reply)
+	if channel != 1 || m.ID != amqp.ChannelClose || m.ReplyCode != 404 {
+		t.Fatalf("Want channel.close of 404 to the client, got %+v", m)
+	}
+	channel, m = amqpMethod(t, ctx.Bytes)
+	if channel != 1 || m.ID != amqp.ChannelClose || m.ReplyCode != 200 {
+		t.Fatalf("Want channel.close of 200 to the broker, got %+v", m)
+	}
+
+	// Frames on the channel are discarded until both sides acknowledge
+	// the close, including their acknowledgements
+	frames := []struct {
+		command   string
+		frame     string
+		direction muxy.Direction
+		discarded bool
+	}{
+		{"basic.publish", "body", muxy.DirectionRequest, true},
+		{"basic.deliver", "method", muxy.DirectionResponse, true},
+		{"channel.close-ok", "method", muxy.DirectionRequest, true},
+		{"channel.open", "method", muxy.DirectionRequest, false},
+		{"channel.close-ok", "method", muxy.DirectionResponse, true},
+		{"channel.open-ok", "method", muxy.DirectionResponse, false},
+	}
+	for _, f := range frames {
+		ctx := amqpContext(f.command, f.frame, "", f.direction)
+		ctx.Connection.Values = values
+		e := muxy.EventPreDispatch
+		if f.direction == muxy.DirectionResponse {
+			e = muxy.EventPostDispatch
+		}
+		s.HandleEvent(e, ctx)
+		if (ctx.Bytes == nil) != f.discarded {
+			t.Fatalf("Want %s %s discarded to be %v", f.direction, f.command, f.discarded)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package symptom
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of delay distribution
+const (
+	DistributionUniform     = "uniform"
+	DistributionNormal      = "normal"
+	DistributionLogNormal   = "lognormal"
+	DistributionPareto      = "pareto"
+	DistributionPercentiles = "percentiles"
+)
+
+// DelayDistribution describes a distribution of delays in ms, so that
+// delays have the long tail of real dependencies rather than being fixed
+type DelayDistribution struct {
+	// Type is one of uniform, normal, lognormal, pareto or percentiles
+	Type string
+
+	// Min and Max bound a uniform distribution. For other types, they
+	// clamp the delays drawn, if set
+	Min float64
+	Max float64
+
+	// Mean and StdDev describe a normal distribution
+	Mean   float64
+	StdDev float64 `mapstructure:"stddev"`
+
+	// Median and Sigma describe a log-normal distribution: the median
+	// delay, and the standard deviation of its natural logarithm
+	Median float64
+	Sigma  float64
+
+	// Scale and Shape describe a Pareto distribution: the smallest delay,
+	// and the tail index, where smaller shapes have longer tails
+	Scale float64
+	Shape float64
+
+	// Percentiles describe an empirical distribution by the delay at each
+	// percentile, e.g. p50: 20, p99: 300 and p999: 1200. Delays between
+	// them are interpolated, and those below the lowest from Min.
+	Percentiles map[string]float64
+
+	// points are the parsed Percentiles, in order
+	points []percentilePoint
+}
+
+// percentilePoint is the delay at a percentile of an empirical distribution
+type percentilePoint struct {
+	percentile float64
+	delay      float64
+}
+
+// validate checks the distribution, and parses its percentiles
+func (d *DelayDistribution) validate() error {
+	if d.Min < 0 || (d.Max != 0 && d.Max < d.Min) {
+		return fmt.Errorf("invalid bounds %v-%v", d.Min, d.Max)
+	}
+
+	switch d.Type {
+	case DistributionUniform:
+		if d.Max <= 0 {
+			return fmt.Errorf("uniform distribution requires a max")
+		}
+	case DistributionNormal:
+		if d.StdDev < 0 {
+			return fmt.Errorf("invalid stddev %v", d.StdDev)
+		}
+	case DistributionLogNormal:
+		if d.Median <= 0 || d.Sigma < 0 {
+			return fmt.Errorf("lognormal distribution requires a positive median and sigma")
+		}
+	case DistributionPareto:
+		if d.Scale <= 0 || d.Shape <= 0 {
+			return fmt.Errorf("pareto distribution requires a positive scale and shape")
+		}
+	case DistributionPercentiles:
+		return d.parsePercentiles()
+	default:
+		return fmt.Errorf("unknown distribution type '%s'", d.Type)
+	}
+	return nil
+}
+
+// parsePercentiles parses the keys of Percentiles, e.g. p50, p999 or p99.9,
+// checking that delays increase with each percentile
+func (d *DelayDistribution) parsePercentiles() error {
+	if len(d.Percentiles) == 0 {
+		return fmt.Errorf("percentiles distribution requires at least one percentile")
+	}
+
+	d.points = nil
+	for key, delay := range d.Percentiles {
+		p := strings.TrimPrefix(strings.ToLower(key), "p")
+		// Digits after the first two are decimals, so that p999 is 99.9
+		if !strings.Contains(p, ".") && len(p) > 2 && p != "100" {
+			p = p[:2] + "." + p[2:]
+		}
+		percentile, err := strconv.ParseFloat(p, 64)
+		if err != nil || percentile < 0 || percentile > 100 {
+			return fmt.Errorf("invalid percentile '%s'", key)
+		}
+		if delay < 0 {
+			return fmt.Errorf("invalid delay %v of percentile '%s'", delay, key)
+		}
+		d.points = append(d.points, percentilePoint{percentile, delay})
+	}
+
+	sort.Slice(d.points, func(i, j int) bool {
+		return d.points[i].percentile < d.points[j].percentile
+	})
+	for i := 1; i < len(d.points); i++ {
+		if d.points[i].delay < d.points[i-1].delay {
+			return fmt.Errorf("delays must increase with each percentile")
+		}
+	}
+	return nil
+}
+
+// sample draws a delay from the distribution
+func (d *DelayDistribution) sample(r *rand.Rand) time.Duration {
+	var ms float64
+	switch d.Type {
+	case DistributionUniform:
+		ms = d.Min + r.Float64()*(d.Max-d.Min)
+	case DistributionNormal:
+		ms = d.Mean + r.NormFloat64()*d.StdDev
+	case DistributionLogNormal:
+		ms = d.Median * math.Exp(r.NormFloat64()*d.Sigma)
+	case DistributionPareto:
+		ms = d.Scale * math.Pow(1-r.Float64(), -1/d.Shape)
+	case DistributionPercentiles:
+		ms = d.interpolate(r.Float64() * 100)
+	}
+
+	if d.Max > 0 && ms > d.Max {
+		ms = d.Max
+	}
+	if ms < d.Min {
+		ms = d.Min
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// interpolate returns the delay at a percentile of an empirical
+// distribution. Beyond the highest percentile, delays rise towards Max,
+// if it is set.
+func (d *DelayDistribution) interpolate(percentile float64) float64 {
+	lower := percentilePoint{0, d.Min}
+	for _, p := range d.points {
+		if percentile <= p.percentile {
+			if p.percentile == lower.percentile {
+				return p.delay
+			}
+			f := (percentile - lower.percentile) / (p.percentile - lower.percentile)
+			return lower.delay + f*(p.delay-lower.delay)
+		}
+		lower = p
+	}
+
+	if d.Max <= lower.delay || lower.percentile >= 100 {
+		return lower.delay
+	}
+	f := (percentile - lower.percentile) / (100 - lower.percentile)
+	return lower.delay + f*(d.Max-lower.delay)
+}
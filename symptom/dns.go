@@ -0,0 +1,201 @@
+package symptom
+
+import (
+	"net"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/dns"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// defaultDNSAnswerTTL is the TTL of the answers given in place of the resolver
+const defaultDNSAnswerTTL = 60
+
+// DNSSymptom fails, redirects, delays or drops the queries of a DNS Proxy,
+// and tampers with the TTLs and size of their responses
+type DNSSymptom struct {
+	// Rcode answers matching queries with an error in place of the resolver:
+	// NXDOMAIN, SERVFAIL, REFUSED, NOTIMP or FORMERR
+	Rcode string `required:"false"`
+
+	// Answer answers matching A and AAAA queries with these addresses in
+	// place of the resolver
+	Answer []string `required:"false"`
+
+	// TTL sets the TTL of every record in responses, and of Answer
+	TTL int `required:"false"`
+
+	// ZeroTTL sets the TTL of every record in responses, and of Answer,
+	// to zero
+	ZeroTTL bool `required:"false" mapstructure:"zero_ttl"`
+
+	// Truncate empties UDP responses and marks them as truncated, so
+	// that clients retry over TCP
+	Truncate bool `required:"false"`
+
+	// Delay in ms before matching queries are sent to the resolver
+	Delay int `required:"false"`
+
+	// Drop discards matching queries
+	Drop bool `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	rcode int
+	ips   []net.IP
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &DNSSymptom{}, nil
+	}, "dns")
+}
+
+// Setup sets up the plugin
+func (s *DNSSymptom) Setup() {
+	log.Debug("DNS Symptom - Setup()")
+
+	if s.Rcode != "" {
+		rcode, ok := dns.ParseRcode(s.Rcode)
+		if !ok || rcode == dns.RcodeSuccess {
+			fail("DNS Symptom - Incorrectly specified rcode:", s.Rcode)
+		}
+		s.rcode = rcode
+	}
+
+	s.ips = nil
+	for _, a := range s.Answer {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			fail("DNS Symptom - Incorrectly specified answer:", a)
+		}
+		s.ips = append(s.ips, ip)
+	}
+
+	if s.TTL < 0 {
+		fail("DNS Symptom - Incorrectly specified ttl:", s.TTL)
+	}
+	if s.ZeroTTL {
+		s.TTL = 0
+	}
+	if s.Rcode == "" && len(s.Answer) == 0 && s.TTL == 0 && !s.ZeroTTL && !s.Truncate && s.Delay == 0 && !s.Drop {
+		fail("DNS Symptom - one of rcode, answer, ttl, zero_ttl, truncate, delay or drop must be specified")
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *DNSSymptom) Teardown() {
+	log.Debug("DNS Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Rules match the name queried with key, and its type with command.
+func (s *DNSSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "dns" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("DNS Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			s.Muck(ctx)
+		} else {
+			s.MuckResponse(ctx)
+		}
+	} else {
+		log.Trace("DNS Symptom Miss")
+	}
+}
+
+// Muck delays, drops or answers the query
+func (s *DNSSymptom) Muck(ctx *muxy.Context) {
+	if s.Delay > 0 {
+		log.Debug("DNS Symptom - delaying query for %s by %dms", ctx.Message.Key, s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+
+	if s.Drop {
+		log.Debug("DNS Symptom - dropping query for %s", ctx.Message.Key)
+		ctx.Bytes = nil
+		return
+	}
+	if s.Rcode == "" && len(s.ips) == 0 {
+		return
+	}
+
+	query, tcp := dnsPayload(ctx)
+	m, err := dns.Parse(query)
+	if err != nil {
+		return
+	}
+
+	var reply []byte
+	if s.Rcode != "" {
+		log.Debug("DNS Symptom - answering query for %s with %s", ctx.Message.Key, s.Rcode)
+		reply = dns.NewError(query, m, s.rcode)
+	} else {
+		ttl := s.TTL
+		if ttl == 0 && !s.ZeroTTL {
+			ttl = defaultDNSAnswerTTL
+		}
+		log.Debug("DNS Symptom - answering query for %s with %v", ctx.Message.Key, s.Answer)
+		reply = dns.NewAnswer(query, m, s.ips, uint32(ttl))
+	}
+
+	if tcp {
+		reply = dns.Frame(reply)
+	}
+	ctx.Bytes = nil
+	ctx.Connection.Reply = reply
+}
+
+// MuckResponse rewrites the TTLs of the response, or truncates it
+func (s *DNSSymptom) MuckResponse(ctx *muxy.Context) {
+	if !s.ZeroTTL && s.TTL == 0 && !s.Truncate {
+		return
+	}
+
+	response, tcp := dnsPayload(ctx)
+	m, err := dns.Parse(response)
+	if err != nil {
+		return
+	}
+
+	if s.ZeroTTL || s.TTL > 0 {
+		log.Debug("DNS Symptom - setting TTLs of %s to %d", ctx.Message.Key, s.TTL)
+		response = dns.SetTTL(response, m, uint32(s.TTL))
+	}
+	if s.Truncate && !tcp {
+		log.Debug("DNS Symptom - truncating response for %s", ctx.Message.Key)
+		response = dns.Truncate(response, m)
+	}
+
+	if tcp {
+		response = dns.Frame(response)
+	}
+	ctx.Bytes = response
+}
+
+// dnsPayload returns the DNS message of ctx, without the length prefix
+// of messages sent over TCP
+func dnsPayload(ctx *muxy.Context) ([]byte, bool) {
+	if ctx.Message.Fields["transport"] == "tcp" && len(ctx.Bytes) >= 2 {
+		return ctx.Bytes[2:], true
+	}
+	return ctx.Bytes, false
+}
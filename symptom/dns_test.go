@@ -0,0 +1,158 @@
+package symptom
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/dns"
+)
+
+func dnsContext(b []byte, name string, qtype string, transport string) *muxy.Context {
+	if transport == "tcp" {
+		b = dns.Frame(b)
+	}
+	return &muxy.Context{
+		Bytes:      b,
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "dns",
+			Command:  qtype,
+			Key:      name,
+			Fields:   map[string]string{"transport": transport},
+		},
+	}
+}
+
+// dnsResponse returns an answer to a query for name from the resolver
+func dnsResponse(name string) []byte {
+	query := dns.NewQuery(1, name, dns.TypeA)
+	m, _ := dns.Parse(query)
+	return dns.NewAnswer(query, m, []net.IP{net.ParseIP("10.0.0.1")}, 300)
+}
+
+func TestDNS_Setup(t *testing.T) {
+	s := DNSSymptom{Rcode: "nxdomain", Answer: []string{"10.0.0.1"}}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.rcode != dns.RcodeNameError || len(s.ips) != 1 {
+		t.Fatal("Want NXDOMAIN and 1 address, got", s.rcode, s.ips)
+	}
+}
+
+func TestDNS_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := DNSSymptom{}
+	s.Setup()
+	s = DNSSymptom{Rcode: "NOERROR"}
+	s.Setup()
+	s = DNSSymptom{Answer: []string{"10.0.0"}}
+	s.Setup()
+	s = DNSSymptom{TTL: -1}
+	s.Setup()
+
+	if failed != 4 {
+		t.Fatal("Want 4 failures, got", failed)
+	}
+}
+
+func TestDNS_Teardown(t *testing.T) {
+	s := DNSSymptom{}
+	s.Teardown()
+}
+
+func TestDNS_Rcode(t *testing.T) {
+	s := DNSSymptom{
+		Rcode: "SERVFAIL",
+		MatchingRules: []MatchingRule{
+			MatchingRule{Key: `\.internal$`, Command: "^A$"},
+		},
+	}
+	s.Setup()
+
+	for _, transport := range []string{"udp", "tcp"} {
+		ctx := dnsContext(dns.NewQuery(9, "db.internal", dns.TypeA), "db.internal", "A", transport)
+		s.HandleEvent(muxy.EventPreDispatch, ctx)
+		reply := ctx.Connection.Reply
+		if transport == "tcp" && len(reply) > 2 {
+			reply = reply[2:]
+		}
+		m, err := dns.Parse(reply)
+		if ctx.Bytes != nil || err != nil || m.ID != 9 || m.Rcode() != dns.RcodeServerFailure {
+			t.Fatalf("Want SERVFAIL reply over %s, got %q", transport, ctx.Connection.Reply)
+		}
+	}
+
+	ctx := dnsContext(dns.NewQuery(9, "db.internal", dns.TypeAAAA), "db.internal", "AAAA", "udp")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want AAAA query to be forwarded")
+	}
+}
+
+func TestDNS_Answer(t *testing.T) {
+	s := DNSSymptom{Answer: []string{"192.0.2.1"}, ZeroTTL: true}
+	s.Setup()
+
+	ctx := dnsContext(dns.NewQuery(2, "api.example.com", dns.TypeA), "api.example.com", "A", "udp")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	m, err := dns.Parse(ctx.Connection.Reply)
+	if err != nil || len(m.Records) != 1 || m.Records[0].TTL != 0 || !m.Answers()[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("Want answer of 192.0.2.1 with a TTL of 0, got %+v %v", m, err)
+	}
+}
+
+func TestDNS_DelayAndDrop(t *testing.T) {
+	s := DNSSymptom{Delay: 20, Drop: true}
+	s.Setup()
+
+	ctx := dnsContext(dns.NewQuery(2, "example.com", dns.TypeA), "example.com", "A", "udp")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil || ctx.Connection.Reply != nil || ctx.Connection.Delay != 20*time.Millisecond {
+		t.Fatal("Want query to be delayed and dropped")
+	}
+}
+
+func TestDNS_TTL(t *testing.T) {
+	s := DNSSymptom{ZeroTTL: true}
+	s.Setup()
+
+	ctx := dnsContext(dnsResponse("example.com"), "example.com", "A", "tcp")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	m, err := dns.Parse(ctx.Bytes[2:])
+	if err != nil || len(m.Records) != 1 || m.Records[0].TTL != 0 {
+		t.Fatalf("Want TTL of 0, got %+v %v", m, err)
+	}
+}
+
+func TestDNS_Truncate(t *testing.T) {
+	s := DNSSymptom{Truncate: true}
+	s.Setup()
+
+	ctx := dnsContext(dnsResponse("example.com"), "example.com", "A", "udp")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	m, err := dns.Parse(ctx.Bytes)
+	if err != nil || !m.Truncated() || len(m.Records) != 0 {
+		t.Fatalf("Want truncated response, got %+v %v", m, err)
+	}
+
+	// Responses over TCP are never truncated
+	ctx = dnsContext(dnsResponse("example.com"), "example.com", "A", "tcp")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	m, err = dns.Parse(ctx.Bytes[2:])
+	if err != nil || m.Truncated() || len(m.Records) != 1 {
+		t.Fatalf("Want complete response over TCP, got %+v %v", m, err)
+	}
+}
@@ -0,0 +1,108 @@
+package symptom
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/layout"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// FieldTampererSymptom rewrites individual fields of the messages of a
+// TCP Proxy with a Layout, rather than the whole message
+type FieldTampererSymptom struct {
+	// Set rewrites the named fields of matching messages, e.g. status: 3.
+	// Values are given as they are decoded: integers in decimal, or in hex
+	// with a 0x prefix, strings as text and bytes in hex
+	Set map[string]interface{} `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	// names of the fields set, in order
+	names  []string
+	values map[string]string
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &FieldTampererSymptom{}, nil
+	}, "field_tamperer")
+}
+
+// Setup sets up the plugin
+func (s *FieldTampererSymptom) Setup() {
+	log.Debug("Field Tamperer Symptom - Setup()")
+
+	if len(s.Set) == 0 {
+		fail("Field Tamperer Symptom - set must specify at least one field")
+	}
+	s.names = nil
+	s.values = map[string]string{}
+	for name, value := range s.Set {
+		if value == nil {
+			fail("Field Tamperer Symptom - Incorrectly specified value of field:", name)
+		}
+		s.names = append(s.names, name)
+		s.values[name] = fmt.Sprint(value)
+	}
+	sort.Strings(s.names)
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *FieldTampererSymptom) Teardown() {
+	log.Debug("Field Tamperer Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *FieldTampererSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Message == nil || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+	l, ok := ctx.Message.Value.(*layout.Layout)
+	if !ok {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Field Tamperer Symptom Hit")
+		s.Muck(ctx, l)
+	} else {
+		log.Trace("Field Tamperer Symptom Miss")
+	}
+}
+
+// Muck rewrites the fields of the message, and the fields decoded from it
+func (s *FieldTampererSymptom) Muck(ctx *muxy.Context, l *layout.Layout) {
+	for _, name := range s.names {
+		b, err := l.Set(ctx.Bytes, name, s.values[name])
+		if err != nil {
+			log.Error("Field Tamperer Symptom - %s", err.Error())
+			continue
+		}
+		log.Debug("Field Tamperer Symptom - setting %s from '%s' to '%s'", name, ctx.Message.Fields[name], s.values[name])
+		ctx.Bytes = b
+	}
+
+	ctx.Message.Fields = l.Decode(ctx.Bytes)
+	if l.Command != "" {
+		ctx.Message.Command = ctx.Message.Fields[l.Command]
+	}
+	if l.Key != "" {
+		ctx.Message.Key = ctx.Message.Fields[l.Key]
+	}
+}
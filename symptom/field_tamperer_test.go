@@ -0,0 +1,101 @@
+package symptom
+
+import (
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/layout"
+)
+
+var fieldLayout = &layout.Layout{
+	Fields: []layout.Field{
+		{Name: "length", Offset: 0, Size: 2},
+		{Name: "status", Offset: 2, Size: 1},
+		{Name: "op", Offset: 3, Size: 4, Type: "string"},
+	},
+	Length:  "length",
+	Command: "op",
+}
+
+func fieldContext(b string) *muxy.Context {
+	return &muxy.Context{
+		Bytes:      []byte(b),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionResponse},
+		Message: &muxy.Message{
+			Protocol: "binary",
+			Command:  fieldLayout.Decode([]byte(b))["op"],
+			Fields:   fieldLayout.Decode([]byte(b)),
+			Value:    fieldLayout,
+		},
+	}
+}
+
+func TestFieldTamperer_Setup(t *testing.T) {
+	s := FieldTampererSymptom{Set: map[string]interface{}{"status": 3, "op": "pong"}}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.values["status"] != "3" || s.names[0] != "op" {
+		t.Fatal("Want values in order of name, got", s.names, s.values)
+	}
+}
+
+func TestFieldTamperer_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := FieldTampererSymptom{}
+	s.Setup()
+	s = FieldTampererSymptom{Set: map[string]interface{}{"status": nil}}
+	s.Setup()
+
+	if failed != 2 {
+		t.Fatal("Want 2 failures, got", failed)
+	}
+}
+
+func TestFieldTamperer_Teardown(t *testing.T) {
+	s := FieldTampererSymptom{}
+	s.Teardown()
+}
+
+func TestFieldTamperer_Set(t *testing.T) {
+	s := FieldTampererSymptom{
+		Set: map[string]interface{}{"status": 3, "op": "pong"},
+		MatchingRules: []MatchingRule{
+			MatchingRule{Field: "status", FieldValue: "^1$"},
+		},
+	}
+	s.Setup()
+
+	ctx := fieldContext("\x00\x02\x01pinghi")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if want := "\x00\x02\x03ponghi"; string(ctx.Bytes) != want {
+		t.Fatalf("Want %q, got %q", want, ctx.Bytes)
+	}
+	if ctx.Message.Command != "pong" || ctx.Message.Fields["status"] != "3" {
+		t.Fatalf("Want decoded fields updated, got %+v", ctx.Message)
+	}
+
+	ctx = fieldContext("\x00\x02\x02pinghi")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if want := "\x00\x02\x02pinghi"; string(ctx.Bytes) != want {
+		t.Fatalf("Want other messages untouched, got %q", ctx.Bytes)
+	}
+
+	// Messages without a layout are never touched
+	ctx = fieldContext("\x00\x02\x01pinghi")
+	ctx.Message.Value = nil
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if want := "\x00\x02\x01pinghi"; string(ctx.Bytes) != want {
+		t.Fatalf("Want message untouched, got %q", ctx.Bytes)
+	}
+}
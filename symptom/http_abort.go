@@ -0,0 +1,199 @@
+package symptom
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// AbortResponse is one of the error responses of the HTTP Abort Symptom
+type AbortResponse struct {
+	Status int
+
+	// Weight is the share of aborted requests given this response,
+	// relative to the weights of the others. Defaults to 1, and a weight
+	// of 0 is never chosen
+	Weight *int `required:"false"`
+
+	// Body is the canned body of the response
+	Body string `required:"false"`
+
+	// RetryAfter sets the Retry-After header, in seconds
+	RetryAfter int `required:"false" mapstructure:"retry_after"`
+
+	Headers map[string]string `required:"false"`
+}
+
+// HTTPAbortSymptom fails HTTP requests with a weighted mix of error
+// responses, e.g. 70% 503, 20% 429 and 10% 500, to test the retries of
+// clients
+type HTTPAbortSymptom struct {
+	Responses []AbortResponse
+
+	// AfterDispatch sends the request to the target before returning the
+	// error, so that its side effects still happen upstream. By default,
+	// requests are failed without being sent.
+	AfterDispatch bool `required:"false" mapstructure:"after_dispatch"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPAbortSymptom{}, nil
+	}, "http_abort")
+}
+
+// Setup sets up the plugin
+func (m *HTTPAbortSymptom) Setup() {
+	log.Debug("HTTP Abort Symptom - Setup()")
+
+	if len(m.Responses) == 0 {
+		fail("HTTP Abort Symptom - at least one response must be specified")
+	}
+	total := 0
+	for _, r := range m.Responses {
+		if r.Status < 100 || r.Status > 599 {
+			fail("HTTP Abort Symptom - Incorrectly specified status:", r.Status)
+		}
+		if r.weight() < 0 || r.RetryAfter < 0 {
+			fail("HTTP Abort Symptom - Incorrectly specified weight or retry_after of status:", r.Status)
+		}
+		total += r.weight()
+	}
+	if len(m.Responses) > 0 && total <= 0 {
+		fail("HTTP Abort Symptom - at least one response must have a weight")
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPAbortSymptom) Teardown() {
+	log.Debug("HTTP Abort Symptom - Teardown()")
+}
+
+// HandleEvent fails requests before dispatch, or replaces the response of
+// the target after dispatch if AfterDispatch is set
+func (m *HTTPAbortSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Request == nil {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && !m.AfterDispatch:
+	case e == muxy.EventPostDispatch && m.AfterDispatch && ctx.Response != nil:
+	default:
+		return
+	}
+
+	if match, step := MatchStep(m.MatchingRules, *ctx); match {
+		log.Trace("HTTP Abort Symptom Hit")
+		m.abort(ctx, m.forStep(step))
+	} else {
+		log.Trace("HTTP Abort Symptom Miss")
+	}
+}
+
+// Muck responds with one of the error responses, chosen by weight
+func (m *HTTPAbortSymptom) Muck(ctx *muxy.Context) {
+	m.abort(ctx, m.choose())
+}
+
+// abort responds with r, in place of the target or its response
+func (m *HTTPAbortSymptom) abort(ctx *muxy.Context, r AbortResponse) {
+	res := r.response(ctx.Request)
+
+	if ctx.Response == nil {
+		log.Debug("HTTP Abort Symptom - failing %s %s with %d", ctx.Request.Method, ctx.Request.URL.Path, r.Status)
+		ctx.Response = res
+		return
+	}
+
+	log.Debug("HTTP Abort Symptom - replacing response %d to %s %s with %d", ctx.Response.StatusCode, ctx.Request.Method, ctx.Request.URL.Path, r.Status)
+	ctx.Response.Body.Close()
+	*ctx.Response = *res
+}
+
+// forStep returns the response for a step of the sequence of a matching
+// rule: that of its status, for steps such as "503", or otherwise one
+// chosen by weight
+func (m *HTTPAbortSymptom) forStep(step string) AbortResponse {
+	status, err := strconv.Atoi(step)
+	if err != nil || status < 100 || status > 599 {
+		return m.choose()
+	}
+	for _, r := range m.Responses {
+		if r.Status == status {
+			return r
+		}
+	}
+	return AbortResponse{Status: status}
+}
+
+// choose returns one of the responses at random, by weight
+func (m *HTTPAbortSymptom) choose() AbortResponse {
+	total := 0
+	for _, r := range m.Responses {
+		total += r.weight()
+	}
+
+	n := rand.Intn(total)
+	for _, r := range m.Responses {
+		if n < r.weight() {
+			return r
+		}
+		n -= r.weight()
+	}
+	return m.Responses[len(m.Responses)-1]
+}
+
+// weight returns the weight of the response, defaulting to 1 if unset
+func (r AbortResponse) weight() int {
+	if r.Weight == nil {
+		return 1
+	}
+	return *r.Weight
+}
+
+// response builds the response to req
+func (r AbortResponse) response(req *http.Request) *http.Response {
+	res := newResponse(req, r.Status, r.Body)
+	if r.RetryAfter > 0 {
+		res.Header.Set("Retry-After", strconv.Itoa(r.RetryAfter))
+	}
+	for k, v := range r.Headers {
+		res.Header.Set(strings.Replace(k, "_", "-", -1), v)
+	}
+	return res
+}
+
+// newResponse builds a response to req, sent in place of that of the target
+func newResponse(req *http.Request, status int, body string) *http.Response {
+	return &http.Response{
+		Request:       req,
+		Header:        http.Header{},
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}
+}
@@ -0,0 +1,213 @@
+package symptom
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func abortContext() *muxy.Context {
+	return &muxy.Context{
+		Request: &http.Request{
+			Method: "POST",
+			URL:    &url.URL{Path: "/orders"},
+		},
+	}
+}
+
+func TestHTTPAbort_Setup(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses: []AbortResponse{{Status: 503}},
+	}
+	abort.Setup()
+
+	if len(abort.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPAbort_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	abort := HTTPAbortSymptom{}
+	abort.Setup()
+	abort = HTTPAbortSymptom{
+		Responses: []AbortResponse{
+			{Status: 42},
+			{Status: 429, RetryAfter: -1},
+			{Status: 503, Weight: abortWeight(-1)},
+		},
+	}
+	abort.Setup()
+	abort = HTTPAbortSymptom{
+		Responses: []AbortResponse{
+			{Status: 503, Weight: abortWeight(0)},
+		},
+	}
+	abort.Setup()
+
+	if failures != 5 {
+		t.Fatalf("Expected 5 failures, got %d", failures)
+	}
+}
+
+func TestHTTPAbort_Teardown(t *testing.T) {
+	abort := HTTPAbortSymptom{}
+	abort.Teardown()
+}
+
+func TestHTTPAbort_BeforeDispatch(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses: []AbortResponse{
+			{
+				Status:     429,
+				Body:       "slow down",
+				RetryAfter: 30,
+				Headers:    map[string]string{"content_type": "text/plain"},
+			},
+		},
+	}
+	abort.Setup()
+
+	ctx := abortContext()
+	abort.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Response != nil {
+		t.Fatal("Expected no response after dispatch")
+	}
+
+	abort.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response == nil || ctx.Response.StatusCode != 429 {
+		t.Fatalf("Expected a 429 response before dispatch, got %v", ctx.Response)
+	}
+	if ctx.Response.Header.Get("Retry-After") != "30" {
+		t.Fatal("Expected Retry-After of 30, got", ctx.Response.Header.Get("Retry-After"))
+	}
+	if ctx.Response.Header.Get("Content-Type") != "text/plain" {
+		t.Fatal("Expected Content-Type of text/plain, got", ctx.Response.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(ctx.Response.Body)
+	if string(body) != "slow down" || ctx.Response.ContentLength != 9 {
+		t.Fatalf("Expected body 'slow down', got '%s'", body)
+	}
+}
+
+func TestHTTPAbort_AfterDispatch(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses:     []AbortResponse{{Status: 500}},
+		AfterDispatch: true,
+	}
+	abort.Setup()
+
+	ctx := abortContext()
+	abort.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response != nil {
+		t.Fatal("Expected no response before dispatch")
+	}
+
+	res := &http.Response{
+		StatusCode: 201,
+		Header:     http.Header{"Location": []string{"/orders/1"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte("created"))),
+	}
+	ctx.Response = res
+	abort.HandleEvent(muxy.EventPostDispatch, ctx)
+	if res.StatusCode != 500 || res.Header.Get("Location") != "" {
+		t.Fatalf("Expected the response to be replaced with a 500, got %d", res.StatusCode)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	if len(body) != 0 {
+		t.Fatalf("Expected an empty body, got '%s'", body)
+	}
+}
+
+func TestHTTPAbort_Weights(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses: []AbortResponse{
+			{Status: 503, Weight: abortWeight(70)},
+			{Status: 429, Weight: abortWeight(20)},
+			{Status: 500, Weight: abortWeight(10)},
+		},
+	}
+	abort.Setup()
+
+	counts := map[int]int{}
+	for i := 0; i < 10000; i++ {
+		counts[abort.choose().Status]++
+	}
+	for status, expected := range map[int]int{503: 7000, 429: 2000, 500: 1000} {
+		if counts[status] < expected-300 || counts[status] > expected+300 {
+			t.Fatalf("Expected around %d responses of %d, got %d", expected, status, counts[status])
+		}
+	}
+}
+
+func TestHTTPAbort_ZeroWeight(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses: []AbortResponse{
+			{Status: 503, Weight: abortWeight(0)},
+			{Status: 429},
+		},
+	}
+	abort.Setup()
+
+	for i := 0; i < 100; i++ {
+		if status := abort.choose().Status; status != 429 {
+			t.Fatalf("Expected the response of weight 0 never to be chosen, got %d", status)
+		}
+	}
+}
+
+func TestHTTPAbort_Miss(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses:     []AbortResponse{{Status: 503}},
+		MatchingRules: []MatchingRule{{Path: "^/health"}},
+	}
+	abort.Setup()
+
+	ctx := abortContext()
+	abort.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response != nil {
+		t.Fatal("Expected unmatched request not to be failed")
+	}
+}
+
+func TestHTTPAbort_Sequence(t *testing.T) {
+	abort := HTTPAbortSymptom{
+		Responses:     []AbortResponse{{Status: 503, Body: "unavailable"}},
+		MatchingRules: []MatchingRule{{Path: "/", Sequence: "503,429,ok"}},
+	}
+	abort.Setup()
+
+	for _, expected := range []int{503, 429, 0} {
+		ctx := abortContext()
+		abort.HandleEvent(muxy.EventPreDispatch, ctx)
+		status := 0
+		if ctx.Response != nil {
+			status = ctx.Response.StatusCode
+		}
+		if status != expected {
+			t.Fatalf("Expected status %d of the sequence, got %d", expected, status)
+		}
+		if status == 503 {
+			body, _ := ioutil.ReadAll(ctx.Response.Body)
+			if string(body) != "unavailable" {
+				t.Fatal("Expected the configured response of the status, got", string(body))
+			}
+		}
+	}
+}
+
+func abortWeight(w int) *int {
+	return &w
+}
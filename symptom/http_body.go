@@ -0,0 +1,146 @@
+package symptom
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// readBody reads the whole body of a response, leaving it to be read again
+func readBody(res *http.Response) ([]byte, error) {
+	if res.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// setBody replaces the body of a response, keeping its Content-Length
+// consistent with the new body
+func setBody(res *http.Response, b []byte) {
+	res.Body = ioutil.NopCloser(bytes.NewReader(b))
+	res.ContentLength = int64(len(b))
+	res.TransferEncoding = nil
+	if res.Header == nil {
+		res.Header = http.Header{}
+	}
+	res.Header.Set("Content-Length", strconv.Itoa(len(b)))
+}
+
+// readRequestBody reads the whole body of a request, leaving it to be read
+// again
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// setRequestBody replaces the body of a request, keeping its
+// Content-Length consistent with the new body
+func setRequestBody(req *http.Request, b []byte) {
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	req.ContentLength = int64(len(b))
+	req.TransferEncoding = nil
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Header.Set("Content-Length", strconv.Itoa(len(b)))
+}
+
+// decodeBody decodes a body by its Content-Encoding: gzip, deflate or br.
+// It returns false if the encoding is not supported, e.g. zstd.
+func decodeBody(b []byte, encoding string) ([]byte, bool) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return b, true
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, false
+		}
+		decoded, err := ioutil.ReadAll(r)
+		return decoded, err == nil
+	case "deflate":
+		// deflate is meant to be zlib wrapped, but is often sent raw
+		if r, err := zlib.NewReader(bytes.NewReader(b)); err == nil {
+			if decoded, err := ioutil.ReadAll(r); err == nil {
+				return decoded, true
+			}
+		}
+		decoded, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+		return decoded, err == nil
+	case "br":
+		decoded, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(b)))
+		return decoded, err == nil
+	}
+	return nil, false
+}
+
+// encodeBody encodes a body decoded by decodeBody with the same encoding
+func encodeBody(b []byte, encoding string) []byte {
+	var buf bytes.Buffer
+	switch strings.ToLower(encoding) {
+	case "gzip", "x-gzip":
+		w := gzip.NewWriter(&buf)
+		w.Write(b)
+		w.Close()
+	case "deflate":
+		w := zlib.NewWriter(&buf)
+		w.Write(b)
+		w.Close()
+	case "br":
+		w := brotli.NewWriter(&buf)
+		w.Write(b)
+		w.Close()
+	default:
+		return b
+	}
+	return buf.Bytes()
+}
+
+// transformBody applies transform to the decoded body of a response,
+// re-encoding the result. It returns false if the body could not be read
+// or decoded.
+func transformBody(res *http.Response, transform func([]byte) []byte) bool {
+	b, err := readBody(res)
+	if err != nil {
+		return false
+	}
+	encoding := res.Header.Get("Content-Encoding")
+	decoded, ok := decodeBody(b, encoding)
+	if !ok {
+		return false
+	}
+	setBody(res, encodeBody(transform(decoded), encoding))
+	return true
+}
+
+// transformRequestBody applies transform to the decoded body of a request,
+// re-encoding the result. It returns false if the body could not be read
+// or decoded.
+func transformRequestBody(req *http.Request, transform func([]byte) []byte) bool {
+	b, err := readRequestBody(req)
+	if err != nil {
+		return false
+	}
+	encoding := req.Header.Get("Content-Encoding")
+	decoded, ok := decodeBody(b, encoding)
+	if !ok {
+		return false
+	}
+	setRequestBody(req, encodeBody(transform(decoded), encoding))
+	return true
+}
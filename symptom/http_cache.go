@@ -0,0 +1,168 @@
+package symptom
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// Types of caching fault
+const (
+	CacheFaultNotModified = "not_modified"
+	CacheFaultVary        = "vary"
+	CacheFaultErrors      = "cache_errors"
+)
+
+// Default values of caching faults
+const (
+	defaultStaleETag = `"muxy-stale"`
+	defaultVary      = "*"
+	defaultMaxAge    = 3600
+)
+
+// CacheFault is an anomaly in the caching of responses
+type CacheFault struct {
+	// Type is one of not_modified, vary or cache_errors
+	Type string
+
+	// Value overrides the ETag of not_modified, or the Vary of vary
+	Value string `required:"false"`
+
+	// MaxAge is the max-age of stale responses and cached errors, in
+	// seconds. Defaults to 3600
+	MaxAge int `required:"false" mapstructure:"max_age"`
+}
+
+// HTTPCacheSymptom injects caching anomalies: stale 304 Not Modified
+// responses, conflicting Vary headers and cached errors, to test HTTP caches
+// and CDNs
+type HTTPCacheSymptom struct {
+	Faults        []CacheFault
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPCacheSymptom{}, nil
+	}, "http_cache")
+}
+
+// Setup sets up the plugin
+func (m *HTTPCacheSymptom) Setup() {
+	log.Debug("HTTP Cache Symptom - Setup()")
+
+	if len(m.Faults) == 0 {
+		fail("HTTP Cache Symptom - at least one fault must be specified")
+	}
+	for _, f := range m.Faults {
+		switch f.Type {
+		case CacheFaultNotModified, CacheFaultVary, CacheFaultErrors:
+		default:
+			fail("HTTP Cache Symptom - Incorrectly specified fault:", f.Type)
+		}
+		if f.MaxAge < 0 {
+			fail("HTTP Cache Symptom - Incorrectly specified max_age:", f.MaxAge)
+		}
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPCacheSymptom) Teardown() {
+	log.Debug("HTTP Cache Symptom - Teardown()")
+}
+
+// HandleEvent answers matching requests with stale 304s before dispatch,
+// and applies the other faults to their responses after dispatch
+func (m *HTTPCacheSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Request == nil {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && ctx.Response == nil && m.has(CacheFaultNotModified):
+	case e == muxy.EventPostDispatch && ctx.Response != nil:
+	default:
+		return
+	}
+
+	if MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP Cache Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			m.MuckRequest(ctx)
+		} else {
+			m.MuckResponse(ctx)
+		}
+	} else {
+		log.Trace("HTTP Cache Symptom Miss")
+	}
+}
+
+// MuckRequest answers the request with a 304 Not Modified, whether or not
+// it is conditional, so that clients keep using whatever they have cached
+func (m *HTTPCacheSymptom) MuckRequest(ctx *muxy.Context) {
+	for _, f := range m.Faults {
+		if f.Type != CacheFaultNotModified {
+			continue
+		}
+		log.Debug("HTTP Cache Symptom - answering %s %s with 304 Not Modified (If-None-Match: '%s')", ctx.Request.Method, ctx.Request.URL.Path, ctx.Request.Header.Get("If-None-Match"))
+		res := newResponse(ctx.Request, http.StatusNotModified, "")
+		res.Header.Set("ETag", valueOr(f.Value, defaultStaleETag))
+		res.Header.Set("Cache-Control", fmt.Sprintf("max-age=%d", f.maxAge()))
+		ctx.Response = res
+		return
+	}
+}
+
+// MuckResponse applies the faults to the headers of the response
+func (m *HTTPCacheSymptom) MuckResponse(ctx *muxy.Context) {
+	h := ctx.Response.Header
+	for _, f := range m.Faults {
+		switch f.Type {
+		case CacheFaultVary:
+			// Conflict with the Vary of the response, if there is one
+			if len(h["Vary"]) == 0 {
+				h.Add("Vary", "Accept-Encoding")
+			}
+			h.Add("Vary", valueOr(f.Value, defaultVary))
+		case CacheFaultErrors:
+			if ctx.Response.StatusCode < 400 {
+				continue
+			}
+			log.Debug("HTTP Cache Symptom - caching %d response for %ds", ctx.Response.StatusCode, f.maxAge())
+			h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", f.maxAge()))
+			h.Set("Expires", time.Now().Add(time.Duration(f.maxAge())*time.Second).UTC().Format(http.TimeFormat))
+			h.Del("Pragma")
+		}
+	}
+}
+
+// has returns true if one of the faults is of type t
+func (m *HTTPCacheSymptom) has(t string) bool {
+	for _, f := range m.Faults {
+		if f.Type == t {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAge returns the max-age of the fault, defaulting to 3600s
+func (f CacheFault) maxAge() int {
+	if f.MaxAge == 0 {
+		return defaultMaxAge
+	}
+	return f.MaxAge
+}
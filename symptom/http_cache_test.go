@@ -0,0 +1,97 @@
+package symptom
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func cacheContext(status int) *muxy.Context {
+	return &muxy.Context{
+		Request: &http.Request{Method: "GET", URL: &url.URL{Path: "/"}, Header: http.Header{"If-None-Match": []string{`"v2"`}}},
+		Response: &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Cache-Control": []string{"no-store"}, "Pragma": []string{"no-cache"}},
+			Body:       ioutil.NopCloser(strings.NewReader("error")),
+		},
+	}
+}
+
+func TestHTTPCache_Setup(t *testing.T) {
+	cache := HTTPCacheSymptom{Faults: []CacheFault{{Type: CacheFaultVary}}}
+	cache.Setup()
+
+	if len(cache.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPCache_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	cache := HTTPCacheSymptom{}
+	cache.Setup()
+	cache = HTTPCacheSymptom{Faults: []CacheFault{{Type: "stale"}, {Type: CacheFaultErrors, MaxAge: -1}}}
+	cache.Setup()
+
+	if failures != 3 {
+		t.Fatalf("Expected 3 failures, got %d", failures)
+	}
+}
+
+func TestHTTPCache_Teardown(t *testing.T) {
+	cache := HTTPCacheSymptom{}
+	cache.Teardown()
+}
+
+func TestHTTPCache_NotModified(t *testing.T) {
+	cache := HTTPCacheSymptom{Faults: []CacheFault{{Type: CacheFaultNotModified, Value: `"v1"`}}}
+	cache.Setup()
+
+	ctx := cacheContext(200)
+	ctx.Response = nil
+	cache.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response == nil || ctx.Response.StatusCode != 304 || ctx.Response.Header.Get("ETag") != `"v1"` {
+		t.Fatalf("Expected a stale 304 whatever the If-None-Match, got %v", ctx.Response)
+	}
+}
+
+func TestHTTPCache_Vary(t *testing.T) {
+	cache := HTTPCacheSymptom{Faults: []CacheFault{{Type: CacheFaultVary}}}
+	cache.Setup()
+
+	ctx := cacheContext(200)
+	cache.HandleEvent(muxy.EventPostDispatch, ctx)
+	if vary := ctx.Response.Header["Vary"]; len(vary) != 2 || vary[0] != "Accept-Encoding" || vary[1] != "*" {
+		t.Fatalf("Expected conflicting Vary headers, got %v", vary)
+	}
+}
+
+func TestHTTPCache_CacheErrors(t *testing.T) {
+	cache := HTTPCacheSymptom{Faults: []CacheFault{{Type: CacheFaultErrors, MaxAge: 60}}}
+	cache.Setup()
+
+	ctx := cacheContext(503)
+	cache.HandleEvent(muxy.EventPostDispatch, ctx)
+	h := ctx.Response.Header
+	if h.Get("Cache-Control") != "public, max-age=60" || h.Get("Expires") == "" || h.Get("Pragma") != "" {
+		t.Fatalf("Expected the error to be cached, got %v", h)
+	}
+
+	ctx = cacheContext(200)
+	cache.HandleEvent(muxy.EventPostDispatch, ctx)
+	if h := ctx.Response.Header; h.Get("Cache-Control") != "no-store" {
+		t.Fatalf("Expected successful responses to be left alone, got %v", h)
+	}
+}
@@ -1,6 +1,8 @@
 package symptom
 
 import (
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/mefellows/muxy/log"
@@ -15,6 +17,17 @@ type HTTPDelaySymptom struct {
 	ResponseDelay int            `required:"false" mapstructure:"response_delay"`
 	Delay         int            `required:"false" mapstructure:"delay"`
 	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	// RequestDistribution and ResponseDistribution draw each delay from a
+	// distribution, in place of RequestDelay and ResponseDelay
+	RequestDistribution  *DelayDistribution `required:"false" mapstructure:"request_distribution"`
+	ResponseDistribution *DelayDistribution `required:"false" mapstructure:"response_distribution"`
+
+	// Seed makes the delays drawn reproducible. Defaults to the time
+	Seed int64 `required:"false" mapstructure:"seed"`
+
+	random *rand.Rand
+	lock   sync.Mutex
 }
 
 var oneSecondInMillis = 1000
@@ -32,6 +45,20 @@ func init() {
 func (m *HTTPDelaySymptom) Setup() {
 	log.Debug("Delay Symptom - Setup()")
 
+	if m.RequestDistribution != nil {
+		if err := m.RequestDistribution.validate(); err != nil {
+			fail("Delay Symptom - Incorrectly specified request_distribution:", err)
+		}
+	}
+	if m.ResponseDistribution != nil {
+		if err := m.ResponseDistribution.validate(); err != nil {
+			fail("Delay Symptom - Incorrectly specified response_distribution:", err)
+		}
+	}
+	m.seed()
+
+	setupMatchingRules(m.MatchingRules)
+
 	// Add default (catch all) matching rule
 	// Only applicable if none supplied
 	if len(m.MatchingRules) == 0 {
@@ -48,16 +75,24 @@ func (m *HTTPDelaySymptom) Teardown() {
 
 // HandleEvent takes a proxy event for the proxy to intercept and modify
 func (m *HTTPDelaySymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
 	if MatchSymptoms(m.MatchingRules, *ctx) {
 		log.Trace("HTTP Delay Tamperer Hit")
 
 		switch e {
 		case muxy.EventPreDispatch:
-			if m.RequestDelay != 0 {
+			if m.RequestDistribution != nil {
+				m.wait(m.sample(m.RequestDistribution))
+			} else if m.RequestDelay != 0 {
 				m.Muck(ctx, m.RequestDelay)
 			}
 		case muxy.EventPostDispatch:
-			if m.ResponseDelay != 0 {
+			if m.ResponseDistribution != nil {
+				m.wait(m.sample(m.ResponseDistribution))
+			} else if m.ResponseDelay != 0 {
 				m.Muck(ctx, m.ResponseDelay)
 			} else if m.Delay != 0 { // legacy behaviour
 				m.Muck(ctx, m.Delay*oneSecondInMillis) // convert to ms
@@ -70,7 +105,31 @@ func (m *HTTPDelaySymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
 
 // Muck injects chaos into the system
 func (m *HTTPDelaySymptom) Muck(ctx *muxy.Context, wait int) {
-	delay := time.Duration(wait) * time.Millisecond
+	m.wait(time.Duration(wait) * time.Millisecond)
+}
+
+// seed seeds the delays drawn from distributions
+func (m *HTTPDelaySymptom) seed() {
+	seed := m.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	m.random = rand.New(rand.NewSource(seed))
+}
+
+// sample draws a delay from d. The source of delays is shared by the
+// requests of every connection, so it is guarded by a lock.
+func (m *HTTPDelaySymptom) sample(d *DelayDistribution) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.random == nil {
+		m.seed()
+	}
+	return d.sample(m.random)
+}
+
+// wait delays the request or response
+func (m *HTTPDelaySymptom) wait(delay time.Duration) {
 	log.Debug("Delay Symptom - Muck(), delaying for %v seconds", delay.Seconds())
 
 	for {
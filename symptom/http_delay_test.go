@@ -1,7 +1,9 @@
 package symptom
 
 import (
+	"math/rand"
 	"testing"
+	"time"
 
 	"github.com/mefellows/muxy/muxy"
 )
@@ -78,3 +80,110 @@ func TestHTTPDelay_Teardown(t *testing.T) {
 	delay := HTTPDelaySymptom{}
 	delay.Teardown()
 }
+
+func TestHTTPDelay_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	distributions := []DelayDistribution{
+		{Type: "bogus"},
+		{Type: DistributionUniform},
+		{Type: DistributionUniform, Min: 10, Max: 5},
+		{Type: DistributionNormal, Mean: 10, StdDev: -1},
+		{Type: DistributionLogNormal, Sigma: 1},
+		{Type: DistributionPareto, Scale: 10},
+		{Type: DistributionPercentiles},
+		{Type: DistributionPercentiles, Percentiles: map[string]float64{"median": 10}},
+		{Type: DistributionPercentiles, Percentiles: map[string]float64{"p50": 100, "p99": 10}},
+	}
+	for i, d := range distributions {
+		failures = 0
+		delay := HTTPDelaySymptom{RequestDistribution: &d}
+		delay.Setup()
+		if failures != 1 {
+			t.Fatalf("Expected distribution %d to fail setup, got %d failures", i, failures)
+		}
+	}
+}
+
+func TestHTTPDelay_Seed(t *testing.T) {
+	d := &DelayDistribution{Type: DistributionLogNormal, Median: 20, Sigma: 1}
+	first := HTTPDelaySymptom{ResponseDistribution: d, Seed: 42}
+	second := HTTPDelaySymptom{ResponseDistribution: d, Seed: 42}
+	first.Setup()
+	second.Setup()
+
+	for i := 0; i < 100; i++ {
+		if a, b := first.sample(d), second.sample(d); a != b {
+			t.Fatalf("Expected seeded delays to match, got %v and %v", a, b)
+		}
+	}
+}
+
+func TestDelayDistribution_Sample(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		distribution DelayDistribution
+		min, max     time.Duration
+	}{
+		{DelayDistribution{Type: DistributionUniform, Min: 10, Max: 20}, 10 * time.Millisecond, 20 * time.Millisecond},
+		{DelayDistribution{Type: DistributionNormal, Mean: 5, StdDev: 50}, 0, time.Hour},
+		{DelayDistribution{Type: DistributionLogNormal, Median: 20, Sigma: 2, Max: 100}, 0, 100 * time.Millisecond},
+		{DelayDistribution{Type: DistributionPareto, Scale: 10, Shape: 1.5}, 10 * time.Millisecond, time.Hour},
+		{DelayDistribution{Type: DistributionPercentiles, Min: 1, Percentiles: map[string]float64{"p50": 10, "p999": 1000}}, time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		d := test.distribution
+		if err := d.validate(); err != nil {
+			t.Fatalf("Expected %s distribution to be valid, got %v", d.Type, err)
+		}
+		for i := 0; i < 1000; i++ {
+			if delay := d.sample(r); delay < test.min || delay > test.max {
+				t.Fatalf("Expected %s delay within %v-%v, got %v", d.Type, test.min, test.max, delay)
+			}
+		}
+	}
+}
+
+func TestDelayDistribution_Percentiles(t *testing.T) {
+	d := DelayDistribution{
+		Type:        DistributionPercentiles,
+		Max:         5000,
+		Percentiles: map[string]float64{"p50": 20, "p90": 100, "p99": 300, "p999": 1200},
+	}
+	if err := d.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[float64]float64{
+		25:    10,
+		50:    20,
+		70:    60,
+		99:    300,
+		99.9:  1200,
+		99.95: 3100,
+		100:   5000,
+	}
+	for percentile, delay := range expected {
+		if got := d.interpolate(percentile); got != delay {
+			t.Fatalf("Expected delay %v at p%v, got %v", delay, percentile, got)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	below := 0
+	for i := 0; i < 10000; i++ {
+		if d.sample(r) <= 20*time.Millisecond {
+			below++
+		}
+	}
+	if below < 4800 || below > 5200 {
+		t.Fatalf("Expected half of delays within the median, got %d of 10000", below)
+	}
+}
@@ -0,0 +1,144 @@
+package symptom
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Types of header fault
+const (
+	HeaderFaultDuplicate     = "duplicate"
+	HeaderFaultContentType   = "content_type"
+	HeaderFaultContentLength = "content_length"
+	HeaderFaultSetCookie     = "set_cookie"
+	HeaderFaultOversized     = "oversized"
+	HeaderFaultCacheControl  = "cache_control"
+	HeaderFaultETag          = "etag"
+)
+
+// Default values of header faults
+const (
+	defaultFaultyContentType  = "application/x-invalid; charset=x-invalid-charset"
+	defaultFaultySetCookie    = "=no-name; Expires=Mon, 99 Foo 9999 99:99:99 GMT; Max-Age=abc;; Domain"
+	defaultFaultyCacheControl = "max-age=-1, no-store, public, private, s-maxage=abc"
+	defaultFaultyETag         = "unquoted-etag"
+	defaultOversizedHeader    = "X-Oversized"
+	defaultOversizedSize      = 65536
+)
+
+// HeaderFault is a malformed, conflicting or oversized response header
+type HeaderFault struct {
+	// Type is one of duplicate, content_type, content_length, set_cookie,
+	// oversized, cache_control or etag
+	Type string
+
+	// Header names the header duplicated, or that which is oversized
+	Header string `required:"false"`
+
+	// Value overrides the faulty value of the header
+	Value string `required:"false"`
+
+	// Size of an oversized header, in bytes
+	Size int `required:"false"`
+}
+
+// validate checks the fault
+func (f HeaderFault) validate() error {
+	switch f.Type {
+	case HeaderFaultDuplicate:
+		if f.Header == "" {
+			return fmt.Errorf("duplicate fault requires a header")
+		}
+	case HeaderFaultContentLength:
+		if f.Value != "" {
+			if _, err := strconv.ParseInt(f.Value, 10, 64); err != nil {
+				return fmt.Errorf("invalid content_length '%s'", f.Value)
+			}
+		}
+	case HeaderFaultContentType, HeaderFaultSetCookie, HeaderFaultOversized, HeaderFaultCacheControl, HeaderFaultETag:
+	default:
+		return fmt.Errorf("unknown header fault '%s'", f.Type)
+	}
+	if f.Size < 0 {
+		return fmt.Errorf("invalid size %d", f.Size)
+	}
+	return nil
+}
+
+// apply applies the fault to the headers of res
+func (f HeaderFault) apply(res *http.Response) {
+	h := res.Header
+	switch f.Type {
+	case HeaderFaultDuplicate:
+		key := http.CanonicalHeaderKey(f.Header)
+		value := f.Value
+		if value == "" {
+			value = conflicting(h.Get(key))
+		}
+		h[key] = append(h[key], value)
+	case HeaderFaultContentType:
+		h.Set("Content-Type", valueOr(f.Value, defaultFaultyContentType))
+	case HeaderFaultContentLength:
+		value := f.Value
+		if value == "" {
+			// Claim one byte more than is sent, so clients wait for it
+			if b, err := readBody(res); err == nil {
+				value = strconv.Itoa(len(b) + 1)
+			}
+		}
+		h.Set("Content-Length", value)
+	case HeaderFaultSetCookie:
+		h.Add("Set-Cookie", valueOr(f.Value, defaultFaultySetCookie))
+	case HeaderFaultOversized:
+		size := f.Size
+		if size == 0 {
+			size = defaultOversizedSize
+		}
+		h.Set(valueOr(f.Header, defaultOversizedHeader), valueOr(f.Value, strings.Repeat("a", size)))
+	case HeaderFaultCacheControl:
+		h.Set("Cache-Control", valueOr(f.Value, defaultFaultyCacheControl))
+	case HeaderFaultETag:
+		h.Set("ETag", valueOr(f.Value, defaultFaultyETag))
+	}
+}
+
+// conflicting returns a value that conflicts with v: the next integer, if
+// it is one
+func conflicting(v string) string {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return strconv.FormatInt(n+1, 10)
+	}
+	if v == "" {
+		return "conflict"
+	}
+	return v + "-conflict"
+}
+
+func valueOr(v string, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+// setHeader sets a header, keeping the exact case of key if preserveCase is
+// set, rather than canonicalising it
+func setHeader(h http.Header, key string, value string, preserveCase bool) {
+	if !preserveCase {
+		h.Set(key, value)
+		return
+	}
+	deleteHeader(h, key)
+	h[key] = []string{value}
+}
+
+// deleteHeader removes a header, in any case
+func deleteHeader(h http.Header, key string) {
+	for k := range h {
+		if strings.EqualFold(k, key) {
+			delete(h, k)
+		}
+	}
+}
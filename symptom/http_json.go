@@ -0,0 +1,265 @@
+package symptom
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// JSON mutation operations
+const (
+	JSONRemove     = "remove"
+	JSONNull       = "null"
+	JSONType       = "type"
+	JSONInject     = "inject"
+	JSONShuffle    = "shuffle"
+	JSONTruncate   = "truncate"
+	JSONLongString = "long_string"
+)
+
+// defaultLongString is the length of strings set by long_string
+const defaultLongString = 65536
+
+// JSONMutation is an operation on the values at a path of a JSON body
+type JSONMutation struct {
+	// Path is a JSON Pointer, e.g. "/items/0/id", or JSONPath of member,
+	// index and wildcard steps, e.g. "$.items[*].id"
+	Path string
+
+	// Op is one of remove, null, type, inject, shuffle, truncate or
+	// long_string
+	Op string
+
+	// Type is the type a value is changed to by type: string, number,
+	// boolean, array, object or null. By default strings become numbers,
+	// and other values strings.
+	Type string `required:"false"`
+
+	// Field and Value are the member injected into objects by inject,
+	// or the element appended to arrays
+	Field string      `required:"false"`
+	Value interface{} `required:"false"`
+
+	// Length is the length arrays and strings are truncated to, or that
+	// of the strings set by long_string
+	Length int `required:"false"`
+
+	steps []jsonStep
+}
+
+// HTTPJSONSymptom mutates JSON response bodies, to test the tolerance of
+// clients to drift in the schema of upstream APIs
+type HTTPJSONSymptom struct {
+	Mutations     []JSONMutation
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPJSONSymptom{}, nil
+	}, "http_json")
+}
+
+// Setup sets up the plugin
+func (m *HTTPJSONSymptom) Setup() {
+	log.Debug("HTTP JSON Symptom - Setup()")
+
+	if len(m.Mutations) == 0 {
+		fail("HTTP JSON Symptom - at least one mutation must be specified")
+	}
+	for i := range m.Mutations {
+		mutation := &m.Mutations[i]
+		var err error
+		if mutation.steps, err = parseJSONPath(mutation.Path); err != nil {
+			fail("HTTP JSON Symptom - Incorrectly specified path:", err)
+		}
+		switch mutation.Op {
+		case JSONRemove, JSONNull, JSONInject, JSONShuffle, JSONTruncate, JSONLongString:
+		case JSONType:
+			switch mutation.Type {
+			case "", "string", "number", "boolean", "array", "object", "null":
+			default:
+				fail("HTTP JSON Symptom - Incorrectly specified type:", mutation.Type)
+			}
+		default:
+			fail("HTTP JSON Symptom - Incorrectly specified op:", mutation.Op)
+		}
+		if mutation.Length < 0 {
+			fail("HTTP JSON Symptom - Incorrectly specified length:", mutation.Length)
+		}
+		mutation.Value = jsonValue(mutation.Value)
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPJSONSymptom) Teardown() {
+	log.Debug("HTTP JSON Symptom - Teardown()")
+}
+
+// HandleEvent mutates the body of matching responses
+func (m *HTTPJSONSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPostDispatch || ctx.Response == nil {
+		return
+	}
+
+	if MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP JSON Symptom Hit")
+		m.Muck(ctx)
+	} else {
+		log.Trace("HTTP JSON Symptom Miss")
+	}
+}
+
+// Muck applies the mutations to a JSON response body, decoding and
+// re-encoding compressed bodies. Bodies that are not JSON are left untouched.
+func (m *HTTPJSONSymptom) Muck(ctx *muxy.Context) {
+	if !transformBody(ctx.Response, m.mutate) {
+		log.Error("HTTP JSON Symptom - unable to decode body with Content-Encoding '%s'", ctx.Response.Header.Get("Content-Encoding"))
+	}
+}
+
+// mutate applies the mutations to a JSON document
+func (m *HTTPJSONSymptom) mutate(body []byte) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		log.Debug("HTTP JSON Symptom - not mutating body that is not JSON: %v", err)
+		return body
+	}
+
+	for _, mutation := range m.Mutations {
+		setRoot := func(v interface{}) { doc = v }
+		for _, l := range selectJSON(doc, mutation.steps, setRoot) {
+			mutation.apply(l)
+		}
+		doc = compactJSON(doc)
+	}
+
+	mutated, err := json.Marshal(doc)
+	if err != nil {
+		log.Error("HTTP JSON Symptom - unable to encode mutated body: %v", err)
+		return body
+	}
+	log.Debug("HTTP JSON Symptom - mutated body to [%s]", log.Colorize(log.BLUE, string(mutated)))
+	return mutated
+}
+
+// apply applies the mutation to the value at l
+func (mutation JSONMutation) apply(l jsonLocation) {
+	switch mutation.Op {
+	case JSONRemove:
+		l.remove()
+	case JSONNull:
+		l.set(nil)
+	case JSONType:
+		l.set(changeType(l.value, mutation.Type))
+	case JSONInject:
+		switch v := l.value.(type) {
+		case map[string]interface{}:
+			field := mutation.Field
+			if field == "" {
+				field = "unexpected_field"
+			}
+			v[field] = mutation.injected()
+		case []interface{}:
+			l.set(append(v, mutation.injected()))
+		}
+	case JSONShuffle:
+		if v, ok := l.value.([]interface{}); ok {
+			rand.Shuffle(len(v), func(i, j int) { v[i], v[j] = v[j], v[i] })
+		}
+	case JSONTruncate:
+		switch v := l.value.(type) {
+		case []interface{}:
+			if len(v) > mutation.Length {
+				l.set(v[:mutation.Length])
+			}
+		case string:
+			if r := []rune(v); len(r) > mutation.Length {
+				l.set(string(r[:mutation.Length]))
+			}
+		}
+	case JSONLongString:
+		length := mutation.Length
+		if length == 0 {
+			length = defaultLongString
+		}
+		l.set(strings.Repeat("A", length))
+	}
+}
+
+// injected returns the value injected, defaulting to a string
+func (mutation JSONMutation) injected() interface{} {
+	if mutation.Value == nil {
+		return "unexpected value"
+	}
+	return mutation.Value
+}
+
+// changeType converts value to the given type. By default, strings become
+// numbers, and other values strings.
+func changeType(value interface{}, to string) interface{} {
+	if to == "" {
+		if _, ok := value.(string); ok {
+			to = "number"
+		} else {
+			to = "string"
+		}
+	}
+
+	switch to {
+	case "string":
+		if s, ok := value.(string); ok {
+			return s
+		}
+		b, _ := json.Marshal(value)
+		return string(b)
+	case "number":
+		switch v := value.(type) {
+		case json.Number:
+			return v
+		case string:
+			if n, err := strconv.ParseFloat(v, 64); err == nil {
+				return n
+			}
+			return len(v)
+		case bool:
+			if v {
+				return 1
+			}
+		}
+		return 0
+	case "boolean":
+		switch v := value.(type) {
+		case bool:
+			return v
+		case string:
+			return v != ""
+		case json.Number:
+			return v.String() != "0"
+		}
+		return value != nil
+	case "array":
+		return []interface{}{value}
+	case "object":
+		return map[string]interface{}{"value": value}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package symptom
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+const jsonBody = `{"id":"42","name":"widget","price":9.5,"tags":["a","b","c"],"items":[{"sku":"x1","qty":1},{"sku":"x2","qty":2}]}`
+
+func jsonContext(body string) *muxy.Context {
+	return &muxy.Context{
+		Request: &http.Request{URL: &url.URL{Path: "/widgets/42"}},
+		Response: &http.Response{
+			StatusCode:    200,
+			Header:        http.Header{"Content-Type": []string{"application/json"}, "Content-Length": []string{strconv.Itoa(len(body))}},
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		},
+	}
+}
+
+// mutate applies mutations to jsonBody, returning the decoded result
+func mutate(t *testing.T, mutations ...JSONMutation) map[string]interface{} {
+	m := HTTPJSONSymptom{Mutations: mutations}
+	m.Setup()
+	ctx := jsonContext(jsonBody)
+	m.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	body, _ := ioutil.ReadAll(ctx.Response.Body)
+	if ctx.Response.ContentLength != int64(len(body)) || ctx.Response.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Fatalf("Expected Content-Length of %d, got %d and %s", len(body), ctx.Response.ContentLength, ctx.Response.Header.Get("Content-Length"))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		t.Fatalf("Expected mutated body to be JSON, got %s", body)
+	}
+	return doc
+}
+
+func TestHTTPJSON_Setup(t *testing.T) {
+	m := HTTPJSONSymptom{Mutations: []JSONMutation{{Path: "$.id", Op: JSONRemove}}}
+	m.Setup()
+
+	if len(m.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPJSON_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	m := HTTPJSONSymptom{}
+	m.Setup()
+	m = HTTPJSONSymptom{
+		Mutations: []JSONMutation{
+			{Path: "id", Op: JSONRemove},
+			{Path: "$.items[x]", Op: JSONRemove},
+			{Path: "$.id", Op: "explode"},
+			{Path: "$.id", Op: JSONType, Type: "date"},
+			{Path: "$.tags", Op: JSONTruncate, Length: -1},
+		},
+	}
+	m.Setup()
+
+	if failures != 6 {
+		t.Fatalf("Expected 6 failures, got %d", failures)
+	}
+}
+
+func TestHTTPJSON_Teardown(t *testing.T) {
+	m := HTTPJSONSymptom{}
+	m.Teardown()
+}
+
+func TestHTTPJSON_ParsePath(t *testing.T) {
+	testCases := map[string][]jsonStep{
+		"":                 nil,
+		"$":                nil,
+		"/items/0/sku":     {{key: "items"}, {key: "0"}, {key: "sku"}},
+		"/a~1b/c~0d":       {{key: "a/b"}, {key: "c~d"}},
+		"$.items[*].sku":   {{key: "items"}, {wildcard: true}, {key: "sku"}},
+		"$.items[-1]":      {{key: "items"}, {index: -1, indexed: true}},
+		"$['a b'].*":       {{key: "a b"}, {key: "*", wildcard: true}},
+		`$["items"][0].id`: {{key: "items"}, {index: 0, indexed: true}, {key: "id"}},
+	}
+
+	for path, expected := range testCases {
+		steps, err := parseJSONPath(path)
+		if err != nil || !reflect.DeepEqual(steps, expected) {
+			t.Fatalf("Expected path %s to parse to %v, got %v, %v", path, expected, steps, err)
+		}
+	}
+}
+
+func TestHTTPJSON_Mutations(t *testing.T) {
+	doc := mutate(t,
+		JSONMutation{Path: "$.name", Op: JSONRemove},
+		JSONMutation{Path: "/price", Op: JSONNull},
+		JSONMutation{Path: "$.id", Op: JSONType},
+		JSONMutation{Path: "$.items[*].qty", Op: JSONType, Type: "string"},
+		JSONMutation{Path: "$.items[-1]", Op: JSONInject, Field: "discontinued", Value: true},
+		JSONMutation{Path: "$", Op: JSONInject},
+	)
+
+	if _, ok := doc["name"]; ok {
+		t.Fatal("Expected name to be removed")
+	}
+	if v, ok := doc["price"]; !ok || v != nil {
+		t.Fatal("Expected price to be null, got", v)
+	}
+	if doc["id"] != float64(42) {
+		t.Fatalf("Expected id to be the number 42, got %#v", doc["id"])
+	}
+	items := doc["items"].([]interface{})
+	if items[0].(map[string]interface{})["qty"] != "1" || items[1].(map[string]interface{})["qty"] != "2" {
+		t.Fatalf("Expected quantities to be strings, got %v", items)
+	}
+	if items[1].(map[string]interface{})["discontinued"] != true || items[0].(map[string]interface{})["discontinued"] != nil {
+		t.Fatalf("Expected last item only to be discontinued, got %v", items)
+	}
+	if doc["unexpected_field"] != "unexpected value" {
+		t.Fatal("Expected unknown field to be injected, got", doc["unexpected_field"])
+	}
+}
+
+func TestHTTPJSON_Arrays(t *testing.T) {
+	doc := mutate(t,
+		JSONMutation{Path: "$.tags", Op: JSONTruncate, Length: 1},
+		JSONMutation{Path: "/items/0", Op: JSONRemove},
+		JSONMutation{Path: "$.items", Op: JSONInject, Value: map[interface{}]interface{}{"sku": "x3"}},
+	)
+	if !reflect.DeepEqual(doc["tags"], []interface{}{"a"}) {
+		t.Fatal("Expected tags to be truncated, got", doc["tags"])
+	}
+	expected := []interface{}{
+		map[string]interface{}{"sku": "x2", "qty": float64(2)},
+		map[string]interface{}{"sku": "x3"},
+	}
+	if !reflect.DeepEqual(doc["items"], expected) {
+		t.Fatal("Expected first item removed and another appended, got", doc["items"])
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		doc = mutate(t, JSONMutation{Path: "$.tags", Op: JSONShuffle})
+		tags := doc["tags"].([]interface{})
+		if len(tags) != 3 {
+			t.Fatal("Expected shuffled tags to keep their elements, got", tags)
+		}
+		seen[tags[0].(string)] = true
+	}
+	if len(seen) != 3 {
+		t.Fatal("Expected tags to be shuffled, got first tags", seen)
+	}
+}
+
+func TestHTTPJSON_LongString(t *testing.T) {
+	doc := mutate(t, JSONMutation{Path: "$.items[*].sku", Op: JSONLongString, Length: 1000})
+	for _, item := range doc["items"].([]interface{}) {
+		if sku := item.(map[string]interface{})["sku"].(string); len(sku) != 1000 {
+			t.Fatalf("Expected sku of 1000 characters, got %d", len(sku))
+		}
+	}
+}
+
+func TestHTTPJSON_NotJSON(t *testing.T) {
+	m := HTTPJSONSymptom{Mutations: []JSONMutation{{Path: "$.id", Op: JSONRemove}}}
+	m.Setup()
+
+	ctx := jsonContext("<html></html>")
+	m.HandleEvent(muxy.EventPostDispatch, ctx)
+	body, _ := ioutil.ReadAll(ctx.Response.Body)
+	if string(body) != "<html></html>" {
+		t.Fatal("Expected body that is not JSON to be untouched, got", string(body))
+	}
+
+	ctx = jsonContext(jsonBody)
+	ctx.Response.Header.Set("Content-Encoding", "zstd")
+	m.HandleEvent(muxy.EventPostDispatch, ctx)
+	body, _ = ioutil.ReadAll(ctx.Response.Body)
+	if string(body) != jsonBody {
+		t.Fatal("Expected body of unsupported encoding to be untouched, got", string(body))
+	}
+}
+
+func TestHTTPJSON_Gzip(t *testing.T) {
+	m := HTTPJSONSymptom{Mutations: []JSONMutation{{Path: "$.id", Op: JSONRemove}}}
+	m.Setup()
+
+	ctx := jsonContext(string(encodeBody([]byte(`{"id":1,"name":"widget"}`), "gzip")))
+	ctx.Response.Header.Set("Content-Encoding", "gzip")
+	m.HandleEvent(muxy.EventPostDispatch, ctx)
+	body, _ := ioutil.ReadAll(ctx.Response.Body)
+	decoded, ok := decodeBody(body, "gzip")
+	if !ok || string(decoded) != `{"name":"widget"}` {
+		t.Fatalf("Expected gzipped body to be mutated, got '%s'", decoded)
+	}
+}
@@ -0,0 +1,293 @@
+package symptom
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// Rate limiting modes
+const (
+	RateLimitTokenBucket   = "token_bucket"
+	RateLimitFixedWindow   = "fixed_window"
+	RateLimitSlidingWindow = "sliding_window"
+)
+
+// maxRateLimitKeys is the number of keys above which idle buckets are
+// forgotten
+const maxRateLimitKeys = 10000
+
+// HTTPRateLimitSymptom limits the rate of matching requests for each key,
+// e.g. client IP address or API key, responding with 429 Too Many Requests
+// once the limit is reached, to test the backoff of clients
+type HTTPRateLimitSymptom struct {
+	// Limit is the number of requests allowed each Window, in ms. Window
+	// defaults to 1000
+	Limit  int
+	Window int `required:"false"`
+
+	// Mode is one of token_bucket, fixed_window or sliding_window.
+	// Defaults to token_bucket
+	Mode string `required:"false"`
+
+	// Burst is the size of token buckets, refilled at Limit tokens each
+	// Window. Defaults to Limit
+	Burst int `required:"false"`
+
+	// Per limits the requests of each client_ip, header:<name> or path
+	// separately, rather than all together
+	Per string `required:"false"`
+
+	// Status and Body of limited requests. Status defaults to 429
+	Status int    `required:"false"`
+	Body   string `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	lock    sync.Mutex
+	buckets map[string]*rateLimitBucket
+
+	// pending holds the limits of allowed requests, by exchange, until
+	// they are set on their responses. Those of requests more than
+	// maxExchanges behind the latest are forgotten.
+	pending map[uint64]rateLimit
+
+	now func() time.Time
+}
+
+// rateLimit is the state of a limit after a request
+type rateLimit struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration
+}
+
+// rateLimitBucket is the state of the limit of a key
+type rateLimitBucket struct {
+	used time.Time
+
+	// tokens of a token bucket
+	tokens float64
+
+	// start and count of a fixed window
+	start time.Time
+	count int
+
+	// times of the requests within a sliding window
+	times []time.Time
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPRateLimitSymptom{}, nil
+	}, "http_rate_limit")
+}
+
+// Setup sets up the plugin
+func (m *HTTPRateLimitSymptom) Setup() {
+	log.Debug("HTTP Rate Limit Symptom - Setup()")
+
+	if m.Limit <= 0 {
+		fail("HTTP Rate Limit Symptom - Incorrectly specified limit:", m.Limit)
+	}
+	if m.Window < 0 || m.Burst < 0 {
+		fail("HTTP Rate Limit Symptom - Incorrectly specified window or burst")
+	}
+	switch m.Mode {
+	case "", RateLimitTokenBucket, RateLimitFixedWindow, RateLimitSlidingWindow:
+	default:
+		fail("HTTP Rate Limit Symptom - Incorrectly specified mode:", m.Mode)
+	}
+	if !validPer(m.Per) {
+		fail("HTTP Rate Limit Symptom - Incorrectly specified per:", m.Per)
+	}
+	if m.Status != 0 && (m.Status < 100 || m.Status > 599) {
+		fail("HTTP Rate Limit Symptom - Incorrectly specified status:", m.Status)
+	}
+
+	if m.Window == 0 {
+		m.Window = 1000
+	}
+	if m.Burst == 0 {
+		m.Burst = m.Limit
+	}
+	if m.Status == 0 {
+		m.Status = http.StatusTooManyRequests
+	}
+	m.buckets = make(map[string]*rateLimitBucket)
+	m.pending = make(map[uint64]rateLimit)
+	if m.now == nil {
+		m.now = time.Now
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPRateLimitSymptom) Teardown() {
+	log.Debug("HTTP Rate Limit Symptom - Teardown()")
+}
+
+// HandleEvent limits matching requests before dispatch, and sets the
+// X-RateLimit headers of the responses of those allowed after dispatch
+func (m *HTTPRateLimitSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Request == nil {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && ctx.Response == nil:
+	case e == muxy.EventPostDispatch && ctx.Response != nil:
+		m.MuckResponse(ctx)
+		return
+	default:
+		return
+	}
+
+	if MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP Rate Limit Symptom Hit")
+		m.MuckRequest(ctx)
+	} else {
+		log.Trace("HTTP Rate Limit Symptom Miss")
+	}
+}
+
+// MuckRequest counts the request against the limit of its key, responding
+// in place of the target once the limit is reached
+func (m *HTTPRateLimitSymptom) MuckRequest(ctx *muxy.Context) {
+	key := activationKey(m.Per, *ctx)
+	limit := m.take(key)
+
+	if limit.allowed {
+		m.lock.Lock()
+		m.pending[ctx.Exchange] = limit
+		for exchange := range m.pending {
+			if exchange+maxExchanges < ctx.Exchange {
+				delete(m.pending, exchange)
+			}
+		}
+		m.lock.Unlock()
+		return
+	}
+
+	log.Debug("HTTP Rate Limit Symptom - limiting %s %s of '%s' for %v", ctx.Request.Method, ctx.Request.URL.Path, key, limit.reset)
+	res := newResponse(ctx.Request, m.Status, m.Body)
+	res.Header.Set("Retry-After", strconv.Itoa(seconds(limit.reset)))
+	m.setHeaders(res.Header, limit)
+	ctx.Response = res
+}
+
+// MuckResponse sets the X-RateLimit headers of an allowed request on its
+// response
+func (m *HTTPRateLimitSymptom) MuckResponse(ctx *muxy.Context) {
+	m.lock.Lock()
+	limit, ok := m.pending[ctx.Exchange]
+	delete(m.pending, ctx.Exchange)
+	m.lock.Unlock()
+
+	if ok {
+		m.setHeaders(ctx.Response.Header, limit)
+	}
+}
+
+func (m *HTTPRateLimitSymptom) setHeaders(h http.Header, limit rateLimit) {
+	h.Set("X-RateLimit-Limit", strconv.Itoa(m.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(limit.remaining))
+	h.Set("X-RateLimit-Reset", strconv.Itoa(seconds(limit.reset)))
+}
+
+// take counts a request against the limit of key
+func (m *HTTPRateLimitSymptom) take(key string) rateLimit {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	window := time.Duration(m.Window) * time.Millisecond
+	m.forget(now, window)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &rateLimitBucket{tokens: float64(m.Burst), start: now}
+		m.buckets[key] = b
+	}
+	b.used = now
+
+	switch m.Mode {
+	case RateLimitFixedWindow:
+		if now.Sub(b.start) >= window {
+			b.start = now
+			b.count = 0
+		}
+		reset := b.start.Add(window).Sub(now)
+		if b.count >= m.Limit {
+			return rateLimit{reset: reset}
+		}
+		b.count++
+		return rateLimit{allowed: true, remaining: m.Limit - b.count, reset: reset}
+
+	case RateLimitSlidingWindow:
+		kept := b.times[:0]
+		for _, t := range b.times {
+			if now.Sub(t) < window {
+				kept = append(kept, t)
+			}
+		}
+		b.times = kept
+		if len(b.times) >= m.Limit {
+			return rateLimit{reset: b.times[0].Add(window).Sub(now)}
+		}
+		b.times = append(b.times, now)
+		return rateLimit{allowed: true, remaining: m.Limit - len(b.times), reset: b.times[0].Add(window).Sub(now)}
+
+	default:
+		// Refill at Limit tokens each window, up to Burst
+		rate := float64(m.Limit) / float64(window)
+		b.tokens = math.Min(float64(m.Burst), b.tokens+float64(now.Sub(b.start))*rate)
+		b.start = now
+		allowed := b.tokens >= 1
+		if allowed {
+			b.tokens--
+		}
+		// Reset is the time until the next token, as for Retry-After
+		return rateLimit{
+			allowed:   allowed,
+			remaining: int(b.tokens),
+			reset:     time.Duration((math.Floor(b.tokens) + 1 - b.tokens) / rate),
+		}
+	}
+}
+
+// forget removes the buckets of keys idle for long enough to have been
+// reset, once there are too many of them
+func (m *HTTPRateLimitSymptom) forget(now time.Time, window time.Duration) {
+	if len(m.buckets) <= maxRateLimitKeys {
+		return
+	}
+	idle := window
+	if m.Burst > m.Limit {
+		idle = window * time.Duration(m.Burst) / time.Duration(m.Limit)
+	}
+	for key, b := range m.buckets {
+		if now.Sub(b.used) > idle {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// seconds rounds d up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,199 @@
+package symptom
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+// clock is a fake clock for rate limits
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(ms int) {
+	c.t = c.t.Add(time.Duration(ms) * time.Millisecond)
+}
+
+func rateLimited(limit *HTTPRateLimitSymptom, apiKey string) *muxy.Context {
+	ctx := &muxy.Context{
+		Request: &http.Request{
+			Method:     "GET",
+			URL:        &url.URL{Path: "/api"},
+			Header:     http.Header{"X-Api-Key": []string{apiKey}},
+			RemoteAddr: "10.0.0.1:1234",
+		},
+	}
+	limit.HandleEvent(muxy.EventPreDispatch, ctx)
+	return ctx
+}
+
+// allowed sends n requests, returning how many were allowed
+func allowed(limit *HTTPRateLimitSymptom, apiKey string, n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if rateLimited(limit, apiKey).Response == nil {
+			count++
+		}
+	}
+	return count
+}
+
+func newRateLimit(limit *HTTPRateLimitSymptom) (*HTTPRateLimitSymptom, *clock) {
+	c := &clock{t: time.Unix(1000, 0)}
+	limit.now = c.now
+	limit.Setup()
+	return limit, c
+}
+
+func TestHTTPRateLimit_Setup(t *testing.T) {
+	limit := HTTPRateLimitSymptom{Limit: 10}
+	limit.Setup()
+
+	if len(limit.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if limit.Window != 1000 || limit.Burst != 10 || limit.Status != 429 {
+		t.Fatalf("Expected default window, burst and status, got %d, %d and %d", limit.Window, limit.Burst, limit.Status)
+	}
+}
+
+func TestHTTPRateLimit_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	limit := HTTPRateLimitSymptom{}
+	limit.Setup()
+	limit = HTTPRateLimitSymptom{Limit: 1, Window: -1}
+	limit.Setup()
+	limit = HTTPRateLimitSymptom{Limit: 1, Mode: "leaky"}
+	limit.Setup()
+	limit = HTTPRateLimitSymptom{Limit: 1, Per: "clientip"}
+	limit.Setup()
+
+	if failures != 4 {
+		t.Fatalf("Expected 4 failures, got %d", failures)
+	}
+}
+
+func TestHTTPRateLimit_Teardown(t *testing.T) {
+	limit := HTTPRateLimitSymptom{}
+	limit.Teardown()
+}
+
+func TestHTTPRateLimit_TokenBucket(t *testing.T) {
+	limit, c := newRateLimit(&HTTPRateLimitSymptom{Limit: 2, Window: 1000, Burst: 4})
+
+	if n := allowed(limit, "", 6); n != 4 {
+		t.Fatalf("Expected a burst of 4 requests, got %d", n)
+	}
+	c.advance(500)
+	if n := allowed(limit, "", 3); n != 1 {
+		t.Fatalf("Expected 1 token to be refilled after 500ms, got %d", n)
+	}
+
+	ctx := rateLimited(limit, "")
+	h := ctx.Response.Header
+	if ctx.Response.StatusCode != 429 || h.Get("Retry-After") != "1" || h.Get("X-RateLimit-Remaining") != "0" || h.Get("X-RateLimit-Limit") != "2" {
+		t.Fatalf("Expected a 429 with rate limit headers, got %d %v", ctx.Response.StatusCode, h)
+	}
+}
+
+func TestHTTPRateLimit_FixedWindow(t *testing.T) {
+	limit, c := newRateLimit(&HTTPRateLimitSymptom{Limit: 3, Window: 1000, Mode: RateLimitFixedWindow})
+
+	if n := allowed(limit, "", 5); n != 3 {
+		t.Fatalf("Expected 3 requests in the window, got %d", n)
+	}
+	c.advance(999)
+	if n := allowed(limit, "", 1); n != 0 {
+		t.Fatalf("Expected no requests until the window ends, got %d", n)
+	}
+	c.advance(1)
+	if n := allowed(limit, "", 5); n != 3 {
+		t.Fatalf("Expected 3 requests in the next window, got %d", n)
+	}
+}
+
+func TestHTTPRateLimit_SlidingWindow(t *testing.T) {
+	limit, c := newRateLimit(&HTTPRateLimitSymptom{Limit: 2, Window: 1000, Mode: RateLimitSlidingWindow})
+
+	allowed(limit, "", 1)
+	c.advance(600)
+	if n := allowed(limit, "", 2); n != 1 {
+		t.Fatalf("Expected 1 more request in the window, got %d", n)
+	}
+	c.advance(400)
+	if n := allowed(limit, "", 2); n != 1 {
+		t.Fatalf("Expected the first request to slide out of the window, got %d", n)
+	}
+	if retry := rateLimited(limit, "").Response.Header.Get("Retry-After"); retry != "1" {
+		t.Fatalf("Expected to retry after 1s, got '%s'", retry)
+	}
+}
+
+func TestHTTPRateLimit_Per(t *testing.T) {
+	limit, _ := newRateLimit(&HTTPRateLimitSymptom{Limit: 1, Per: "header:X-Api-Key"})
+
+	if allowed(limit, "a", 2) != 1 || allowed(limit, "b", 2) != 1 {
+		t.Fatal("Expected each API key to be limited separately")
+	}
+}
+
+func TestHTTPRateLimit_ResponseHeaders(t *testing.T) {
+	limit, _ := newRateLimit(&HTTPRateLimitSymptom{Limit: 5, Window: 60000})
+
+	ctx := rateLimited(limit, "")
+	ctx.Response = &http.Response{StatusCode: 200, Header: http.Header{}}
+	limit.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	h := ctx.Response.Header
+	if h.Get("X-RateLimit-Limit") != "5" || h.Get("X-RateLimit-Remaining") != "4" || h.Get("X-RateLimit-Reset") != "12" {
+		t.Fatalf("Expected rate limit headers on allowed responses, got %v", h)
+	}
+}
+
+func TestHTTPRateLimit_TokenBucketReset(t *testing.T) {
+	limit, _ := newRateLimit(&HTTPRateLimitSymptom{Limit: 2, Window: 60000, Burst: 4})
+
+	// Reset is the time to the next token, not until the bucket is full
+	allowed(limit, "", 1)
+	ctx := rateLimited(limit, "")
+	ctx.Response = &http.Response{StatusCode: 200, Header: http.Header{}}
+	limit.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	if reset := ctx.Response.Header.Get("X-RateLimit-Reset"); reset != "30" {
+		t.Fatalf("Expected to reset in 30s, got '%s'", reset)
+	}
+}
+
+func TestHTTPRateLimit_ForgetPending(t *testing.T) {
+	limit, _ := newRateLimit(&HTTPRateLimitSymptom{Limit: 10000})
+
+	for _, exchange := range []uint64{1, 2, 2 + maxExchanges} {
+		limit.HandleEvent(muxy.EventPreDispatch, &muxy.Context{
+			Exchange: exchange,
+			Request:  &http.Request{Method: "GET", URL: &url.URL{Path: "/api"}, Header: http.Header{}},
+		})
+	}
+
+	if _, ok := limit.pending[1]; ok {
+		t.Fatal("Expected the limit of an old exchange to be forgotten")
+	}
+	if _, ok := limit.pending[2]; !ok {
+		t.Fatal("Expected the limit of a recent exchange to be kept")
+	}
+}
@@ -0,0 +1,158 @@
+package symptom
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// redirectParam is the query parameter counting the hops of a redirect chain
+const redirectParam = "muxy_redirect"
+
+// HTTPRedirectSymptom redirects matching requests through a chain of
+// redirects before they are sent to the target, or around an endless loop,
+// to test how clients follow redirects
+type HTTPRedirectSymptom struct {
+	// Status of the redirects: 301, 302, 303, 307 or 308. Defaults to 302
+	Status int `required:"false"`
+
+	// Length is the number of redirects in the chain, or of URLs in the
+	// loop. Defaults to 1
+	Length int `required:"false"`
+
+	// Loop redirects endlessly, and the request is never sent to the target
+	Loop bool `required:"false"`
+
+	// Downgrade redirects to http, on the same host, e.g. from https
+	Downgrade bool `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPRedirectSymptom{}, nil
+	}, "http_redirect")
+}
+
+// Setup sets up the plugin
+func (m *HTTPRedirectSymptom) Setup() {
+	log.Debug("HTTP Redirect Symptom - Setup()")
+
+	switch m.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		fail("HTTP Redirect Symptom - Incorrectly specified status:", m.Status)
+	}
+	if m.Length < 0 {
+		fail("HTTP Redirect Symptom - Incorrectly specified length:", m.Length)
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPRedirectSymptom) Teardown() {
+	log.Debug("HTTP Redirect Symptom - Teardown()")
+}
+
+// HandleEvent redirects matching requests before dispatch. Requests part
+// way through a chain always continue along it.
+func (m *HTTPRedirectSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch || ctx.Request == nil || ctx.Response != nil {
+		return
+	}
+
+	if redirectHop(requestURL(ctx.Request)) > 0 || MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP Redirect Symptom Hit")
+		m.Muck(ctx)
+	} else {
+		log.Trace("HTTP Redirect Symptom Miss")
+	}
+}
+
+// Muck redirects the request to the next hop of the chain, or sends it to
+// the target, without the hop, once the chain is complete
+func (m *HTTPRedirectSymptom) Muck(ctx *muxy.Context) {
+	u := requestURL(ctx.Request)
+	hop := redirectHop(u)
+	length := m.Length
+	if length == 0 {
+		length = 1
+	}
+
+	if !m.Loop && hop >= length {
+		log.Debug("HTTP Redirect Symptom - completed chain of %d redirects to %s", hop, u.Path)
+		ctx.Request.URL.RawQuery = withoutParam(ctx.Request.URL.RawQuery, redirectParam)
+		return
+	}
+
+	next := hop + 1
+	if m.Loop {
+		next = hop%length + 1
+	}
+	location := *u
+	location.RawQuery = withoutParam(location.RawQuery, redirectParam)
+	if location.RawQuery != "" {
+		location.RawQuery += "&"
+	}
+	location.RawQuery += redirectParam + "=" + strconv.Itoa(next)
+	if m.Downgrade {
+		location.Scheme = "http"
+		location.Host = ctx.Request.Host
+	}
+
+	status := m.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	log.Debug("HTTP Redirect Symptom - redirecting %s %s with %d to %s", ctx.Request.Method, u.Path, status, location.String())
+	ctx.Response = newResponse(ctx.Request, status, "")
+	ctx.Response.Header.Set("Location", location.String())
+}
+
+// requestURL returns the URL requested by the client, rather than that of
+// the target the request is sent to
+func requestURL(req *http.Request) *url.URL {
+	if req.RequestURI != "" {
+		if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			return u
+		}
+	}
+	u := *req.URL
+	u.Scheme = ""
+	u.Host = ""
+	return &u
+}
+
+// redirectHop returns the hop of the redirect chain of u, or 0 if it is not
+// part of one
+func redirectHop(u *url.URL) int {
+	hop, _ := strconv.Atoi(u.Query().Get(redirectParam))
+	return hop
+}
+
+// withoutParam removes a parameter from a query, keeping the order of the
+// others
+func withoutParam(query string, name string) string {
+	var kept []string
+	for _, p := range strings.Split(query, "&") {
+		if p != "" && p != name && !strings.HasPrefix(p, name+"=") {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
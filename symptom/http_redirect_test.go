@@ -0,0 +1,133 @@
+package symptom
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func redirectContext(uri string) *muxy.Context {
+	u, _ := url.Parse("http://target" + uri)
+	return &muxy.Context{
+		Request: &http.Request{Method: "GET", Host: "example.com", RequestURI: uri, URL: u, Header: http.Header{}},
+	}
+}
+
+// follow sends requests along the redirects of a chain, returning the
+// locations redirected to, and the context of the last request
+func follow(redirect *HTTPRedirectSymptom, uri string, max int) ([]string, *muxy.Context) {
+	var locations []string
+	ctx := redirectContext(uri)
+	for i := 0; i < max; i++ {
+		redirect.HandleEvent(muxy.EventPreDispatch, ctx)
+		if ctx.Response == nil {
+			break
+		}
+		location := ctx.Response.Header.Get("Location")
+		locations = append(locations, location)
+		ctx = redirectContext(location)
+	}
+	return locations, ctx
+}
+
+func TestHTTPRedirect_Setup(t *testing.T) {
+	redirect := HTTPRedirectSymptom{}
+	redirect.Setup()
+
+	if len(redirect.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPRedirect_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	redirect := HTTPRedirectSymptom{Status: 200}
+	redirect.Setup()
+	redirect = HTTPRedirectSymptom{Length: -1}
+	redirect.Setup()
+
+	if failures != 2 {
+		t.Fatalf("Expected 2 failures, got %d", failures)
+	}
+}
+
+func TestHTTPRedirect_Teardown(t *testing.T) {
+	redirect := HTTPRedirectSymptom{}
+	redirect.Teardown()
+}
+
+func TestHTTPRedirect_Chain(t *testing.T) {
+	redirect := HTTPRedirectSymptom{Status: 307, Length: 3}
+	redirect.Setup()
+
+	ctx := redirectContext("/items?a=1")
+	redirect.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response == nil || ctx.Response.StatusCode != 307 {
+		t.Fatalf("Expected a 307 redirect, got %v", ctx.Response)
+	}
+
+	locations, last := follow(&redirect, "/items?a=1", 10)
+	expected := []string{"/items?a=1&muxy_redirect=1", "/items?a=1&muxy_redirect=2", "/items?a=1&muxy_redirect=3"}
+	if len(locations) != len(expected) {
+		t.Fatalf("Expected redirects to %v, got %v", expected, locations)
+	}
+	for i := range expected {
+		if locations[i] != expected[i] {
+			t.Fatalf("Expected redirects to %v, got %v", expected, locations)
+		}
+	}
+	if last.Request.URL.RawQuery != "a=1" {
+		t.Fatalf("Expected the request to be sent without the hop, got '%s'", last.Request.URL.RawQuery)
+	}
+}
+
+func TestHTTPRedirect_Loop(t *testing.T) {
+	redirect := HTTPRedirectSymptom{Length: 2, Loop: true}
+	redirect.Setup()
+
+	locations, _ := follow(&redirect, "/", 5)
+	expected := []string{"/?muxy_redirect=1", "/?muxy_redirect=2", "/?muxy_redirect=1", "/?muxy_redirect=2", "/?muxy_redirect=1"}
+	for i := range expected {
+		if i >= len(locations) || locations[i] != expected[i] {
+			t.Fatalf("Expected redirects to %v, got %v", expected, locations)
+		}
+	}
+}
+
+func TestHTTPRedirect_Downgrade(t *testing.T) {
+	redirect := HTTPRedirectSymptom{Status: 301, Downgrade: true}
+	redirect.Setup()
+
+	ctx := redirectContext("/login")
+	redirect.HandleEvent(muxy.EventPreDispatch, ctx)
+	if location := ctx.Response.Header.Get("Location"); location != "http://example.com/login?muxy_redirect=1" {
+		t.Fatalf("Expected a redirect to http, got '%s'", location)
+	}
+}
+
+func TestHTTPRedirect_ContinuesChain(t *testing.T) {
+	redirect := HTTPRedirectSymptom{Length: 2, MatchingRules: []MatchingRule{{Method: "POST"}}}
+	redirect.Setup()
+
+	ctx := redirectContext("/")
+	redirect.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response != nil {
+		t.Fatal("Expected the request not to match")
+	}
+
+	ctx = redirectContext("/?muxy_redirect=1")
+	redirect.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Response == nil {
+		t.Fatal("Expected a request part way through a chain to continue along it")
+	}
+}
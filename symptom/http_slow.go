@@ -0,0 +1,182 @@
+package symptom
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// errClientGone ends slowed bodies once the client has gone away
+var errClientGone = errors.New("client went away")
+
+// HTTPSlowSymptom sends responses and reads requests slowly, slow-loris
+// style, to exercise the read, write and idle timeouts of HTTP clients
+// and servers
+type HTTPSlowSymptom struct {
+	// ResponseInterval dribbles the response body once the headers have
+	// been sent, a ResponseChunk of bytes (1 by default) every interval, in ms
+	ResponseInterval int `required:"false" mapstructure:"response_interval"`
+	ResponseChunk    int `required:"false" mapstructure:"response_chunk"`
+
+	// Hold holds the connection open after sending the response headers,
+	// for Hold ms before the body is sent. If negative, it is held until
+	// the client goes away, and the body is never sent.
+	Hold int `required:"false"`
+
+	// RequestInterval reads the request body slowly, a RequestChunk of
+	// bytes (1 by default) every interval, in ms, to apply back-pressure
+	// to the client
+	RequestInterval int `required:"false" mapstructure:"request_interval"`
+	RequestChunk    int `required:"false" mapstructure:"request_chunk"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPSlowSymptom{}, nil
+	}, "http_slow")
+}
+
+// Setup sets up the plugin
+func (m *HTTPSlowSymptom) Setup() {
+	log.Debug("HTTP Slow Symptom - Setup()")
+
+	if m.ResponseInterval < 0 || m.ResponseChunk < 0 {
+		fail("HTTP Slow Symptom - Incorrectly specified response_interval or response_chunk")
+	}
+	if m.RequestInterval < 0 || m.RequestChunk < 0 {
+		fail("HTTP Slow Symptom - Incorrectly specified request_interval or request_chunk")
+	}
+	if m.ResponseInterval == 0 && m.Hold == 0 && m.RequestInterval == 0 {
+		fail("HTTP Slow Symptom - one of response_interval, hold or request_interval must be specified")
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPSlowSymptom) Teardown() {
+	log.Debug("HTTP Slow Symptom - Teardown()")
+}
+
+// HandleEvent slows the request body before dispatch, and the response
+// after dispatch
+func (m *HTTPSlowSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Request == nil {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && m.RequestInterval > 0:
+	case e == muxy.EventPostDispatch && ctx.Response != nil && (m.ResponseInterval > 0 || m.Hold != 0):
+	default:
+		return
+	}
+
+	if MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP Slow Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			m.MuckRequest(ctx)
+		} else {
+			m.MuckResponse(ctx)
+		}
+	} else {
+		log.Trace("HTTP Slow Symptom Miss")
+	}
+}
+
+// MuckRequest reads the request body slowly
+func (m *HTTPSlowSymptom) MuckRequest(ctx *muxy.Context) {
+	if ctx.Request.Body == nil || ctx.Request.Body == http.NoBody {
+		return
+	}
+	log.Debug("HTTP Slow Symptom - reading request body %d bytes every %dms", chunkOf(m.RequestChunk), m.RequestInterval)
+	ctx.Request.Body = &slowReader{
+		ReadCloser: ctx.Request.Body,
+		chunk:      chunkOf(m.RequestChunk),
+		interval:   time.Duration(m.RequestInterval) * time.Millisecond,
+		done:       ctx.Request.Context().Done(),
+	}
+}
+
+// MuckResponse holds or dribbles the response body, once the headers have
+// been sent
+func (m *HTTPSlowSymptom) MuckResponse(ctx *muxy.Context) {
+	log.Debug("HTTP Slow Symptom - holding response body for %dms, then sending %d bytes every %dms", m.Hold, chunkOf(m.ResponseChunk), m.ResponseInterval)
+	r := &slowReader{
+		ReadCloser: ctx.Response.Body,
+		hold:       time.Duration(m.Hold) * time.Millisecond,
+		interval:   time.Duration(m.ResponseInterval) * time.Millisecond,
+		done:       ctx.Request.Context().Done(),
+	}
+	if m.ResponseInterval > 0 {
+		r.chunk = chunkOf(m.ResponseChunk)
+	}
+	ctx.Response.Body = r
+	ctx.Flush = true
+}
+
+// chunkOf returns the size of a chunk of a slowed body, defaulting to 1
+func chunkOf(chunk int) int {
+	if chunk <= 0 {
+		return 1
+	}
+	return chunk
+}
+
+// slowReader reads a body slowly: after holding for hold, then a chunk
+// of bytes every interval, until done is closed
+type slowReader struct {
+	io.ReadCloser
+
+	hold     time.Duration
+	chunk    int
+	interval time.Duration
+	done     <-chan struct{}
+
+	held bool
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	if !r.held {
+		r.held = true
+		if r.hold != 0 && !r.wait(r.hold) {
+			return 0, errClientGone
+		}
+	}
+	if r.interval > 0 && !r.wait(r.interval) {
+		return 0, errClientGone
+	}
+	if r.chunk > 0 && len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	return r.ReadCloser.Read(p)
+}
+
+// wait waits for d, or until done if d is negative, returning false if
+// done is closed first
+func (r *slowReader) wait(d time.Duration) bool {
+	if d < 0 {
+		<-r.done
+		return false
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.done:
+		return false
+	}
+}
@@ -0,0 +1,119 @@
+package symptom
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func slowContext(body string) *muxy.Context {
+	return &muxy.Context{
+		Request: &http.Request{
+			URL:  &url.URL{Path: "/upload"},
+			Body: ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		},
+	}
+}
+
+func TestHTTPSlow_Setup(t *testing.T) {
+	slow := HTTPSlowSymptom{ResponseInterval: 10}
+	slow.Setup()
+
+	if len(slow.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPSlow_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	slow := HTTPSlowSymptom{}
+	slow.Setup()
+	slow = HTTPSlowSymptom{ResponseInterval: -1, RequestChunk: -1}
+	slow.Setup()
+
+	if failures != 3 {
+		t.Fatalf("Expected 3 failures, got %d", failures)
+	}
+}
+
+func TestHTTPSlow_Teardown(t *testing.T) {
+	slow := HTTPSlowSymptom{}
+	slow.Teardown()
+}
+
+func TestHTTPSlow_Request(t *testing.T) {
+	slow := HTTPSlowSymptom{RequestInterval: 10, RequestChunk: 2}
+	slow.Setup()
+
+	ctx := slowContext("abcdef")
+	slow.HandleEvent(muxy.EventPreDispatch, ctx)
+
+	start := time.Now()
+	b := make([]byte, 100)
+	n, _ := ctx.Request.Body.Read(b)
+	if n != 2 || string(b[:n]) != "ab" {
+		t.Fatalf("Expected a chunk of 2 bytes, got '%s'", b[:n])
+	}
+	rest, _ := ioutil.ReadAll(ctx.Request.Body)
+	if string(rest) != "cdef" {
+		t.Fatalf("Expected the rest of the body, got '%s'", rest)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Fatalf("Expected body to take at least 30ms to read, took %v", elapsed)
+	}
+}
+
+func TestHTTPSlow_Response(t *testing.T) {
+	slow := HTTPSlowSymptom{Hold: 30, ResponseInterval: 5}
+	slow.Setup()
+
+	ctx := slowContext("")
+	ctx.Response = &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("hello")))}
+	slow.HandleEvent(muxy.EventPreDispatch, ctx)
+	if _, ok := ctx.Request.Body.(*slowReader); ok {
+		t.Fatal("Expected request body not to be slowed")
+	}
+	slow.HandleEvent(muxy.EventPostDispatch, ctx)
+	if !ctx.Flush {
+		t.Fatal("Expected response to be flushed as it is read")
+	}
+
+	start := time.Now()
+	b, _ := ioutil.ReadAll(ctx.Response.Body)
+	if string(b) != "hello" {
+		t.Fatalf("Expected the whole body, got '%s'", b)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected body to take at least 50ms to read, took %v", elapsed)
+	}
+}
+
+func TestHTTPSlow_ClientGone(t *testing.T) {
+	slow := HTTPSlowSymptom{Hold: -1}
+	slow.Setup()
+
+	c, cancel := context.WithCancel(context.Background())
+	ctx := slowContext("")
+	ctx.Request = ctx.Request.WithContext(c)
+	ctx.Response = &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("hello")))}
+	slow.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, err := ioutil.ReadAll(ctx.Response.Body); err != errClientGone {
+		t.Fatal("Expected body to be held until the client went away, got", err)
+	}
+}
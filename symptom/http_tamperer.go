@@ -9,6 +9,8 @@ import (
 	"net/http"
 
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/mefellows/muxy/log"
@@ -25,6 +27,23 @@ type RequestConfig struct {
 	Body    string
 	Path    string
 	Host    string
+
+	// Replace applies regular expression replacements to the body and
+	// headers, once the body has been set
+	Replace []Replacement
+
+	// Template is a Go template for the body, given TemplateData with the
+	// original request
+	Template string
+
+	// Delete removes headers
+	Delete []string
+
+	// PreserveCase sets Headers with the exact case given, rather than
+	// canonicalising them
+	PreserveCase bool `mapstructure:"preserve_case"`
+
+	template *template.Template
 }
 
 // ResponseConfig contains details of the HTTP response to tamper with prior to
@@ -34,6 +53,27 @@ type ResponseConfig struct {
 	Cookies []http.Cookie
 	Body    string
 	Status  int
+
+	// Replace applies regular expression replacements to the body and
+	// headers, once the body has been set
+	Replace []Replacement
+
+	// Template is a Go template for the body, given TemplateData with the
+	// original request and response
+	Template string
+
+	// Delete removes headers
+	Delete []string
+
+	// PreserveCase sets Headers with the exact case given, rather than
+	// canonicalising them
+	PreserveCase bool `mapstructure:"preserve_case"`
+
+	// Faults are malformed, conflicting or oversized headers, applied
+	// once headers have been set and deleted
+	Faults []HeaderFault
+
+	template *template.Template
 }
 
 // HTTPTampererSymptom is a plugin to mess with request/responses between
@@ -42,6 +82,12 @@ type HTTPTampererSymptom struct {
 	Request       RequestConfig
 	Response      ResponseConfig
 	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	// requestBodies keeps the original request bodies of recent exchanges
+	// for response templates, as they have been read by the time of the
+	// response
+	requestBodies map[uint64][]byte
+	lock          sync.Mutex
 }
 
 func init() {
@@ -60,6 +106,27 @@ var defaultMatchingRule = MatchingRule{
 func (m *HTTPTampererSymptom) Setup() {
 	log.Debug("HTTP Tamperer Setup()")
 
+	var err error
+	if m.Request.template, err = compileTemplate(m.Request.Template); err != nil {
+		fail("HTTP Tamperer - Incorrectly specified request template:", err)
+	}
+	if m.Response.template, err = compileTemplate(m.Response.Template); err != nil {
+		fail("HTTP Tamperer - Incorrectly specified response template:", err)
+	}
+	if err = compileReplacements(m.Request.Replace); err != nil {
+		fail("HTTP Tamperer - Incorrectly specified request replacement:", err)
+	}
+	if err = compileReplacements(m.Response.Replace); err != nil {
+		fail("HTTP Tamperer - Incorrectly specified response replacement:", err)
+	}
+	for _, f := range m.Response.Faults {
+		if err = f.validate(); err != nil {
+			fail("HTTP Tamperer - Incorrectly specified response fault:", err)
+		}
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
 	// Add default (catch all) matching rule
 	// Only applicable if none supplied
 	if len(m.MatchingRules) == 0 {
@@ -77,6 +144,10 @@ func (m *HTTPTampererSymptom) Teardown() {
 // HandleEvent is a hook to allow the plugin to intervene with a request/response
 // event
 func (m *HTTPTampererSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
 	if MatchSymptoms(m.MatchingRules, *ctx) {
 		log.Trace("HTTP Tamperer Symptom Hit")
 		switch e {
@@ -93,6 +164,9 @@ func (m *HTTPTampererSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context)
 // MuckRequest adds chaos to the request
 func (m *HTTPTampererSymptom) MuckRequest(ctx *muxy.Context) {
 	if ctx.Request != nil {
+		if m.Response.template != nil {
+			m.keepRequestBody(ctx)
+		}
 
 		// Path
 		if m.Request.Path != "" {
@@ -117,6 +191,20 @@ func (m *HTTPTampererSymptom) MuckRequest(ctx *muxy.Context) {
 			log.Debug("HTTP Tamperer Spoofing HTTP Request Body With [%s]", log.Colorize(log.BLUE, m.Request.Body))
 		}
 
+		// Transform body
+		if m.Request.template != nil || replacesBody(m.Request.Replace) {
+			data := TemplateData{Request: requestMessage(ctx.Request)}
+			transformed := transformRequestBody(ctx.Request, func(b []byte) []byte {
+				if m.Request.template != nil {
+					b = executeTemplate(m.Request.template, data, b)
+				}
+				return replaceBody(m.Request.Replace, b)
+			})
+			if !transformed {
+				log.Error("HTTP Tamperer unable to transform request body with Content-Encoding '%s'", ctx.Request.Header.Get("Content-Encoding"))
+			}
+		}
+
 		// Set Cookies
 		for _, c := range m.Request.Cookies {
 			c.Expires = stringToDate(c.RawExpires)
@@ -126,9 +214,16 @@ func (m *HTTPTampererSymptom) MuckRequest(ctx *muxy.Context) {
 
 		// Set Headers
 		for k, v := range m.Request.Headers {
-			key := strings.ToTitle(strings.Replace(k, "_", "-", -1))
+			key := headerKey(k, m.Request.PreserveCase)
 			log.Debug("HTTP Tamperer Spoofing Request Header [%s => %s]", log.Colorize(log.LIGHTMAGENTA, key), v)
-			ctx.Request.Header.Set(key, v)
+			setHeader(ctx.Request.Header, key, v, m.Request.PreserveCase)
+		}
+		replaceHeaders(m.Request.Replace, ctx.Request.Header)
+
+		// Delete Headers
+		for _, k := range m.Request.Delete {
+			log.Debug("HTTP Tamperer Deleting Request Header [%s]", log.Colorize(log.LIGHTMAGENTA, k))
+			deleteHeader(ctx.Request.Header, k)
 		}
 
 		// This Writes all headers, setting status code - so call this last
@@ -164,6 +259,23 @@ func (m *HTTPTampererSymptom) MuckResponse(ctx *muxy.Context) {
 			*ctx.Response = *r
 		}
 
+		// Transform body
+		if m.Response.template != nil || replacesBody(m.Response.Replace) {
+			transformed := transformBody(ctx.Response, func(b []byte) []byte {
+				if m.Response.template != nil {
+					data := TemplateData{
+						Request:  m.originalRequest(ctx),
+						Response: responseMessage(ctx.Response, b),
+					}
+					b = executeTemplate(m.Response.template, data, b)
+				}
+				return replaceBody(m.Response.Replace, b)
+			})
+			if !transformed {
+				log.Error("HTTP Tamperer unable to transform response body with Content-Encoding '%s'", ctx.Response.Header.Get("Content-Encoding"))
+			}
+		}
+
 		// Set Cookies
 		for _, c := range m.Response.Cookies {
 			c.Expires = stringToDate(c.RawExpires)
@@ -173,9 +285,22 @@ func (m *HTTPTampererSymptom) MuckResponse(ctx *muxy.Context) {
 
 		// Set Headers
 		for k, v := range m.Response.Headers {
-			key := strings.ToTitle(strings.Replace(k, "_", "-", -1))
+			key := headerKey(k, m.Response.PreserveCase)
 			log.Debug("HTTP Tamperer Spoofing Response Header [%s => %s]", log.Colorize(log.LIGHTMAGENTA, key), v)
-			ctx.Response.Header.Set(key, v)
+			setHeader(ctx.Response.Header, key, v, m.Response.PreserveCase)
+		}
+		replaceHeaders(m.Response.Replace, ctx.Response.Header)
+
+		// Delete Headers
+		for _, k := range m.Response.Delete {
+			log.Debug("HTTP Tamperer Deleting Response Header [%s]", log.Colorize(log.LIGHTMAGENTA, k))
+			deleteHeader(ctx.Response.Header, k)
+		}
+
+		// Header Faults
+		for _, f := range m.Response.Faults {
+			log.Debug("HTTP Tamperer Injecting Response Header Fault [%s]", log.Colorize(log.LIGHTMAGENTA, f.Type))
+			f.apply(ctx.Response)
 		}
 
 		// This Writes all headers, setting status code - so call this last
@@ -187,6 +312,65 @@ func (m *HTTPTampererSymptom) MuckResponse(ctx *muxy.Context) {
 	}
 }
 
+// keepRequestBody keeps the decoded body of the request of ctx, until
+// its response
+func (m *HTTPTampererSymptom) keepRequestBody(ctx *muxy.Context) {
+	b, err := readRequestBody(ctx.Request)
+	if err != nil {
+		return
+	}
+	decoded, ok := decodeBody(b, ctx.Request.Header.Get("Content-Encoding"))
+	if !ok {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.requestBodies == nil {
+		m.requestBodies = map[uint64][]byte{}
+	}
+	m.requestBodies[ctx.Exchange] = decoded
+	for exchange := range m.requestBodies {
+		if exchange+maxExchanges < ctx.Exchange {
+			delete(m.requestBodies, exchange)
+		}
+	}
+}
+
+// originalRequest describes the request of ctx for response templates,
+// with the body kept before dispatch
+func (m *HTTPTampererSymptom) originalRequest(ctx *muxy.Context) *TemplateMessage {
+	msg := requestMessage(ctx.Request)
+
+	m.lock.Lock()
+	body, ok := m.requestBodies[ctx.Exchange]
+	delete(m.requestBodies, ctx.Exchange)
+	m.lock.Unlock()
+
+	if ok && msg != nil {
+		msg.setBody(body)
+	}
+	return msg
+}
+
+// headerKey returns the header set for a configured key, in which
+// underscores stand for hyphens
+func headerKey(k string, preserveCase bool) string {
+	k = strings.Replace(k, "_", "-", -1)
+	if preserveCase {
+		return k
+	}
+	return strings.ToTitle(k)
+}
+
+// compileTemplate compiles a body template, if one is given
+func compileTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("body").Parse(text)
+}
+
 func stringToDate(val string) time.Time {
 
 	exptime, err := time.Parse(time.RFC1123, val)
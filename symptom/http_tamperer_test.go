@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 
@@ -271,3 +273,327 @@ func TestHTTPTampererSymptom_Teardown(t *testing.T) {
 	tamperer := HTTPTampererSymptom{}
 	tamperer.Teardown()
 }
+
+func TestHTTPTampererSymptom_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	tamperer := HTTPTampererSymptom{
+		Request: RequestConfig{
+			Template: "{{.Request.Path",
+			Replace:  []Replacement{{Pattern: "("}},
+		},
+		Response: ResponseConfig{
+			Template: "{{end}}",
+			Replace:  []Replacement{{Header: "ETag", Pattern: "[a-"}},
+		},
+	}
+	tamperer.Setup()
+
+	if failures != 4 {
+		t.Fatalf("Expected 4 failures, got %d", failures)
+	}
+}
+
+func TestHTTPTampererSymptom_ReplaceRequest(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Request: RequestConfig{
+			Replace: []Replacement{
+				{Pattern: `"qty":\s*(\d+)`, With: `"qty":-${1}`},
+				{Header: "Authorization", Pattern: "^Bearer .*", With: "Bearer expired"},
+				{Header: "X-Tenant", Pattern: "acme", With: "other"},
+			},
+		},
+	}
+	tamperer.Setup()
+
+	body := `{"sku":"x1","qty": 3}`
+	ctx := &muxy.Context{
+		Request: &http.Request{
+			Method:        "POST",
+			URL:           &url.URL{Path: "/orders"},
+			Header:        http.Header{"Authorization": []string{"Bearer abc"}, "Accept-Encoding": []string{"gzip, br"}, "x-tenant": []string{"acme"}},
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		},
+	}
+	tamperer.MuckRequest(ctx)
+
+	b, _ := ioutil.ReadAll(ctx.Request.Body)
+	if string(b) != `{"sku":"x1","qty":-3}` || ctx.Request.ContentLength != int64(len(b)) {
+		t.Fatalf("Expected quantity to be negated, got '%s' of length %d", b, ctx.Request.ContentLength)
+	}
+	if ctx.Request.Header.Get("Authorization") != "Bearer expired" {
+		t.Fatal("Expected Authorization to be replaced, got", ctx.Request.Header.Get("Authorization"))
+	}
+	if tenant := ctx.Request.Header["x-tenant"]; len(tenant) != 1 || tenant[0] != "other" {
+		t.Fatal("Expected header of preserved case to be replaced, got", tenant)
+	}
+	if ctx.Request.Header.Get("Accept-Encoding") != "gzip, br" {
+		t.Fatal("Expected Accept-Encoding to be untouched, got", ctx.Request.Header.Get("Accept-Encoding"))
+	}
+}
+
+func TestHTTPTampererSymptom_TemplateRequest(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Request: RequestConfig{
+			Template: `{"order":"{{.Request.JSON.id}}","via":"{{.Request.Method}} {{.Request.Path}}"}`,
+		},
+		Response: ResponseConfig{
+			Replace: []Replacement{{Pattern: "price", With: "cost"}},
+		},
+	}
+	tamperer.Setup()
+
+	ctx := &muxy.Context{
+		Request: &http.Request{
+			Method: "PUT",
+			URL:    &url.URL{Path: "/orders/7"},
+			Header: http.Header{"Accept-Encoding": []string{"br;q=1.0, gzip;q=0.8"}},
+			Body:   ioutil.NopCloser(bytes.NewReader([]byte(`{"id":7}`))),
+		},
+	}
+	tamperer.MuckRequest(ctx)
+
+	b, _ := ioutil.ReadAll(ctx.Request.Body)
+	if string(b) != `{"order":"7","via":"PUT /orders/7"}` {
+		t.Fatal("Expected request body from template, got", string(b))
+	}
+	if ctx.Request.Header.Get("Accept-Encoding") != "br;q=1.0, gzip;q=0.8" {
+		t.Fatal("Expected Accept-Encoding to be untouched, got", ctx.Request.Header.Get("Accept-Encoding"))
+	}
+}
+
+func TestHTTPTampererSymptom_TemplateResponse(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Template: `{"request_id":"{{.Request.Header.Get "X-Request-Id"}}","status":{{.Response.Status}},"price":{{.Response.JSON.price}}}`,
+			Replace: []Replacement{
+				{Pattern: `"price":[\d.]+`, With: `"price":"NaN"`},
+				{Header: "ETag", Pattern: `"(.*)"`, With: `W/"${1}"`},
+			},
+		},
+	}
+	tamperer.Setup()
+
+	for _, encoding := range []string{"", "gzip", "deflate", "br"} {
+		body := encodeBody([]byte(`{"price":9.99}`), encoding)
+		ctx := &muxy.Context{
+			Request: &http.Request{
+				URL:    &url.URL{Path: "/products/1"},
+				Header: http.Header{"X-Request-Id": []string{"abc-123"}},
+			},
+			Response: &http.Response{
+				StatusCode:    200,
+				Header:        http.Header{"Content-Encoding": []string{encoding}, "Etag": []string{`"v1"`}},
+				ContentLength: int64(len(body)),
+				Body:          ioutil.NopCloser(bytes.NewReader(body)),
+			},
+		}
+		tamperer.MuckResponse(ctx)
+
+		b, _ := ioutil.ReadAll(ctx.Response.Body)
+		if ctx.Response.ContentLength != int64(len(b)) || ctx.Response.Header.Get("Content-Length") != strconv.Itoa(len(b)) {
+			t.Fatalf("Expected Content-Length of %d, got %d", len(b), ctx.Response.ContentLength)
+		}
+		decoded, ok := decodeBody(b, encoding)
+		if !ok || string(decoded) != `{"request_id":"abc-123","status":200,"price":"NaN"}` {
+			t.Fatalf("Expected %s response body from template, got '%s'", encoding, decoded)
+		}
+		if ctx.Response.Header.Get("ETag") != `W/"v1"` {
+			t.Fatal("Expected weak ETag, got", ctx.Response.Header.Get("ETag"))
+		}
+	}
+}
+
+func TestHTTPTampererSymptom_TemplateResponseRequestBody(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Template: `{"order":{{.Request.JSON.id}},"echo":"{{.Request.Body}}"}`,
+		},
+	}
+	tamperer.Setup()
+
+	req := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: "/orders"},
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(bytes.NewReader([]byte(`{"id":7}`))),
+	}
+	tamperer.HandleEvent(muxy.EventPreDispatch, &muxy.Context{Request: req, Exchange: 42})
+
+	// The body is sent to the target, and read, before the response
+	b, _ := ioutil.ReadAll(req.Body)
+	if string(b) != `{"id":7}` {
+		t.Fatal("Expected request body to be sent untouched, got", string(b))
+	}
+	ctx := &muxy.Context{
+		Request:  req,
+		Response: &http.Response{StatusCode: 200, Header: http.Header{}, Body: ioutil.NopCloser(bytes.NewReader(nil))},
+		Exchange: 42,
+	}
+	tamperer.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	b, _ = ioutil.ReadAll(ctx.Response.Body)
+	if string(b) != `{"order":7,"echo":"{"id":7}"}` {
+		t.Fatal("Expected response template to be given the request body, got", string(b))
+	}
+	if len(tamperer.requestBodies) != 0 {
+		t.Fatal("Expected kept request body to be forgotten once used")
+	}
+}
+
+func TestHTTPTampererSymptom_DeleteHeaders(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Request:  RequestConfig{Delete: []string{"authorization"}},
+		Response: ResponseConfig{Delete: []string{"Content-Type", "etag"}},
+	}
+	tamperer.Setup()
+
+	ctx := &muxy.Context{
+		Request: &http.Request{
+			URL:    &url.URL{Path: "/"},
+			Header: http.Header{"Authorization": []string{"Bearer abc"}, "Accept": []string{"*/*"}},
+		},
+		Response: &http.Response{
+			Header: http.Header{"Content-Type": []string{"text/plain"}, "Etag": []string{`"v1"`}, "Date": []string{"today"}},
+			Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		},
+	}
+	tamperer.MuckRequest(ctx)
+	tamperer.MuckResponse(ctx)
+
+	if len(ctx.Request.Header) != 1 || ctx.Request.Header.Get("Accept") != "*/*" {
+		t.Fatal("Expected only Authorization to be deleted from request, got", ctx.Request.Header)
+	}
+	if len(ctx.Response.Header) != 1 || ctx.Response.Header.Get("Date") != "today" {
+		t.Fatal("Expected Content-Type and ETag to be deleted from response, got", ctx.Response.Header)
+	}
+}
+
+func TestHTTPTampererSymptom_PreserveCase(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Headers:      map[string]string{"x-request_ID": "abc", "content-type": "text/plain"},
+			PreserveCase: true,
+		},
+	}
+	tamperer.Setup()
+
+	ctx := &muxy.Context{
+		Response: &http.Response{
+			Header: http.Header{"Content-Type": []string{"application/json"}},
+			Body:   ioutil.NopCloser(bytes.NewReader(nil)),
+		},
+	}
+	tamperer.MuckResponse(ctx)
+
+	expected := http.Header{"x-request-ID": []string{"abc"}, "content-type": []string{"text/plain"}}
+	if !reflect.DeepEqual(ctx.Response.Header, expected) {
+		t.Fatal("Expected headers to keep their case, got", ctx.Response.Header)
+	}
+}
+
+func TestHTTPTampererSymptom_HeaderFaults(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Faults: []HeaderFault{
+				{Type: HeaderFaultDuplicate, Header: "content-length"},
+				{Type: HeaderFaultDuplicate, Header: "X-Version", Value: "v2"},
+				{Type: HeaderFaultContentType},
+				{Type: HeaderFaultSetCookie},
+				{Type: HeaderFaultOversized, Size: 10000},
+				{Type: HeaderFaultCacheControl, Value: "max-age=abc"},
+				{Type: HeaderFaultETag},
+			},
+		},
+	}
+	tamperer.Setup()
+
+	ctx := &muxy.Context{
+		Response: &http.Response{
+			Header: http.Header{"Content-Length": []string{"5"}, "X-Version": []string{"v1"}},
+			Body:   ioutil.NopCloser(bytes.NewReader([]byte("hello"))),
+		},
+	}
+	tamperer.MuckResponse(ctx)
+
+	h := ctx.Response.Header
+	if !reflect.DeepEqual(h["Content-Length"], []string{"5", "6"}) {
+		t.Fatal("Expected conflicting Content-Length, got", h["Content-Length"])
+	}
+	if !reflect.DeepEqual(h["X-Version"], []string{"v1", "v2"}) {
+		t.Fatal("Expected conflicting X-Version, got", h["X-Version"])
+	}
+	if h.Get("Content-Type") != defaultFaultyContentType {
+		t.Fatal("Expected invalid Content-Type, got", h.Get("Content-Type"))
+	}
+	if h.Get("Set-Cookie") != defaultFaultySetCookie || len(ctx.Response.Cookies()) != 0 {
+		t.Fatal("Expected malformed Set-Cookie, got", h.Get("Set-Cookie"))
+	}
+	if len(h.Get("X-Oversized")) != 10000 {
+		t.Fatal("Expected oversized header of 10000 bytes, got", len(h.Get("X-Oversized")))
+	}
+	if h.Get("Cache-Control") != "max-age=abc" || h.Get("ETag") != defaultFaultyETag {
+		t.Fatal("Expected bogus Cache-Control and ETag, got", h)
+	}
+}
+
+func TestHTTPTampererSymptom_WrongContentLength(t *testing.T) {
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Body:   "my new body",
+			Faults: []HeaderFault{{Type: HeaderFaultContentLength}},
+		},
+	}
+	tamperer.Setup()
+
+	ctx := &muxy.Context{
+		Response: &http.Response{
+			Header: http.Header{},
+			Body:   ioutil.NopCloser(bytes.NewReader([]byte("hello"))),
+		},
+	}
+	tamperer.MuckResponse(ctx)
+
+	if ctx.Response.Header.Get("Content-Length") != "12" {
+		t.Fatal("Expected Content-Length one more than the body, got", ctx.Response.Header.Get("Content-Length"))
+	}
+	body, _ := ioutil.ReadAll(ctx.Response.Body)
+	if string(body) != "my new body" {
+		t.Fatal("Expected body to be readable, got", string(body))
+	}
+}
+
+func TestHTTPTampererSymptom_SetupInvalidFaults(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	tamperer := HTTPTampererSymptom{
+		Response: ResponseConfig{
+			Faults: []HeaderFault{
+				{Type: "explode"},
+				{Type: HeaderFaultDuplicate},
+				{Type: HeaderFaultContentLength, Value: "ten"},
+				{Type: HeaderFaultOversized, Size: -1},
+			},
+		},
+	}
+	tamperer.Setup()
+
+	if failures != 4 {
+		t.Fatalf("Expected 4 failures, got %d", failures)
+	}
+}
@@ -0,0 +1,142 @@
+package symptom
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/mefellows/muxy/log"
+)
+
+// Replacement is a regular expression find and replace on a body or header
+type Replacement struct {
+	// Header names the header whose values are replaced in. The body is
+	// replaced in if it is empty
+	Header string `required:"false"`
+
+	Pattern string
+
+	// With replaces each match, and may refer to submatches, e.g. ${1}
+	With string `required:"false"`
+
+	pattern *regexp.Regexp
+}
+
+// TemplateMessage is a request or response given to body templates
+type TemplateMessage struct {
+	Method string
+	URL    string
+	Path   string
+	Status int
+	Header http.Header
+	Body   string
+
+	// JSON is the decoded body, if it is JSON
+	JSON interface{}
+}
+
+// TemplateData is given to body templates
+type TemplateData struct {
+	Request  *TemplateMessage
+	Response *TemplateMessage
+}
+
+// compileReplacements compiles the patterns of replacements
+func compileReplacements(replacements []Replacement) error {
+	for i := range replacements {
+		r := &replacements[i]
+		var err error
+		if r.pattern, err = regexp.Compile(r.Pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceBody applies the body replacements to b
+func replaceBody(replacements []Replacement, b []byte) []byte {
+	for _, r := range replacements {
+		if r.Header == "" && r.pattern != nil {
+			b = r.pattern.ReplaceAll(b, []byte(r.With))
+		}
+	}
+	return b
+}
+
+// replaceHeaders applies the header replacements to header, whose keys are
+// matched in any case, as those set with preserve_case are not canonical
+func replaceHeaders(replacements []Replacement, header http.Header) {
+	for _, r := range replacements {
+		if r.Header == "" || r.pattern == nil {
+			continue
+		}
+		for k, values := range header {
+			if !strings.EqualFold(k, r.Header) {
+				continue
+			}
+			for i, v := range values {
+				values[i] = r.pattern.ReplaceAllString(v, r.With)
+			}
+		}
+	}
+}
+
+// replacesBody returns true if any of the replacements is of the body
+func replacesBody(replacements []Replacement) bool {
+	for _, r := range replacements {
+		if r.Header == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// requestMessage describes a request for templates. Its body is read, and
+// left to be read again.
+func requestMessage(req *http.Request) *TemplateMessage {
+	if req == nil {
+		return nil
+	}
+	msg := &TemplateMessage{Method: req.Method, Header: req.Header}
+	if req.URL != nil {
+		msg.URL = req.URL.String()
+		msg.Path = req.URL.Path
+	}
+	if b, err := readRequestBody(req); err == nil {
+		if decoded, ok := decodeBody(b, req.Header.Get("Content-Encoding")); ok {
+			msg.setBody(decoded)
+		}
+	}
+	return msg
+}
+
+// responseMessage describes a response, with its decoded body, for templates
+func responseMessage(res *http.Response, body []byte) *TemplateMessage {
+	msg := &TemplateMessage{Status: res.StatusCode, Header: res.Header}
+	msg.setBody(body)
+	return msg
+}
+
+func (msg *TemplateMessage) setBody(b []byte) {
+	msg.Body = string(b)
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var doc interface{}
+	if decoder.Decode(&doc) == nil {
+		msg.JSON = doc
+	}
+}
+
+// executeTemplate executes a body template, returning the body unchanged
+// if it fails
+func executeTemplate(t *template.Template, data TemplateData, body []byte) []byte {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Error("HTTP Tamperer unable to execute body template: %v", err)
+		return body
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,223 @@
+package symptom
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// Types of HTTP/1.1 protocol violation
+const (
+	ViolationStatusLine       = "status_line"
+	ViolationChunkSize        = "chunk_size"
+	ViolationChunkTerminator  = "chunk_terminator"
+	ViolationContentLength    = "content_length"
+	ViolationTransferEncoding = "transfer_encoding"
+	ViolationPrematureEOF     = "premature_eof"
+	ViolationEarlyResponse    = "early_response"
+)
+
+// defaultViolationStatusLine is the invalid status line sent by status_line
+const defaultViolationStatusLine = "HTTP/1.1 2OO OK"
+
+// HTTPViolationSymptom hijacks the connection of matching requests, and
+// writes a deliberately broken HTTP/1.1 response to it, to harden HTTP
+// clients against misbehaving servers. The connection is closed after.
+type HTTPViolationSymptom struct {
+	// Violation is one of status_line, chunk_size, chunk_terminator,
+	// content_length, transfer_encoding, premature_eof or early_response
+	Violation string
+
+	// StatusLine overrides the invalid status line sent by status_line
+	StatusLine string `required:"false" mapstructure:"status_line"`
+
+	// Length is the Content-Length claimed by content_length, or the number
+	// of bytes of the response sent by premature_eof. By default, ten bytes
+	// more than the body are claimed, and half of the response is sent.
+	Length int `required:"false"`
+
+	// Status and Body are those of the response sent by early_response,
+	// before the request is read or sent to the target
+	Status int    `required:"false"`
+	Body   string `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &HTTPViolationSymptom{}, nil
+	}, "http_violation")
+}
+
+// Setup sets up the plugin
+func (m *HTTPViolationSymptom) Setup() {
+	log.Debug("HTTP Violation Symptom - Setup()")
+
+	switch m.Violation {
+	case ViolationStatusLine, ViolationChunkSize, ViolationChunkTerminator, ViolationContentLength,
+		ViolationTransferEncoding, ViolationPrematureEOF, ViolationEarlyResponse:
+	default:
+		fail("HTTP Violation Symptom - Incorrectly specified violation:", m.Violation)
+	}
+	if m.Length < 0 {
+		fail("HTTP Violation Symptom - Incorrectly specified length:", m.Length)
+	}
+	if m.Status != 0 && (m.Status < 100 || m.Status > 999) {
+		fail("HTTP Violation Symptom - Incorrectly specified status:", m.Status)
+	}
+
+	setupMatchingRules(m.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(m.MatchingRules) == 0 {
+		m.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (m *HTTPViolationSymptom) Teardown() {
+	log.Debug("HTTP Violation Symptom - Teardown()")
+}
+
+// HandleEvent breaks the response to matching requests: before dispatch
+// for early_response, and otherwise after dispatch, breaking the response
+// of the target
+func (m *HTTPViolationSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Request == nil || ctx.ResponseWriter == nil || ctx.Hijacked {
+		return
+	}
+	switch {
+	case e == muxy.EventPreDispatch && m.Violation == ViolationEarlyResponse:
+	case e == muxy.EventPostDispatch && ctx.Response != nil && m.Violation != ViolationEarlyResponse:
+	default:
+		return
+	}
+
+	if MatchSymptoms(m.MatchingRules, *ctx) {
+		log.Trace("HTTP Violation Symptom Hit")
+		m.Muck(ctx)
+	} else {
+		log.Trace("HTTP Violation Symptom Miss")
+	}
+}
+
+// Muck hijacks the connection, and writes the broken response to it
+func (m *HTTPViolationSymptom) Muck(ctx *muxy.Context) {
+	hijacker, ok := ctx.ResponseWriter.(http.Hijacker)
+	if !ok {
+		log.Error("HTTP Violation Symptom - unable to hijack the connection, e.g. of an HTTP/2 request")
+		return
+	}
+
+	var raw []byte
+	if m.Violation == ViolationEarlyResponse {
+		raw = m.earlyResponse()
+	} else {
+		body, err := readBody(ctx.Response)
+		if err != nil {
+			log.Error("HTTP Violation Symptom - unable to read response body: %v", err)
+			return
+		}
+		raw = m.violate(ctx.Response, body)
+	}
+
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Error("HTTP Violation Symptom - unable to hijack the connection: %v", err)
+		return
+	}
+	defer conn.Close()
+	ctx.Hijacked = true
+
+	log.Debug("HTTP Violation Symptom - writing %s violation [%s]", m.Violation, log.Colorize(log.BLUE, strconv.Quote(string(raw))))
+	buf.Write(raw)
+	buf.Flush()
+}
+
+// earlyResponse returns a well formed response, sent before the request
+// body is read
+func (m *HTTPViolationSymptom) earlyResponse() []byte {
+	status := m.Status
+	if status == 0 {
+		status = http.StatusRequestEntityTooLarge
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	fmt.Fprintf(&b, "Content-Length: %d\r\nConnection: close\r\n\r\n", len(m.Body))
+	b.WriteString(m.Body)
+	return b.Bytes()
+}
+
+// violate serialises res, with the given body, breaking it by the violation
+func (m *HTTPViolationSymptom) violate(res *http.Response, body []byte) []byte {
+	var b bytes.Buffer
+	if m.Violation == ViolationStatusLine {
+		b.WriteString(valueOr(m.StatusLine, defaultViolationStatusLine))
+		b.WriteString("\r\n")
+	} else {
+		fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	res.Header.WriteSubset(&b, framingHeaders)
+
+	switch m.Violation {
+	case ViolationChunkSize:
+		// Claim more bytes in the chunk than are sent
+		fmt.Fprintf(&b, "Transfer-Encoding: chunked\r\n\r\n%x\r\n", len(body)+16)
+		b.Write(body)
+		b.WriteString("\r\n0\r\n\r\n")
+	case ViolationChunkTerminator:
+		b.WriteString("Transfer-Encoding: chunked\r\n\r\n")
+		if len(body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n", len(body))
+			b.Write(body)
+			b.WriteString("\r\n")
+		}
+	case ViolationContentLength:
+		length := m.Length
+		if length == 0 {
+			length = len(body) + 10
+		}
+		fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", length)
+		b.Write(body)
+	case ViolationTransferEncoding:
+		b.WriteString("Transfer-Encoding: chunked\r\nTransfer-Encoding: identity\r\n\r\n")
+		if len(body) > 0 {
+			fmt.Fprintf(&b, "%x\r\n", len(body))
+			b.Write(body)
+			b.WriteString("\r\n")
+		}
+		b.WriteString("0\r\n\r\n")
+	default:
+		fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(body))
+		b.Write(body)
+	}
+
+	raw := b.Bytes()
+	if m.Violation == ViolationPrematureEOF {
+		length := m.Length
+		if length == 0 {
+			length = len(raw) / 2
+		}
+		if length < len(raw) {
+			raw = raw[:length]
+		}
+	}
+	return raw
+}
+
+// framingHeaders are the headers written by violations themselves, rather
+// than copied from the response
+var framingHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+}
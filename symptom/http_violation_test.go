@@ -0,0 +1,113 @@
+package symptom
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func violationResponse() *http.Response {
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"text/plain"}, "Content-Length": []string{"5"}},
+		Body:       ioutil.NopCloser(strings.NewReader("hello")),
+	}
+}
+
+// parseViolation parses a raw response as a client would, returning the
+// error of reading it
+func parseViolation(raw []byte) ([]byte, error) {
+	res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+func TestHTTPViolation_Setup(t *testing.T) {
+	violation := HTTPViolationSymptom{Violation: ViolationChunkSize}
+	violation.Setup()
+
+	if len(violation.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestHTTPViolation_SetupInvalid(t *testing.T) {
+	failures := 0
+	oldFail := fail
+	fail = func(reason string, i ...interface{}) {
+		failures++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	violation := HTTPViolationSymptom{}
+	violation.Setup()
+	violation = HTTPViolationSymptom{Violation: ViolationPrematureEOF, Length: -1}
+	violation.Setup()
+	violation = HTTPViolationSymptom{Violation: ViolationEarlyResponse, Status: 42}
+	violation.Setup()
+
+	if failures != 3 {
+		t.Fatalf("Expected 3 failures, got %d", failures)
+	}
+}
+
+func TestHTTPViolation_Teardown(t *testing.T) {
+	violation := HTTPViolationSymptom{}
+	violation.Teardown()
+}
+
+func TestHTTPViolation_Violate(t *testing.T) {
+	cases := map[string]string{
+		ViolationStatusLine:       "malformed HTTP status code",
+		ViolationChunkSize:        "unexpected EOF",
+		ViolationChunkTerminator:  "unexpected EOF",
+		ViolationContentLength:    "unexpected EOF",
+		ViolationTransferEncoding: "too many transfer encodings",
+		ViolationPrematureEOF:     "EOF",
+	}
+	for v, expected := range cases {
+		violation := HTTPViolationSymptom{Violation: v}
+		violation.Setup()
+		raw := violation.violate(violationResponse(), []byte("hello"))
+
+		if _, err := parseViolation(raw); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %s violation to fail with '%s', got %v for %q", v, expected, err, raw)
+		}
+		if v != ViolationPrematureEOF && !bytes.Contains(raw, []byte("Content-Type: text/plain\r\n")) {
+			t.Errorf("Expected %s violation to keep the response headers, got %q", v, raw)
+		}
+	}
+}
+
+func TestHTTPViolation_Length(t *testing.T) {
+	violation := HTTPViolationSymptom{Violation: ViolationPrematureEOF, Length: 8}
+	violation.Setup()
+	if raw := violation.violate(violationResponse(), []byte("hello")); string(raw) != "HTTP/1.1" {
+		t.Fatalf("Expected the first 8 bytes of the response, got %q", raw)
+	}
+
+	violation = HTTPViolationSymptom{Violation: ViolationContentLength, Length: 3}
+	violation.Setup()
+	raw := violation.violate(violationResponse(), []byte("hello"))
+	if body, err := parseViolation(raw); err != nil || string(body) != "hel" {
+		t.Fatalf("Expected a body of 3 bytes, got '%s' (%v)", body, err)
+	}
+}
+
+func TestHTTPViolation_EarlyResponse(t *testing.T) {
+	violation := HTTPViolationSymptom{Violation: ViolationEarlyResponse, Body: "too large"}
+	violation.Setup()
+
+	body, err := parseViolation(violation.earlyResponse())
+	if err != nil || string(body) != "too large" {
+		t.Fatalf("Expected a well formed early response, got '%s' (%v)", body, err)
+	}
+}
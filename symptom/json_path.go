@@ -0,0 +1,206 @@
+package symptom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonStep is a step of a path into a JSON document
+type jsonStep struct {
+	// key is an object member or, for JSON Pointers, an array index
+	key string
+
+	// index is an array index, for JSONPath steps such as [2]. Negative
+	// indices count from the end of the array.
+	index   int
+	indexed bool
+
+	// wildcard selects every member or element
+	wildcard bool
+}
+
+// jsonLocation is a value selected from a JSON document
+type jsonLocation struct {
+	value  interface{}
+	set    func(interface{})
+	remove func()
+}
+
+// removedValue marks array elements that are removed, until the document
+// is compacted
+type removedValue struct{}
+
+// parseJSONPath parses a JSON Pointer, e.g. "/items/0/id", or JSONPath made
+// of member, index and wildcard steps, e.g. "$.items[*].id" or "$['a b']"
+func parseJSONPath(path string) ([]jsonStep, error) {
+	switch {
+	case path == "" || path == "$":
+		return nil, nil
+	case strings.HasPrefix(path, "/"):
+		var steps []jsonStep
+		for _, token := range strings.Split(path[1:], "/") {
+			token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+			steps = append(steps, jsonStep{key: token})
+		}
+		return steps, nil
+	case !strings.HasPrefix(path, "$"):
+		return nil, fmt.Errorf("path '%s' is neither a JSON Pointer nor JSONPath", path)
+	}
+
+	var steps []jsonStep
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[") + 1
+			if end == 0 {
+				end = len(rest)
+			}
+			name := rest[1:end]
+			if name == "" {
+				return nil, fmt.Errorf("path '%s' has an empty member", path)
+			}
+			steps = append(steps, jsonStep{key: name, wildcard: name == "*"})
+			rest = rest[end:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("path '%s' has an unterminated '['", path)
+			}
+			inner := rest[1:end]
+			switch {
+			case inner == "*":
+				steps = append(steps, jsonStep{wildcard: true})
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, jsonStep{key: inner[1 : len(inner)-1]})
+			default:
+				index, err := strconv.Atoi(inner)
+				if err != nil {
+					return nil, fmt.Errorf("path '%s' has an invalid index '%s'", path, inner)
+				}
+				steps = append(steps, jsonStep{index: index, indexed: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("path '%s' has an unexpected '%c'", path, rest[0])
+		}
+	}
+	return steps, nil
+}
+
+// selectJSON returns the values of doc at the path given by steps. The
+// root of the document is set with setRoot.
+func selectJSON(doc interface{}, steps []jsonStep, setRoot func(interface{})) []jsonLocation {
+	locations := []jsonLocation{{value: doc, set: setRoot, remove: func() {}}}
+	for _, step := range steps {
+		var next []jsonLocation
+		for _, l := range locations {
+			next = append(next, step.children(l.value)...)
+		}
+		locations = next
+	}
+	return locations
+}
+
+// children returns the members or elements of value selected by the step
+func (step jsonStep) children(value interface{}) []jsonLocation {
+	var locations []jsonLocation
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if step.indexed {
+			return nil
+		}
+		if step.wildcard {
+			for key := range v {
+				locations = append(locations, memberLocation(v, key))
+			}
+			return locations
+		}
+		if _, ok := v[step.key]; ok {
+			locations = append(locations, memberLocation(v, step.key))
+		}
+	case []interface{}:
+		if step.wildcard {
+			for i := range v {
+				locations = append(locations, elementLocation(v, i))
+			}
+			return locations
+		}
+		index := step.index
+		if !step.indexed {
+			var err error
+			if index, err = strconv.Atoi(step.key); err != nil {
+				return nil
+			}
+		}
+		if index < 0 {
+			index += len(v)
+		}
+		if index >= 0 && index < len(v) {
+			locations = append(locations, elementLocation(v, index))
+		}
+	}
+	return locations
+}
+
+func memberLocation(m map[string]interface{}, key string) jsonLocation {
+	return jsonLocation{
+		value:  m[key],
+		set:    func(v interface{}) { m[key] = v },
+		remove: func() { delete(m, key) },
+	}
+}
+
+func elementLocation(a []interface{}, i int) jsonLocation {
+	return jsonLocation{
+		value:  a[i],
+		set:    func(v interface{}) { a[i] = v },
+		remove: func() { a[i] = removedValue{} },
+	}
+}
+
+// compactJSON returns value without the array elements that were removed
+func compactJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, member := range v {
+			v[key] = compactJSON(member)
+		}
+	case []interface{}:
+		kept := v[:0]
+		for _, element := range v {
+			if _, ok := element.(removedValue); !ok {
+				kept = append(kept, compactJSON(element))
+			}
+		}
+		return kept
+	}
+	return value
+}
+
+// jsonValue converts a configured value, which may hold maps decoded from
+// YAML, into one that can be encoded as JSON
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for key, member := range v {
+			m[fmt.Sprint(key)] = jsonValue(member)
+		}
+		return m
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for key, member := range v {
+			m[key] = jsonValue(member)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, element := range v {
+			a[i] = jsonValue(element)
+		}
+		return a
+	}
+	return value
+}
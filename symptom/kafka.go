@@ -0,0 +1,189 @@
+package symptom
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/kafka"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// KafkaSymptom fails Produce requests, delays responses and hides
+// partitions from the clients of a Kafka Proxy
+type KafkaSymptom struct {
+	// Error answers matching Produce requests in place of the broker, failing
+	// every partition with an error code given by name or number, e.g.
+	// NOT_LEADER_OR_FOLLOWER, REQUEST_TIMED_OUT or NOT_ENOUGH_REPLICAS
+	Error string `required:"false"`
+
+	// Delay in ms before responses to matching requests are sent to the client
+	Delay int `required:"false"`
+
+	// Topic is a regular expression restricting the topics affected. Produce
+	// requests are failed if any of their topics match
+	Topic string `required:"false"`
+
+	// DropPartitions are the partitions removed from Metadata responses
+	DropPartitions []int `required:"false" mapstructure:"drop_partitions"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	code  int16
+	topic *regexp.Regexp
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &KafkaSymptom{}, nil
+	}, "kafka")
+}
+
+// Setup sets up the plugin
+func (s *KafkaSymptom) Setup() {
+	log.Debug("Kafka Symptom - Setup()")
+
+	if s.Error != "" {
+		code, ok := kafka.ErrorCode(s.Error)
+		if !ok {
+			fail("Kafka Symptom - Incorrectly specified error:", s.Error)
+		}
+		s.code = code
+	}
+	if s.Error == "" && s.Delay == 0 && len(s.DropPartitions) == 0 {
+		fail("Kafka Symptom - one of error, delay or drop_partitions must be specified")
+	}
+
+	topic, err := regexp.Compile(s.Topic)
+	if err != nil {
+		fail("Kafka Symptom - Incorrectly specified topic:", err)
+	}
+	s.topic = topic
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *KafkaSymptom) Teardown() {
+	log.Debug("Kafka Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *KafkaSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "kafka" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Kafka Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			s.Muck(ctx)
+		} else {
+			s.MuckResponse(ctx)
+		}
+	} else {
+		log.Trace("Kafka Symptom Miss")
+	}
+}
+
+// Muck fails Produce requests
+func (s *KafkaSymptom) Muck(ctx *muxy.Context) {
+	if s.Error == "" || ctx.Message.Command != "Produce" {
+		return
+	}
+
+	h, body, ok := kafka.ParseRequest(ctx.Bytes)
+	if !ok {
+		return
+	}
+	req, err := kafka.ParseProduceRequest(h.APIVersion, body)
+	if err != nil || !s.anyTopic(req) {
+		return
+	}
+
+	ctx.Bytes = nil
+
+	// Brokers close the connection when they cannot tell the client of an error
+	if req.Acks == 0 {
+		log.Debug("Kafka Symptom - closing connection in place of Produce")
+		ctx.Connection.Fault = muxy.FaultClose
+		return
+	}
+
+	log.Debug("Kafka Symptom - failing Produce with error %s", s.Error)
+	if s.Delay > 0 {
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+	ctx.Connection.Reply = kafka.NewResponse(h.CorrelationID, h.APIKey, h.APIVersion,
+		kafka.NewProduceResponse(h.APIVersion, req, s.code))
+}
+
+// anyTopic returns true if any topic produced to matches Topic
+func (s *KafkaSymptom) anyTopic(req *kafka.ProduceRequest) bool {
+	for _, t := range req.Topics {
+		if s.topic.MatchString(t.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// MuckResponse delays responses and drops partitions from Metadata responses
+func (s *KafkaSymptom) MuckResponse(ctx *muxy.Context) {
+	if s.Delay > 0 {
+		log.Debug("Kafka Symptom - delaying %s response by %dms", ctx.Message.Command, s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+
+	if len(s.DropPartitions) > 0 && ctx.Message.Command == "Metadata" {
+		s.dropPartitions(ctx)
+	}
+}
+
+// dropPartitions removes partitions of matching topics from a Metadata response
+func (s *KafkaSymptom) dropPartitions(ctx *muxy.Context) {
+	version, _ := strconv.Atoi(ctx.Message.Fields["version"])
+	correlationID, body, ok := kafka.ParseResponse(ctx.Bytes, kafka.Metadata, int16(version))
+	if !ok {
+		return
+	}
+	metadata, err := kafka.ParseMetadataResponse(int16(version), body)
+	if err != nil {
+		log.Debug("Kafka Symptom - unable to decode Metadata response: %s", err)
+		return
+	}
+
+	drop := map[int32]bool{}
+	for _, p := range s.DropPartitions {
+		drop[int32(p)] = true
+	}
+	for i, t := range metadata.Topics {
+		if t.Name == nil || !s.topic.MatchString(*t.Name) {
+			continue
+		}
+		var partitions []kafka.PartitionMetadata
+		for _, p := range t.Partitions {
+			if drop[p.Index] {
+				log.Trace("Kafka Symptom - dropping partition %d of %s", p.Index, *t.Name)
+				continue
+			}
+			partitions = append(partitions, p)
+		}
+		metadata.Topics[i].Partitions = partitions
+	}
+
+	ctx.Bytes = kafka.NewResponse(correlationID, kafka.Metadata, int16(version), metadata.Encode())
+}
@@ -0,0 +1,152 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/kafka"
+)
+
+func kafkaContext(command string, b []byte) *muxy.Context {
+	return &muxy.Context{
+		Bytes:      b,
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "kafka",
+			Command:  command,
+			Fields:   map[string]string{"version": "9"},
+		},
+	}
+}
+
+func produceRequest(acks int16, topic string) ([]byte, *kafka.ProduceRequest) {
+	req := &kafka.ProduceRequest{
+		Acks:   acks,
+		Topics: []kafka.ProduceTopic{{Name: topic, Partitions: []int32{0, 1}}},
+	}
+	h := kafka.RequestHeader{APIKey: kafka.Produce, APIVersion: 9, CorrelationID: 3}
+	return kafka.NewRequest(h, req.Encode(9)), req
+}
+
+func TestKafka_Setup(t *testing.T) {
+	s := KafkaSymptom{Error: "NOT_LEADER_OR_FOLLOWER"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.code != 6 {
+		t.Fatal("Want error code 6, got", s.code)
+	}
+}
+
+func TestKafka_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := KafkaSymptom{}
+	s.Setup()
+	s = KafkaSymptom{Error: "NOT_AN_ERROR"}
+	s.Setup()
+	s = KafkaSymptom{Delay: 10, Topic: "("}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestKafka_Teardown(t *testing.T) {
+	s := KafkaSymptom{}
+	s.Teardown()
+}
+
+func TestKafka_Produce(t *testing.T) {
+	s := KafkaSymptom{Error: "NOT_ENOUGH_REPLICAS", Topic: "^orders$"}
+	s.Setup()
+
+	b, req := produceRequest(-1, "orders")
+	ctx := kafkaContext("Produce", b)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	want := kafka.NewResponse(3, kafka.Produce, 9, kafka.NewProduceResponse(9, req, 19))
+	if ctx.Bytes != nil || string(ctx.Connection.Reply) != string(want) {
+		t.Fatalf("Want error reply %q, got %q", want, ctx.Connection.Reply)
+	}
+
+	b, _ = produceRequest(-1, "events")
+	ctx = kafkaContext("Produce", b)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want Produce to other topics to be forwarded")
+	}
+
+	// Without acks, the broker closes the connection
+	b, _ = produceRequest(0, "orders")
+	ctx = kafkaContext("Produce", b)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection to be closed, got", ctx.Connection.Fault)
+	}
+}
+
+func TestKafka_Delay(t *testing.T) {
+	s := KafkaSymptom{
+		Delay: 100,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Command: "^Fetch$"},
+		},
+	}
+	s.Setup()
+
+	ctx := kafkaContext("Fetch", []byte("response"))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Connection.Delay != 100*time.Millisecond {
+		t.Fatal("Want Fetch response delayed by 100ms, got", ctx.Connection.Delay)
+	}
+
+	ctx = kafkaContext("Metadata", []byte("response"))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want Metadata response not delayed, got", ctx.Connection.Delay)
+	}
+}
+
+func TestKafka_DropPartitions(t *testing.T) {
+	s := KafkaSymptom{DropPartitions: []int{1}, Topic: "^orders$"}
+	s.Setup()
+
+	orders, events := "orders", "events"
+	partitions := []kafka.PartitionMetadata{{Index: 0}, {Index: 1}}
+	m := &kafka.MetadataResponse{
+		Version: 9,
+		Topics: []kafka.TopicMetadata{
+			{Name: &orders, Partitions: partitions},
+			{Name: &events, Partitions: partitions},
+		},
+	}
+
+	ctx := kafkaContext("Metadata", kafka.NewResponse(5, kafka.Metadata, 9, m.Encode()))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	correlationID, body, ok := kafka.ParseResponse(ctx.Bytes, kafka.Metadata, 9)
+	if !ok || correlationID != 5 {
+		t.Fatal("Want response 5, got", correlationID, ok)
+	}
+	got, err := kafka.ParseMetadataResponse(9, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Topics[0].Partitions) != 1 || got.Topics[0].Partitions[0].Index != 0 {
+		t.Fatal("Want only partition 0 of orders, got", got.Topics[0].Partitions)
+	}
+	if len(got.Topics[1].Partitions) != 2 {
+		t.Fatal("Want both partitions of events, got", got.Topics[1].Partitions)
+	}
+}
@@ -1,8 +1,14 @@
 package symptom
 
 import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
 	"math"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
 
 	"math/rand"
 
@@ -11,11 +17,123 @@ import (
 )
 
 // MatchingRule describes the fields to match on an HTTP request
+// or TCP session
 type MatchingRule struct {
 	Method      string
 	Path        string
 	Host        string
 	Probability float64
+
+	// Connection matches the nth connection accepted by a TCP proxy,
+	// starting from 1. Zero matches any connection.
+	Connection uint64
+
+	// Payload is a regular expression matched against TCP message bytes
+	Payload string
+
+	// PayloadHex is a hex encoded byte sequence, e.g. "0a ff 00",
+	// that must appear within a TCP message
+	PayloadHex string `mapstructure:"payload_hex"`
+
+	// Direction of TCP messages to match: request or response
+	Direction string
+
+	// Offset of TCP messages to match, within the stream of their
+	// direction: either an exact offset, e.g. "0", or a range, e.g. "0-1023"
+	Offset string
+
+	// ClientAddr matches TCP clients by IP address or CIDR block
+	ClientAddr string `mapstructure:"client_addr"`
+
+	// Command is a regular expression matched against the command of
+	// messages decoded by protocol-aware proxies, e.g. "GET|MGET"
+	Command string
+
+	// Key is a regular expression matched against the key of
+	// messages decoded by protocol-aware proxies
+	Key string
+
+	// Query is a regular expression matched against the SQL of
+	// messages decoded by database proxies
+	Query string
+
+	// Field names a field of messages decoded by protocol-aware proxies,
+	// whose value is matched against the regular expression FieldValue
+	Field      string
+	FieldValue string `mapstructure:"field_value"`
+
+	// First activates the rule for only the first N requests it matches,
+	// e.g. to fail N times and then succeed
+	First int
+
+	// Every activates the rule for only every Kth request it matches
+	Every int
+
+	// FlapOn and FlapOff alternate the rule between windows in which it is
+	// active and inactive, in ms, from the first request it matches
+	FlapOn  int `mapstructure:"flap_on"`
+	FlapOff int `mapstructure:"flap_off"`
+
+	// Sequence activates the rule by a comma separated list of steps, one
+	// for each request it matches, repeated once exhausted. Steps of "ok"
+	// are inactive, and any others active. Symptoms may act on the step,
+	// e.g. HTTP Abort responds with the status of steps such as "503".
+	Sequence string
+
+	// Per keeps the state of the above for each client_ip, header:<name>
+	// or path of HTTP requests, or key of decoded messages, rather than for
+	// all
+	Per string
+
+	// payload, from and to are PayloadHex and Offset decoded by compile,
+	// once for all messages
+	payload  string
+	from, to uint64
+	compiled bool
+}
+
+// setupMatchingRules validates the matching rules of a symptom, from its
+// Setup, and compiles them for matching
+func setupMatchingRules(rules []MatchingRule) {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			fail("MatchingRule - Incorrectly specified rule:", err)
+		}
+	}
+}
+
+// compile decodes the PayloadHex and Offset of the rule, and validates its
+// activation pattern
+func (rule *MatchingRule) compile() error {
+	if rule.PayloadHex != "" {
+		payload, err := hex.DecodeString(strings.Replace(rule.PayloadHex, " ", "", -1))
+		if err != nil || len(payload) == 0 {
+			return fmt.Errorf("invalid payload_hex '%s'", rule.PayloadHex)
+		}
+		rule.payload = string(payload)
+	}
+
+	if rule.Offset != "" {
+		from, to, err := parseOffset(rule.Offset)
+		if err != nil {
+			return err
+		}
+		rule.from, rule.to = from, to
+	}
+
+	if !validPer(rule.Per) {
+		return fmt.Errorf("invalid per '%s'", rule.Per)
+	}
+	if rule.Sequence != "" {
+		for _, step := range strings.Split(rule.Sequence, ",") {
+			if strings.TrimSpace(step) == "" {
+				return fmt.Errorf("empty step in sequence '%s'", rule.Sequence)
+			}
+		}
+	}
+
+	rule.compiled = true
+	return nil
 }
 
 // MatchSymptom takes a matching rule and a Muxy context and determines
@@ -23,6 +141,11 @@ type MatchingRule struct {
 func MatchSymptom(rule MatchingRule, ctx muxy.Context) bool {
 	log.Trace("MatchSymptom testing rule %v", rule)
 
+	// Rules not set up by a symptom are compiled for each match
+	if !rule.compiled && rule.compile() != nil {
+		return false
+	}
+
 	// HTTP only matching
 	// TODO: Rules should be abstracted better so that we can pass them around
 	//       without awareness of individual protocols, like TCP or HTTP
@@ -50,6 +173,93 @@ func MatchSymptom(rule MatchingRule, ctx muxy.Context) bool {
 		}
 	}
 
+	// TCP only matching
+	if ctx.Connection != nil {
+		if rule.Connection != 0 {
+			log.Debug("MatchingRule matching connection #%d with #%d", rule.Connection, ctx.Connection.ID)
+			if rule.Connection != ctx.Connection.ID {
+				return false
+			}
+		}
+
+		if rule.ClientAddr != "" {
+			log.Debug("MatchingRule matching client address '%s' with '%v'", rule.ClientAddr, ctx.Connection.ClientAddr)
+			if !matchAddr(rule.ClientAddr, ctx.Connection.ClientAddr) {
+				return false
+			}
+		}
+
+		if rule.Direction != "" {
+			log.Debug("MatchingRule matching direction '%s' with '%s'", rule.Direction, ctx.Connection.Direction)
+			if rule.Direction != ctx.Connection.Direction.String() {
+				return false
+			}
+		}
+
+		if rule.Offset != "" {
+			log.Debug("MatchingRule matching offset '%s' with '%d'", rule.Offset, ctx.Connection.Offset)
+			if ctx.Connection.Direction == muxy.DirectionNone || ctx.Connection.Offset < rule.from || ctx.Connection.Offset > rule.to {
+				return false
+			}
+		}
+
+		if rule.Payload != "" {
+			log.Debug("MatchingRule matching payload '%s' with '%s'", rule.Payload, ctx.Bytes)
+			if match, _ := regexp.Match(rule.Payload, ctx.Bytes); ctx.Bytes == nil || !match {
+				return false
+			}
+		}
+
+		if rule.PayloadHex != "" {
+			log.Debug("MatchingRule matching payload '%s' with '%x'", rule.PayloadHex, ctx.Bytes)
+			if ctx.Bytes == nil || !bytes.Contains(ctx.Bytes, []byte(rule.payload)) {
+				return false
+			}
+		}
+	}
+
+	// Protocol-aware proxy matching
+	if rule.Command != "" {
+		if ctx.Message == nil {
+			return false
+		}
+		log.Debug("MatchingRule matching command '%s' with '%s'", rule.Command, ctx.Message.Command)
+		if match, _ := regexp.MatchString(rule.Command, ctx.Message.Command); !match {
+			return false
+		}
+	}
+
+	if rule.Key != "" {
+		if ctx.Message == nil {
+			return false
+		}
+		log.Debug("MatchingRule matching key '%s' with '%s'", rule.Key, ctx.Message.Key)
+		if match, _ := regexp.MatchString(rule.Key, ctx.Message.Key); !match {
+			return false
+		}
+	}
+
+	if rule.Query != "" {
+		if ctx.Message == nil || ctx.Message.Fields["sql"] == "" {
+			return false
+		}
+		log.Debug("MatchingRule matching query '%s' with '%s'", rule.Query, ctx.Message.Fields["sql"])
+		if match, _ := regexp.MatchString(rule.Query, ctx.Message.Fields["sql"]); !match {
+			return false
+		}
+	}
+
+	if rule.Field != "" {
+		if ctx.Message == nil {
+			return false
+		}
+		value, ok := ctx.Message.Fields[rule.Field]
+		log.Debug("MatchingRule matching field %s '%s' with '%s'", rule.Field, rule.FieldValue, value)
+		if match, _ := regexp.MatchString(rule.FieldValue, value); !ok || !match {
+			return false
+		}
+	}
+
 	// All protocols
 	if rule.Probability > 0 {
 		random := rand.Intn(100)
@@ -62,13 +272,61 @@ func MatchSymptom(rule MatchingRule, ctx muxy.Context) bool {
 	return true
 }
 
+// matchAddr determines if addr is the IP address, or within the CIDR block, given
+func matchAddr(rule string, addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if _, cidr, err := net.ParseCIDR(rule); err == nil {
+		return cidr.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(rule))
+}
+
+// parseOffset parses an exact offset, or a range of offsets, into its bounds
+func parseOffset(rule string) (uint64, uint64, error) {
+	bounds := strings.SplitN(rule, "-", 2)
+	from, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid offset '%s'", rule)
+	}
+	to := from
+	if len(bounds) == 2 {
+		to, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 64)
+		if err != nil || to < from {
+			return 0, 0, fmt.Errorf("invalid offset '%s'", rule)
+		}
+	}
+	return from, to, nil
+}
+
 // MatchSymptoms takes a set of matching rules and a Muxy context and determines
 // if there is a match
 var MatchSymptoms = func(rules []MatchingRule, ctx muxy.Context) bool {
-	for _, rule := range rules {
-		if MatchSymptom(rule, ctx) {
-			return true
+	match, _ := MatchStep(rules, ctx)
+	return match
+}
+
+// MatchStep determines if there is a match, as MatchSymptoms does, and
+// returns the step of the sequence of the rule matched, if it has one
+func MatchStep(rules []MatchingRule, ctx muxy.Context) (bool, string) {
+	for i, rule := range rules {
+		if !MatchSymptom(rule, ctx) {
+			continue
+		}
+		if active, step := activate(&rules[i], ctx); active {
+			return true, step
 		}
 	}
-	return false
+	return false, ""
 }
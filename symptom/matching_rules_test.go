@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -111,3 +113,323 @@ func TestProbability(t *testing.T) {
 	fmt.Println(likelihood)
 	fmt.Println(int(math.Min(65, 100)))
 }
+
+func TestMatchSymptom_TCP(t *testing.T) {
+	ctx := muxy.Context{
+		Bytes: []byte("*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"),
+		Connection: &muxy.Connection{
+			ID:         2,
+			ClientAddr: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 50000},
+			Direction:  muxy.DirectionRequest,
+			Offset:     128,
+		},
+	}
+
+	testCases := map[MatchingRule]bool{
+		MatchingRule{Connection: 2}:                                          true,
+		MatchingRule{Connection: 1}:                                          false,
+		MatchingRule{Payload: "\\$3\r\nSET"}:                                 true,
+		MatchingRule{Payload: "\\$3\r\nGET"}:                                 false,
+		MatchingRule{PayloadHex: "53 45 54"}:                                 true,
+		MatchingRule{PayloadHex: "474554"}:                                   false,
+		MatchingRule{PayloadHex: "zz"}:                                       false,
+		MatchingRule{Direction: "request"}:                                   true,
+		MatchingRule{Direction: "response"}:                                  false,
+		MatchingRule{Offset: "128"}:                                          true,
+		MatchingRule{Offset: "0"}:                                            false,
+		MatchingRule{Offset: "100-200"}:                                      true,
+		MatchingRule{Offset: "0-127"}:                                        false,
+		MatchingRule{Offset: "foo"}:                                          false,
+		MatchingRule{ClientAddr: "10.1.2.3"}:                                 true,
+		MatchingRule{ClientAddr: "10.0.0.0/8"}:                               true,
+		MatchingRule{ClientAddr: "192.168.0.0/16"}:                           false,
+		MatchingRule{Payload: "SET", Direction: "request", Offset: "0-1024"}: true,
+	}
+
+	for rule, expected := range testCases {
+		if MatchSymptom(rule, ctx) != expected {
+			t.Fatal("Rule", rule, "expected", expected, ", got", !expected)
+		}
+	}
+
+	// Message rules never match connection events
+	connect := muxy.Context{
+		Connection: &muxy.Connection{ID: 2},
+	}
+	for _, rule := range []MatchingRule{
+		MatchingRule{Payload: ".*"},
+		MatchingRule{PayloadHex: "00"},
+		MatchingRule{Direction: "request"},
+		MatchingRule{Offset: "0"},
+	} {
+		if MatchSymptom(rule, connect) {
+			t.Fatal("Rule", rule, "expected not to match connection event")
+		}
+	}
+}
+
+func TestSetupMatchingRules(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	rules := []MatchingRule{
+		MatchingRule{PayloadHex: "53 45 54", Offset: "100-200"},
+	}
+	setupMatchingRules(rules)
+	ctx := muxy.Context{
+		Bytes:      []byte("SET"),
+		Connection: &muxy.Connection{Direction: muxy.DirectionRequest, Offset: 128},
+	}
+	if failed != 0 || !rules[0].compiled || !MatchSymptoms(rules, ctx) {
+		t.Fatal("Want compiled rule to match, got", rules[0], failed)
+	}
+
+	setupMatchingRules([]MatchingRule{
+		MatchingRule{PayloadHex: "0g"},
+		MatchingRule{PayloadHex: "123"},
+		MatchingRule{Offset: "foo"},
+		MatchingRule{Offset: "200-100"},
+		MatchingRule{Offset: "0-"},
+	})
+	if failed != 5 {
+		t.Fatal("Want 5 failures, got", failed)
+	}
+}
+
+func TestSetupMatchingRules_Patterns(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	setupMatchingRules([]MatchingRule{
+		MatchingRule{Per: "client_ip"},
+		MatchingRule{Per: "header:X-Tenant"},
+		MatchingRule{Per: "path"},
+		MatchingRule{Per: "key"},
+		MatchingRule{Sequence: "503, ok,500"},
+	})
+	if failed != 0 {
+		t.Fatal("Want no failures, got", failed)
+	}
+
+	setupMatchingRules([]MatchingRule{
+		MatchingRule{Per: "clientip"},
+		MatchingRule{Per: "header:"},
+		MatchingRule{Sequence: "503,,ok"},
+		MatchingRule{Sequence: "503,"},
+	})
+	if failed != 4 {
+		t.Fatal("Want 4 failures, got", failed)
+	}
+}
+
+func TestMatchSymptom_Message(t *testing.T) {
+	ctx := muxy.Context{
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "redis",
+			Command:  "GET",
+			Key:      "session:1234",
+			Fields:   map[string]string{"sql": "SELECT * FROM sessions", "db": "0"},
+		},
+	}
+
+	testCases := map[MatchingRule]bool{
+		MatchingRule{Command: "GET"}:                            true,
+		MatchingRule{Command: "^(SET|DEL)$"}:                    false,
+		MatchingRule{Key: "^session:"}:                          true,
+		MatchingRule{Key: "^cache:"}:                            false,
+		MatchingRule{Command: "GET", Key: "session:\\d+"}:       true,
+		MatchingRule{Command: "GET", Direction: "response"}:     false,
+		MatchingRule{Command: "GET|MGET", Direction: "request"}: true,
+		MatchingRule{Query: "(?i)^select .* from sessions"}:     true,
+		MatchingRule{Query: "(?i)^update"}:                      false,
+		MatchingRule{Field: "db", FieldValue: "^0$"}:            true,
+		MatchingRule{Field: "db", FieldValue: "^1$"}:            false,
+		MatchingRule{Field: "db"}:                               true,
+		MatchingRule{Field: "status"}:                           false,
+	}
+
+	for rule, expected := range testCases {
+		if MatchSymptom(rule, ctx) != expected {
+			t.Fatal("Rule", rule, "expected", expected, ", got", !expected)
+		}
+	}
+
+	// Message rules never match undecoded messages
+	ctx.Message = nil
+	for _, rule := range []MatchingRule{
+		MatchingRule{Command: ".*"},
+		MatchingRule{Key: ".*"},
+		MatchingRule{Query: ".*"},
+		MatchingRule{Field: "db"},
+	} {
+		if MatchSymptom(rule, ctx) {
+			t.Fatal("Rule", rule, "expected not to match undecoded message")
+		}
+	}
+}
+
+// activationsOf returns the activation of rules for each of n requests
+func activationsOf(rules []MatchingRule, ctx muxy.Context, n int) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		if MatchSymptoms(rules, ctx) {
+			s += "x"
+		} else {
+			s += "."
+		}
+	}
+	return s
+}
+
+func TestMatchSymptoms_Patterns(t *testing.T) {
+	ctx := muxy.Context{Request: &http.Request{URL: &url.URL{Path: "/foo"}}}
+
+	testCases := map[MatchingRule]string{
+		MatchingRule{First: 3}:                   "xxx.....",
+		MatchingRule{Every: 3}:                   "..x..x..",
+		MatchingRule{Sequence: "ok, 503,503,ok"}: ".xx..xx.",
+		MatchingRule{First: 6, Every: 2}:         ".x.x.x..",
+		MatchingRule{Path: "/bar", First: 3}:     "........",
+	}
+
+	for rule, expected := range testCases {
+		if got := activationsOf([]MatchingRule{rule}, ctx, 8); got != expected {
+			t.Fatalf("Rule %v expected %s, got %s", rule, expected, got)
+		}
+	}
+}
+
+func TestMatchSymptoms_Flapping(t *testing.T) {
+	ctx := muxy.Context{Request: &http.Request{URL: &url.URL{Path: "/foo"}}}
+	rules := []MatchingRule{MatchingRule{FlapOn: 1000, FlapOff: 1000}}
+
+	if !MatchSymptoms(rules, ctx) {
+		t.Fatal("Expected rule to be active in its first window")
+	}
+
+	// Move the start of the pattern back into its inactive window
+	for _, state := range activations[&rules[0]] {
+		state.started = state.started.Add(-1500 * time.Millisecond)
+	}
+	if MatchSymptoms(rules, ctx) {
+		t.Fatal("Expected rule to be inactive in its second window")
+	}
+	for _, state := range activations[&rules[0]] {
+		state.started = state.started.Add(-1000 * time.Millisecond)
+	}
+	if !MatchSymptoms(rules, ctx) {
+		t.Fatal("Expected rule to be active in its third window")
+	}
+}
+
+func TestMatchSymptoms_Per(t *testing.T) {
+	request := func(addr string, key string) muxy.Context {
+		return muxy.Context{Request: &http.Request{
+			URL:        &url.URL{Path: "/foo"},
+			RemoteAddr: addr,
+			Header:     http.Header{"X-Api-Key": []string{key}},
+		}}
+	}
+
+	rules := []MatchingRule{MatchingRule{First: 1, Per: "client_ip"}}
+	for _, addr := range []string{"10.0.0.1:1234", "10.0.0.2:1234"} {
+		if got := activationsOf(rules, request(addr, ""), 2); got != "x." {
+			t.Fatalf("Expected first request of %s to match, got %s", addr, got)
+		}
+	}
+	if got := activationsOf(rules, request("10.0.0.1:5678", ""), 1); got != "." {
+		t.Fatal("Expected state to be kept per client IP, not port")
+	}
+
+	rules = []MatchingRule{MatchingRule{Every: 2, Per: "header:X-Api-Key"}}
+	for _, key := range []string{"a", "b"} {
+		if got := activationsOf(rules, request("10.0.0.1:1234", key), 4); got != ".x.x" {
+			t.Fatalf("Expected every second request with key %s to match, got %s", key, got)
+		}
+	}
+
+	rules = []MatchingRule{MatchingRule{First: 1, Per: "client_ip"}}
+	tcp := muxy.Context{Connection: &muxy.Connection{ClientAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1}}}
+	if got := activationsOf(rules, tcp, 2); got != "x." {
+		t.Fatalf("Expected first message of TCP client to match, got %s", got)
+	}
+}
+
+func TestMatchSymptoms_Exchange(t *testing.T) {
+	rules := []MatchingRule{MatchingRule{Sequence: "503,ok"}}
+	for exchange := uint64(1); exchange <= 4; exchange++ {
+		ctx := muxy.Context{Request: &http.Request{URL: &url.URL{Path: "/foo"}}, Exchange: exchange}
+		request := MatchSymptoms(rules, ctx)
+		ctx.Response = &http.Response{}
+		if response := MatchSymptoms(rules, ctx); response != request {
+			t.Fatalf("Expected response of exchange %d to share the decision of its request", exchange)
+		}
+		if request != (exchange%2 == 1) {
+			t.Fatalf("Expected exchange %d to be activated %v", exchange, exchange%2 == 1)
+		}
+	}
+}
+
+func TestMatchSymptoms_Connection(t *testing.T) {
+	message := func(values *sync.Map, direction muxy.Direction) muxy.Context {
+		return muxy.Context{Connection: &muxy.Connection{ID: 1, Values: values, Direction: direction}}
+	}
+	rules := []MatchingRule{MatchingRule{Sequence: "reset,ok"}}
+
+	// Responses share the decision of the requests they answer, in order
+	values := &sync.Map{}
+	got := ""
+	for _, d := range []muxy.Direction{muxy.DirectionRequest, muxy.DirectionRequest, muxy.DirectionResponse, muxy.DirectionResponse, muxy.DirectionRequest, muxy.DirectionResponse} {
+		got += activationsOf(rules, message(values, d), 1)
+	}
+	if got != "x.x.xx" {
+		t.Fatalf("Expected responses to share the decisions of their requests, got %s", got)
+	}
+
+	// Each connection has its own unanswered requests
+	other := &sync.Map{}
+	activationsOf(rules, message(values, muxy.DirectionRequest), 1)
+	if got := activationsOf(rules, message(other, muxy.DirectionResponse), 1); got != "x" {
+		t.Fatalf("Expected a response with no request to count, got %s", got)
+	}
+}
+
+func TestMatchStep(t *testing.T) {
+	ctx := muxy.Context{Request: &http.Request{URL: &url.URL{Path: "/foo"}}}
+	rules := []MatchingRule{MatchingRule{Sequence: "ok,503,429"}}
+
+	for _, expected := range []string{"", "503", "429", ""} {
+		if _, step := MatchStep(rules, ctx); step != expected {
+			t.Fatalf("Expected step '%s', got '%s'", expected, step)
+		}
+	}
+}
+
+func TestMatchSymptoms_ForgetKeys(t *testing.T) {
+	rules := []MatchingRule{MatchingRule{First: 1, Per: "header:X-Api-Key"}}
+	for i := 0; i <= maxActivationKeys; i++ {
+		ctx := muxy.Context{Request: &http.Request{URL: &url.URL{Path: "/foo"}, Header: http.Header{"X-Api-Key": []string{fmt.Sprint(i)}}}}
+		activationsOf(rules, ctx, 1)
+	}
+
+	states := activations[&rules[0]]
+	if len(states) != maxActivationKeys {
+		t.Fatalf("Expected state of %d keys to be kept, got %d", maxActivationKeys, len(states))
+	}
+	if _, ok := states["0"]; ok {
+		t.Fatal("Expected the state of the least recently used key to be forgotten")
+	}
+}
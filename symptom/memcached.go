@@ -0,0 +1,217 @@
+package symptom
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/memcached"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// memcachedError is a canned error, as given by the text and binary protocols
+type memcachedError struct {
+	line    string
+	status  uint16
+	message string
+}
+
+// memcachedErrors are the canned errors of a Memcached Symptom
+var memcachedErrors = map[string]memcachedError{
+	"OUT_OF_MEMORY":     {"SERVER_ERROR out of memory storing object", memcached.StatusOutOfMemory, "Out of memory"},
+	"TOO_LARGE":         {"SERVER_ERROR object too large for cache", memcached.StatusTooLarge, "Too large."},
+	"BUSY":              {"SERVER_ERROR busy", memcached.StatusBusy, "Busy"},
+	"TEMPORARY_FAILURE": {"SERVER_ERROR temporary failure", memcached.StatusTemporary, "Temporary failure"},
+	"ERROR":             {"ERROR", memcached.StatusUnknownCommand, "Unknown command"},
+}
+
+// MemcachedSymptom fails, delays and fabricates misses for the commands
+// of a Memcached Proxy
+type MemcachedSymptom struct {
+	// Error replies to matching commands with an error, in place of the
+	// server. One of OUT_OF_MEMORY, TOO_LARGE, BUSY, TEMPORARY_FAILURE or
+	// ERROR, or a complete error e.g. "SERVER_ERROR cache unavailable"
+	Error string `required:"false"`
+
+	// Miss removes the values of matching keys from the replies to
+	// lookups. Rules are matched against each key looked up, so that a
+	// probability evicts that proportion of the keys.
+	Miss bool `required:"false"`
+
+	// Delay in ms before matching commands are sent to the server
+	Delay int `required:"false"`
+
+	// Multiget only affects lookups of many keys: text and meta gets with
+	// more than one key, and quiet binary gets
+	Multiget bool `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MemcachedSymptom{}, nil
+	}, "memcached")
+}
+
+// Setup sets up the plugin
+func (s *MemcachedSymptom) Setup() {
+	log.Debug("Memcached Symptom - Setup()")
+
+	if s.Error == "" && !s.Miss && s.Delay == 0 {
+		fail("Memcached Symptom - one of error, miss or delay must be specified")
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *MemcachedSymptom) Teardown() {
+	log.Debug("Memcached Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *MemcachedSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "memcached" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if s.Multiget && !memcachedMultiget(ctx.Message) {
+		return
+	}
+
+	switch e {
+	case muxy.EventPreDispatch:
+		if s.Error == "" && s.Delay == 0 {
+			return
+		}
+		if MatchSymptoms(s.MatchingRules, *ctx) {
+			log.Trace("Memcached Symptom Hit")
+			s.Muck(ctx)
+		} else {
+			log.Trace("Memcached Symptom Miss")
+		}
+	case muxy.EventPostDispatch:
+		if s.Miss && memcachedRetrieval(ctx.Message) {
+			s.MuckResponse(ctx)
+		}
+	}
+}
+
+// Muck delays the command, or answers it with an error
+func (s *MemcachedSymptom) Muck(ctx *muxy.Context) {
+	if s.Delay > 0 {
+		log.Debug("Memcached Symptom - delaying %s by %dms", ctx.Message.Command, s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+	if s.Error == "" {
+		return
+	}
+
+	err, ok := memcachedErrors[strings.ToUpper(s.Error)]
+	if !ok {
+		err = memcachedError{s.Error, memcached.StatusInternalError, s.Error}
+	}
+
+	log.Debug("Memcached Symptom - replying to %s with '%s'", ctx.Message.Command, err.line)
+	ctx.Bytes = nil
+	if r, ok := ctx.Message.Value.(*memcached.Request); ok && r.Binary {
+		ctx.Connection.Reply = memcached.NewBinaryError(r.Opcode, r.Opaque, err.status, err.message)
+		return
+	}
+
+	// Commands sent with noreply are never answered, even on failure
+	if ctx.Message.Fields["noreply"] == "true" {
+		return
+	}
+	ctx.Connection.Reply = []byte(err.line + "\r\n")
+}
+
+// MuckResponse fabricates misses for the matching keys of a lookup
+func (s *MemcachedSymptom) MuckResponse(ctx *muxy.Context) {
+	hit := false
+	miss := func(key string) bool {
+		c := *ctx
+		msg := *ctx.Message
+		msg.Key = key
+		c.Message = &msg
+		if MatchSymptoms(s.MatchingRules, c) {
+			log.Debug("Memcached Symptom - fabricating a miss for %s", key)
+			hit = true
+			return true
+		}
+		return false
+	}
+
+	if ctx.Message.Fields["protocol"] == "binary" {
+		p, ok := memcached.ParseBinary(ctx.Bytes)
+		if !ok || p.Status != memcached.StatusOK || !miss(ctx.Message.Key) {
+			log.Trace("Memcached Symptom Miss")
+			return
+		}
+
+		// Quiet gets are not answered on a miss
+		if ctx.Message.Fields["quiet"] == "true" {
+			ctx.Bytes = nil
+		} else {
+			notFound := &memcached.Packet{
+				Magic:  memcached.MagicResponse,
+				Opcode: p.Opcode,
+				Status: memcached.StatusKeyNotFound,
+				Opaque: p.Opaque,
+				Value:  []byte("Not found"),
+			}
+			if p.Opcode == memcached.OpGetK || p.Opcode == memcached.OpGATK {
+				notFound.Key = p.Key
+			}
+			ctx.Bytes = notFound.Encode()
+		}
+	} else {
+		switch memcached.Reply(ctx.Bytes) {
+		case "VALUE":
+			ctx.Bytes = memcached.RemoveValues(ctx.Bytes, miss)
+		case "VA", "HD":
+			if !miss(ctx.Message.Key) {
+				break
+			}
+			ctx.Bytes = []byte("EN\r\n")
+			if ctx.Message.Fields["quiet"] == "true" {
+				ctx.Bytes = nil
+			}
+		}
+	}
+
+	if hit {
+		log.Trace("Memcached Symptom Hit")
+	} else {
+		log.Trace("Memcached Symptom Miss")
+	}
+}
+
+// memcachedRetrieval returns true if msg is a lookup, or its reply
+func memcachedRetrieval(msg *muxy.Message) bool {
+	r, ok := msg.Value.(*memcached.Request)
+	return ok && r.Retrieval()
+}
+
+// memcachedMultiget returns true if msg is a lookup of many keys, or
+// its reply
+func memcachedMultiget(msg *muxy.Message) bool {
+	if !memcachedRetrieval(msg) {
+		return false
+	}
+	if msg.Fields["protocol"] == "binary" {
+		quiet, _ := strconv.ParseBool(msg.Fields["quiet"])
+		return quiet
+	}
+	return strings.Contains(msg.Fields["keys"], " ")
+}
@@ -0,0 +1,178 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/memcached"
+)
+
+func memcachedContext(b []byte, reply []byte) *muxy.Context {
+	r, _ := memcached.ParseRequest(b)
+	ctx := &muxy.Context{
+		Bytes:      b,
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "memcached",
+			Command:  r.Command,
+			Fields: map[string]string{
+				"protocol": "text",
+				"quiet":    "false",
+				"noreply":  "false",
+			},
+			Value: r,
+		},
+	}
+	if len(r.Keys) > 0 {
+		ctx.Message.Key = r.Keys[0]
+	}
+	for i, key := range r.Keys {
+		if i > 0 {
+			ctx.Message.Fields["keys"] += " "
+		}
+		ctx.Message.Fields["keys"] += key
+	}
+	if r.Binary {
+		ctx.Message.Fields["protocol"] = "binary"
+	}
+	if r.Quiet {
+		ctx.Message.Fields["quiet"] = "true"
+	}
+	if r.NoReply {
+		ctx.Message.Fields["noreply"] = "true"
+	}
+	if reply != nil {
+		ctx.Bytes = reply
+		ctx.Connection.Direction = muxy.DirectionResponse
+	}
+	return ctx
+}
+
+func TestMemcached_Setup(t *testing.T) {
+	s := MemcachedSymptom{Miss: true}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestMemcached_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := MemcachedSymptom{}
+	s.Setup()
+	s = MemcachedSymptom{Multiget: true}
+	s.Setup()
+
+	if failed != 2 {
+		t.Fatal("Want 2 failures, got", failed)
+	}
+}
+
+func TestMemcached_Teardown(t *testing.T) {
+	s := MemcachedSymptom{}
+	s.Teardown()
+}
+
+func TestMemcached_Error(t *testing.T) {
+	s := MemcachedSymptom{
+		Error: "OUT_OF_MEMORY",
+		MatchingRules: []MatchingRule{
+			MatchingRule{Command: "^set$"},
+		},
+	}
+	s.Setup()
+
+	ctx := memcachedContext([]byte("set user:1 0 0 5\r\nalice\r\n"), nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if want := "SERVER_ERROR out of memory storing object\r\n"; ctx.Bytes != nil || string(ctx.Connection.Reply) != want {
+		t.Fatalf("Want reply %q, got %q", want, ctx.Connection.Reply)
+	}
+
+	ctx = memcachedContext([]byte("set user:1 0 0 5 noreply\r\nalice\r\n"), nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil || ctx.Connection.Reply != nil {
+		t.Fatalf("Want set with noreply dropped, got %q", ctx.Connection.Reply)
+	}
+
+	ctx = memcachedContext([]byte("get user:1\r\n"), nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want get to be forwarded")
+	}
+
+	// Quiet binary commands are answered on failure
+	set := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpSetQ, Opaque: 7, Extras: make([]byte, 8), Key: []byte("user:1")}
+	ctx = memcachedContext(set.Encode(), nil)
+	s.MatchingRules[0].Command = "^setq$"
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	p, ok := memcached.ParseBinary(ctx.Connection.Reply)
+	if !ok || p.Status != memcached.StatusOutOfMemory || p.Opaque != 7 {
+		t.Fatalf("Want out of memory reply to 7, got %+v", p)
+	}
+}
+
+func TestMemcached_Miss(t *testing.T) {
+	s := MemcachedSymptom{
+		Miss: true,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Key: "^session:"},
+		},
+	}
+	s.Setup()
+
+	ctx := memcachedContext([]byte("get user:1 session:1\r\n"),
+		[]byte("VALUE user:1 0 5\r\nalice\r\nVALUE session:1 0 3\r\nabc\r\nEND\r\n"))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if want := "VALUE user:1 0 5\r\nalice\r\nEND\r\n"; string(ctx.Bytes) != want {
+		t.Fatalf("Want %q, got %q", want, ctx.Bytes)
+	}
+
+	ctx = memcachedContext([]byte("mg session:1 v\r\n"), []byte("VA 3\r\nabc\r\n"))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if string(ctx.Bytes) != "EN\r\n" {
+		t.Fatalf("Want meta miss, got %q", ctx.Bytes)
+	}
+
+	get := &memcached.Packet{Magic: memcached.MagicRequest, Opcode: memcached.OpGetK, Opaque: 2, Key: []byte("session:1")}
+	hit := &memcached.Packet{Magic: memcached.MagicResponse, Opcode: memcached.OpGetK, Opaque: 2, Extras: make([]byte, 4), Key: []byte("session:1"), Value: []byte("abc")}
+	ctx = memcachedContext(get.Encode(), hit.Encode())
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	p, ok := memcached.ParseBinary(ctx.Bytes)
+	if !ok || p.Status != memcached.StatusKeyNotFound || p.Opaque != 2 || string(p.Key) != "session:1" {
+		t.Fatalf("Want not found for session:1, got %+v", p)
+	}
+
+	// Stores are never affected
+	ctx = memcachedContext([]byte("set session:1 0 0 3\r\nabc\r\n"), []byte("STORED\r\n"))
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if string(ctx.Bytes) != "STORED\r\n" {
+		t.Fatalf("Want STORED, got %q", ctx.Bytes)
+	}
+}
+
+func TestMemcached_Multiget(t *testing.T) {
+	s := MemcachedSymptom{Delay: 100, Multiget: true}
+	s.Setup()
+
+	ctx := memcachedContext([]byte("get user:1 user:2\r\n"), nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 100*time.Millisecond {
+		t.Fatal("Want multiget delayed by 100ms, got", ctx.Connection.Delay)
+	}
+
+	ctx = memcachedContext([]byte("get user:1\r\n"), nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want get of one key not delayed, got", ctx.Connection.Delay)
+	}
+}
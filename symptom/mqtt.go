@@ -0,0 +1,144 @@
+package symptom
+
+import (
+	"strconv"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mqtt"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// MQTTSymptom drops or withholds the acknowledgement of the messages of an
+// MQTT Proxy, and refuses or disconnects its clients
+type MQTTSymptom struct {
+	// Topic is a topic filter, e.g. sensors/+/temp, limiting the PUBLISH
+	// packets and acknowledgements affected
+	Topic string `required:"false"`
+
+	// Drop discards matching PUBLISH packets
+	Drop bool `required:"false"`
+
+	// WithholdAcks discards the PUBACK and PUBREC of matching messages,
+	// so that they are redelivered
+	WithholdAcks bool `required:"false" mapstructure:"withhold_acks"`
+
+	// Reject refuses matching CONNECTs with a reason code, by name or
+	// number, e.g. NOT_AUTHORIZED or SERVER_UNAVAILABLE. Clients before
+	// MQTT 5 are given the nearest return code.
+	Reject string `required:"false"`
+
+	// KeepAliveMiss disconnects clients when they next ping, as though
+	// their keep alive had expired
+	KeepAliveMiss bool `required:"false" mapstructure:"keep_alive_miss"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	reason byte
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MQTTSymptom{}, nil
+	}, "mqtt")
+}
+
+// Setup sets up the plugin
+func (s *MQTTSymptom) Setup() {
+	log.Debug("MQTT Symptom - Setup()")
+
+	if s.Reject != "" {
+		reason, ok := mqtt.ParseReasonCode(s.Reject)
+		if !ok {
+			fail("MQTT Symptom - Incorrectly specified reject reason code:", s.Reject)
+		}
+		s.reason = reason
+	}
+	if s.Topic != "" && !mqtt.ValidFilter(s.Topic) {
+		fail("MQTT Symptom - Incorrectly specified topic filter:", s.Topic)
+	}
+	if !s.Drop && !s.WithholdAcks && s.Reject == "" && !s.KeepAliveMiss {
+		fail("MQTT Symptom - one of drop, withhold_acks, reject or keep_alive_miss must be specified")
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *MQTTSymptom) Teardown() {
+	log.Debug("MQTT Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Rules match the packet type with command, and the topic with key.
+func (s *MQTTSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "mqtt" {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
+	switch ctx.Message.Command {
+	case "PUBLISH":
+		if !s.Drop || !s.matchTopic(ctx.Message.Key) {
+			return
+		}
+	case "PUBACK", "PUBREC":
+		if !s.WithholdAcks || !s.matchTopic(ctx.Message.Key) {
+			return
+		}
+	case "CONNECT":
+		if s.Reject == "" || e != muxy.EventPreDispatch {
+			return
+		}
+	case "PINGREQ":
+		if !s.KeepAliveMiss || e != muxy.EventPreDispatch {
+			return
+		}
+	default:
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("MQTT Symptom Hit")
+		s.Muck(ctx)
+	} else {
+		log.Trace("MQTT Symptom Miss")
+	}
+}
+
+// matchTopic returns true if the topic is matched by the Topic filter
+func (s *MQTTSymptom) matchTopic(topic string) bool {
+	return s.Topic == "" || mqtt.MatchTopic(s.Topic, topic)
+}
+
+// Muck drops the packet, or refuses or disconnects the client
+func (s *MQTTSymptom) Muck(ctx *muxy.Context) {
+	version, _ := strconv.Atoi(ctx.Message.Fields["version"])
+
+	switch ctx.Message.Command {
+	case "PUBLISH", "PUBACK", "PUBREC":
+		log.Debug("MQTT Symptom - dropping %s to %s", ctx.Message.Command, ctx.Message.Key)
+		ctx.Bytes = nil
+	case "CONNECT":
+		code := mqtt.ConnAckCode(byte(version), s.reason)
+		log.Debug("MQTT Symptom - refusing connection of %s with %#x", ctx.Message.Key, code)
+		ctx.Bytes = nil
+		ctx.Connection.Reply = mqtt.NewConnAck(byte(version), code)
+		ctx.Connection.Fault = muxy.FaultClose
+	case "PINGREQ":
+		log.Debug("MQTT Symptom - disconnecting %s after a keep alive miss", ctx.Message.Fields["client_id"])
+		ctx.Bytes = nil
+		ctx.Connection.Reply = mqtt.NewDisconnect(byte(version), mqtt.ReasonKeepAliveTimeout)
+		ctx.Connection.Fault = muxy.FaultClose
+	}
+}
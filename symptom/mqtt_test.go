@@ -0,0 +1,146 @@
+package symptom
+
+import (
+	"testing"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mqtt"
+)
+
+func mqttContext(command string, topic string, direction muxy.Direction) *muxy.Context {
+	return &muxy.Context{
+		Bytes:      []byte("packet"),
+		Connection: &muxy.Connection{ID: 1, Direction: direction},
+		Message: &muxy.Message{
+			Protocol: "mqtt",
+			Command:  command,
+			Key:      topic,
+			Fields:   map[string]string{"version": "5", "client_id": "sensor-1"},
+		},
+	}
+}
+
+func TestMQTT_Setup(t *testing.T) {
+	s := MQTTSymptom{Reject: "not_authorized"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.reason != 0x87 {
+		t.Fatal("Want reason code 0x87, got", s.reason)
+	}
+}
+
+func TestMQTT_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := MQTTSymptom{}
+	s.Setup()
+	s = MQTTSymptom{Reject: "NOT_A_REASON"}
+	s.Setup()
+	s = MQTTSymptom{Drop: true, Topic: "sensors/#/temp"}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestMQTT_Teardown(t *testing.T) {
+	s := MQTTSymptom{}
+	s.Teardown()
+}
+
+func TestMQTT_Drop(t *testing.T) {
+	s := MQTTSymptom{Drop: true, Topic: "sensors/+/temp"}
+	s.Setup()
+
+	ctx := mqttContext("PUBLISH", "sensors/1/temp", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes != nil {
+		t.Fatal("Want PUBLISH to sensors/1/temp dropped")
+	}
+
+	for _, ctx := range []*muxy.Context{
+		mqttContext("PUBLISH", "sensors/1/humidity", muxy.DirectionRequest),
+		mqttContext("PUBACK", "sensors/1/temp", muxy.DirectionRequest),
+	} {
+		s.HandleEvent(muxy.EventPreDispatch, ctx)
+		if ctx.Bytes == nil {
+			t.Fatalf("Want %s to %s forwarded", ctx.Message.Command, ctx.Message.Key)
+		}
+	}
+}
+
+func TestMQTT_WithholdAcks(t *testing.T) {
+	s := MQTTSymptom{WithholdAcks: true, Topic: "alerts/#"}
+	s.Setup()
+
+	for _, command := range []string{"PUBACK", "PUBREC"} {
+		ctx := mqttContext(command, "alerts/fire", muxy.DirectionResponse)
+		s.HandleEvent(muxy.EventPostDispatch, ctx)
+		if ctx.Bytes != nil {
+			t.Fatalf("Want %s withheld", command)
+		}
+	}
+
+	ctx := mqttContext("PUBCOMP", "alerts/fire", muxy.DirectionResponse)
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes == nil {
+		t.Fatal("Want PUBCOMP forwarded")
+	}
+}
+
+func TestMQTT_Reject(t *testing.T) {
+	s := MQTTSymptom{Reject: "SERVER_BUSY"}
+	s.Setup()
+
+	ctx := mqttContext("CONNECT", "sensor-1", muxy.DirectionRequest)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	p, ok := mqtt.Parse(ctx.Connection.Reply)
+	if ctx.Bytes != nil || !ok || p.Type != mqtt.ConnAck || p.ReasonCode() != 0x89 {
+		t.Fatalf("Want CONNACK of 0x89, got %q", ctx.Connection.Reply)
+	}
+	if ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection closed, got", ctx.Connection.Fault)
+	}
+
+	// Clients before MQTT 5 are given the nearest return code
+	ctx = mqttContext("CONNECT", "sensor-1", muxy.DirectionRequest)
+	ctx.Message.Fields["version"] = "4"
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if p, _ := mqtt.Parse(ctx.Connection.Reply); p.ReasonCode() != 3 {
+		t.Fatalf("Want CONNACK of 3, got %q", ctx.Connection.Reply)
+	}
+}
+
+func TestMQTT_KeepAliveMiss(t *testing.T) {
+	s := MQTTSymptom{KeepAliveMiss: true}
+	s.Setup()
+
+	ctx := mqttContext("PINGREQ", "", muxy.DirectionRequest)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	p, ok := mqtt.Parse(ctx.Connection.Reply)
+	if ctx.Bytes != nil || !ok || p.Type != mqtt.Disconnect || p.ReasonCode() != mqtt.ReasonKeepAliveTimeout {
+		t.Fatalf("Want DISCONNECT for a keep alive timeout, got %q", ctx.Connection.Reply)
+	}
+	if ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection closed, got", ctx.Connection.Fault)
+	}
+
+	// Servers before MQTT 5 close the connection without a DISCONNECT
+	ctx = mqttContext("PINGREQ", "", muxy.DirectionRequest)
+	ctx.Message.Fields["version"] = "4"
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Reply != nil || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection closed without a DISCONNECT")
+	}
+}
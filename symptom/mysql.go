@@ -0,0 +1,201 @@
+package symptom
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mysql"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// mysqlErrors are the SQL states and messages of common error codes
+var mysqlErrors = map[int][2]string{
+	1040: {"08004", "Too many connections"},
+	1053: {"08S01", "Server shutdown in progress"},
+	1062: {"23000", "Duplicate entry for key 'PRIMARY'"},
+	1205: {"HY000", "Lock wait timeout exceeded; try restarting transaction"},
+	1213: {"40001", "Deadlock found when trying to get lock; try restarting transaction"},
+	1290: {"HY000", "The MySQL server is running with the --read-only option so it cannot execute this statement"},
+	1317: {"70100", "Query execution was interrupted"},
+	3024: {"HY000", "Query execution was interrupted, maximum statement execution time exceeded"},
+}
+
+// mysqlLost are the client error codes for a lost connection, which are
+// emulated by closing the connection
+var mysqlLost = map[int]bool{
+	2006: true,
+	2013: true,
+}
+
+// MySQLSymptom fails, delays or truncates the statements of a MySQL Proxy
+type MySQLSymptom struct {
+	// Error is the code of an ERR packet sent in place of running matching
+	// statements, e.g. 1213. The client errors 2006 and 2013 close the
+	// connection instead
+	Error int `required:"false"`
+
+	// Message of the ERR packet. Defaults to that of the code
+	Message string `required:"false"`
+
+	// State is the SQL state of the ERR packet. Defaults to that of the code
+	State string `required:"false" mapstructure:"sql_state"`
+
+	// Delay in ms before matching statements are sent to the server
+	Delay int `required:"false"`
+
+	// RowDelay in ms before each row of a result set is sent to the client
+	RowDelay int `required:"false" mapstructure:"row_delay"`
+
+	// MaxRows truncates result sets after this many rows. With Error, the
+	// error is sent in place of the rest of the result set
+	MaxRows int `required:"false" mapstructure:"max_rows"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &MySQLSymptom{}, nil
+	}, "mysql")
+}
+
+// Setup sets up the plugin
+func (s *MySQLSymptom) Setup() {
+	log.Debug("MySQL Symptom - Setup()")
+
+	if s.Error < 0 || s.Error > 0xffff {
+		fail("MySQL Symptom - Incorrectly specified error code:", s.Error)
+	}
+	if s.State != "" && len(s.State) != 5 {
+		fail("MySQL Symptom - Incorrectly specified SQL state:", s.State)
+	}
+	if s.Error == 0 && s.Delay == 0 && s.RowDelay == 0 && s.MaxRows == 0 {
+		fail("MySQL Symptom - one of error, delay, row_delay or max_rows must be specified")
+	}
+
+	if known, ok := mysqlErrors[s.Error]; ok {
+		if s.State == "" {
+			s.State = known[0]
+		}
+		if s.Message == "" {
+			s.Message = known[1]
+		}
+	}
+	if s.Message == "" {
+		s.Message = "error injected by Muxy"
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *MySQLSymptom) Teardown() {
+	log.Debug("MySQL Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Only the commands that run statements, COM_QUERY and COM_STMT_EXECUTE,
+// and their results are affected.
+func (s *MySQLSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "mysql" {
+		return
+	}
+	if ctx.Message.Command != "COM_QUERY" && ctx.Message.Command != "COM_STMT_EXECUTE" {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("MySQL Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			s.Muck(ctx)
+		} else {
+			s.MuckResult(ctx)
+		}
+	} else {
+		log.Trace("MySQL Symptom Miss")
+	}
+}
+
+// Muck delays or fails the statement
+func (s *MySQLSymptom) Muck(ctx *muxy.Context) {
+	if s.Delay > 0 {
+		log.Debug("MySQL Symptom - delaying statement by %dms", s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+
+	// Errors are injected into the results of truncated result sets
+	if s.Error == 0 || s.MaxRows > 0 {
+		return
+	}
+
+	seq, _ := strconv.Atoi(ctx.Message.Fields["seq"])
+	s.reject(ctx, byte(seq+1), true)
+}
+
+// MuckResult slows or truncates the result of the statement
+func (s *MySQLSymptom) MuckResult(ctx *muxy.Context) {
+	fields := ctx.Message.Fields
+	row, _ := strconv.Atoi(fields["row"])
+
+	if fields["type"] == "Row" && s.RowDelay > 0 {
+		time.Sleep(time.Duration(s.RowDelay) * time.Millisecond)
+	}
+	if s.MaxRows == 0 {
+		return
+	}
+
+	seq, _ := strconv.Atoi(fields["seq"])
+	switch {
+	case fields["type"] == "Row" && row == s.MaxRows+1 && s.Error != 0:
+		s.reject(ctx, byte(seq), false)
+	case fields["type"] == "Row" && row > s.MaxRows:
+		log.Trace("MySQL Symptom - dropping row %d", row)
+		ctx.Bytes = nil
+	case fields["type"] == "EOF" && fields["rows"] != "":
+		rows, _ := strconv.Atoi(fields["rows"])
+		if rows <= s.MaxRows {
+			return
+		}
+		if s.Error != 0 {
+			ctx.Bytes = nil
+			return
+		}
+
+		// Renumber the end of the result set to follow the last row sent
+		b := append([]byte(nil), ctx.Bytes...)
+		b[3] = byte(seq - (rows - s.MaxRows))
+		ctx.Bytes = b
+	}
+}
+
+// reject sends an ERR packet in place of the statement, when request is
+// true, or of its results, or closes the connection
+func (s *MySQLSymptom) reject(ctx *muxy.Context, seq byte, request bool) {
+	ctx.Bytes = nil
+	if mysqlLost[s.Error] {
+		log.Debug("MySQL Symptom - closing connection")
+		ctx.Connection.Fault = muxy.FaultClose
+		return
+	}
+
+	log.Debug("MySQL Symptom - replying with error %d (%s): %s", s.Error, s.State, s.Message)
+	packet := mysql.NewError(seq, uint16(s.Error), s.State, s.Message)
+	if request {
+		ctx.Connection.Reply = packet
+	} else {
+		ctx.Bytes = packet
+	}
+}
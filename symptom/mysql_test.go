@@ -0,0 +1,167 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/mysql"
+)
+
+func mysqlContext(command string, sql string, fields ...string) *muxy.Context {
+	ctx := &muxy.Context{
+		Bytes:      mysql.NewPacket(0, []byte("packet")),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "mysql",
+			Command:  command,
+			Fields:   map[string]string{"sql": sql, "seq": "0"},
+		},
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		ctx.Message.Fields[fields[i]] = fields[i+1]
+	}
+	return ctx
+}
+
+func TestMySQL_Setup(t *testing.T) {
+	s := MySQLSymptom{Error: 1213}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.State != "40001" || s.Message != "Deadlock found when trying to get lock; try restarting transaction" {
+		t.Fatal("Want default state and message, got", s.State, s.Message)
+	}
+}
+
+func TestMySQL_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := MySQLSymptom{}
+	s.Setup()
+	s = MySQLSymptom{Error: 70000}
+	s.Setup()
+	s = MySQLSymptom{Error: 1213, State: "4001"}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestMySQL_Teardown(t *testing.T) {
+	s := MySQLSymptom{}
+	s.Teardown()
+}
+
+func TestMySQL_Error(t *testing.T) {
+	s := MySQLSymptom{
+		Error: 1205,
+		Delay: 10,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Query: "(?i)for update$"},
+		},
+	}
+	s.Setup()
+
+	ctx := mysqlContext("COM_QUERY", "SELECT * FROM accounts FOR UPDATE")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	want := mysql.NewError(1, 1205, "HY000", "Lock wait timeout exceeded; try restarting transaction")
+	if ctx.Bytes != nil || string(ctx.Connection.Reply) != string(want) {
+		t.Fatalf("Want error reply %q, got %q", want, ctx.Connection.Reply)
+	}
+	if ctx.Connection.Delay != 10*time.Millisecond {
+		t.Fatal("Want delay of 10ms, got", ctx.Connection.Delay)
+	}
+
+	ctx = mysqlContext("COM_QUERY", "SELECT 1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want query to be forwarded, got reply", ctx.Connection.Reply)
+	}
+
+	// Only commands that run statements are affected
+	ctx = mysqlContext("COM_STMT_PREPARE", "SELECT * FROM accounts FOR UPDATE")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want prepare to be forwarded, got reply", ctx.Connection.Reply)
+	}
+}
+
+func TestMySQL_LostConnection(t *testing.T) {
+	s := MySQLSymptom{Error: 2013}
+	s.Setup()
+
+	ctx := mysqlContext("COM_STMT_EXECUTE", "SELECT 1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil || ctx.Connection.Reply != nil || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want connection to be closed, got", ctx.Connection.Fault, ctx.Connection.Reply)
+	}
+}
+
+func TestMySQL_MaxRows(t *testing.T) {
+	s := MySQLSymptom{MaxRows: 1, RowDelay: 5}
+	s.Setup()
+
+	ctx := mysqlContext("COM_QUERY", "SELECT 1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil {
+		t.Fatal("Want query to be forwarded")
+	}
+
+	start := time.Now()
+	ctx = mysqlContext("COM_QUERY", "SELECT 1", "type", "Row", "row", "1", "seq", "3")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes == nil {
+		t.Fatal("Want first row to be sent")
+	}
+	if time.Since(start) < 5*time.Millisecond {
+		t.Fatal("Want row to be delayed")
+	}
+
+	ctx = mysqlContext("COM_QUERY", "SELECT 1", "type", "Row", "row", "2", "seq", "4")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes != nil {
+		t.Fatal("Want second row to be dropped")
+	}
+
+	ctx = mysqlContext("COM_QUERY", "SELECT 1", "type", "EOF", "rows", "3", "seq", "6")
+	ctx.Bytes = mysql.NewPacket(6, []byte{mysql.EOF, 0, 0, 2, 0})
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if seq, _, _ := mysql.Packet(ctx.Bytes); seq != 4 {
+		t.Fatal("Want EOF to follow the first row, got sequence", seq)
+	}
+}
+
+func TestMySQL_MaxRowsError(t *testing.T) {
+	s := MySQLSymptom{MaxRows: 1, Error: 1317}
+	s.Setup()
+
+	ctx := mysqlContext("COM_QUERY", "SELECT 1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want query to be forwarded")
+	}
+
+	ctx = mysqlContext("COM_QUERY", "SELECT 1", "type", "Row", "row", "2", "seq", "4")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	want := mysql.NewError(4, 1317, "70100", "Query execution was interrupted")
+	if string(ctx.Bytes) != string(want) {
+		t.Fatalf("Want error %q in place of the second row, got %q", want, ctx.Bytes)
+	}
+
+	ctx = mysqlContext("COM_QUERY", "SELECT 1", "type", "EOF", "rows", "2", "seq", "5")
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes != nil {
+		t.Fatal("Want EOF to be dropped")
+	}
+}
@@ -0,0 +1,173 @@
+package symptom
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/postgres"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// postgresErrors are the messages of common SQLSTATEs
+var postgresErrors = map[string]string{
+	"08006": "connection failure",
+	"23505": "duplicate key value violates unique constraint",
+	"25P02": "current transaction is aborted, commands ignored until end of transaction block",
+	"40001": "could not serialize access due to concurrent update",
+	"40P01": "deadlock detected",
+	"53100": "could not extend file: No space left on device",
+	"53300": "sorry, too many clients already",
+	"55P03": "could not obtain lock on row in relation",
+	"57014": "canceling statement due to user request",
+	"57P01": "terminating connection due to administrator command",
+	"57P02": "terminating connection due to crash of another server process",
+	"57P03": "the database system is starting up",
+}
+
+// postgresFatal are the SQLSTATEs reported with FATAL severity,
+// after which the server closes the connection
+var postgresFatal = map[string]bool{
+	"53300": true,
+	"57P01": true,
+	"57P02": true,
+	"57P03": true,
+}
+
+var sqlstate = regexp.MustCompile("^[0-9A-Z]{5}$")
+
+// PostgresSymptom fails, delays or terminates the queries of a Postgres Proxy
+type PostgresSymptom struct {
+	// Error is the SQLSTATE of an ErrorResponse sent in place of running
+	// matching queries, e.g. 40001
+	Error string `required:"false"`
+
+	// Message of the ErrorResponse. Defaults to that of the SQLSTATE
+	Message string `required:"false"`
+
+	// Severity of the ErrorResponse: ERROR or FATAL. Defaults to FATAL
+	// for SQLSTATEs that end the session, such as 57P01
+	Severity string `required:"false"`
+
+	// Delay in ms before matching queries are sent to the server
+	Delay int `required:"false"`
+
+	// Terminate closes the connection in place of running matching queries
+	Terminate bool `required:"false"`
+
+	// InTransaction only affects queries made within a transaction block
+	InTransaction bool `required:"false" mapstructure:"in_transaction"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &PostgresSymptom{}, nil
+	}, "postgres")
+}
+
+// Setup sets up the plugin
+func (s *PostgresSymptom) Setup() {
+	log.Debug("Postgres Symptom - Setup()")
+
+	if s.Error != "" && !sqlstate.MatchString(s.Error) {
+		fail("Postgres Symptom - Incorrectly specified SQLSTATE:", s.Error)
+	}
+	if s.Error == "" && s.Delay == 0 && !s.Terminate {
+		fail("Postgres Symptom - one of error, delay or terminate must be specified")
+	}
+
+	s.Severity = strings.ToUpper(s.Severity)
+	switch s.Severity {
+	case "":
+		s.Severity = "ERROR"
+		if postgresFatal[s.Error] {
+			s.Severity = "FATAL"
+		}
+	case "ERROR", "FATAL", "PANIC":
+	default:
+		fail("Postgres Symptom - Incorrectly specified severity:", s.Severity)
+	}
+
+	if s.Message == "" {
+		s.Message = postgresErrors[s.Error]
+		if s.Message == "" {
+			s.Message = "error injected by Muxy"
+		}
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *PostgresSymptom) Teardown() {
+	log.Debug("Postgres Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Only the messages that run queries, Query and Execute, are affected.
+func (s *PostgresSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch || ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "postgres" {
+		return
+	}
+	if ctx.Message.Command != "Query" && ctx.Message.Command != "Execute" {
+		return
+	}
+	status := ctx.Message.Fields["status"]
+	if s.InTransaction && status != "T" && status != "E" {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Postgres Symptom Hit")
+		s.Muck(ctx)
+	} else {
+		log.Trace("Postgres Symptom Miss")
+	}
+}
+
+// Muck delays, fails or terminates the query
+func (s *PostgresSymptom) Muck(ctx *muxy.Context) {
+	if s.Delay > 0 {
+		log.Debug("Postgres Symptom - delaying query by %dms", s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+
+	var reply []byte
+	if s.Error != "" {
+		log.Debug("Postgres Symptom - replying to query with %s %s: %s", s.Severity, s.Error, s.Message)
+		reply = postgres.NewErrorResponse(s.Severity, s.Error, s.Message)
+	}
+
+	switch {
+	case s.Terminate || (reply != nil && s.Severity != "ERROR"):
+		log.Debug("Postgres Symptom - terminating connection")
+		ctx.Bytes = nil
+		ctx.Connection.Reply = reply
+		ctx.Connection.Fault = muxy.FaultClose
+	case reply == nil:
+	case ctx.Message.Command == "Query":
+		// A failed query ends, or aborts, any transaction in progress
+		status := byte('I')
+		if st := ctx.Message.Fields["status"]; st == "T" || st == "E" {
+			status = 'E'
+		}
+		ctx.Bytes = nil
+		ctx.Connection.Reply = append(reply, postgres.NewReadyForQuery(status)...)
+	default:
+		// The server answers the Sync that ends the extended query
+		ctx.Bytes = nil
+		ctx.Connection.Reply = reply
+	}
+}
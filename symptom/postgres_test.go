@@ -0,0 +1,137 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/postgres"
+)
+
+func postgresContext(command string, sql string, status string) *muxy.Context {
+	return &muxy.Context{
+		Bytes:      []byte("query"),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "postgres",
+			Command:  command,
+			Fields:   map[string]string{"sql": sql, "status": status},
+		},
+	}
+}
+
+func TestPostgres_Setup(t *testing.T) {
+	s := PostgresSymptom{Error: "40001"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.Severity != "ERROR" || s.Message != "could not serialize access due to concurrent update" {
+		t.Fatal("Want default severity and message, got", s.Severity, s.Message)
+	}
+
+	s = PostgresSymptom{Error: "57P01"}
+	s.Setup()
+	if s.Severity != "FATAL" {
+		t.Fatal("Want FATAL severity, got", s.Severity)
+	}
+}
+
+func TestPostgres_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := PostgresSymptom{}
+	s.Setup()
+	s = PostgresSymptom{Error: "4001"}
+	s.Setup()
+	s = PostgresSymptom{Error: "40001", Severity: "oops"}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestPostgres_Teardown(t *testing.T) {
+	s := PostgresSymptom{}
+	s.Teardown()
+}
+
+func TestPostgres_Query(t *testing.T) {
+	s := PostgresSymptom{
+		Error: "40001",
+		MatchingRules: []MatchingRule{
+			MatchingRule{Query: "(?i)^update"},
+		},
+	}
+	s.Setup()
+
+	ctx := postgresContext("Query", "UPDATE accounts SET balance = 0", "T")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	want := string(postgres.NewErrorResponse("ERROR", "40001", "could not serialize access due to concurrent update")) +
+		string(postgres.NewReadyForQuery('E'))
+	if ctx.Bytes != nil || string(ctx.Connection.Reply) != want {
+		t.Fatalf("Want error reply %q, got %q", want, ctx.Connection.Reply)
+	}
+
+	ctx = postgresContext("Query", "SELECT 1", "I")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want query to be forwarded, got reply", string(ctx.Connection.Reply))
+	}
+
+	// Only messages that run queries are affected
+	ctx = postgresContext("Parse", "UPDATE accounts SET balance = 0", "I")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want Parse to be forwarded, got reply", string(ctx.Connection.Reply))
+	}
+}
+
+func TestPostgres_Execute(t *testing.T) {
+	s := PostgresSymptom{Error: "40P01", Delay: 10}
+	s.Setup()
+
+	ctx := postgresContext("Execute", "SELECT 1", "I")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	want := string(postgres.NewErrorResponse("ERROR", "40P01", "deadlock detected"))
+	if ctx.Bytes != nil || string(ctx.Connection.Reply) != want {
+		t.Fatalf("Want error reply %q, got %q", want, ctx.Connection.Reply)
+	}
+	if ctx.Connection.Delay != 10*time.Millisecond {
+		t.Fatal("Want delay of 10ms, got", ctx.Connection.Delay)
+	}
+}
+
+func TestPostgres_Terminate(t *testing.T) {
+	s := PostgresSymptom{Terminate: true, InTransaction: true}
+	s.Setup()
+
+	ctx := postgresContext("Query", "COMMIT", "I")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Fault != muxy.FaultNone {
+		t.Fatal("Want no fault outside a transaction, got", ctx.Connection.Fault)
+	}
+
+	ctx = postgresContext("Query", "COMMIT", "T")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Fault != muxy.FaultClose || ctx.Bytes != nil {
+		t.Fatal("Want connection to be closed, got", ctx.Connection.Fault)
+	}
+
+	s = PostgresSymptom{Error: "57P01"}
+	s.Setup()
+	ctx = postgresContext("Query", "SELECT 1", "I")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Fault != muxy.FaultClose || ctx.Connection.Reply == nil {
+		t.Fatal("Want FATAL error then close, got", ctx.Connection.Fault, ctx.Connection.Reply)
+	}
+}
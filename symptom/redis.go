@@ -0,0 +1,177 @@
+package symptom
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/redis"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// redisErrors are the canned messages of common Redis errors
+var redisErrors = map[string]string{
+	"ERR":         "ERR Error injected by Muxy",
+	"LOADING":     "LOADING Redis is loading the dataset in memory",
+	"BUSY":        "BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSCRIPT.",
+	"CLUSTERDOWN": "CLUSTERDOWN The cluster is down",
+	"TRYAGAIN":    "TRYAGAIN Multiple keys request during rehashing of slot",
+	"READONLY":    "READONLY You can't write against a read only replica.",
+	"OOM":         "OOM command not allowed when used memory > 'maxmemory'.",
+}
+
+// RedisSymptom tampers with the commands and replies of a Redis Proxy
+type RedisSymptom struct {
+	// Error replies to matching commands with an error, in place of the
+	// server. One of ERR, MOVED, ASK, LOADING, BUSY, CLUSTERDOWN, TRYAGAIN,
+	// READONLY or OOM, or a complete error message e.g. "ERR unknown command"
+	Error string `required:"false"`
+
+	// Redirect is the host:port given in MOVED and ASK errors
+	Redirect string `required:"false"`
+
+	// Nil replies to matching commands with nil, in place of the server
+	Nil bool `required:"false"`
+
+	// Delay in ms before matching commands are sent to the server
+	Delay int `required:"false"`
+
+	// DropReply discards the server's reply to matching commands
+	DropReply bool `required:"false" mapstructure:"drop_reply"`
+
+	// Pipelined only affects commands sent as part of a pipeline
+	Pipelined bool `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &RedisSymptom{}, nil
+	}, "redis")
+}
+
+// Setup sets up the plugin
+func (s *RedisSymptom) Setup() {
+	log.Debug("Redis Symptom - Setup()")
+
+	name := strings.ToUpper(s.Error)
+	if (name == "MOVED" || name == "ASK") && s.Redirect == "" {
+		fail("Redis Symptom - a redirect address is required for error:", s.Error)
+	}
+	if s.Error == "" && !s.Nil && s.Delay == 0 && !s.DropReply {
+		fail("Redis Symptom - one of error, nil, delay or drop_reply must be specified")
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *RedisSymptom) Teardown() {
+	log.Debug("Redis Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *RedisSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "redis" {
+		return
+	}
+	if s.Pipelined && !ctx.Message.Pipelined {
+		return
+	}
+
+	switch e {
+	case muxy.EventPreDispatch:
+		if s.Error == "" && !s.Nil && s.Delay == 0 {
+			return
+		}
+	case muxy.EventPostDispatch:
+		if !s.DropReply {
+			return
+		}
+	default:
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Redis Symptom Hit")
+		s.Muck(ctx, e)
+	} else {
+		log.Trace("Redis Symptom Miss")
+	}
+}
+
+// Muck delays or answers matching commands, or drops their replies
+func (s *RedisSymptom) Muck(ctx *muxy.Context, e muxy.ProxyEvent) {
+	if e == muxy.EventPostDispatch {
+		log.Debug("Redis Symptom - dropping reply to %s", ctx.Message.Command)
+		ctx.Bytes = nil
+		return
+	}
+
+	if s.Delay > 0 {
+		log.Debug("Redis Symptom - delaying %s by %dms", ctx.Message.Command, s.Delay)
+		ctx.Connection.Delay = time.Duration(s.Delay) * time.Millisecond
+	}
+
+	switch {
+	case s.Error != "":
+		msg := s.errorMessage(ctx.Message.Key)
+		log.Debug("Redis Symptom - replying to %s with '%s'", ctx.Message.Command, msg)
+		ctx.Bytes = nil
+		ctx.Connection.Reply = redis.ErrorReply(msg)
+	case s.Nil:
+		log.Debug("Redis Symptom - replying to %s with nil", ctx.Message.Command)
+		ctx.Bytes = nil
+		ctx.Connection.Reply = nilReply(ctx.Message)
+	}
+}
+
+// errorMessage returns the configured error message for a command on key
+func (s *RedisSymptom) errorMessage(key string) string {
+	name := strings.ToUpper(s.Error)
+	switch name {
+	case "MOVED", "ASK":
+		return fmt.Sprintf("%s %d %s", name, redis.Slot(key), s.Redirect)
+	}
+	if msg, ok := redisErrors[name]; ok {
+		return msg
+	}
+	return s.Error
+}
+
+// nilReply returns a nil reply suitable for the command in msg. Commands
+// returning multiple values are given a nil for each.
+func nilReply(msg *muxy.Message) []byte {
+	version, _ := strconv.Atoi(msg.Fields["resp"])
+
+	n := -1
+	if cmd, ok := msg.Value.(*redis.Command); ok {
+		switch cmd.Name {
+		case "MGET":
+			n = len(cmd.Args)
+		case "HMGET":
+			n = len(cmd.Args) - 1
+		}
+	}
+	if n < 0 {
+		return redis.NilReply(version)
+	}
+
+	reply := []byte(fmt.Sprintf("*%d\r\n", n))
+	for i := 0; i < n; i++ {
+		reply = append(reply, redis.NilReply(version)...)
+	}
+	return reply
+}
@@ -0,0 +1,157 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/redis"
+)
+
+func redisContext(name string, args ...string) *muxy.Context {
+	v := redis.Value{Type: redis.Array}
+	for _, arg := range append([]string{name}, args...) {
+		v.Elems = append(v.Elems, redis.Value{Type: redis.BulkString, Str: arg})
+	}
+	cmd, _ := redis.ParseCommand(v)
+
+	return &muxy.Context{
+		Bytes:      redis.Encode(v),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message: &muxy.Message{
+			Protocol: "redis",
+			Command:  cmd.Name,
+			Key:      cmd.Key(),
+			Fields:   map[string]string{"resp": "2"},
+			Value:    cmd,
+		},
+	}
+}
+
+func TestRedis_Setup(t *testing.T) {
+	s := RedisSymptom{Error: "LOADING"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestRedis_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := RedisSymptom{}
+	s.Setup()
+	s = RedisSymptom{Error: "MOVED"}
+	s.Setup()
+
+	if failed != 2 {
+		t.Fatal("Want 2 failures, got", failed)
+	}
+}
+
+func TestRedis_Teardown(t *testing.T) {
+	s := RedisSymptom{}
+	s.Teardown()
+}
+
+func TestRedis_Error(t *testing.T) {
+	testCases := map[string]string{
+		"ERR":                 "-ERR Error injected by Muxy\r\n",
+		"loading":             "-LOADING Redis is loading the dataset in memory\r\n",
+		"MOVED":               "-MOVED 12182 10.0.0.2:6379\r\n",
+		"ERR unknown command": "-ERR unknown command\r\n",
+	}
+
+	for name, want := range testCases {
+		s := RedisSymptom{Error: name, Redirect: "10.0.0.2:6379"}
+		s.Setup()
+
+		ctx := redisContext("GET", "foo")
+		s.HandleEvent(muxy.EventPreDispatch, ctx)
+		if ctx.Bytes != nil {
+			t.Fatal("Want command not to be forwarded, got", string(ctx.Bytes))
+		}
+		if string(ctx.Connection.Reply) != want {
+			t.Fatalf("Want reply %q, got %q", want, ctx.Connection.Reply)
+		}
+	}
+}
+
+func TestRedis_Nil(t *testing.T) {
+	s := RedisSymptom{
+		Nil: true,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Key: "^session:"},
+		},
+	}
+	s.Setup()
+
+	ctx := redisContext("GET", "session:1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if string(ctx.Connection.Reply) != "$-1\r\n" {
+		t.Fatalf("Want nil reply, got %q", ctx.Connection.Reply)
+	}
+
+	ctx = redisContext("MGET", "session:1", "session:2")
+	ctx.Message.Fields["resp"] = "3"
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if string(ctx.Connection.Reply) != "*2\r\n_\r\n_\r\n" {
+		t.Fatalf("Want array of RESP3 nils, got %q", ctx.Connection.Reply)
+	}
+
+	ctx = redisContext("GET", "cache:1")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Reply != nil || ctx.Bytes == nil {
+		t.Fatal("Want command to be forwarded, got reply", string(ctx.Connection.Reply))
+	}
+}
+
+func TestRedis_Delay(t *testing.T) {
+	s := RedisSymptom{
+		Delay: 100,
+		MatchingRules: []MatchingRule{
+			MatchingRule{Command: "^KEYS$"},
+		},
+	}
+	s.Setup()
+
+	ctx := redisContext("KEYS", "*")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 100*time.Millisecond {
+		t.Fatal("Want delay of 100ms, got", ctx.Connection.Delay)
+	}
+
+	ctx = redisContext("GET", "foo")
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want no delay, got", ctx.Connection.Delay)
+	}
+}
+
+func TestRedis_DropReply(t *testing.T) {
+	s := RedisSymptom{DropReply: true, Pipelined: true}
+	s.Setup()
+
+	ctx := redisContext("GET", "foo")
+	ctx.Bytes = []byte("$3\r\nbar\r\n")
+	ctx.Connection.Direction = muxy.DirectionResponse
+
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes == nil {
+		t.Fatal("Want reply to a command outside a pipeline to be sent")
+	}
+
+	ctx.Message.Pipelined = true
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Bytes != nil {
+		t.Fatal("Want reply to be dropped, got", string(ctx.Bytes))
+	}
+}
@@ -0,0 +1,256 @@
+package symptom
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/muxy/protocol/smtp"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// smtpStages are the commands replied to at each stage of the dialogue
+var smtpStages = map[string][]string{
+	"helo": {"HELO", "EHLO", "LHLO"},
+	"mail": {"MAIL"},
+	"rcpt": {"RCPT"},
+	"data": {"DATA", "BDAT"},
+}
+
+// SMTPSymptom defers or rejects the mail of an SMTP Proxy, stalls or
+// interrupts its delivery, and withholds STARTTLS
+type SMTPSymptom struct {
+	// Code is the reply sent in place of the server at Stage: a 4xx to
+	// defer the mail, or a 5xx to reject it. A 421 also closes the connection
+	Code int `required:"false"`
+
+	// Message is the text of the reply. Defaults to that of the code
+	Message string `required:"false"`
+
+	// Stage is the command replied to with Code: helo, mail, rcpt or data
+	Stage string `required:"false"`
+
+	// Stall in ms before the end of matching messages is sent to the
+	// server, so that the reply to the message is withheld
+	Stall int `required:"false"`
+
+	// Close closes the connection part way through matching messages,
+	// once CloseAfter bytes of the message have been sent
+	Close      bool `required:"false"`
+	CloseAfter int  `required:"false" mapstructure:"close_after"`
+
+	// DropStartTLS removes STARTTLS from the extensions advertised in
+	// reply to EHLO, and refuses the command if it is sent regardless
+	DropStartTLS bool `required:"false" mapstructure:"drop_starttls"`
+
+	// Sender and Recipient are regular expressions limiting the mail
+	// affected to that of matching senders, and with any matching
+	// recipient. Recipients are only known once RCPT has been sent.
+	Sender    string `required:"false"`
+	Recipient string `required:"false"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+
+	sender    *regexp.Regexp
+	recipient *regexp.Regexp
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &SMTPSymptom{}, nil
+	}, "smtp")
+}
+
+// Setup sets up the plugin
+func (s *SMTPSymptom) Setup() {
+	log.Debug("SMTP Symptom - Setup()")
+
+	if s.Code != 0 {
+		if s.Code < 400 || s.Code > 599 {
+			fail("SMTP Symptom - Incorrectly specified code:", s.Code)
+		}
+		if _, ok := smtpStages[strings.ToLower(s.Stage)]; !ok {
+			fail("SMTP Symptom - Incorrectly specified stage:", s.Stage)
+		}
+		if s.Message == "" {
+			s.Message = smtp.ReplyText(s.Code)
+		}
+	}
+	if s.Stall < 0 {
+		fail("SMTP Symptom - Incorrectly specified stall:", s.Stall)
+	}
+	if s.CloseAfter < 0 {
+		fail("SMTP Symptom - Incorrectly specified close_after:", s.CloseAfter)
+	}
+	if s.Code == 0 && s.Stall == 0 && !s.Close && !s.DropStartTLS {
+		fail("SMTP Symptom - one of code, stall, close or drop_starttls must be specified")
+	}
+
+	var err error
+	if s.sender, err = regexp.Compile(s.Sender); err != nil {
+		fail("SMTP Symptom - Incorrectly specified sender:", err)
+	}
+	if s.recipient, err = regexp.Compile(s.Recipient); err != nil {
+		fail("SMTP Symptom - Incorrectly specified recipient:", err)
+	}
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *SMTPSymptom) Teardown() {
+	log.Debug("SMTP Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Rules match the command with command, and the domain of HELO, sender of
+// MAIL or recipient of RCPT with key. Lines of a message have the command
+// MESSAGE.
+func (s *SMTPSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if ctx.Connection == nil || ctx.Message == nil || ctx.Message.Protocol != "smtp" || len(ctx.Bytes) == 0 {
+		return
+	}
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+	if !s.matchAddresses(ctx.Message) || !s.applies(ctx.Message, e) {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("SMTP Symptom Hit")
+		if e == muxy.EventPreDispatch {
+			s.Muck(ctx)
+		} else {
+			s.MuckResponse(ctx)
+		}
+	} else {
+		log.Trace("SMTP Symptom Miss")
+	}
+}
+
+// matchAddresses returns true if the sender and any recipient of msg match
+func (s *SMTPSymptom) matchAddresses(msg *muxy.Message) bool {
+	if s.Sender != "" && !s.sender.MatchString(msg.Fields["sender"]) {
+		return false
+	}
+	if s.Recipient == "" {
+		return true
+	}
+
+	recipients := strings.Split(msg.Fields["recipients"], ",")
+	if msg.Command == "RCPT" {
+		recipients = []string{msg.Key}
+	}
+	for _, r := range recipients {
+		if r != "" && s.recipient.MatchString(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// applies returns true if the symptom affects the command or reply in msg
+func (s *SMTPSymptom) applies(msg *muxy.Message, e muxy.ProxyEvent) bool {
+	if e == muxy.EventPostDispatch {
+		return s.DropStartTLS && msg.Command == "EHLO" && msg.Fields["code"] == "250"
+	}
+	if s.atStage(msg) {
+		return true
+	}
+	switch msg.Command {
+	case "STARTTLS":
+		return s.DropStartTLS
+	case "MESSAGE":
+		return (s.Stall > 0 && msg.Fields["part"] == "end") || (s.Close && msg.Fields["part"] == "content")
+	case "BDAT":
+		return (s.Stall > 0 && msg.Fields["last"] == "true") || (s.Close && msg.Fields["offset"] != "")
+	}
+	return false
+}
+
+// atStage returns true if msg is the command replied to with Code
+func (s *SMTPSymptom) atStage(msg *muxy.Message) bool {
+	if s.Code == 0 || msg.Fields["part"] != "" {
+		return false
+	}
+	for _, command := range smtpStages[strings.ToLower(s.Stage)] {
+		if msg.Command == command {
+			return true
+		}
+	}
+	return false
+}
+
+// Muck replies in place of the server, or stalls or interrupts the message
+func (s *SMTPSymptom) Muck(ctx *muxy.Context) {
+	msg := ctx.Message
+	switch {
+	case s.atStage(msg):
+		log.Debug("SMTP Symptom - replying to %s with %d", msg.Command, s.Code)
+		ctx.Bytes = nil
+		ctx.Connection.Reply = smtp.NewReply(s.Code, s.Message)
+		if s.Code == 421 {
+			ctx.Connection.Fault = muxy.FaultClose
+		}
+	case msg.Command == "STARTTLS":
+		log.Debug("SMTP Symptom - refusing STARTTLS")
+		ctx.Bytes = nil
+		ctx.Connection.Reply = smtp.NewReply(454, smtp.ReplyText(454))
+	default:
+		if s.Close && s.interrupt(ctx) {
+			return
+		}
+		if s.Stall > 0 && (msg.Fields["part"] == "end" || msg.Fields["last"] == "true") {
+			log.Debug("SMTP Symptom - stalling the message from %s by %dms", msg.Fields["sender"], s.Stall)
+			ctx.Connection.Delay = time.Duration(s.Stall) * time.Millisecond
+		}
+	}
+}
+
+// interrupt closes the connection once CloseAfter bytes of the message
+// in ctx have been sent, returning true if it does so
+func (s *SMTPSymptom) interrupt(ctx *muxy.Context) bool {
+	offset, err := strconv.Atoi(ctx.Message.Fields["offset"])
+	if err != nil {
+		return false
+	}
+
+	// The chunk of a BDAT follows the command line
+	header := 0
+	size := len(ctx.Bytes)
+	if ctx.Message.Command == "BDAT" {
+		header = bytes.Index(ctx.Bytes, []byte("\r\n")) + 2
+		size -= header
+	}
+	if offset+size <= s.CloseAfter {
+		return false
+	}
+
+	n := s.CloseAfter - offset
+	if n < 0 {
+		n = 0
+	}
+	log.Debug("SMTP Symptom - closing connection after %d bytes of the message from %s", offset+n, ctx.Message.Fields["sender"])
+	ctx.Bytes = ctx.Bytes[:header+n]
+	ctx.Connection.Fault = muxy.FaultClose
+	return true
+}
+
+// MuckResponse withholds STARTTLS from the extensions advertised
+func (s *SMTPSymptom) MuckResponse(ctx *muxy.Context) {
+	log.Debug("SMTP Symptom - removing STARTTLS from the reply to EHLO")
+	ctx.Bytes = smtp.RemoveExtension(ctx.Bytes, "STARTTLS")
+}
@@ -0,0 +1,155 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func smtpContext(command string, key string, b string, fields map[string]string) *muxy.Context {
+	msg := &muxy.Message{
+		Protocol: "smtp",
+		Command:  command,
+		Key:      key,
+		Fields: map[string]string{
+			"sender":     "alerts@example.com",
+			"recipients": "ops@example.com,blocked@example.com",
+		},
+	}
+	for k, v := range fields {
+		msg.Fields[k] = v
+	}
+	return &muxy.Context{
+		Bytes:      []byte(b),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+		Message:    msg,
+	}
+}
+
+func TestSMTP_Setup(t *testing.T) {
+	s := SMTPSymptom{Code: 451, Stage: "mail"}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+	if s.Message != "4.3.0 Requested action aborted: local error in processing" {
+		t.Fatal("Want default message of 451, got", s.Message)
+	}
+}
+
+func TestSMTP_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := SMTPSymptom{}
+	s.Setup()
+	s = SMTPSymptom{Code: 250, Stage: "rcpt"}
+	s.Setup()
+	s = SMTPSymptom{Code: 550, Stage: "quit"}
+	s.Setup()
+	s = SMTPSymptom{Stall: -1, Close: true}
+	s.Setup()
+	s = SMTPSymptom{Close: true, Sender: "("}
+	s.Setup()
+
+	if failed != 5 {
+		t.Fatal("Want 5 failures, got", failed)
+	}
+}
+
+func TestSMTP_Teardown(t *testing.T) {
+	s := SMTPSymptom{}
+	s.Teardown()
+}
+
+func TestSMTP_Reject(t *testing.T) {
+	s := SMTPSymptom{Code: 550, Stage: "rcpt", Recipient: "^blocked@"}
+	s.Setup()
+
+	ctx := smtpContext("RCPT", "blocked@example.com", "RCPT TO:<blocked@example.com>\r\n", nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if want := "550 5.1.1 Requested action not taken: mailbox unavailable\r\n"; ctx.Bytes != nil || string(ctx.Connection.Reply) != want {
+		t.Fatalf("Want reply %q, got %q", want, ctx.Connection.Reply)
+	}
+
+	ctx = smtpContext("RCPT", "ops@example.com", "RCPT TO:<ops@example.com>\r\n", nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes == nil || ctx.Connection.Reply != nil {
+		t.Fatal("Want other recipients to be forwarded")
+	}
+
+	// A 421 closes the connection
+	s = SMTPSymptom{Code: 421, Stage: "data", Sender: "^alerts@"}
+	s.Setup()
+	ctx = smtpContext("DATA", "", "DATA\r\n", nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Bytes != nil || ctx.Connection.Reply == nil || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatal("Want DATA deferred and connection closed, got", ctx.Connection.Fault)
+	}
+}
+
+func TestSMTP_Stall(t *testing.T) {
+	s := SMTPSymptom{Stall: 100}
+	s.Setup()
+
+	ctx := smtpContext("MESSAGE", "", "Subject: hi\r\n", map[string]string{"part": "content", "offset": "0"})
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want lines of the message not delayed, got", ctx.Connection.Delay)
+	}
+
+	ctx = smtpContext("MESSAGE", "", ".\r\n", map[string]string{"part": "end", "offset": "13"})
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 100*time.Millisecond {
+		t.Fatal("Want end of the message delayed by 100ms, got", ctx.Connection.Delay)
+	}
+}
+
+func TestSMTP_Close(t *testing.T) {
+	s := SMTPSymptom{Close: true, CloseAfter: 20}
+	s.Setup()
+
+	ctx := smtpContext("MESSAGE", "", "Subject: hi\r\n", map[string]string{"part": "content", "offset": "0"})
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Fault != muxy.FaultNone {
+		t.Fatal("Want first line forwarded, got", ctx.Connection.Fault)
+	}
+
+	ctx = smtpContext("MESSAGE", "", "hello world\r\n", map[string]string{"part": "content", "offset": "13"})
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if string(ctx.Bytes) != "hello w" || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatalf("Want connection closed after 20 bytes, got %q %v", ctx.Bytes, ctx.Connection.Fault)
+	}
+
+	ctx = smtpContext("BDAT", "", "BDAT 30 LAST\r\n", map[string]string{"last": "true", "offset": "0"})
+	ctx.Bytes = append(ctx.Bytes, "Subject: hi\r\n\r\nhello world\r\n\r\n"...)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if string(ctx.Bytes) != "BDAT 30 LAST\r\nSubject: hi\r\n\r\nhello" || ctx.Connection.Fault != muxy.FaultClose {
+		t.Fatalf("Want chunk cut after 20 bytes, got %q %v", ctx.Bytes, ctx.Connection.Fault)
+	}
+}
+
+func TestSMTP_DropStartTLS(t *testing.T) {
+	s := SMTPSymptom{DropStartTLS: true}
+	s.Setup()
+
+	ctx := smtpContext("EHLO", "client.example.com", "250-mail.example.com\r\n250-STARTTLS\r\n250 SIZE 1000\r\n", map[string]string{"code": "250"})
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if want := "250-mail.example.com\r\n250 SIZE 1000\r\n"; string(ctx.Bytes) != want {
+		t.Fatalf("Want %q, got %q", want, ctx.Bytes)
+	}
+
+	ctx = smtpContext("STARTTLS", "", "STARTTLS\r\n", nil)
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if want := "454 4.7.0 TLS not available due to temporary reason\r\n"; ctx.Bytes != nil || string(ctx.Connection.Reply) != want {
+		t.Fatalf("Want reply %q, got %q", want, ctx.Connection.Reply)
+	}
+}
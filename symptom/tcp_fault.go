@@ -0,0 +1,97 @@
+package symptom
+
+import (
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// TCPFaultSymptom injects connection-level faults into TCP sessions, such as
+// resets, half-closes, stalls and refused connections
+type TCPFaultSymptom struct {
+	// Fault is one of reset, close, refuse, half_close or stall
+	Fault string `required:"true"`
+
+	// Direction the half_close and stall faults apply to: request or response
+	Direction string `default:"response"`
+
+	// After delays the fault by a number of ms after the connection is accepted
+	After int `required:"false" mapstructure:"after"`
+
+	// AfterBytes delays the fault until this many bytes have been proxied
+	AfterBytes int `required:"false" mapstructure:"after_bytes"`
+
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+	fault         muxy.ConnectionFault
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &TCPFaultSymptom{}, nil
+	}, "tcp_fault")
+}
+
+// Setup sets up the plugin
+func (s *TCPFaultSymptom) Setup() {
+	log.Debug("TCP Fault Symptom - Setup()")
+
+	name := s.Fault
+	if name == "half_close" || name == "stall" {
+		if s.Direction != "request" && s.Direction != "response" {
+			fail("TCP Fault Symptom - Incorrectly specified direction:", s.Direction)
+		}
+		name = name + "_" + s.Direction
+	}
+
+	fault, ok := muxy.ParseConnectionFault(name)
+	if !ok || fault == muxy.FaultNone {
+		fail("TCP Fault Symptom - Incorrectly specified fault:", s.Fault)
+	}
+	s.fault = fault
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *TCPFaultSymptom) Teardown() {
+	log.Debug("TCP Fault Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify.
+// Faults are decided once per connection, when it is first accepted.
+func (s *TCPFaultSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventConnect || ctx.Connection == nil {
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("TCP Fault Symptom Hit")
+		s.Muck(ctx)
+	} else {
+		log.Trace("TCP Fault Symptom Miss")
+	}
+}
+
+// Muck requests the configured fault be applied to the connection
+func (s *TCPFaultSymptom) Muck(ctx *muxy.Context) {
+	log.Debug("TCP Fault Symptom - requesting fault '%s' on connection #%d", s.fault, ctx.Connection.ID)
+
+	ctx.Connection.Fault = s.fault
+	if s.fault == muxy.FaultRefuse {
+		return
+	}
+	ctx.Connection.FaultDelay = time.Duration(s.After) * time.Millisecond
+	if s.AfterBytes > 0 {
+		ctx.Connection.FaultAfterBytes = uint64(s.AfterBytes)
+	}
+}
@@ -0,0 +1,118 @@
+package symptom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func TestTCPFault_Setup(t *testing.T) {
+	testCases := map[string]muxy.ConnectionFault{
+		"reset":  muxy.FaultReset,
+		"close":  muxy.FaultClose,
+		"refuse": muxy.FaultRefuse,
+	}
+
+	for name, want := range testCases {
+		s := TCPFaultSymptom{Fault: name}
+		s.Setup()
+		if s.fault != want {
+			t.Fatal("Want", want, "got", s.fault)
+		}
+		if len(s.MatchingRules) != 1 {
+			t.Fatal("Expected default MatchingRule to be present")
+		}
+	}
+
+	s := TCPFaultSymptom{Fault: "stall", Direction: "request"}
+	s.Setup()
+	if s.fault != muxy.FaultStallRequest {
+		t.Fatal("Want", muxy.FaultStallRequest, "got", s.fault)
+	}
+
+	s = TCPFaultSymptom{Fault: "half_close", Direction: "response"}
+	s.Setup()
+	if s.fault != muxy.FaultHalfCloseResponse {
+		t.Fatal("Want", muxy.FaultHalfCloseResponse, "got", s.fault)
+	}
+}
+
+func TestTCPFault_SetupInvalid(t *testing.T) {
+	oldFail := fail
+	failed := 0
+	fail = func(reason string, i ...interface{}) {
+		failed++
+	}
+	defer func() {
+		fail = oldFail
+	}()
+
+	s := TCPFaultSymptom{Fault: "explode"}
+	s.Setup()
+	s = TCPFaultSymptom{Fault: "stall", Direction: "sideways"}
+	s.Setup()
+
+	if failed != 3 {
+		t.Fatal("Want 3 failures, got", failed)
+	}
+}
+
+func TestTCPFault_Teardown(t *testing.T) {
+	s := TCPFaultSymptom{}
+	s.Teardown()
+}
+
+func TestTCPFault_HandleEvent(t *testing.T) {
+	s := TCPFaultSymptom{Fault: "reset", After: 10}
+	s.Setup()
+
+	ctx := &muxy.Context{Connection: &muxy.Connection{ID: 1}}
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Fault != muxy.FaultNone {
+		t.Fatal("Want no fault outside of EventConnect, got", ctx.Connection.Fault)
+	}
+
+	s.HandleEvent(muxy.EventConnect, ctx)
+	if ctx.Connection.Fault != muxy.FaultReset {
+		t.Fatal("Want", muxy.FaultReset, "got", ctx.Connection.Fault)
+	}
+	if ctx.Connection.FaultDelay != 10*time.Millisecond {
+		t.Fatal("Want 10ms delay, got", ctx.Connection.FaultDelay)
+	}
+
+	s = TCPFaultSymptom{Fault: "close", AfterBytes: 20}
+	s.Setup()
+	ctx = &muxy.Context{Connection: &muxy.Connection{ID: 1}}
+	s.HandleEvent(muxy.EventConnect, ctx)
+	if ctx.Connection.FaultAfterBytes != 20 {
+		t.Fatal("Want fault after 20 bytes, got", ctx.Connection.FaultAfterBytes)
+	}
+
+	// HTTP events are ignored
+	s.HandleEvent(muxy.EventConnect, &muxy.Context{})
+}
+
+func TestTCPFault_HandleEventConnectionMiss(t *testing.T) {
+	s := TCPFaultSymptom{
+		Fault: "refuse",
+		MatchingRules: []MatchingRule{
+			MatchingRule{
+				Connection: 2,
+			},
+		},
+	}
+	s.Setup()
+
+	ctx := &muxy.Context{Connection: &muxy.Connection{ID: 1}}
+	s.HandleEvent(muxy.EventConnect, ctx)
+	if ctx.Connection.Fault != muxy.FaultNone {
+		t.Fatal("Want no fault on connection #1, got", ctx.Connection.Fault)
+	}
+
+	ctx = &muxy.Context{Connection: &muxy.Connection{ID: 2}}
+	s.HandleEvent(muxy.EventConnect, ctx)
+	if ctx.Connection.Fault != muxy.FaultRefuse {
+		t.Fatal("Want", muxy.FaultRefuse, "got", ctx.Connection.Fault)
+	}
+}
@@ -53,6 +53,8 @@ func init() {
 func (m *TCPTampererSymptom) Setup() {
 	log.Debug("TCP Tamperer Setup()")
 
+	setupMatchingRules(m.MatchingRules)
+
 	// Add default (catch all) matching rule
 	// Only applicable if none supplied
 	if len(m.MatchingRules) == 0 {
@@ -70,6 +72,10 @@ func (m *TCPTampererSymptom) Teardown() {
 // HandleEvent is a hook to allow the plugin to intervene with a request/response
 // event
 func (m *TCPTampererSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	if e != muxy.EventPreDispatch && e != muxy.EventPostDispatch {
+		return
+	}
+
 	if MatchSymptoms(m.MatchingRules, *ctx) {
 		log.Trace("TCP Delay Tamperer Hit")
 
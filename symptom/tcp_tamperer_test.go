@@ -97,6 +97,26 @@ func TestTCPTamperer_HandleEventPreDispatchWithTCP(t *testing.T) {
 	}
 }
 
+func TestTCPTamperer_HandleEventConnect(t *testing.T) {
+	tamperer := TCPTampererSymptom{
+		Request:       TCPRequestConfig{Body: newRequestBody},
+		MatchingRules: []MatchingRule{MatchingRule{First: 1}},
+	}
+	tamperer.Setup()
+
+	// Connect events must not use up the activations of the rule
+	tamperer.HandleEvent(muxy.EventConnect, &muxy.Context{Connection: &muxy.Connection{ID: 1}})
+
+	ctx := &muxy.Context{
+		Bytes:      []byte("this is a message"),
+		Connection: &muxy.Connection{ID: 1, Direction: muxy.DirectionRequest},
+	}
+	tamperer.HandleEvent(muxy.EventPreDispatch, ctx)
+	if string(ctx.Bytes) != newRequestBody {
+		t.Fatal("Want", newRequestBody, "got", string(ctx.Bytes))
+	}
+}
+
 func TestTCPTamperer_HandleEventPostDispatchWithTCP(t *testing.T) {
 	// Body tests
 	tamperer := defaultTamperer()
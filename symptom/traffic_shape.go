@@ -0,0 +1,219 @@
+package symptom
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mefellows/muxy/log"
+	"github.com/mefellows/muxy/muxy"
+	"github.com/mefellows/plugo/plugo"
+)
+
+// ShapeConfig describes how to shape one direction of traffic
+type ShapeConfig struct {
+	// Bandwidth in kbits/s. Zero is unlimited
+	Bandwidth int
+
+	// Burst is the number of bytes that may be sent at once, before
+	// the bandwidth limit applies. Defaults to 1/10th of a second of bandwidth
+	Burst int
+
+	// Latency to add to each message in ms
+	Latency int
+
+	// Jitter is the maximum variation in latency in ms, added or subtracted
+	// at random to each message
+	Jitter int
+}
+
+// TrafficShaperSymptom shapes the bandwidth and latency of each connection
+// within the proxy, without the privileges required by the Network Shaper
+type TrafficShaperSymptom struct {
+	Request       ShapeConfig
+	Response      ShapeConfig
+	MatchingRules []MatchingRule `required:"false" mapstructure:"matching_rules"`
+}
+
+func init() {
+	plugo.PluginFactories.Register(func() (interface{}, error) {
+		return &TrafficShaperSymptom{}, nil
+	}, "traffic_shape")
+}
+
+// Setup sets up the plugin
+func (s *TrafficShaperSymptom) Setup() {
+	log.Debug("Traffic Shaper Symptom - Setup()")
+
+	setupMatchingRules(s.MatchingRules)
+
+	// Add default (catch all) matching rule
+	// Only applicable if none supplied
+	if len(s.MatchingRules) == 0 {
+		s.MatchingRules = []MatchingRule{
+			defaultMatchingRule,
+		}
+	}
+}
+
+// Teardown shuts down the plugin
+func (s *TrafficShaperSymptom) Teardown() {
+	log.Debug("Traffic Shaper Symptom - Teardown()")
+}
+
+// HandleEvent takes a proxy event for the proxy to intercept and modify
+func (s *TrafficShaperSymptom) HandleEvent(e muxy.ProxyEvent, ctx *muxy.Context) {
+	var config ShapeConfig
+	switch e {
+	case muxy.EventPreDispatch:
+		config = s.Request
+	case muxy.EventPostDispatch:
+		config = s.Response
+	default:
+		return
+	}
+
+	if MatchSymptoms(s.MatchingRules, *ctx) {
+		log.Trace("Traffic Shaper Symptom Hit")
+		s.Muck(ctx, e, config)
+	} else {
+		log.Trace("Traffic Shaper Symptom Miss")
+	}
+}
+
+// shapeKey identifies the bucket of a connection direction
+type shapeKey struct {
+	symptom *TrafficShaperSymptom
+	event   muxy.ProxyEvent
+}
+
+// Muck shapes the current TCP message, or HTTP body
+func (s *TrafficShaperSymptom) Muck(ctx *muxy.Context, e muxy.ProxyEvent, config ShapeConfig) {
+	// TCP: throttle reading the next message, and delay delivery of this one
+	if ctx.Connection != nil {
+		if bucket := newTokenBucket(config); bucket != nil {
+			if ctx.Connection.Values != nil {
+				b, _ := ctx.Connection.Values.LoadOrStore(shapeKey{s, e}, bucket)
+				bucket = b.(*tokenBucket)
+			}
+			wait := bucket.take(len(ctx.Bytes))
+			log.Debug("Traffic Shaper Symptom - throttling message of %d bytes for %v", len(ctx.Bytes), wait)
+			time.Sleep(wait)
+		}
+		ctx.Connection.Delay = latency(config)
+		return
+	}
+
+	// HTTP: shape the body as it is read
+	switch e {
+	case muxy.EventPreDispatch:
+		if ctx.Request != nil && ctx.Request.Body != nil && ctx.Request.ContentLength != 0 {
+			ctx.Request.Body = newShapedReader(ctx.Request.Body, config)
+		}
+	case muxy.EventPostDispatch:
+		if ctx.Response != nil && ctx.Response.Body != nil {
+			ctx.Response.Body = newShapedReader(ctx.Response.Body, config)
+		}
+	}
+}
+
+// latency returns the configured latency, with a random jitter applied
+func latency(config ShapeConfig) time.Duration {
+	delay := config.Latency
+	if config.Jitter > 0 {
+		delay += rand.Intn(2*config.Jitter+1) - config.Jitter
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// tokenBucket limits the rate at which bytes are sent
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// newTokenBucket creates a full bucket for the configured bandwidth,
+// or returns nil if the bandwidth is unlimited
+func newTokenBucket(config ShapeConfig) *tokenBucket {
+	if config.Bandwidth <= 0 {
+		return nil
+	}
+
+	rate := float64(config.Bandwidth) * 1000 / 8
+	burst := float64(config.Burst)
+	if burst <= 0 {
+		burst = rate / 10
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// take removes n tokens from the bucket, returning how long to wait before
+// they may be sent. The bucket may go into debt to allow messages larger
+// than the burst size.
+func (b *tokenBucket) take(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// shapedReader shapes an HTTP body as it is read. Latency is applied before
+// the first byte, and jitter to each subsequent read.
+type shapedReader struct {
+	io.ReadCloser
+	config  ShapeConfig
+	bucket  *tokenBucket
+	started bool
+}
+
+func newShapedReader(r io.ReadCloser, config ShapeConfig) io.ReadCloser {
+	return &shapedReader{
+		ReadCloser: r,
+		config:     config,
+		bucket:     newTokenBucket(config),
+	}
+}
+
+func (r *shapedReader) Read(p []byte) (int, error) {
+	if !r.started {
+		r.started = true
+		time.Sleep(latency(r.config))
+	} else if r.config.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Intn(r.config.Jitter+1)) * time.Millisecond)
+	}
+
+	// Don't read more than can be sent in one burst
+	if r.bucket != nil && len(p) > int(r.bucket.burst) && r.bucket.burst >= 1 {
+		p = p[:int(r.bucket.burst)]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+	if r.bucket != nil && n > 0 {
+		time.Sleep(r.bucket.take(n))
+	}
+	return n, err
+}
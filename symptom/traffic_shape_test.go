@@ -0,0 +1,155 @@
+package symptom
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mefellows/muxy/muxy"
+)
+
+func TestTrafficShaper_Setup(t *testing.T) {
+	s := TrafficShaperSymptom{}
+	s.Setup()
+
+	if len(s.MatchingRules) != 1 {
+		t.Fatal("Expected default MatchingRule to be present")
+	}
+}
+
+func TestTrafficShaper_Teardown(t *testing.T) {
+	s := TrafficShaperSymptom{}
+	s.Teardown()
+}
+
+func TestTrafficShaper_latency(t *testing.T) {
+	if d := latency(ShapeConfig{Latency: 10}); d != 10*time.Millisecond {
+		t.Fatal("Want 10ms, got", d)
+	}
+
+	for i := 0; i < 100; i++ {
+		d := latency(ShapeConfig{Latency: 10, Jitter: 5})
+		if d < 5*time.Millisecond || d > 15*time.Millisecond {
+			t.Fatal("Want between 5ms and 15ms, got", d)
+		}
+	}
+
+	if d := latency(ShapeConfig{Latency: 0, Jitter: 5}); d < 0 {
+		t.Fatal("Want non-negative latency, got", d)
+	}
+}
+
+func TestTrafficShaper_tokenBucket(t *testing.T) {
+	if newTokenBucket(ShapeConfig{}) != nil {
+		t.Fatal("Want nil bucket for unlimited bandwidth")
+	}
+
+	// 8 kbits/s = 1000 bytes/s
+	b := newTokenBucket(ShapeConfig{Bandwidth: 8, Burst: 500})
+	if wait := b.take(500); wait != 0 {
+		t.Fatal("Want burst to be sent immediately, got", wait)
+	}
+
+	wait := b.take(500)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatal("Want to wait ~500ms, got", wait)
+	}
+
+	b = newTokenBucket(ShapeConfig{Bandwidth: 8})
+	if b.burst != 100 {
+		t.Fatal("Want default burst of 100 bytes, got", b.burst)
+	}
+}
+
+func TestTrafficShaper_HandleEventTCP(t *testing.T) {
+	s := TrafficShaperSymptom{
+		Request: ShapeConfig{
+			Bandwidth: 8,
+			Burst:     10,
+			Latency:   100,
+		},
+	}
+	s.Setup()
+
+	values := &sync.Map{}
+	ctx := &muxy.Context{
+		Bytes:      []byte("0123456789"),
+		Connection: &muxy.Connection{ID: 1, Values: values},
+	}
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if ctx.Connection.Delay != 100*time.Millisecond {
+		t.Fatal("Want 100ms delay, got", ctx.Connection.Delay)
+	}
+
+	// The bucket is shared by the connection, and now empty
+	ctx = &muxy.Context{
+		Bytes:      []byte("0123456789"),
+		Connection: &muxy.Connection{ID: 1, Values: values},
+	}
+	start := time.Now()
+	s.HandleEvent(muxy.EventPreDispatch, ctx)
+	if elapsed := time.Since(start); elapsed < 5*time.Millisecond {
+		t.Fatal("Want message to be throttled, took", elapsed)
+	}
+
+	// Responses are unshaped
+	ctx = &muxy.Context{
+		Bytes:      []byte("0123456789"),
+		Connection: &muxy.Connection{ID: 1, Values: values},
+	}
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+	if ctx.Connection.Delay != 0 {
+		t.Fatal("Want no delay, got", ctx.Connection.Delay)
+	}
+}
+
+func TestTrafficShaper_HandleEventHTTP(t *testing.T) {
+	s := TrafficShaperSymptom{
+		Response: ShapeConfig{
+			Latency: 50,
+		},
+	}
+	s.Setup()
+
+	body := "some response body"
+	ctx := &muxy.Context{
+		Request: &http.Request{URL: &url.URL{Path: "/"}},
+		Response: &http.Response{
+			Body: ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		},
+	}
+	s.HandleEvent(muxy.EventPostDispatch, ctx)
+
+	start := time.Now()
+	b, err := ioutil.ReadAll(ctx.Response.Body)
+	if err != nil {
+		t.Fatal("Got error, want nil", err)
+	}
+	if string(b) != body {
+		t.Fatal("Want", body, "got", string(b))
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("Want response body to be delayed 50ms, took", elapsed)
+	}
+}
+
+func TestTrafficShaper_shapedReaderBandwidth(t *testing.T) {
+	// 80 kbits/s = 10000 bytes/s, in 100 byte bursts
+	r := newShapedReader(ioutil.NopCloser(bytes.NewReader(make([]byte, 1100))), ShapeConfig{
+		Bandwidth: 80,
+		Burst:     100,
+	})
+
+	start := time.Now()
+	b, _ := ioutil.ReadAll(r)
+	if len(b) != 1100 {
+		t.Fatal("Want 1100 bytes, got", len(b))
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatal("Want body to take ~100ms, took", elapsed)
+	}
+}